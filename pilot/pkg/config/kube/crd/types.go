@@ -125,6 +125,16 @@ var knownTypes = map[string]schemaType{
 		},
 		collection: &DestinationRuleList{},
 	},
+	model.SidecarConfig.Type: {
+		schema: model.SidecarConfig,
+		object: &Sidecar{
+			TypeMeta: meta_v1.TypeMeta{
+				Kind:       "Sidecar",
+				APIVersion: apiVersion(&model.SidecarConfig),
+			},
+		},
+		collection: &SidecarList{},
+	},
 	model.HTTPAPISpec.Type: {
 		schema: model.HTTPAPISpec,
 		object: &HTTPAPISpec{
@@ -1144,6 +1154,109 @@ func (in *DestinationRuleList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// Sidecar is the generic Kubernetes API object wrapper
+type Sidecar struct {
+	meta_v1.TypeMeta   `json:",inline"`
+	meta_v1.ObjectMeta `json:"metadata"`
+	Spec               map[string]interface{} `json:"spec"`
+}
+
+// GetSpec from a wrapper
+func (in *Sidecar) GetSpec() map[string]interface{} {
+	return in.Spec
+}
+
+// SetSpec for a wrapper
+func (in *Sidecar) SetSpec(spec map[string]interface{}) {
+	in.Spec = spec
+}
+
+// GetObjectMeta from a wrapper
+func (in *Sidecar) GetObjectMeta() meta_v1.ObjectMeta {
+	return in.ObjectMeta
+}
+
+// SetObjectMeta for a wrapper
+func (in *Sidecar) SetObjectMeta(metadata meta_v1.ObjectMeta) {
+	in.ObjectMeta = metadata
+}
+
+// SidecarList is the generic Kubernetes API list wrapper
+type SidecarList struct {
+	meta_v1.TypeMeta `json:",inline"`
+	meta_v1.ListMeta `json:"metadata"`
+	Items            []Sidecar `json:"items"`
+}
+
+// GetItems from a wrapper
+func (in *SidecarList) GetItems() []IstioObject {
+	out := make([]IstioObject, len(in.Items))
+	for i := range in.Items {
+		out[i] = &in.Items[i]
+	}
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Sidecar) DeepCopyInto(out *Sidecar) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	out.Spec = in.Spec
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Sidecar.
+func (in *Sidecar) DeepCopy() *Sidecar {
+	if in == nil {
+		return nil
+	}
+	out := new(Sidecar)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *Sidecar) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SidecarList) DeepCopyInto(out *SidecarList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	out.ListMeta = in.ListMeta
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]Sidecar, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SidecarList.
+func (in *SidecarList) DeepCopy() *SidecarList {
+	if in == nil {
+		return nil
+	}
+	out := new(SidecarList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *SidecarList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+
+	return nil
+}
+
 // HTTPAPISpec is the generic Kubernetes API object wrapper
 type HTTPAPISpec struct {
 	meta_v1.TypeMeta   `json:",inline"`
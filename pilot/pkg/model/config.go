@@ -277,6 +277,10 @@ type IstioConfigStore interface {
 	// SubsetToLabels returns the labels associated with a subset of a given service.
 	SubsetToLabels(subsetName, hostname, domain string) LabelsCollection
 
+	// Sidecar returns the sidecar configuration of the workload with the labels in the namespace, the
+	// one selecting the workload, or else the one of the namespace without selector, or nil if none.
+	Sidecar(namespace string, workloadLabels LabelsCollection) *Config
+
 	// HTTPAPISpecByDestination selects Mixerclient HTTP API Specs
 	// associated with destination service instances.
 	HTTPAPISpecByDestination(instance *ServiceInstance) []Config
@@ -425,6 +429,16 @@ var (
 		Validate:    ValidateDestinationRule,
 	}
 
+	// SidecarConfig describes the sidecar configuration of the workloads of a namespace
+	SidecarConfig = ProtoSchema{
+		Type:        "sidecar",
+		Plural:      "sidecars",
+		Group:       "networking",
+		Version:     "v1alpha3",
+		MessageName: "istio.networking.v1alpha3.Sidecar",
+		Validate:    ValidateSidecar,
+	}
+
 	// HTTPAPISpec describes an HTTP API specification.
 	HTTPAPISpec = ProtoSchema{
 		Type:        "http-api-spec",
@@ -525,6 +539,7 @@ var (
 		ExternalService,
 		DestinationPolicy,
 		DestinationRule,
+		SidecarConfig,
 		HTTPAPISpec,
 		HTTPAPISpecBinding,
 		QuotaSpec,
@@ -859,6 +874,30 @@ func (store *istioConfigStore) DestinationRule(name, domain string) *Config {
 	return nil
 }
 
+func (store *istioConfigStore) Sidecar(namespace string, workloadLabels LabelsCollection) *Config {
+	configs, err := store.List(SidecarConfig.Type, namespace)
+	if err != nil {
+		return nil
+	}
+	// conflicting configurations are resolved by name, independently of the order of the store
+	sort.Slice(configs, func(i, j int) bool { return configs[i].Name < configs[j].Name })
+
+	var namespaceDefault *Config
+	for i, config := range configs {
+		selector := config.Spec.(*networking.Sidecar).GetWorkloadSelector().GetLabels()
+		if len(selector) == 0 {
+			if namespaceDefault == nil {
+				namespaceDefault = &configs[i]
+			}
+			continue
+		}
+		if workloadLabels.IsSupersetOf(Labels(selector)) {
+			return &configs[i]
+		}
+	}
+	return namespaceDefault
+}
+
 func (store *istioConfigStore) SubsetToLabels(subsetName, hostname, domain string) LabelsCollection {
 	// empty subset
 	if subsetName == "" {
@@ -568,6 +568,62 @@ func TestEgressRules(t *testing.T) {
 	}
 }
 
+func TestSidecar(t *testing.T) {
+	store := model.MakeIstioStore(memory.Make(model.IstioConfigTypes))
+	sidecars := map[string]*networking.Sidecar{
+		"default": {
+			Egress: []*networking.IstioEgressListener{{Hosts: []string{"./*"}}},
+		},
+		"reviews": {
+			WorkloadSelector: &networking.WorkloadSelector{Labels: map[string]string{"app": "reviews"}},
+			Egress:           []*networking.IstioEgressListener{{Hosts: []string{"./ratings.default.svc.cluster.local"}}},
+		},
+	}
+	for name, sidecar := range sidecars {
+		config := model.Config{
+			ConfigMeta: model.ConfigMeta{
+				Type:      model.SidecarConfig.Type,
+				Name:      name,
+				Namespace: "default",
+				Domain:    "cluster.local",
+			},
+			Spec: sidecar,
+		}
+		if _, err := store.Create(config); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		name      string
+		namespace string
+		labels    model.LabelsCollection
+		expected  string
+	}{
+		{"selected", "default", model.LabelsCollection{{"app": "reviews", "version": "v1"}}, "reviews"},
+		{"namespace default", "default", model.LabelsCollection{{"app": "ratings"}}, "default"},
+		{"no labels", "default", nil, "default"},
+		{"other namespace", "istio-system", model.LabelsCollection{{"app": "reviews"}}, ""},
+	}
+	for _, c := range cases {
+		got := store.Sidecar(c.namespace, c.labels)
+		if c.expected == "" {
+			if got != nil {
+				t.Errorf("%s: Sidecar() => got %s, want none", c.name, got.Name)
+			}
+			continue
+		}
+		if got == nil || got.Name != c.expected {
+			t.Errorf("%s: Sidecar() => got %v, want %s", c.name, got, c.expected)
+		}
+	}
+
+	// erroring out list
+	if out := model.MakeIstioStore(errorStore{}).Sidecar("default", nil); out != nil {
+		t.Errorf("Sidecar() => expected nil but got %v", out)
+	}
+}
+
 func TestDestinationPolicy(t *testing.T) {
 	store := model.MakeIstioStore(memory.Make(model.IstioConfigTypes))
 	labels := map[string]string{"version": "v1"}
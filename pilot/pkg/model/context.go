@@ -21,6 +21,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/gogo/protobuf/types"
 	"github.com/golang/protobuf/ptypes"
 	multierror "github.com/hashicorp/go-multierror"
 
@@ -61,6 +62,43 @@ type Proxy struct {
 	// Domain defines the DNS domain suffix for short hostnames (e.g.
 	// "default.svc.cluster.local")
 	Domain string
+
+	// Metadata is the string valued node metadata sent by the proxy
+	Metadata map[string]string
+}
+
+// NodeMetadataInboundBindAddress is the node metadata key of the address the application listens on,
+// which inbound clusters forward the traffic to. The default is 127.0.0.1.
+const NodeMetadataInboundBindAddress = "INBOUND_BIND_ADDRESS"
+
+// NodeMetadataInboundTLSMode is the node metadata key of the TLS mode, as in the TLS settings of a
+// destination rule, for the connections from the proxy to an application requiring TLS.
+const NodeMetadataInboundTLSMode = "INBOUND_TLS_MODE"
+
+// NodeMetadataInboundTLSCaCertificates is the node metadata key of the file with the CA certificates
+// verifying the application certificate in the SIMPLE inbound TLS mode.
+const NodeMetadataInboundTLSCaCertificates = "INBOUND_TLS_CA_CERTIFICATES"
+
+// NodeMetadataInboundMaxRequestsPerConnection is the node metadata key of the maximum number of
+// requests per connection from the proxy to its application, so that the connections are recycled.
+const NodeMetadataInboundMaxRequestsPerConnection = "INBOUND_MAX_REQUESTS_PER_CONNECTION"
+
+// NodeMetadataNetwork is the node metadata key of the network the proxy is in, for meshes spanning
+// networks. The proxy is in the default network if unset.
+const NodeMetadataNetwork = "NETWORK"
+
+// ParseMetadata returns the string values of the node metadata, ignoring values of other kinds.
+func ParseMetadata(metadata *types.Struct) map[string]string {
+	if metadata == nil {
+		return nil
+	}
+	out := make(map[string]string, len(metadata.Fields))
+	for key, value := range metadata.Fields {
+		if s, ok := value.GetKind().(*types.Value_StringValue); ok {
+			out[key] = s.StringValue
+		}
+	}
+	return out
 }
 
 // NodeType decides the responsibility of the proxy serves in the mesh
@@ -210,6 +248,9 @@ func DefaultMeshConfig() meshconfig.MeshConfig {
 		EnableTracing:         true,
 		AccessLogFile:         "/dev/stdout",
 		DefaultConfig:         &config,
+		OutboundTrafficPolicy: &meshconfig.MeshConfig_OutboundTrafficPolicy{
+			Mode: meshconfig.MeshConfig_OutboundTrafficPolicy_ALLOW_ANY,
+		},
 	}
 }
 
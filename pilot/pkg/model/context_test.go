@@ -19,6 +19,8 @@ import (
 	"reflect"
 	"testing"
 
+	"github.com/gogo/protobuf/types"
+
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/proxy/envoy/v1/mock"
 )
@@ -98,3 +100,19 @@ defaultConfig:
 		t.Fatalf("Wrong default values:\n got %#v \nwant %#v", got, &want)
 	}
 }
+
+func TestParseMetadata(t *testing.T) {
+	metadata := &types.Struct{
+		Fields: map[string]*types.Value{
+			"INBOUND_BIND_ADDRESS": {Kind: &types.Value_StringValue{StringValue: "::1"}},
+			"ignored":              {Kind: &types.Value_NumberValue{NumberValue: 1}},
+		},
+	}
+	expected := map[string]string{"INBOUND_BIND_ADDRESS": "::1"}
+	if got := model.ParseMetadata(metadata); !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %v, want %v", got, expected)
+	}
+	if got := model.ParseMetadata(nil); got != nil {
+		t.Errorf("got %v for nil metadata, want nil", got)
+	}
+}
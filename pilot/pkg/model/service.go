@@ -24,12 +24,17 @@ package model
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"os"
 	"sort"
+	"strconv"
 	"strings"
 
 	authn "istio.io/api/authentication/v1alpha1"
 	meshconfig "istio.io/api/mesh/v1alpha1"
+	"istio.io/istio/pkg/log"
 )
 
 // Service describes an Istio service (e.g., catalog.mystore.com:8080)
@@ -90,6 +95,9 @@ const (
 	DNSLB
 	// Passthrough implies that the proxy should forward traffic to the destination IP requested by the caller
 	Passthrough
+	// LogicalDNSLB implies that the proxy will resolve a DNS address and connect to a single resolved
+	// address at a time, which suits large services fronted by their own load balancer
+	LogicalDNSLB
 )
 
 // Port represents a network port where a service is listening for
@@ -218,6 +226,15 @@ type NetworkEndpoint struct {
 	// the service associated with this instance (e.g.,
 	// catalog.mystore.com)
 	ServicePort *Port `json:"service_port"`
+
+	// Protocol spoken by the application on the endpoint port, if known to the registry. This
+	// may differ from the protocol of the service port, e.g. a TCP service port in front of an
+	// application speaking HTTP/2. Empty if unknown.
+	Protocol Protocol `json:"protocol,omitempty"`
+
+	// Network the endpoint is in, for meshes spanning networks whose endpoints are not directly
+	// reachable from one another. Empty for the default network.
+	Network string `json:"network,omitempty"`
 }
 
 // Labels is a non empty set of arbitrary strings. Each version of a service can
@@ -504,13 +521,62 @@ func ParseServiceKey(s string) (hostname string, ports PortList, labels LabelsCo
 	return
 }
 
-// BuildSubsetKey generates a unique string referencing service instances for a given service name, a subset and a port.
-// The proxy queries Pilot with this key to obtain the list of instances in a subset.
+// MaxClusterNameLength is the maximum length of the cluster names built by BuildSubsetKey, read from
+// PILOT_MAX_CLUSTER_NAME_LENGTH. Zero disables the limit.
+var MaxClusterNameLength = parseMaxClusterNameLength(os.Getenv("PILOT_MAX_CLUSTER_NAME_LENGTH"))
+
+const (
+	// clusterNameHashLength is the number of hex digits of the hash ending a shortened cluster name.
+	clusterNameHashLength = 16
+
+	// minClusterNameLength is the smallest limit on the cluster names, leaving room for a readable
+	// start of the key before the hash.
+	minClusterNameLength = 48
+)
+
+// parseMaxClusterNameLength parses the limit on the cluster names. Limits below minClusterNameLength
+// are raised to it, since the names would be little more than the hash.
+func parseMaxClusterNameLength(value string) int {
+	if value == "" {
+		return 0
+	}
+	length, err := strconv.Atoi(value)
+	if err != nil || length < 0 {
+		log.Warnf("invalid value PILOT_MAX_CLUSTER_NAME_LENGTH=%q, ignoring", value)
+		return 0
+	}
+	if length > 0 && length < minClusterNameLength {
+		log.Warnf("PILOT_MAX_CLUSTER_NAME_LENGTH=%d is below the minimum, using %d", length, minClusterNameLength)
+		return minClusterNameLength
+	}
+	return length
+}
+
+// BuildSubsetKey generates the name of the cluster for a given service name, a subset and a port. It is
+// the subset service key, shortened if longer than MaxClusterNameLength, so that inbound, outbound and
+// subset clusters and the routes referencing them agree on the name.
 func BuildSubsetKey(direction TrafficDirection, subsetName, hostname string, port *Port) string {
+	return shortenClusterName(BuildSubsetServiceKey(direction, subsetName, hostname, port))
+}
+
+// BuildSubsetServiceKey generates a unique string referencing service instances for a given service name,
+// a subset and a port. The proxy queries Pilot with this key to obtain the list of instances in a subset.
+func BuildSubsetServiceKey(direction TrafficDirection, subsetName, hostname string, port *Port) string {
 	return fmt.Sprintf("%s|%s|%s|%s", direction, port.Name, subsetName, hostname)
 }
 
-// ParseSubsetKey is the inverse of the BuildSubsetKey method
+// shortenClusterName keeps the start of a key longer than MaxClusterNameLength for readability, and
+// replaces the rest with a hash of the full key. The name is stable across restarts of Pilot.
+func shortenClusterName(key string) string {
+	if MaxClusterNameLength <= 0 || len(key) <= MaxClusterNameLength {
+		return key
+	}
+	sum := sha256.Sum256([]byte(key))
+	hash := hex.EncodeToString(sum[:])[:clusterNameHashLength]
+	return key[:MaxClusterNameLength-clusterNameHashLength-1] + "-" + hash
+}
+
+// ParseSubsetKey is the inverse of the BuildSubsetServiceKey method
 func ParseSubsetKey(s string) (direction TrafficDirection, subsetName, hostname string, port *Port) {
 	parts := strings.Split(s, "|")
 	// we ignore direction since its typically not used by the consuming functions
@@ -208,3 +208,71 @@ func TestConvertCaseInsensitiveStringToProtocol(t *testing.T) {
 		}
 	}
 }
+
+func TestBuildSubsetKeyMaxLength(t *testing.T) {
+	defer func(length int) { MaxClusterNameLength = length }(MaxClusterNameLength)
+
+	port := &Port{Name: "http", Port: 80}
+	hostname := "a-very-long-service-name-exceeding-the-limit.some-namespace.svc.cluster.local"
+	key := BuildSubsetServiceKey(TrafficDirectionOutbound, "v1", hostname, port)
+
+	cases := []struct {
+		name      string
+		maxLength int
+		shortened bool
+	}{
+		{name: "no limit", maxLength: 0},
+		{name: "within the limit", maxLength: len(key)},
+		{name: "over the limit", maxLength: 60, shortened: true},
+	}
+
+	for _, c := range cases {
+		MaxClusterNameLength = c.maxLength
+		name := BuildSubsetKey(TrafficDirectionOutbound, "v1", hostname, port)
+		if !c.shortened {
+			if name != key {
+				t.Errorf("%s: got %q, want %q", c.name, name, key)
+			}
+			continue
+		}
+		if len(name) > c.maxLength {
+			t.Errorf("%s: got %q of length %d, want at most %d", c.name, name, len(name), c.maxLength)
+		}
+		if again := BuildSubsetKey(TrafficDirectionOutbound, "v1", hostname, port); again != name {
+			t.Errorf("%s: got unstable names %q and %q", c.name, name, again)
+		}
+		if other := BuildSubsetKey(TrafficDirectionOutbound, "v2", hostname, port); other == name {
+			t.Errorf("%s: got the same name %q for different subsets", c.name, name)
+		}
+	}
+}
+
+func TestParseMaxClusterNameLength(t *testing.T) {
+	cases := []struct {
+		value string
+		want  int
+	}{
+		{value: "", want: 0},
+		{value: "0", want: 0},
+		{value: "-1", want: 0},
+		{value: "abc", want: 0},
+		{value: "8", want: minClusterNameLength},
+		{value: "16", want: minClusterNameLength},
+		{value: "60", want: 60},
+	}
+
+	for _, c := range cases {
+		if got := parseMaxClusterNameLength(c.value); got != c.want {
+			t.Errorf("parseMaxClusterNameLength(%q) => %d, want %d", c.value, got, c.want)
+		}
+	}
+}
+
+func TestParseSubsetKey(t *testing.T) {
+	port := &Port{Name: "http", Port: 80}
+	key := BuildSubsetServiceKey(TrafficDirectionOutbound, "v1", "hello.default.svc.cluster.local", port)
+	_, subset, hostname, p := ParseSubsetKey(key)
+	if subset != "v1" || hostname != "hello.default.svc.cluster.local" || p.Name != "http" {
+		t.Errorf("got subset %q, hostname %q, port %q from %q", subset, hostname, p.Name, key)
+	}
+}
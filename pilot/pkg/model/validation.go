@@ -1098,6 +1098,49 @@ func ValidateDestinationRule(msg proto.Message) (errs error) {
 	return
 }
 
+// ValidateSidecar checks sidecar configurations
+func ValidateSidecar(msg proto.Message) (errs error) {
+	sidecar, ok := msg.(*networking.Sidecar)
+	if !ok {
+		return fmt.Errorf("cannot cast to sidecar")
+	}
+
+	if selector := sidecar.GetWorkloadSelector(); selector != nil {
+		errs = appendErrors(errs, Labels(selector.Labels).Validate())
+	}
+
+	if len(sidecar.Egress) == 0 {
+		errs = appendErrors(errs, fmt.Errorf("sidecar must have at least one egress listener"))
+	}
+	for _, egress := range sidecar.Egress {
+		if len(egress.Hosts) == 0 {
+			errs = appendErrors(errs, fmt.Errorf("sidecar egress listener must have at least one host"))
+		}
+		for _, host := range egress.Hosts {
+			errs = appendErrors(errs, validateSidecarEgressHost(host))
+		}
+	}
+	return
+}
+
+// validateSidecarEgressHost checks a host of a sidecar egress listener, of the form namespace/dnsName.
+// The namespace may be * for any namespace or . for the namespace of the sidecar, the DNS name may be
+// a wildcard domain.
+func validateSidecarEgressHost(host string) error {
+	parts := strings.SplitN(host, "/", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("sidecar egress host %q must be of the form namespace/dnsName", host)
+	}
+	namespace, dnsName := parts[0], parts[1]
+	if namespace != "*" && namespace != "." && !IsDNS1123Label(namespace) {
+		return fmt.Errorf("sidecar egress host %q has an invalid namespace %q", host, namespace)
+	}
+	if dnsName == "*" {
+		return nil
+	}
+	return ValidateWildcardDomain(dnsName)
+}
+
 func validateTrafficPolicy(policy *networking.TrafficPolicy) error {
 	if policy == nil {
 		return nil
@@ -1156,6 +1199,9 @@ func validateConnectionPool(settings *networking.ConnectionPoolSettings) (errs e
 		if http.MaxRetries < 0 {
 			errs = appendErrors(errs, fmt.Errorf("max retries must be non-negative"))
 		}
+		if http.IdleTimeout != nil {
+			errs = appendErrors(errs, ValidateDurationGogo(http.IdleTimeout))
+		}
 	}
 
 	if tcp := settings.Tcp; tcp != nil {
@@ -1178,6 +1224,44 @@ func validateLoadBalancer(settings *networking.LoadBalancerSettings) (errs error
 	// simple load balancing is always valid
 	// TODO: settings.GetConsistentHash()
 
+	errs = appendErrors(errs, validateLocalityLbSetting(settings.LocalityLbSetting))
+	return
+}
+
+func validateLocalityLbSetting(setting *networking.LocalityLoadBalancerSetting) (errs error) {
+	if setting == nil {
+		return
+	}
+
+	if len(setting.Failover) > 0 && len(setting.Distribute) > 0 {
+		errs = appendErrors(errs, fmt.Errorf("locality load balancing cannot both fail over and distribute traffic"))
+	}
+
+	for _, distribute := range setting.Distribute {
+		if distribute.From == "" {
+			errs = appendErrors(errs, fmt.Errorf("locality distribution requires a from locality"))
+		}
+		var total uint32
+		for to, weight := range distribute.To {
+			if to == "" {
+				errs = appendErrors(errs, fmt.Errorf("locality distribution from %s has an empty to locality", distribute.From))
+			}
+			total += weight
+		}
+		if total != 100 {
+			errs = appendErrors(errs, fmt.Errorf("locality distribution from %s must total 100%%, got %d%%",
+				distribute.From, total))
+		}
+	}
+
+	for _, failover := range setting.Failover {
+		if failover.From == "" || failover.To == "" {
+			errs = appendErrors(errs, fmt.Errorf("locality failover requires a from and a to region"))
+		} else if failover.From == failover.To {
+			errs = appendErrors(errs, fmt.Errorf("locality failover from region %s cannot be to itself", failover.From))
+		}
+	}
+
 	return
 }
 
@@ -1186,7 +1270,8 @@ func validateTLS(settings *networking.TLSSettings) (errs error) {
 		return
 	}
 
-	if settings.Mode == networking.TLSSettings_MUTUAL {
+	// the certificates of a credential are fetched by name
+	if settings.Mode == networking.TLSSettings_MUTUAL && settings.CredentialName == "" {
 		if settings.ClientCertificate == "" {
 			errs = appendErrors(errs, fmt.Errorf("client certificate required for mutual tls"))
 		}
@@ -1195,6 +1280,15 @@ func validateTLS(settings *networking.TLSSettings) (errs error) {
 		}
 	}
 
+	if settings.GetInsecureSkipVerify().GetValue() {
+		if settings.Mode != networking.TLSSettings_SIMPLE {
+			errs = appendErrors(errs, fmt.Errorf("insecure skip verify is only supported with simple tls"))
+		}
+		if settings.CaCertificates != "" || len(settings.SubjectAltNames) > 0 {
+			errs = appendErrors(errs, fmt.Errorf("ca certificates and subject alt names cannot be verified with insecure skip verify"))
+		}
+	}
+
 	return
 }
 
@@ -2038,6 +2038,50 @@ func TestValidateGateway(t *testing.T) {
 	}
 }
 
+func TestValidateSidecar(t *testing.T) {
+	egress := func(hosts ...string) []*networking.IstioEgressListener {
+		return []*networking.IstioEgressListener{{Hosts: hosts}}
+	}
+	tests := []struct {
+		name string
+		in   proto.Message
+		out  string
+	}{
+		{"empty", &networking.Sidecar{}, "egress listener"},
+		{"invalid message", &networking.Gateway{}, "cannot cast"},
+		{"happy", &networking.Sidecar{Egress: egress("default/foo.default.svc.cluster.local", "*/bar.example.com")}, ""},
+		{"happy wildcards", &networking.Sidecar{Egress: egress("./*", "*/*.example.com")}, ""},
+		{"happy selector",
+			&networking.Sidecar{
+				WorkloadSelector: &networking.WorkloadSelector{Labels: map[string]string{"app": "reviews"}},
+				Egress:           egress("./*"),
+			},
+			""},
+		{"no hosts", &networking.Sidecar{Egress: egress()}, "at least one host"},
+		{"no namespace", &networking.Sidecar{Egress: egress("foo.example.com")}, "namespace/dnsName"},
+		{"bad namespace", &networking.Sidecar{Egress: egress("Default_ns/foo.example.com")}, "invalid namespace"},
+		{"bad host", &networking.Sidecar{Egress: egress("default/foo..example.com")}, "domain"},
+		{"bad selector",
+			&networking.Sidecar{
+				WorkloadSelector: &networking.WorkloadSelector{Labels: map[string]string{"": "reviews"}},
+				Egress:           egress("./*"),
+			},
+			"tag key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateSidecar(tt.in)
+			if err == nil && tt.out != "" {
+				t.Fatalf("ValidateSidecar(%v) = nil, wanted %q", tt.in, tt.out)
+			} else if err != nil && tt.out == "" {
+				t.Fatalf("ValidateSidecar(%v) = %v, wanted nil", tt.in, err)
+			} else if err != nil && !strings.Contains(err.Error(), tt.out) {
+				t.Fatalf("ValidateSidecar(%v) = %v, wanted %q", tt.in, err, tt.out)
+			}
+		})
+	}
+}
+
 func TestValidateServer(t *testing.T) {
 	tests := []struct {
 		name string
@@ -2215,6 +2259,127 @@ func TestValidateTlsOptions(t *testing.T) {
 	}
 }
 
+func TestValidateLocalityLbSetting(t *testing.T) {
+	tests := []struct {
+		name string
+		in   *networking.LocalityLoadBalancerSetting
+		out  string
+	}{
+		{"nil", nil, ""},
+		{"failover",
+			&networking.LocalityLoadBalancerSetting{
+				Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+					{From: "us-east", To: "us-west"},
+					{From: "us-west", To: "us-east"}}},
+			""},
+		{"failover without to",
+			&networking.LocalityLoadBalancerSetting{
+				Failover: []*networking.LocalityLoadBalancerSetting_Failover{{From: "us-east"}}},
+			"from and a to region"},
+		{"failover to itself",
+			&networking.LocalityLoadBalancerSetting{
+				Failover: []*networking.LocalityLoadBalancerSetting_Failover{{From: "us-east", To: "us-east"}}},
+			"to itself"},
+		{"distribute",
+			&networking.LocalityLoadBalancerSetting{
+				Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+					{From: "us-east/zone1/*", To: map[string]uint32{"us-east/zone1/*": 80, "us-west/*": 20}}}},
+			""},
+		{"distribute not totaling 100",
+			&networking.LocalityLoadBalancerSetting{
+				Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+					{From: "us-east/*", To: map[string]uint32{"us-east/*": 80, "us-west/*": 10}}}},
+			"must total 100%"},
+		{"distribute without from",
+			&networking.LocalityLoadBalancerSetting{
+				Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+					{To: map[string]uint32{"us-west/*": 100}}}},
+			"requires a from locality"},
+		{"distribute and failover",
+			&networking.LocalityLoadBalancerSetting{
+				Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+					{From: "us-east/*", To: map[string]uint32{"us-west/*": 100}}},
+				Failover: []*networking.LocalityLoadBalancerSetting_Failover{{From: "us-east", To: "us-west"}}},
+			"cannot both"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateLocalityLbSetting(tt.in)
+			if err == nil && tt.out != "" {
+				t.Fatalf("validateLocalityLbSetting(%v) = nil, wanted %q", tt.in, tt.out)
+			} else if err != nil && tt.out == "" {
+				t.Fatalf("validateLocalityLbSetting(%v) = %v, wanted nil", tt.in, err)
+			} else if err != nil && !strings.Contains(err.Error(), tt.out) {
+				t.Fatalf("validateLocalityLbSetting(%v) = %v, wanted %q", tt.in, err, tt.out)
+			}
+		})
+	}
+}
+
+func TestValidateTLS(t *testing.T) {
+	tests := []struct {
+		name string
+		in   *networking.TLSSettings
+		out  string
+	}{
+		{"nil", nil, ""},
+		{"simple", &networking.TLSSettings{Mode: networking.TLSSettings_SIMPLE}, ""},
+		{"mutual",
+			&networking.TLSSettings{
+				Mode:              networking.TLSSettings_MUTUAL,
+				ClientCertificate: "/etc/certs/cert.pem",
+				PrivateKey:        "/etc/certs/key.pem"},
+			""},
+		{"mutual no client cert",
+			&networking.TLSSettings{
+				Mode:       networking.TLSSettings_MUTUAL,
+				PrivateKey: "/etc/certs/key.pem"},
+			"client certificate"},
+		{"mutual no private key",
+			&networking.TLSSettings{
+				Mode:              networking.TLSSettings_MUTUAL,
+				ClientCertificate: "/etc/certs/cert.pem"},
+			"private key"},
+		{"mutual credential",
+			&networking.TLSSettings{
+				Mode:           networking.TLSSettings_MUTUAL,
+				CredentialName: "backend-credential"},
+			""},
+		{"simple insecure skip verify",
+			&networking.TLSSettings{
+				Mode:               networking.TLSSettings_SIMPLE,
+				InsecureSkipVerify: &types.BoolValue{Value: true}},
+			""},
+		{"mutual insecure skip verify",
+			&networking.TLSSettings{
+				Mode:               networking.TLSSettings_MUTUAL,
+				ClientCertificate:  "/etc/certs/cert.pem",
+				PrivateKey:         "/etc/certs/key.pem",
+				InsecureSkipVerify: &types.BoolValue{Value: true}},
+			"only supported with simple tls"},
+		{"insecure skip verify with ca certificates",
+			&networking.TLSSettings{
+				Mode:               networking.TLSSettings_SIMPLE,
+				CaCertificates:     "/etc/certs/ca.pem",
+				InsecureSkipVerify: &types.BoolValue{Value: true}},
+			"cannot be verified"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateTLS(tt.in)
+			if err == nil && tt.out != "" {
+				t.Fatalf("validateTLS(%v) = nil, wanted %q", tt.in, tt.out)
+			} else if err != nil && tt.out == "" {
+				t.Fatalf("validateTLS(%v) = %v, wanted nil", tt.in, err)
+			} else if err != nil && !strings.Contains(err.Error(), tt.out) {
+				t.Fatalf("validateTLS(%v) = %v, wanted %q", tt.in, err, tt.out)
+			}
+		})
+	}
+}
+
 func TestValidateHTTPHeaderName(t *testing.T) {
 	testCases := []struct {
 		name  string
@@ -2709,6 +2874,16 @@ func TestValidateConnectionPool(t *testing.T) {
 				ConnectTimeout: &types.Duration{Seconds: 2, Nanos: 5}}},
 			valid: false},
 
+		{name: "valid connection pool, http idle timeout", in: networking.ConnectionPoolSettings{
+			Http: &networking.ConnectionPoolSettings_HTTPSettings{
+				IdleTimeout: &types.Duration{Seconds: 60}}},
+			valid: true},
+
+		{name: "invalid connection pool, bad http idle timeout", in: networking.ConnectionPoolSettings{
+			Http: &networking.ConnectionPoolSettings_HTTPSettings{
+				IdleTimeout: &types.Duration{Nanos: 5}}},
+			valid: false},
+
 		{name: "invalid connection pool, bad max pending requests", in: networking.ConnectionPoolSettings{
 			Http: &networking.ConnectionPoolSettings_HTTPSettings{Http1MaxPendingRequests: -1}},
 			valid: false},
@@ -2749,6 +2924,9 @@ func TestValidateOutlierDetection(t *testing.T) {
 			},
 		}, valid: true},
 
+		{name: "invalid outlier detection, no settings", in: networking.OutlierDetection{},
+			valid: false},
+
 		{name: "invalid outlier detection, bad consecutive errors", in: networking.OutlierDetection{
 			Http: &networking.OutlierDetection_HTTPSettings{ConsecutiveErrors: -1}},
 			valid: false},
@@ -2764,6 +2942,10 @@ func TestValidateOutlierDetection(t *testing.T) {
 		{name: "invalid outlier detection, bad max ejection percent", in: networking.OutlierDetection{
 			Http: &networking.OutlierDetection_HTTPSettings{MaxEjectionPercent: 105}},
 			valid: false},
+
+		{name: "invalid outlier detection, negative max ejection percent", in: networking.OutlierDetection{
+			Http: &networking.OutlierDetection_HTTPSettings{MaxEjectionPercent: -1}},
+			valid: false},
 	}
 
 	for _, c := range cases {
@@ -67,6 +67,24 @@ func BuildJwksURIClustersForProxyInstances(mesh *meshconfig.MeshConfig,
 	return buildJwksURIClusters(jwtSpecs, mesh.ConnectTimeout)
 }
 
+// BuildJwksURIClustersForServices checks the authentication policy for all ports of the
+// input services, and generates (outbound) clusters for all JwksURIs.
+func BuildJwksURIClustersForServices(mesh *meshconfig.MeshConfig,
+	store model.IstioConfigStore, services []*model.Service) []*v2.Cluster {
+	if len(services) == 0 {
+		return nil
+	}
+	var jwtSpecs []*authn.Jwt
+	for _, service := range services {
+		for _, port := range service.Ports {
+			authnPolicy := model.GetConsolidateAuthenticationPolicy(mesh, store, service.Hostname, port)
+			jwtSpecs = append(jwtSpecs, model.CollectJwtSpecs(authnPolicy)...)
+		}
+	}
+
+	return buildJwksURIClusters(jwtSpecs, mesh.ConnectTimeout)
+}
+
 // buildJwksURIClusters returns a list of clusters for each unique JwksUri from
 // the input list of Jwt specs. This function is to support
 // buildJwksURIClustersForProxyInstances above.
@@ -29,6 +29,15 @@ import (
 	"istio.io/istio/pkg/log"
 )
 
+// ALPNInMesh advertises that the upstream connection is mutual TLS between two Istio proxies.
+var ALPNInMesh = []string{"istio"}
+
+// ALPNH2Only advertises that the upstream connection uses HTTP/2.
+var ALPNH2Only = []string{"h2"}
+
+// ALPNHTTP11Only advertises that the upstream connection uses HTTP/1.1.
+var ALPNHTTP11Only = []string{"http/1.1"}
+
 //// convertAddressListToCidrList converts a list of IP addresses with cidr prefixes into envoy CIDR proto
 //func convertAddressListToCidrList(addresses []string) []*core.CidrRange {
 //	if addresses == nil {
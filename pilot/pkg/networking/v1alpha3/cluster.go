@@ -20,10 +20,27 @@ import (
 
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2/auth"
 	v2_cluster "github.com/envoyproxy/go-control-plane/envoy/api/v2/cluster"
+	envoy_type "github.com/envoyproxy/go-control-plane/envoy/type"
 	"github.com/gogo/protobuf/types"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/duration"
+	"github.com/prometheus/client_golang/prometheus"
 
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	meshconfig "istio.io/api/mesh/v1alpha1"
 	networking "istio.io/api/networking/v1alpha3"
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/networking/plugins/authn"
@@ -37,339 +54,2570 @@ const (
 	// ManagementClusterHostname indicates the hostname used for building inbound clusters for management ports
 	ManagementClusterHostname = "mgmtCluster"
 
-	// CDSv2 validation requires ConnectTimeout to be > 0s. This is applied if no explicit policy is set.
-	defaultClusterConnectTimeout = 5 * time.Second
+	// BlackHoleCluster is the name of the cluster without hosts, referenced by routes rejecting traffic.
+	BlackHoleCluster = "BlackHoleCluster"
+	// PassthroughCluster is the name of the ORIGINAL_DST cluster forwarding traffic to its original destination.
+	PassthroughCluster = "PassthroughCluster"
+
+	// Minimum number of entries in the hash ring used by RING_HASH clusters. Matches the envoy default.
+	defaultMinimumRingSize = 1024
+
+	// Maximum percentage of hosts ejected by outlier detection if the policy does not say otherwise.
+	defaultMaxEjectionPercent = 10
+
+	// Envoy default for the DNS refresh rate of STRICT_DNS clusters.
+	defaultDNSRefreshRate = 5 * time.Second
+
+	// Envoy default for the interval at which ORIGINAL_DST clusters remove their unused hosts.
+	defaultOriginalDstCleanupInterval = 5 * time.Second
+
+	// Defaults for active health checks of outbound clusters.
+	defaultHealthCheckTimeout            = 1 * time.Second
+	defaultHealthCheckHealthyThreshold   = 1
+	defaultHealthCheckUnhealthyThreshold = 3
 
 	// Name used for the xds cluster.
 	xdsName = "xds-grpc"
+
+	// Filter metadata namespace of the istio cluster metadata, read by stats and telemetry filters.
+	clusterMetadataNamespace = "istio"
+
+	// Field of the istio cluster metadata holding the idle timeout of TCP connections, read by the
+	// TCP proxy filters of the listeners.
+	clusterMetadataTCPIdleTimeout = "tcp_idle_timeout"
+
+	// Names of the SDS secrets of the workload certificate and of the root CA certificate provisioned
+	// by Istio, as served by the node agent.
+	sdsDefaultSecretName = "default"
+	sdsRootCASecretName  = "ROOTCA"
+
+	// Stat prefix of the gRPC client fetching SDS secrets.
+	sdsStatPrefix = "sdsstat"
+
+	// Suffix of the name of the SDS secret holding the CA certificates of a credential, verifying the
+	// upstream certificates.
+	credentialCACertSuffix = "-cacert"
+
+	// Unix domain socket of the gateway agent serving the credentials of the gateway over SDS, read
+	// from the secrets of the gateway namespace.
+	defaultCredentialSdsUdsPath = "/var/run/ingress_gateway/sds"
+)
+
+var (
+	// Counts the services skipped by the cluster builds as they have no ports, typically a
+	// misconfigured service entry.
+	servicesWithoutPorts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "pilot",
+		Subsystem: "clusters",
+		Name:      "services_without_ports",
+		Help:      "Count of services without ports skipped when building the clusters of a proxy",
+	})
+
+	// Counts the PASSTHROUGH load balancers of destination rules applied to EDS clusters, which turn
+	// the clusters into original destination clusters no longer using the discovered endpoints.
+	passthroughLbConflicts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "pilot",
+		Subsystem: "clusters",
+		Name:      "passthrough_lb_conflicts",
+		Help:      "Count of PASSTHROUGH load balancers applied to clusters of services resolved over EDS",
+	})
+
+	// Counts the clusters built with SIMPLE TLS skipping the verification of the upstream certificate,
+	// so that the clusters left to migrate off the insecure option stay visible.
+	insecureSkipVerifyClusters = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "pilot",
+		Subsystem: "clusters",
+		Name:      "insecure_skip_verify",
+		Help:      "Count of clusters built without verifying the certificate of their upstream",
+	})
+
+	// Counts the clusters built with SIMPLE TLS not verifying the upstream certificate as neither the
+	// destination rule nor the system sets CA certificates.
+	unverifiedUpstreamClusters = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "pilot",
+		Subsystem: "clusters",
+		Name:      "unverified_upstream",
+		Help:      "Count of clusters built without CA certificates to verify the certificate of their upstream",
+	})
+
+	// Counts the clusters built for the proxies by kind: outbound service clusters, outbound subset
+	// clusters, clusters of the endpoints of headless services, inbound clusters, and other clusters
+	// such as the passthrough cluster.
+	clustersBuilt = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "pilot",
+		Subsystem: "clusters",
+		Name:      "built_total",
+		Help:      "Count of clusters built for the proxies, by kind",
+	}, []string{"kind"})
+
+	// Latency of the cluster builds of a proxy, which grows with the number of services of the mesh.
+	clusterBuildDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "pilot",
+		Subsystem: "clusters",
+		Name:      "build_duration_seconds",
+		Help:      "Duration of building the clusters of a proxy",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 15),
+	})
+)
+
+func init() {
+	prometheus.MustRegister(servicesWithoutPorts)
+	prometheus.MustRegister(passthroughLbConflicts)
+	prometheus.MustRegister(insecureSkipVerifyClusters)
+	prometheus.MustRegister(unverifiedUpstreamClusters)
+	prometheus.MustRegister(clustersBuilt)
+	prometheus.MustRegister(clusterBuildDuration)
+}
+
+// Mesh config defaults, used for settings missing from the mesh config of the environment.
+var defaultMeshConfig = model.DefaultMeshConfig()
+
+var (
+	// Minimum and maximum TLS protocol versions for upstream TLS connections, e.g. TLSv1_2.
+	upstreamTLSMinimumProtocolVersion = auth.TlsParameters_TlsProtocol(envEnum("PILOT_UPSTREAM_TLS_MIN_VERSION",
+		auth.TlsParameters_TlsProtocol_value, int32(auth.TlsParameters_TLSv1_2)))
+	upstreamTLSMaximumProtocolVersion = auth.TlsParameters_TlsProtocol(envEnum("PILOT_UPSTREAM_TLS_MAX_VERSION",
+		auth.TlsParameters_TlsProtocol_value, int32(auth.TlsParameters_TLS_AUTO)))
+
+	// Ordered list of cipher suites allowed for upstream TLS connections. Envoy defaults are used if empty.
+	upstreamTLSCipherSuites = envStringList("PILOT_UPSTREAM_TLS_CIPHER_SUITES")
+
+	// CA certificates of the system trust store, verifying upstreams in SIMPLE TLS mode when the
+	// destination rule sets no CA certificates. Such upstreams are not verified if unset, which is
+	// logged and counted for every cluster.
+	upstreamSystemCACertificates = os.Getenv("PILOT_UPSTREAM_SYSTEM_CA_CERTIFICATES")
+
+	// Pins of the upstream certificates of services, verified in SIMPLE and MUTUAL TLS in addition to
+	// the CA certificates, as comma separated lists of <hostname>=<pin> with one entry per pin. SPKI pins
+	// are base64 encoded SHA-256 hashes of the public key, certificate hashes hex encoded SHA-256 hashes
+	// of the certificate. A pinned certificate is trusted without CA certificates, e.g. a self signed one.
+	upstreamTLSSpkiPins = parseCertificatePins("spki pin", envStringList("PILOT_UPSTREAM_TLS_SPKI_PINS"),
+		isSpkiPin)
+	upstreamTLSCertificateHashes = parseCertificatePins("certificate hash",
+		envStringList("PILOT_UPSTREAM_TLS_CERTIFICATE_HASHES"), isCertificateHash)
+
+	// Unix domain socket of the node agent serving the certificates of mutual TLS over SDS. The
+	// certificates are read from files mounted in the proxy if unset.
+	sdsUdsPath = os.Getenv("PILOT_SDS_UDS_PATH")
+
+	// Unix domain socket of the agent serving the credentials referenced by name in the TLS settings of
+	// destination rules, typically for the upstream TLS of gateways.
+	credentialSdsUdsPath = envString("PILOT_CREDENTIAL_SDS_UDS_PATH", defaultCredentialSdsUdsPath)
+
+	// Interval at which Envoy re-resolves the hostnames of DNS clusters.
+	dnsRefreshRate = envDuration("PILOT_DNS_REFRESH_RATE", defaultDNSRefreshRate)
+
+	// DNS resolvers of DNS clusters, as a comma separated list of <ip> or <ip>:<port>, e.g. a resolver
+	// local to the proxy. The resolvers of the system are used if unset.
+	dnsResolvers = parseDNSResolvers(envStringList("PILOT_DNS_RESOLVERS"))
+
+	// IP address family used to resolve the hostnames of DNS clusters. Defaults to IPv4 only.
+	dnsLookupFamily = v2.Cluster_DnsLookupFamily(envEnum("PILOT_DNS_LOOKUP_FAMILY",
+		v2.Cluster_DnsLookupFamily_value, int32(v2.Cluster_V4_ONLY)))
+
+	// Initial HTTP/2 flow control window sizes of upstream streams and connections, in bytes.
+	// Envoy accepts values between 65535 and 2147483647, zero leaves the Envoy default.
+	http2InitialStreamWindowSize     = envUint32("PILOT_HTTP2_INITIAL_STREAM_WINDOW_SIZE", 0)
+	http2InitialConnectionWindowSize = envUint32("PILOT_HTTP2_INITIAL_CONNECTION_WINDOW_SIZE", 0)
+
+	// Maximum number of concurrent streams on a single upstream HTTP/2 connection, zero leaves the Envoy default.
+	http2MaxConcurrentStreams = envUint32("PILOT_HTTP2_MAX_CONCURRENT_STREAMS", 0)
+
+	// Idle timeout of upstream HTTP connections, so that idle connections are closed and new ones
+	// are balanced over the hosts added by a scale up. Unset by default, keeping connections open.
+	httpIdleTimeout = envDuration("PILOT_HTTP_IDLE_TIMEOUT", 0)
+
+	// Idle timeout of the connections proxied to the clusters of TCP ports, e.g. databases, after which
+	// the TCP proxy closes them. Unset by default, keeping idle connections open.
+	tcpIdleTimeout = envDuration("PILOT_TCP_IDLE_TIMEOUT", 0)
+
+	// Active health checking of the hosts of outbound DNS and static clusters, disabled unless an
+	// interval is set. HTTP ports are checked with a GET of the path if set, other ports with a
+	// TCP connect.
+	healthCheckInterval           = envDuration("PILOT_HEALTH_CHECK_INTERVAL", 0)
+	healthCheckTimeout            = envDuration("PILOT_HEALTH_CHECK_TIMEOUT", defaultHealthCheckTimeout)
+	healthCheckHealthyThreshold   = envUint32("PILOT_HEALTH_CHECK_HEALTHY_THRESHOLD", defaultHealthCheckHealthyThreshold)
+	healthCheckUnhealthyThreshold = envUint32("PILOT_HEALTH_CHECK_UNHEALTHY_THRESHOLD", defaultHealthCheckUnhealthyThreshold)
+	healthCheckHTTPPath           = os.Getenv("PILOT_HEALTH_CHECK_HTTP_PATH")
+
+	// Whether the hosts of EDS clusters are also actively health checked, in addition to the health
+	// reported by the platform.
+	healthCheckEDS = envBool("PILOT_HEALTH_CHECK_EDS", false)
+
+	// Whether the connections to a host of an actively health checked cluster are closed when the host
+	// fails its health checks, rather than kept until they fail, e.g. long lived TCP connections.
+	closeConnectionsOnHostHealthFailure = envBool("PILOT_CLOSE_CONNECTIONS_ON_HOST_HEALTH_FAILURE", false)
+
+	// Interval at which ORIGINAL_DST clusters remove the hosts no longer used by any connection, bounding
+	// the memory held by the hosts of short lived destinations.
+	originalDstCleanupInterval = envDuration("PILOT_ORIGINAL_DST_CLEANUP_INTERVAL", defaultOriginalDstCleanupInterval)
+
+	// Whether ORIGINAL_DST clusters route HTTP requests to the host in the x-envoy-original-dst-host
+	// header instead of the original destination address of the connection.
+	originalDstUseHTTPHeader = envBool("PILOT_ORIGINAL_DST_USE_HTTP_HEADER", false)
+
+	// Number of consecutive gateway errors (502, 503 and 504) ejecting a host of the clusters whose
+	// destination rule enables outlier detection, in addition to the consecutive 5xx errors of the
+	// rule. Hosts are not ejected on gateway errors alone if unset.
+	outlierConsecutiveGatewayErrors = envUint32("PILOT_OUTLIER_CONSECUTIVE_GATEWAY_ERRORS", 0)
+
+	// Percentage of the hosts of the clusters whose destination rule enables outlier detection that
+	// are never ejected, capping the max ejection percent of the rule. It is also the healthy panic
+	// threshold of these clusters, unless PILOT_HEALTHY_PANIC_THRESHOLD is set. No floor if unset.
+	outlierMinHealthPercent = envUint32("PILOT_OUTLIER_MIN_HEALTH_PERCENT", 0)
+
+	// Number of consecutive connection failures ejecting a host of the clusters of TCP ports, e.g.
+	// databases, whose destination rule sets no outlier detection. Disabled if unset.
+	tcpOutlierConsecutiveErrors = envUint32("PILOT_OUTLIER_TCP_CONSECUTIVE_ERRORS", 0)
+
+	// Whether EDS clusters balance load across localities according to the locality weights
+	// sent with the endpoints.
+	enableLocalityWeightedLb = envBool("PILOT_ENABLE_LOCALITY_WEIGHTED_LB", false)
+
+	// Whether EDS clusters using the RANDOM or ROUND_ROBIN load balancer, including the default one,
+	// honor the locality weights sent with the endpoints, even if locality weighted load balancing is
+	// not enabled for every EDS cluster. EDS weights the localities by their number of endpoints.
+	enableWeightedSimpleLb = envBool("PILOT_ENABLE_WEIGHTED_SIMPLE_LB", false)
+
+	// Percentage of healthy hosts of EDS clusters below which Envoy balances load across all hosts,
+	// ignoring their health. Zero disables the panic mode, the Envoy default of 50% is used if unset.
+	healthyPanicThreshold, healthyPanicThresholdSet = envOptionalUint32("PILOT_HEALTHY_PANIC_THRESHOLD")
+
+	// Whether EDS clusters drain the connections to the hosts removed from discovery, even if they
+	// still pass their health checks, rather than keeping them until they close or reset.
+	drainConnectionsOnHostRemoval = envBool("PILOT_DRAIN_CONNECTIONS_ON_HOST_REMOVAL", false)
+
+	// Window over which Envoy merges the health and metadata updates of the hosts of EDS clusters,
+	// smoothing the churn of rolling deployments. The updates apply immediately if unset.
+	edsUpdateMergeWindow = envDuration("PILOT_EDS_UPDATE_MERGE_WINDOW", 0)
+
+	// Source address of the upstream connections of outbound clusters, e.g. to match IP based
+	// firewall rules. The address is picked by the OS if unset.
+	upstreamSourceAddress = envIP("PILOT_UPSTREAM_SOURCE_ADDRESS")
+
+	// Whether endpoint updates are only pushed by pilot over the EDS stream. Envoy then does not
+	// poll for endpoints periodically.
+	edsPushOnly = envBool("PILOT_EDS_PUSH_ONLY", false)
+
+	// EDS service names replacing the subset service keys of clusters, as a comma separated list of
+	// <service key>=<service key>, e.g. outbound|http|v1|reviews.default.svc.cluster.local=
+	// outbound|http||reviews.default.svc.cluster.local. Several clusters can share the endpoints of
+	// one key, or point at the key of an alias during a migration.
+	edsServiceNameOverrides = parseEDSServiceNameOverrides(envStringList("PILOT_EDS_SERVICE_NAME_OVERRIDES"))
+
+	// Whether the proxies fetch endpoints over the aggregated discovery stream (ADS), which orders
+	// the EDS updates after the CDS updates they depend on.
+	edsUseADS = envBool("PILOT_EDS_USE_ADS", false)
+
+	// Factor applied to the connection pool limits of the default routing priority to derive the
+	// circuit breaker thresholds of high priority traffic. High priority traffic shares the default
+	// thresholds if unset.
+	highPriorityThresholdFactor = envUint32("PILOT_HIGH_PRIORITY_THRESHOLD_FACTOR", 0)
+
+	// Whether a PASSTHROUGH load balancer of a destination rule is ignored on EDS clusters, which
+	// otherwise become original destination clusters, bypassing endpoint discovery.
+	rejectPassthroughLbOnEDS = envBool("PILOT_REJECT_PASSTHROUGH_LB_ON_EDS", false)
+
+	// Whether clusters emit their stats under a name built from the service short name, subset and
+	// port, without the dots of the cluster name. Off by default to keep existing dashboards working.
+	enableAltStatName = envBool("PILOT_ENABLE_ALT_STAT_NAME", false)
+
+	// Whether a cluster is built for each endpoint of the TCP ports of headless services, in addition
+	// to the cluster of the service, so that clients such as the members of a stateful set can address
+	// a single pod. The cluster of an endpoint is named after its address, as the subset of the service,
+	// and the outbound listener of the endpoint address forwards the connections to it.
+	enableHeadlessEndpointClusters = envBool("PILOT_ENABLE_HEADLESS_ENDPOINT_CLUSTERS", false)
+
+	// Protocols of service ports overriding the classification by port name, as a comma separated list
+	// of <hostname>:<port>=<protocol>, e.g. reviews.default.svc.cluster.local:9080=GRPC. This detects
+	// HTTP/2 and gRPC on ports with generic names such as tcp.
+	protocolOverrides = parseProtocolOverrides(envStringList("PILOT_PROTOCOL_OVERRIDES"))
+
+	// Soft limit on the size of the read and write buffers of each upstream connection, in bytes. The
+	// Envoy default of 1MiB is kept if unset. The overrides set the limit of the clusters of a service,
+	// as a comma separated list of <hostname>=<bytes>, e.g. raising it for the services with large
+	// payloads and lowering it to cap the memory used by those with small ones.
+	perConnectionBufferLimitBytes, perConnectionBufferLimitBytesSet = envOptionalUint32(
+		"PILOT_PER_CONNECTION_BUFFER_LIMIT_BYTES")
+	perConnectionBufferLimitOverrides = parsePerConnectionBufferLimitOverrides(
+		envStringList("PILOT_PER_CONNECTION_BUFFER_LIMIT_OVERRIDES"))
+
+	// Maximum number of connections of ORIGINAL_DST clusters whose destination rule does not set one,
+	// including the passthrough cluster, protecting the proxy from connection exhaustion towards
+	// arbitrary destinations. Unlimited by Pilot if unset.
+	originalDstMaxConnections = envUint32("PILOT_ORIGINAL_DST_MAX_CONNECTIONS", 0)
+
+	// Gateways of the networks of a mesh spanning several networks, as a comma separated list of
+	// <network>=<ip>:<port>. The endpoints of DNS and static clusters in another network than the one
+	// of the proxy are reached through the gateway of their network.
+	meshNetworkGateways = parseMeshNetworkGateways(envStringList("PILOT_MESH_NETWORK_GATEWAYS"))
+
+	// Whether outbound connections to HTTP/1.1 ports are upgraded to HTTP/2 unless the connection pool
+	// of the destination rule says otherwise. The upstreams must then support HTTP/2.
+	h2UpgradePolicy = networking.ConnectionPoolSettings_HTTPSettings_H2UpgradePolicy(envEnum("PILOT_H2_UPGRADE_POLICY",
+		networking.ConnectionPoolSettings_HTTPSettings_H2UpgradePolicy_value,
+		int32(networking.ConnectionPoolSettings_HTTPSettings_DEFAULT)))
+
+	// Number of services whose outbound clusters are built concurrently, as the builds of large meshes
+	// otherwise dominate the push latency. One builds the services one after the other.
+	outboundClusterWorkers = int(envUint32("PILOT_OUTBOUND_CLUSTER_WORKERS", uint32(runtime.NumCPU())))
+
+	// Load balancing policy of the clusters whose destination rule does not set one. ORIGINAL_DST
+	// clusters always use PASSTHROUGH.
+	defaultLbPolicy = envDefaultLbPolicy()
 )
 
-// TODO: Need to do inheritance of DestRules based on domain suffix match
+// BuildClusters returns the list of clusters for the given proxy. This is the CDS output
+// For outbound: Cluster for each service/subset hostname or cidr with SNI set to service hostname
+// Cluster type based on resolution
+// For inbound (sidecar only): Cluster for each inbound endpoint port and for each service port
+func BuildClusters(env model.Environment, proxy model.Proxy) []*v2.Cluster {
+	start := time.Now()
+	defer func() { clusterBuildDuration.Observe(time.Since(start).Seconds()) }()
+
+	clusters := make([]*v2.Cluster, 0)
+
+	// Without the services, the inbound and management clusters are still built, so that the proxy
+	// keeps serving its workload rather than dropping every cluster.
+	services, err := env.Services()
+	if err != nil {
+		log.Errorf("Failed for retrieve services: %v", err)
+		services = nil
+	}
+
+	// the instances of a sidecar select both its sidecar configuration and its inbound clusters
+	var instances []*model.ServiceInstance
+	if proxy.Type == model.Sidecar {
+		instances, err = env.GetProxyServiceInstances(proxy)
+		if err != nil {
+			log.Errorf("failed to get service proxy service instances: %v", err)
+			return nil
+		}
+	}
+
+	outboundClusters := buildOutboundClusters(env, proxy, filterSidecarEgressServices(env, proxy, instances, services))
+	clusters = append(clusters, outboundClusters...)
+	var inboundClusters []*v2.Cluster
+	switch proxy.Type {
+	case model.Sidecar:
+		managementPorts := proxyManagementPorts(env, proxy)
+		inboundClusters = buildInboundClusters(env, proxy, instances, managementPorts)
+		clusters = append(clusters, inboundClusters...)
+
+		// append cluster for JwksUri (for Jwt authentication) if necessary.
+		clusters = append(clusters, authn.BuildJwksURIClustersForProxyInstances(
+			env.Mesh, env.IstioConfigStore, instances)...)
+	case model.Router:
+		// Gateways have no inbound service clusters, but the platform health checks still
+		// need to reach the management ports of the gateway workload.
+		managementPorts := proxyManagementPorts(env, proxy)
+		inboundClusters = buildInboundClusters(env, proxy, nil, managementPorts)
+		clusters = append(clusters, inboundClusters...)
+
+		// append cluster for JwksUri (for Jwt authentication) of the services exposed by the gateway.
+		clusters = append(clusters, buildGatewayJwksURIClusters(env, proxy, services)...)
+	}
+
+	clusters = append(clusters, buildBlackHoleCluster(env))
+	if outboundTrafficPolicyMode(env.Mesh) == meshconfig.MeshConfig_OutboundTrafficPolicy_ALLOW_ANY {
+		clusters = append(clusters, buildPassthroughCluster(env))
+	}
+
+	recordBuiltClusters(outboundClusters, inboundClusters, clusters)
+
+	// Envoy treats a reordered list of clusters as a change, keep the output stable across pushes.
+	sort.Slice(clusters, func(i, j int) bool { return clusters[i].Name < clusters[j].Name })
+
+	return clusters // TODO: normalize/dedup
+}
+
+// proxyManagementPorts returns the management ports of the workload of the proxy, or none if the
+// proxy has no IP address yet, e.g. connecting before its pod IP is known. The management clusters
+// are then built by a later push.
+func proxyManagementPorts(env model.Environment, proxy model.Proxy) model.PortList {
+	if proxy.IPAddress == "" {
+		log.Warnf("proxy %s has no IP address, skipping its management clusters", proxy.ID)
+		return nil
+	}
+	return env.ManagementPorts(proxy.IPAddress)
+}
+
+// BuildClustersForService returns the clusters of the proxy for a single service, the default and
+// subset clusters of its ports and, for sidecars, the inbound clusters of its instances on the proxy,
+// as built by BuildClusters. It lets incremental CDS push the clusters of a changed service alone,
+// the clusters shared by all services and the authentication clusters are left out. The clusters are
+// empty if the service is unknown.
+func BuildClustersForService(env model.Environment, proxy model.Proxy, hostname string) ([]*v2.Cluster, error) {
+	start := time.Now()
+	defer func() { clusterBuildDuration.Observe(time.Since(start).Seconds()) }()
+
+	services, err := env.Services()
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve services: %v", err)
+	}
+	// a service may be listed by several registries, all of them contribute to the clusters
+	matching := make([]*model.Service, 0, 1)
+	for _, service := range services {
+		if service.Hostname == hostname {
+			matching = append(matching, service)
+		}
+	}
+
+	var instances []*model.ServiceInstance
+	if proxy.Type == model.Sidecar {
+		if instances, err = env.GetProxyServiceInstances(proxy); err != nil {
+			return nil, fmt.Errorf("failed to get service proxy service instances: %v", err)
+		}
+	}
+
+	outboundClusters := buildOutboundClusters(env, proxy, filterSidecarEgressServices(env, proxy, instances, matching))
+	clusters := append(make([]*v2.Cluster, 0, len(outboundClusters)), outboundClusters...)
+	var inboundClusters []*v2.Cluster
+	if proxy.Type == model.Sidecar {
+		serviceInstances := make([]*model.ServiceInstance, 0)
+		for _, instance := range instances {
+			if instance.Service.Hostname == hostname {
+				serviceInstances = append(serviceInstances, instance)
+			}
+		}
+		inboundClusters = buildInboundClusters(env, proxy, serviceInstances, nil)
+		clusters = append(clusters, inboundClusters...)
+	}
+
+	recordBuiltClusters(outboundClusters, inboundClusters, clusters)
+
+	sort.Slice(clusters, func(i, j int) bool { return clusters[i].Name < clusters[j].Name })
+	return clusters, nil
+}
+
+// filterSidecarEgressServices returns the services a sidecar may reach, as restricted by the egress
+// hosts of its sidecar configuration, or all the services if it has none. Gateways are not restricted.
+func filterSidecarEgressServices(env model.Environment, proxy model.Proxy, instances []*model.ServiceInstance,
+	services []*model.Service) []*model.Service {
+	hosts := sidecarEgressHosts(env, proxy, instances)
+	if hosts == nil {
+		return services
+	}
+
+	namespace := proxyNamespace(proxy)
+	out := make([]*model.Service, 0, len(services))
+	for _, service := range services {
+		for _, host := range hosts {
+			if matchEgressHost(host, namespace, service.Hostname) {
+				out = append(out, service)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// sidecarEgressHosts returns the egress hosts of the sidecar configuration selecting the proxy through
+// the labels of its instances, or nil if there is none.
+func sidecarEgressHosts(env model.Environment, proxy model.Proxy, instances []*model.ServiceInstance) []string {
+	if proxy.Type != model.Sidecar {
+		return nil
+	}
+	var workloadLabels model.LabelsCollection
+	for _, instance := range instances {
+		workloadLabels = append(workloadLabels, instance.Labels)
+	}
+
+	config := env.IstioConfigStore.Sidecar(proxyNamespace(proxy), workloadLabels)
+	if config == nil {
+		return nil
+	}
+	hosts := make([]string, 0)
+	for _, egress := range config.Spec.(*networking.Sidecar).Egress {
+		hosts = append(hosts, egress.Hosts...)
+	}
+	return hosts
+}
+
+// matchEgressHost returns whether the service matches the namespace/dnsName egress host of a sidecar
+// in the namespace. Services outside of the Kubernetes cluster domain have no namespace and only match
+// the * namespace.
+func matchEgressHost(host, namespace, hostname string) bool {
+	parts := strings.SplitN(host, "/", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	switch parts[0] {
+	case "*":
+	case ".":
+		if namespace == "" || serviceNamespace(hostname) != namespace {
+			return false
+		}
+	default:
+		if serviceNamespace(hostname) != parts[0] {
+			return false
+		}
+	}
+	return matchHost(parts[1], hostname)
+}
+
+// proxyNamespace returns the namespace of the proxy, the first label of its <namespace>.svc.cluster.local
+// domain.
+func proxyNamespace(proxy model.Proxy) string {
+	return strings.SplitN(proxy.Domain, ".", 2)[0]
+}
+
+// serviceNamespace returns the namespace of a <name>.<namespace>.svc.<domain> service hostname, or an
+// empty string for the other hostnames.
+func serviceNamespace(hostname string) string {
+	parts := strings.SplitN(hostname, ".", 4)
+	if len(parts) < 4 || parts[2] != "svc" {
+		return ""
+	}
+	return parts[1]
+}
+
+// outboundTrafficPolicyMode returns whether the traffic to destinations missing from the service
+// registry is allowed, which is the default.
+func outboundTrafficPolicyMode(mesh *meshconfig.MeshConfig) meshconfig.MeshConfig_OutboundTrafficPolicy_Mode {
+	if mesh == nil || mesh.OutboundTrafficPolicy == nil {
+		return meshconfig.MeshConfig_OutboundTrafficPolicy_ALLOW_ANY
+	}
+	return mesh.OutboundTrafficPolicy.Mode
+}
+
+// recordBuiltClusters counts the clusters of a build by kind. Outbound subset clusters and the clusters
+// of the endpoints of headless services are told apart by their metadata, as their names may be shortened.
+func recordBuiltClusters(outbound, inbound, all []*v2.Cluster) {
+	subsets, endpoints := 0, 0
+	for _, cluster := range outbound {
+		fields := cluster.GetMetadata().GetFilterMetadata()[clusterMetadataNamespace].GetFields()
+		if _, ok := fields["endpoint"]; ok {
+			endpoints++
+		} else if _, ok := fields["subset"]; ok {
+			subsets++
+		}
+	}
+	clustersBuilt.WithLabelValues("outbound").Add(float64(len(outbound) - subsets - endpoints))
+	clustersBuilt.WithLabelValues("subset").Add(float64(subsets))
+	clustersBuilt.WithLabelValues("endpoint").Add(float64(endpoints))
+	clustersBuilt.WithLabelValues("inbound").Add(float64(len(inbound)))
+	clustersBuilt.WithLabelValues("other").Add(float64(len(all) - len(outbound) - len(inbound)))
+}
+
+// isCatchAllPassthrough returns whether the service forwards the traffic to any destination, such as
+// a service entry for the * host without resolution.
+func isCatchAllPassthrough(service *model.Service) bool {
+	return service.Resolution == model.Passthrough && service.Hostname == "*"
+}
+
+// isHeadless returns whether the service is a headless service of the platform, without a virtual IP,
+// whose clients connect to the addresses of its endpoints.
+func isHeadless(service *model.Service) bool {
+	return service.Resolution == model.Passthrough && !service.MeshExternal && service.Address == "" &&
+		!isCatchAllPassthrough(service)
+}
+
+// hasHeadlessEndpointClusters returns whether a cluster is built for each endpoint of the service port.
+// Only the TCP ports get them, as the outbound listeners of the endpoints forward their connections
+// to these clusters.
+func hasHeadlessEndpointClusters(service *model.Service, port *model.Port) bool {
+	if !enableHeadlessEndpointClusters || !isHeadless(service) {
+		return false
+	}
+	switch port.Protocol {
+	case model.ProtocolTCP, model.ProtocolHTTPS, model.ProtocolMongo, model.ProtocolRedis:
+		return true
+	}
+	return false
+}
+
+// buildHeadlessEndpointClusters returns a STATIC cluster for each endpoint of the headless service port,
+// named after the endpoint address as the subset of the service and the port name, e.g.
+// outbound|cql|10.4.1.7|cassandra.default.svc.cluster.local.
+func buildHeadlessEndpointClusters(env model.Environment, cache *outboundCache, service *model.Service, port *model.Port,
+	destinationRule *networking.DestinationRule) []*v2.Cluster {
+	instances, err := cache.instances(service.Hostname, port)
+	if err != nil {
+		log.Errorf("failed to retrieve instances for %s: %v", service.Hostname, err)
+		return nil
+	}
+
+	clusters := make([]*v2.Cluster, 0, len(instances))
+	seen := make(map[string]bool)
+	for _, instance := range instances {
+		address := instance.Endpoint.Address
+		if seen[address] {
+			continue
+		}
+		seen[address] = true
+
+		clusterName := model.BuildSubsetKey(model.TrafficDirectionOutbound, address, service.Hostname, port)
+		host := util.BuildAddress(address, uint32(instance.Endpoint.Port))
+		cluster := buildDefaultCluster(env, clusterName, v2.Cluster_STATIC, []*core.Address{&host})
+		setUpstreamProtocol(cluster, service.Hostname, port)
+		applyH2UpgradePolicy(cluster, h2UpgradePolicy, clusterContext{hostname: service.Hostname, port: port})
+		applyUpstreamBindConfig(cluster)
+		applyPerConnectionBufferLimit(cluster, service.Hostname)
+		cluster.Metadata = buildClusterMetadata(service.Hostname, "", port, nil)
+		cluster.Metadata.FilterMetadata[clusterMetadataNamespace].Fields["endpoint"] =
+			&types.Value{Kind: &types.Value_StringValue{StringValue: address}}
+		if destinationRule != nil {
+			applyTrafficPolicy(cluster, selectTrafficPolicy(destinationRule.TrafficPolicy, port),
+				clusterContext{hostname: service.Hostname, port: port})
+		}
+		clusters = append(clusters, cluster)
+	}
+	return clusters
+}
+
+// buildBlackHoleCluster returns the cluster without hosts, so that the requests routed to it fail.
+func buildBlackHoleCluster(env model.Environment) *v2.Cluster {
+	return buildDefaultCluster(env, BlackHoleCluster, v2.Cluster_STATIC, nil)
+}
+
+// buildPassthroughCluster returns the cluster forwarding the connections to their original destination.
+func buildPassthroughCluster(env model.Environment) *v2.Cluster {
+	return buildDefaultCluster(env, PassthroughCluster, v2.Cluster_ORIGINAL_DST, nil)
+}
+
+// buildGatewayJwksURIClusters returns the clusters to fetch the JWT public keys required by the
+// authentication policies of the services exposed through the gateways bound to the proxy.
+func buildGatewayJwksURIClusters(env model.Environment, proxy model.Proxy, services []*model.Service) []*v2.Cluster {
+	workloadInstances, err := env.GetProxyServiceInstances(proxy)
+	if err != nil {
+		log.Errorf("failed to get gateway instances for router %s: %v", proxy.ID, err)
+		return nil
+	}
+
+	var workloadLabels model.LabelsCollection
+	for _, w := range workloadInstances {
+		workloadLabels = append(workloadLabels, w.Labels)
+	}
+
+	hosts := make([]string, 0)
+	for _, config := range env.Gateways(workloadLabels) {
+		for _, server := range config.Spec.(*networking.Gateway).Servers {
+			hosts = append(hosts, server.Hosts...)
+		}
+	}
+
+	exposed := make([]*model.Service, 0)
+	for _, service := range services {
+		for _, host := range hosts {
+			if matchHost(host, service.Hostname) {
+				exposed = append(exposed, service)
+				break
+			}
+		}
+	}
+
+	return authn.BuildJwksURIClustersForServices(env.Mesh, env.IstioConfigStore, exposed)
+}
+
+// matchHost returns true if the hostname matches the host, which may be a wildcard
+// domain such as *.example.com or *.
+func matchHost(host, hostname string) bool {
+	if strings.HasPrefix(host, "*") {
+		return strings.HasSuffix(hostname, host[1:])
+	}
+	return host == hostname
+}
+
+func buildOutboundClusters(env model.Environment, proxy model.Proxy, services []*model.Service) []*v2.Cluster {
+	network := proxy.Metadata[model.NodeMetadataNetwork]
+	cache := newOutboundCache(env)
+	registryOnly := outboundTrafficPolicyMode(env.Mesh) == meshconfig.MeshConfig_OutboundTrafficPolicy_REGISTRY_ONLY
+	build := func(service *model.Service) []*v2.Cluster {
+		return buildServiceClusters(env, cache, service, network, registryOnly)
+	}
+
+	// The clusters of the services are merged in the order of the services, so that the output does
+	// not depend on the scheduling of the workers.
+	serviceClusters := make([][]*v2.Cluster, len(services))
+	workers := outboundClusterWorkers
+	if workers > len(services) {
+		workers = len(services)
+	}
+	if workers <= 1 {
+		for i, service := range services {
+			serviceClusters[i] = build(service)
+		}
+	} else {
+		indexes := make(chan int)
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range indexes {
+					serviceClusters[i] = build(services[i])
+				}
+			}()
+		}
+		for i := range services {
+			indexes <- i
+		}
+		close(indexes)
+		wg.Wait()
+	}
+
+	clusters := make([]*v2.Cluster, 0)
+	for _, c := range serviceClusters {
+		clusters = append(clusters, c...)
+	}
+	return clusters
+}
+
+// buildServiceClusters returns the outbound clusters of the ports and subsets of the service. It is
+// called concurrently for the services of the mesh.
+func buildServiceClusters(env model.Environment, cache *outboundCache, service *model.Service, network string,
+	registryOnly bool) []*v2.Cluster {
+	if registryOnly && isCatchAllPassthrough(service) {
+		log.Warnf("service %s forwards any destination in the REGISTRY_ONLY outbound traffic mode, skipping",
+			service.Hostname)
+		return nil
+	}
+	if len(service.Ports) == 0 {
+		log.Warnf("service %s has no ports, no clusters are built for it", service.Hostname)
+		servicesWithoutPorts.Inc()
+		return nil
+	}
+
+	clusters := make([]*v2.Cluster, 0)
+	destinationRule := cache.destinationRule(service.Hostname)
+	// the cluster names are built from the port names, the first port with a name wins
+	portNumbers := make(map[string]int, len(service.Ports))
+	for _, port := range service.Ports {
+		// a malformed service entry must not break the clusters of every other service
+		if port == nil {
+			log.Warnf("service %s has a nil port, skipping", service.Hostname)
+			continue
+		}
+		if err := model.ValidatePort(port.Port); err != nil {
+			log.Warnf("service %s has an invalid port %s: %v, skipping", service.Hostname, port.Name, err)
+			continue
+		}
+		if number, ok := portNumbers[port.Name]; ok {
+			log.Warnf("service %s has ports %d and %d with the same name %s, skipping %d", service.Hostname,
+				number, port.Port, port.Name, port.Port)
+			continue
+		}
+		portNumbers[port.Name] = port.Port
+		hosts := buildClusterHosts(cache, service, port, network)
+		// Envoy accepts DNS clusters without hosts, but can never route to them
+		if discoveryType := clusterDiscoveryType(service); len(hosts) == 0 &&
+			(discoveryType == v2.Cluster_STRICT_DNS || discoveryType == v2.Cluster_LOGICAL_DNS) {
+			log.Warnf("service %s has no hosts to resolve for port %s, skipping", service.Hostname, port.Name)
+			continue
+		}
+
+		// create default cluster
+		clusterName := model.BuildSubsetKey(model.TrafficDirectionOutbound, "", service.Hostname, port)
+		defaultCluster := buildDefaultCluster(env, clusterName, clusterDiscoveryType(service), hosts)
+		updateEds(env, defaultCluster,
+			model.BuildSubsetServiceKey(model.TrafficDirectionOutbound, "", service.Hostname, port))
+		setUpstreamProtocol(defaultCluster, service.Hostname, port)
+		applyH2UpgradePolicy(defaultCluster, h2UpgradePolicy, clusterContext{hostname: service.Hostname, port: port})
+		applyHealthCheck(defaultCluster, service.Hostname, port)
+		applyTCPOutlierDetection(defaultCluster, service.Hostname, port)
+		applyUpstreamBindConfig(defaultCluster)
+		applyPerConnectionBufferLimit(defaultCluster, service.Hostname)
+		defaultCluster.Metadata = buildClusterMetadata(service.Hostname, "", port, nil)
+		applyTCPIdleTimeout(defaultCluster, service.Hostname, port)
+		applyAltStatName(defaultCluster, model.TrafficDirectionOutbound, service.Hostname, "", port)
+		clusters = append(clusters, defaultCluster)
+
+		if hasHeadlessEndpointClusters(service, port) {
+			clusters = append(clusters, buildHeadlessEndpointClusters(env, cache, service, port, destinationRule)...)
+		}
+
+		if destinationRule != nil {
+			applyTrafficPolicy(defaultCluster, selectTrafficPolicy(destinationRule.TrafficPolicy, port),
+				clusterContext{hostname: service.Hostname, port: port})
+			applyLbSubsetConfig(defaultCluster, destinationRule.Subsets)
+
+			for _, subset := range destinationRule.Subsets {
+				subsetClusterName := model.BuildSubsetKey(model.TrafficDirectionOutbound, subset.Name, service.Hostname, port)
+				subsetCluster := buildDefaultCluster(env, subsetClusterName, clusterDiscoveryType(service), hosts)
+				updateEds(env, subsetCluster,
+					model.BuildSubsetServiceKey(model.TrafficDirectionOutbound, subset.Name, service.Hostname, port))
+				setUpstreamProtocol(subsetCluster, service.Hostname, port)
+				applyH2UpgradePolicy(subsetCluster, h2UpgradePolicy, clusterContext{hostname: service.Hostname, port: port})
+				applyHealthCheck(subsetCluster, service.Hostname, port)
+				applyTCPOutlierDetection(subsetCluster, service.Hostname, port)
+				applyUpstreamBindConfig(subsetCluster)
+				applyPerConnectionBufferLimit(subsetCluster, service.Hostname)
+				subsetCluster.Metadata = buildClusterMetadata(service.Hostname, subset.Name, port, nil)
+				applyTCPIdleTimeout(subsetCluster, service.Hostname, port)
+				applyAltStatName(subsetCluster, model.TrafficDirectionOutbound, service.Hostname, subset.Name, port)
+				// the subset policy overrides the destination policy field by field
+				applyTrafficPolicy(subsetCluster, mergeTrafficPolicy(selectTrafficPolicy(destinationRule.TrafficPolicy, port),
+					selectTrafficPolicy(subset.TrafficPolicy, port)),
+					clusterContext{hostname: service.Hostname, subset: subset.Name, port: port})
+				clusters = append(clusters, subsetCluster)
+			}
+		}
+	}
+
+	return clusters
+}
+
+// outboundCache memoizes the lookups of a single build of the outbound clusters, shared by the clusters
+// of the same service, e.g. a service listed by several registries, or the clusters of the endpoints of
+// a headless service. Errors are not cached.
+type outboundCache struct {
+	env model.Environment
+
+	mu               sync.Mutex
+	serviceInstances map[string]*cachedInstances
+	destinationRules map[string]*cachedDestinationRule
+
+	// the wildcard destination rules are listed once for all the hostnames
+	wildcardOnce  sync.Once
+	wildcardRules []*networking.DestinationRule
+}
+
+// cachedInstances holds the instances of a service port, looked up once by concurrent builders.
+type cachedInstances struct {
+	sync.Mutex
+	instances []*model.ServiceInstance
+	found     bool
+}
+
+// cachedDestinationRule holds the destination rule of a hostname, looked up once by concurrent builders.
+type cachedDestinationRule struct {
+	sync.Once
+	rule *networking.DestinationRule
+}
+
+func newOutboundCache(env model.Environment) *outboundCache {
+	return &outboundCache{
+		env:              env,
+		serviceInstances: make(map[string]*cachedInstances),
+		destinationRules: make(map[string]*cachedDestinationRule),
+	}
+}
+
+// instances returns the instances of the service port.
+func (c *outboundCache) instances(hostname string, port *model.Port) ([]*model.ServiceInstance, error) {
+	key := hostname + "|" + port.Name
+	c.mu.Lock()
+	entry, ok := c.serviceInstances[key]
+	if !ok {
+		entry = &cachedInstances{}
+		c.serviceInstances[key] = entry
+	}
+	c.mu.Unlock()
+
+	entry.Lock()
+	defer entry.Unlock()
+	if entry.found {
+		return entry.instances, nil
+	}
+	// FIXME port name not required if only one port
+	instances, err := c.env.Instances(hostname, []string{port.Name}, nil)
+	if err != nil {
+		return nil, err
+	}
+	entry.instances, entry.found = instances, true
+	return instances, nil
+}
+
+// destinationRule returns the destination rule of the hostname, or nil.
+func (c *outboundCache) destinationRule(hostname string) *networking.DestinationRule {
+	c.mu.Lock()
+	entry, ok := c.destinationRules[hostname]
+	if !ok {
+		entry = &cachedDestinationRule{}
+		c.destinationRules[hostname] = entry
+	}
+	c.mu.Unlock()
+
+	entry.Do(func() { entry.rule = lookupDestinationRule(c.env, c.wildcardDestinationRules(), hostname) })
+	return entry.rule
+}
+
+// wildcardDestinationRules returns the wildcard destination rules, listed on first use.
+func (c *outboundCache) wildcardDestinationRules() []*networking.DestinationRule {
+	c.wildcardOnce.Do(func() { c.wildcardRules = listWildcardDestinationRules(c.env) })
+	return c.wildcardRules
+}
+
+// lookupDestinationRule returns the destination rule for the hostname. The traffic policy of a
+// wildcard rule matching the hostname by domain suffix (e.g. *.prod.svc.cluster.local) is
+// inherited by the rule for the exact hostname, which takes precedence on conflicting fields.
+func lookupDestinationRule(env model.Environment, wildcards []*networking.DestinationRule,
+	hostname string) *networking.DestinationRule {
+	var rule *networking.DestinationRule
+	if config := env.DestinationRule(hostname, ""); config != nil {
+		rule = config.Spec.(*networking.DestinationRule)
+	}
+
+	wildcard := matchWildcardDestinationRule(wildcards, hostname)
+	if wildcard == nil {
+		return rule
+	}
+	if rule == nil {
+		return wildcard
+	}
+
+	merged := *rule
+	merged.TrafficPolicy = mergeTrafficPolicy(wildcard.TrafficPolicy, rule.TrafficPolicy)
+	return &merged
+}
+
+// listWildcardDestinationRules returns the destination rules of wildcard hostnames.
+func listWildcardDestinationRules(env model.Environment) []*networking.DestinationRule {
+	configs, err := env.List(model.DestinationRule.Type, model.NamespaceAll)
+	if err != nil {
+		log.Warnf("failed to list destination rules: %v", err)
+		return nil
+	}
+
+	var out []*networking.DestinationRule
+	for _, config := range configs {
+		if rule := config.Spec.(*networking.DestinationRule); strings.HasPrefix(rule.Name, "*") {
+			out = append(out, rule)
+		}
+	}
+	return out
+}
+
+// matchWildcardDestinationRule returns the most specific wildcard destination rule matching the hostname.
+func matchWildcardDestinationRule(wildcards []*networking.DestinationRule, hostname string) *networking.DestinationRule {
+	var out *networking.DestinationRule
+	for _, rule := range wildcards {
+		if rule.Name == hostname || !matchHost(rule.Name, hostname) {
+			continue
+		}
+		// the longest suffix is the most specific match
+		if out == nil || len(rule.Name) > len(out.Name) {
+			out = rule
+		}
+	}
+	return out
+}
+
+// applyLbSubsetConfig lets Envoy select the endpoints of a subset within the default EDS cluster
+// based on the endpoint metadata, using the label keys of the destination rule subsets. EDS publishes
+// the labels of the endpoints under the envoy.lb metadata matched by the selectors.
+func applyLbSubsetConfig(cluster *v2.Cluster, subsets []*networking.Subset) {
+	if cluster.Type != v2.Cluster_EDS || len(subsets) == 0 {
+		return
+	}
+
+	selectors := make([]*v2.Cluster_LbSubsetConfig_LbSubsetSelector, 0, len(subsets))
+	seen := make(map[string]bool)
+	for _, subset := range subsets {
+		if len(subset.Labels) == 0 {
+			continue
+		}
+		keys := make([]string, 0, len(subset.Labels))
+		for key := range subset.Labels {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		id := strings.Join(keys, ",")
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		selectors = append(selectors, &v2.Cluster_LbSubsetConfig_LbSubsetSelector{Keys: keys})
+	}
+	if len(selectors) == 0 {
+		return
+	}
+
+	cluster.LbSubsetConfig = &v2.Cluster_LbSubsetConfig{
+		// requests that do not match a subset are balanced across all endpoints
+		FallbackPolicy:  v2.Cluster_LbSubsetConfig_ANY_ENDPOINT,
+		SubsetSelectors: selectors,
+	}
+}
+
+// selectTrafficPolicy returns the traffic policy applicable to the port. The port level
+// settings matching the port by number or name override the top level policy.
+func selectTrafficPolicy(policy *networking.TrafficPolicy, port *model.Port) *networking.TrafficPolicy {
+	if policy == nil {
+		return nil
+	}
+
+	for _, portSettings := range policy.PortLevelSettings {
+		if portSettings.Port == nil {
+			continue
+		}
+		name := portSettings.Port.GetName()
+		if portSettings.Port.GetNumber() == uint32(port.Port) || (name != "" && name == port.Name) {
+			portPolicy := &networking.TrafficPolicy{
+				ConnectionPool:   portSettings.ConnectionPool,
+				OutlierDetection: portSettings.OutlierDetection,
+				LoadBalancer:     portSettings.LoadBalancer,
+				Tls:              portSettings.Tls,
+			}
+			return mergeTrafficPolicy(policy, portPolicy)
+		}
+	}
+	return policy
+}
+
+// subsetTrafficPolicy returns the traffic policy applicable to the clusters of a subset of the
+// destination rule, or to the default cluster without a subset.
+func subsetTrafficPolicy(rule *networking.DestinationRule, subsetName string, port *model.Port) *networking.TrafficPolicy {
+	policy := selectTrafficPolicy(rule.TrafficPolicy, port)
+	if subsetName == "" {
+		return policy
+	}
+	for _, subset := range rule.Subsets {
+		if subset.Name == subsetName {
+			return mergeTrafficPolicy(policy, selectTrafficPolicy(subset.TrafficPolicy, port))
+		}
+	}
+	return policy
+}
+
+// outboundTrafficPolicySelector resolves the traffic policies of the outbound clusters for the
+// route configuration, e.g. the consistent hash settings carried by the routes.
+func outboundTrafficPolicySelector(cache *outboundCache) TrafficPolicySelector {
+	return func(service *model.Service, port *model.Port, subset string) *networking.TrafficPolicy {
+		rule := cache.destinationRule(service.Hostname)
+		if rule == nil {
+			return nil
+		}
+		return subsetTrafficPolicy(rule, subset, port)
+	}
+}
+
+// mergeTrafficPolicy overlays the fields set in policy onto the parent policy.
+func mergeTrafficPolicy(parent, policy *networking.TrafficPolicy) *networking.TrafficPolicy {
+	if parent == nil {
+		return policy
+	}
+	if policy == nil {
+		return parent
+	}
+
+	merged := *parent
+	if policy.ConnectionPool != nil {
+		merged.ConnectionPool = mergeConnectionPool(parent.ConnectionPool, policy.ConnectionPool)
+	}
+	if policy.OutlierDetection != nil {
+		merged.OutlierDetection = policy.OutlierDetection
+	}
+	if policy.LoadBalancer != nil {
+		merged.LoadBalancer = policy.LoadBalancer
+	}
+	if policy.Tls != nil {
+		merged.Tls = policy.Tls
+	}
+	return &merged
+}
+
+// mergeConnectionPool overlays the non-zero fields of the settings onto the parent settings.
+func mergeConnectionPool(parent, settings *networking.ConnectionPoolSettings) *networking.ConnectionPoolSettings {
+	if parent == nil {
+		return settings
+	}
+
+	merged := *parent
+	if settings.Http != nil {
+		if parent.Http == nil {
+			merged.Http = settings.Http
+		} else {
+			http := *parent.Http
+			if settings.Http.Http1MaxPendingRequests > 0 {
+				http.Http1MaxPendingRequests = settings.Http.Http1MaxPendingRequests
+			}
+			if settings.Http.Http2MaxRequests > 0 {
+				http.Http2MaxRequests = settings.Http.Http2MaxRequests
+			}
+			if settings.Http.MaxRequestsPerConnection > 0 {
+				http.MaxRequestsPerConnection = settings.Http.MaxRequestsPerConnection
+			}
+			if settings.Http.MaxRetries > 0 {
+				http.MaxRetries = settings.Http.MaxRetries
+			}
+			if settings.Http.H2UpgradePolicy != networking.ConnectionPoolSettings_HTTPSettings_DEFAULT {
+				http.H2UpgradePolicy = settings.Http.H2UpgradePolicy
+			}
+			if settings.Http.IdleTimeout != nil {
+				http.IdleTimeout = settings.Http.IdleTimeout
+			}
+			merged.Http = &http
+		}
+	}
+	if settings.Tcp != nil {
+		if parent.Tcp == nil {
+			merged.Tcp = settings.Tcp
+		} else {
+			tcp := *parent.Tcp
+			if settings.Tcp.MaxConnections > 0 {
+				tcp.MaxConnections = settings.Tcp.MaxConnections
+			}
+			if settings.Tcp.ConnectTimeout != nil {
+				tcp.ConnectTimeout = settings.Tcp.ConnectTimeout
+			}
+			if settings.Tcp.TcpKeepalive != nil {
+				tcp.TcpKeepalive = settings.Tcp.TcpKeepalive
+			}
+			merged.Tcp = &tcp
+		}
+	}
+	return &merged
+}
+
+// meshDuration returns the duration set in the mesh config, or the value of the default mesh
+// config if it is unset or not positive.
+func meshDuration(d, defaultValue *duration.Duration) time.Duration {
+	if out, err := ptypes.Duration(d); err == nil && out > 0 {
+		return out
+	}
+	out, _ := ptypes.Duration(defaultValue)
+	return out
+}
+
+// updateEds sets the EDS config of the cluster. The proxy queries the endpoints by the service name,
+// the full subset service key, as the cluster name may be shortened, unless the key is overridden.
+func updateEds(env model.Environment, cluster *v2.Cluster, serviceName string) {
+	if cluster.Type != v2.Cluster_EDS {
+		return
+	}
+	if override, ok := edsServiceNameOverrides[serviceName]; ok {
+		serviceName = override
+	}
+	if edsUseADS {
+		cluster.EdsClusterConfig = &v2.Cluster_EdsClusterConfig{
+			ServiceName: serviceName,
+			EdsConfig: &core.ConfigSource{
+				ConfigSourceSpecifier: &core.ConfigSource_Ads{
+					Ads: &core.AggregatedConfigSource{},
+				},
+			},
+		}
+		return
+	}
+
+	apiConfigSource := &core.ApiConfigSource{
+		ApiType:      core.ApiConfigSource_GRPC,
+		ClusterNames: []string{xdsName},
+	}
+	if !edsPushOnly {
+		// envoy polling with a refresh delay of 0 crashes, the delay is never 0
+		refresh := meshDuration(env.Mesh.RdsRefreshDelay, defaultMeshConfig.RdsRefreshDelay)
+		apiConfigSource.RefreshDelay = &refresh
+	}
+	cluster.EdsClusterConfig = &v2.Cluster_EdsClusterConfig{
+		ServiceName: serviceName,
+		EdsConfig: &core.ConfigSource{
+			ConfigSourceSpecifier: &core.ConfigSource_ApiConfigSource{
+				ApiConfigSource: apiConfigSource,
+			},
+		},
+	}
+}
+
+// parseEDSServiceNameOverrides parses the <service key>=<service key> EDS service name overrides,
+// skipping the invalid ones. Pilot looks up the endpoints by the parts of the key, so both sides must
+// be subset service keys.
+func parseEDSServiceNameOverrides(overrides []string) map[string]string {
+	out := make(map[string]string, len(overrides))
+	for _, override := range overrides {
+		parts := strings.Split(override, "=")
+		if len(parts) != 2 || !isSubsetServiceKey(parts[0]) || !isSubsetServiceKey(parts[1]) {
+			log.Warnf("invalid EDS service name override %q, ignoring", override)
+			continue
+		}
+		out[parts[0]] = parts[1]
+	}
+	return out
+}
+
+// isSubsetServiceKey returns whether the key is a <direction>|<port>|<subset>|<hostname> subset service key.
+func isSubsetServiceKey(key string) bool {
+	parts := strings.Split(key, "|")
+	return len(parts) == 4 && parts[1] != "" && parts[3] != ""
+}
+
+// buildClusterHosts returns the hosts of the DNS and static clusters of the service port, as seen from
+// a proxy in the network. Endpoints in other networks are replaced by the gateway of their network.
+func buildClusterHosts(cache *outboundCache, service *model.Service, port *model.Port, network string) []*core.Address {
+	discoveryType := clusterDiscoveryType(service)
+	switch discoveryType {
+	case v2.Cluster_STRICT_DNS, v2.Cluster_LOGICAL_DNS, v2.Cluster_STATIC:
+	default:
+		return nil
+	}
+
+	instances, err := cache.instances(service.Hostname, port)
+	if err != nil {
+		log.Errorf("failed to retrieve instances for %s: %v", service.Hostname, err)
+		return nil
+	}
+
+	// the same endpoint may be listed several times, e.g. by several registries
+	hosts := make([]*core.Address, 0)
+	seen := make(map[string]bool)
+	for _, instance := range instances {
+		address, endpointPort := instance.Endpoint.Address, instance.Endpoint.Port
+		if instance.Endpoint.Network != network {
+			gateway, ok := meshNetworkGateways[instance.Endpoint.Network]
+			if !ok {
+				log.Warnf("endpoint %s of service %s is in network %q without a gateway, skipping",
+					address, service.Hostname, instance.Endpoint.Network)
+				continue
+			}
+			address, endpointPort = gateway.address, gateway.port
+		}
+		key := net.JoinHostPort(address, strconv.Itoa(endpointPort))
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		host := util.BuildAddress(address, uint32(endpointPort))
+		hosts = append(hosts, &host)
+	}
+
+	// Envoy only accepts a single host for LOGICAL_DNS clusters
+	if discoveryType == v2.Cluster_LOGICAL_DNS && len(hosts) > 1 {
+		log.Warnf("service %s has %d endpoints with logical DNS resolution, using the first one", service.Hostname, len(hosts))
+		hosts = hosts[:1]
+	}
+
+	return hosts
+}
+
+// networkGateway is the address of the gateway through which the endpoints of a network are reached.
+type networkGateway struct {
+	address string
+	port    int
+}
+
+// parseMeshNetworkGateways parses the <network>=<ip>:<port> network gateways, skipping the invalid ones.
+func parseMeshNetworkGateways(gateways []string) map[string]networkGateway {
+	out := make(map[string]networkGateway, len(gateways))
+	for _, gateway := range gateways {
+		parts := strings.Split(gateway, "=")
+		if len(parts) != 2 || parts[0] == "" {
+			log.Warnf("invalid network gateway %q, ignoring", gateway)
+			continue
+		}
+		host, port, err := net.SplitHostPort(parts[1])
+		if err != nil || net.ParseIP(host) == nil {
+			log.Warnf("invalid network gateway %q, ignoring", gateway)
+			continue
+		}
+		portValue, err := strconv.Atoi(port)
+		if err != nil || model.ValidatePort(portValue) != nil {
+			log.Warnf("invalid port in network gateway %q, ignoring", gateway)
+			continue
+		}
+		out[parts[0]] = networkGateway{address: host, port: portValue}
+	}
+	return out
+}
+
+func buildInboundClusters(env model.Environment, proxy model.Proxy, instances []*model.ServiceInstance,
+	managementPorts []*model.Port) []*v2.Cluster {
+	clusters := make([]*v2.Cluster, 0)
+	bindAddress := inboundBindAddress(proxy)
+	tls := buildInboundTLSSettings(proxy)
+	connectionPool := buildInboundConnectionPool(proxy)
+	for _, instance := range instances {
+		// This cluster name is mainly for stats.
+		clusterName := model.BuildSubsetKey(model.TrafficDirectionInbound, "", instance.Service.Hostname, instance.Endpoint.ServicePort)
+		address := util.BuildAddress(bindAddress, uint32(instance.Endpoint.Port))
+		localCluster := buildDefaultCluster(env, clusterName, v2.Cluster_STATIC, []*core.Address{&address})
+		setProtocolOptions(localCluster, inboundProtocol(instance))
+		localCluster.Metadata = buildClusterMetadata(instance.Service.Hostname, "", instance.Endpoint.ServicePort, instance.Labels)
+		applyAltStatName(localCluster, model.TrafficDirectionInbound, instance.Service.Hostname, "", instance.Endpoint.ServicePort)
+		ctx := clusterContext{hostname: instance.Service.Hostname, port: instance.Endpoint.ServicePort}
+		applyUpstreamTLSSettings(localCluster, tls, ctx)
+		applyInboundConnectionPool(localCluster, connectionPool)
+		clusters = append(clusters, localCluster)
+	}
+
+	// Add a passthrough cluster for traffic to management ports (health check ports)
+	for _, port := range managementPorts {
+		clusterName := model.BuildSubsetKey(model.TrafficDirectionInbound, "", ManagementClusterHostname, port)
+		address := util.BuildAddress(bindAddress, uint32(port.Port))
+		mgmtCluster := buildDefaultCluster(env, clusterName, v2.Cluster_STATIC, []*core.Address{&address})
+		setUpstreamProtocol(mgmtCluster, ManagementClusterHostname, port)
+		clusters = append(clusters, mgmtCluster)
+	}
+	return clusters
+}
+
+// inboundProtocol returns the protocol of the application of the instance, as reported for the
+// endpoint port by the registry, or else the protocol of the service port.
+func inboundProtocol(instance *model.ServiceInstance) model.Protocol {
+	if instance.Endpoint.Protocol != "" {
+		return instance.Endpoint.Protocol
+	}
+	return upstreamProtocol(instance.Service.Hostname, instance.Endpoint.ServicePort)
+}
+
+// buildInboundConnectionPool returns the connection pool settings of the connections from the proxy
+// to its application, as set in the node metadata, or nil.
+func buildInboundConnectionPool(proxy model.Proxy) *networking.ConnectionPoolSettings {
+	value, ok := proxy.Metadata[model.NodeMetadataInboundMaxRequestsPerConnection]
+	if !ok {
+		return nil
+	}
+	maxRequests, err := strconv.ParseUint(value, 10, 31)
+	if err != nil || maxRequests == 0 {
+		log.Warnf("invalid inbound max requests per connection %q for proxy %s, ignoring", value, proxy.ID)
+		return nil
+	}
+	return &networking.ConnectionPoolSettings{
+		Http: &networking.ConnectionPoolSettings_HTTPSettings{MaxRequestsPerConnection: int32(maxRequests)},
+	}
+}
+
+// applyInboundConnectionPool applies the sidecar connection pool settings to an inbound cluster. Unlike
+// outbound clusters, the application is not protected by circuit breakers, so only the settings of the
+// connections themselves apply.
+func applyInboundConnectionPool(cluster *v2.Cluster, settings *networking.ConnectionPoolSettings) {
+	if settings.GetHttp().GetMaxRequestsPerConnection() > 0 {
+		cluster.MaxRequestsPerConnection = &types.UInt32Value{Value: uint32(settings.Http.MaxRequestsPerConnection)}
+	}
+}
+
+// buildInboundTLSSettings returns the TLS settings of the connections from the proxy to its application,
+// for workloads declaring in the node metadata that the application requires TLS, or nil.
+func buildInboundTLSSettings(proxy model.Proxy) *networking.TLSSettings {
+	value, ok := proxy.Metadata[model.NodeMetadataInboundTLSMode]
+	if !ok {
+		return nil
+	}
+	mode, ok := networking.TLSSettings_TLSmode_value[value]
+	if !ok {
+		log.Warnf("invalid inbound TLS mode %q for proxy %s, using plaintext", value, proxy.ID)
+		return nil
+	}
+	tls := &networking.TLSSettings{
+		Mode:           networking.TLSSettings_TLSmode(mode),
+		CaCertificates: proxy.Metadata[model.NodeMetadataInboundTLSCaCertificates],
+	}
+	switch tls.Mode {
+	case networking.TLSSettings_SIMPLE:
+		if tls.CaCertificates == "" {
+			log.Warnf("inbound TLS mode SIMPLE for proxy %s requires the CA certificates, using plaintext", proxy.ID)
+			return nil
+		}
+	case networking.TLSSettings_MUTUAL:
+		// the only client certificate of the proxy is the one provisioned by Istio, used by ISTIO_MUTUAL
+		log.Warnf("inbound TLS mode MUTUAL for proxy %s is not supported, use ISTIO_MUTUAL", proxy.ID)
+		return nil
+	}
+	return tls
+}
+
+// inboundBindAddress returns the address the application of the proxy listens on, as set in the node
+// metadata, for example ::1 on IPv6 only hosts or the pod IP.
+func inboundBindAddress(proxy model.Proxy) string {
+	address, ok := proxy.Metadata[model.NodeMetadataInboundBindAddress]
+	if !ok {
+		return LocalhostAddress
+	}
+	ip := net.ParseIP(address)
+	if ip == nil {
+		log.Warnf("invalid inbound bind address %q for proxy %s, using %s", address, proxy.ID, LocalhostAddress)
+		return LocalhostAddress
+	}
+	return ip.String()
+}
+
+// applyAltStatName sets the name of the stats of the cluster to direction_shortname_subset_port,
+// e.g. outbound_reviews_v1_9080, where the short name is the first label of the hostname. Characters
+// other than letters, digits and underscores are replaced by underscores.
+func applyAltStatName(cluster *v2.Cluster, direction model.TrafficDirection, hostname, subset string, port *model.Port) {
+	if !enableAltStatName {
+		return
+	}
+	shortName := strings.SplitN(hostname, ".", 2)[0]
+	parts := []string{string(direction), shortName}
+	if subset != "" {
+		parts = append(parts, subset)
+	}
+	parts = append(parts, strconv.Itoa(port.Port))
+	cluster.AltStatName = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, strings.Join(parts, "_"))
+}
+
+// buildClusterMetadata returns the istio metadata of a cluster, identifying the service, subset
+// and port it was built for, and the labels of the workload for inbound clusters.
+func buildClusterMetadata(hostname, subset string, port *model.Port, labels model.Labels) *core.Metadata {
+	fields := map[string]*types.Value{
+		"hostname":  {Kind: &types.Value_StringValue{StringValue: hostname}},
+		"port":      {Kind: &types.Value_NumberValue{NumberValue: float64(port.Port)}},
+		"port_name": {Kind: &types.Value_StringValue{StringValue: port.Name}},
+	}
+	if subset != "" {
+		fields["subset"] = &types.Value{Kind: &types.Value_StringValue{StringValue: subset}}
+	}
+	if len(labels) > 0 {
+		labelFields := make(map[string]*types.Value, len(labels))
+		for k, v := range labels {
+			labelFields[k] = &types.Value{Kind: &types.Value_StringValue{StringValue: v}}
+		}
+		fields["labels"] = &types.Value{Kind: &types.Value_StructValue{StructValue: &types.Struct{Fields: labelFields}}}
+	}
+
+	return &core.Metadata{
+		FilterMetadata: map[string]*types.Struct{
+			clusterMetadataNamespace: {Fields: fields},
+		},
+	}
+}
+
+// clusterDiscoveryType returns the discovery type of the outbound clusters of the service.
+func clusterDiscoveryType(service *model.Service) v2.Cluster_DiscoveryType {
+	// The endpoints of mesh external services with static resolution are declared in the
+	// external service itself, so they are sent inline with the cluster rather than through EDS.
+	if service.MeshExternal && service.Resolution == model.ClientSideLB {
+		return v2.Cluster_STATIC
+	}
+	return convertResolution(service.Resolution)
+}
+
+func convertResolution(resolution model.Resolution) v2.Cluster_DiscoveryType {
+	switch resolution {
+	case model.ClientSideLB:
+		return v2.Cluster_EDS
+	case model.DNSLB:
+		return v2.Cluster_STRICT_DNS
+	case model.LogicalDNSLB:
+		return v2.Cluster_LOGICAL_DNS
+	case model.Passthrough:
+		return v2.Cluster_ORIGINAL_DST
+	default:
+		return v2.Cluster_EDS
+	}
+}
+
+// clusterContext identifies the service port and subset a cluster is built for. It is empty for
+// clusters not built for a service, such as when applying the default traffic policy.
+type clusterContext struct {
+	hostname string
+	subset   string
+	port     *model.Port
+}
+
+func applyTrafficPolicy(cluster *v2.Cluster, policy *networking.TrafficPolicy, ctx clusterContext) {
+	if policy == nil {
+		return
+	}
+	applyConnectionPool(cluster, policy.ConnectionPool, ctx)
+	applyOutlierDetection(cluster, policy.OutlierDetection)
+	applyLoadBalancer(cluster, policy.LoadBalancer)
+	applyUpstreamTLSSettings(cluster, policy.Tls, ctx)
+}
+
+// FIXME: there isn't a way to distinguish between unset values and zero values
+func applyConnectionPool(cluster *v2.Cluster, settings *networking.ConnectionPoolSettings, ctx clusterContext) {
+	if settings == nil {
+		return
+	}
+
+	if settings.Http.GetMaxRequestsPerConnection() > 0 {
+		cluster.MaxRequestsPerConnection = &types.UInt32Value{Value: uint32(settings.Http.MaxRequestsPerConnection)}
+	}
+	if settings.Tcp != nil {
+		if settings.Tcp.ConnectTimeout != nil {
+			cluster.ConnectTimeout = util.ConvertGogoDurationToDuration(settings.Tcp.ConnectTimeout)
+		}
+		applyTCPKeepalive(cluster, settings.Tcp.TcpKeepalive)
+	}
+	applyH2UpgradePolicy(cluster, settings.Http.GetH2UpgradePolicy(), ctx)
+	applyHTTPIdleTimeout(cluster, settings.Http.GetIdleTimeout(), ctx)
+
+	// Most policies, starting with the defaults applied to every cluster, limit nothing: the
+	// thresholds are only built if there is something to put in them.
+	if !hasConnectionPoolLimits(settings) {
+		return
+	}
+
+	threshold := &v2_cluster.CircuitBreakers_Thresholds{}
+	if cluster.CircuitBreakers != nil && len(cluster.CircuitBreakers.Thresholds) > 0 {
+		// merge into the thresholds of a previously applied policy, e.g. the destination level
+		// policy of a subset, so that only the fields set in this policy are overridden. The
+		// default priority thresholds come first, the others are derived from them.
+		merged := *cluster.CircuitBreakers.Thresholds[0]
+		threshold = &merged
+	}
+
+	if settings.Http != nil {
+		if settings.Http.Http2MaxRequests > 0 {
+			// Envoy only applies MaxRequests in HTTP/2 clusters, HTTP/1.1 clusters are limited below
+			threshold.MaxRequests = &types.UInt32Value{Value: uint32(settings.Http.Http2MaxRequests)}
+		}
+		if settings.Http.Http1MaxPendingRequests > 0 {
+			// Envoy applies MaxPendingRequests to the requests of HTTP/1.1 clusters waiting for a
+			// connection, and to the connections of the TCP proxy waiting for an upstream connection
+			threshold.MaxPendingRequests = &types.UInt32Value{Value: uint32(settings.Http.Http1MaxPendingRequests)}
+		}
+
+		// FIXME: zero is a valid value if explicitly set, otherwise we want to use the default value of 3
+		if settings.Http.MaxRetries > 0 {
+			threshold.MaxRetries = &types.UInt32Value{Value: uint32(settings.Http.MaxRetries)}
+		}
+	}
+
+	if settings.Tcp != nil {
+		if settings.Tcp.MaxConnections > 0 {
+			threshold.MaxConnections = &types.UInt32Value{Value: uint32(settings.Tcp.MaxConnections)}
+		}
+		// Per host connection limits are not supported, the vendored Envoy API has no per host thresholds.
+	}
+
+	// HTTP/1.1 connections carry a single request at a time, so the maximum number of parallel
+	// requests is also a maximum number of connections, unless the TCP setting is lower.
+	if ctx.port != nil && upstreamProtocol(ctx.hostname, ctx.port) == model.ProtocolHTTP &&
+		cluster.Http2ProtocolOptions == nil && settings.Http.GetHttp2MaxRequests() > 0 {
+		maxRequests := uint32(settings.Http.Http2MaxRequests)
+		if threshold.MaxConnections == nil || threshold.MaxConnections.Value > maxRequests {
+			threshold.MaxConnections = &types.UInt32Value{Value: maxRequests}
+		}
+	}
+
+	// Envoy defaults are higher than the limits an empty thresholds object implies, so circuit
+	// breakers are only set if the policy limits something
+	if !hasThresholdLimits(threshold) {
+		return
+	}
+
+	thresholds := []*v2_cluster.CircuitBreakers_Thresholds{threshold}
+	if highPriorityThresholdFactor > 0 {
+		thresholds = append(thresholds, buildHighPriorityThreshold(threshold, highPriorityThresholdFactor))
+	}
+	cluster.CircuitBreakers = &v2_cluster.CircuitBreakers{
+		Thresholds: thresholds,
+	}
+}
+
+// hasConnectionPoolLimits returns whether the connection pool settings set any circuit breaker threshold.
+func hasConnectionPoolLimits(settings *networking.ConnectionPoolSettings) bool {
+	return settings.Http.GetHttp2MaxRequests() > 0 || settings.Http.GetHttp1MaxPendingRequests() > 0 ||
+		settings.Http.GetMaxRetries() > 0 || settings.Tcp.GetMaxConnections() > 0
+}
+
+// applyH2UpgradePolicy upgrades the connections of an HTTP/1.1 cluster to HTTP/2, or keeps them
+// HTTP/1.1, overriding the mesh wide policy. The default policy leaves the cluster unchanged.
+func applyH2UpgradePolicy(cluster *v2.Cluster, policy networking.ConnectionPoolSettings_HTTPSettings_H2UpgradePolicy,
+	ctx clusterContext) {
+	if ctx.port == nil || upstreamProtocol(ctx.hostname, ctx.port) != model.ProtocolHTTP {
+		return
+	}
+	switch policy {
+	case networking.ConnectionPoolSettings_HTTPSettings_UPGRADE:
+		cluster.Http2ProtocolOptions = buildHTTP2ProtocolOptions()
+	case networking.ConnectionPoolSettings_HTTPSettings_DO_NOT_UPGRADE:
+		cluster.Http2ProtocolOptions = nil
+	}
+}
+
+// applyHTTPIdleTimeout sets the idle timeout of the upstream connections of HTTP/1.1 and HTTP/2
+// clusters, overriding the mesh wide default. Envoy closes a connection without active requests
+// for the timeout.
+func applyHTTPIdleTimeout(cluster *v2.Cluster, idleTimeout *types.Duration, ctx clusterContext) {
+	if idleTimeout == nil || ctx.port == nil || !upstreamProtocol(ctx.hostname, ctx.port).IsHTTP() {
+		return
+	}
+	if cluster.CommonHttpProtocolOptions == nil {
+		cluster.CommonHttpProtocolOptions = &core.HttpProtocolOptions{}
+	}
+	timeout := util.ConvertGogoDurationToDuration(idleTimeout)
+	cluster.CommonHttpProtocolOptions.IdleTimeout = &timeout
+}
+
+// hasThresholdLimits returns whether any limit of the circuit breaker thresholds is set.
+func hasThresholdLimits(threshold *v2_cluster.CircuitBreakers_Thresholds) bool {
+	return threshold.MaxConnections != nil || threshold.MaxPendingRequests != nil ||
+		threshold.MaxRequests != nil || threshold.MaxRetries != nil
+}
+
+// buildHighPriorityThreshold returns the thresholds of the default routing priority scaled by the factor,
+// for the high routing priority. Limits that are not set keep the Envoy defaults.
+func buildHighPriorityThreshold(threshold *v2_cluster.CircuitBreakers_Thresholds, factor uint32) *v2_cluster.CircuitBreakers_Thresholds {
+	scale := func(limit *types.UInt32Value) *types.UInt32Value {
+		if limit == nil {
+			return nil
+		}
+		return &types.UInt32Value{Value: limit.Value * factor}
+	}
+	return &v2_cluster.CircuitBreakers_Thresholds{
+		Priority:           core.RoutingPriority_HIGH,
+		MaxConnections:     scale(threshold.MaxConnections),
+		MaxPendingRequests: scale(threshold.MaxPendingRequests),
+		MaxRequests:        scale(threshold.MaxRequests),
+		MaxRetries:         scale(threshold.MaxRetries),
+	}
+}
+
+// applyTCPIdleTimeout stores the mesh wide idle timeout of TCP connections in the istio metadata of
+// the clusters of TCP ports. Envoy closes idle connections in the TCP proxy filter rather than in the
+// cluster, so the listeners proxying to the cluster read the timeout from the metadata.
+func applyTCPIdleTimeout(cluster *v2.Cluster, hostname string, port *model.Port) {
+	if tcpIdleTimeout == 0 || upstreamProtocol(hostname, port).IsHTTP() {
+		return
+	}
+	istioClusterMetadata(cluster).Fields[clusterMetadataTCPIdleTimeout] = &types.Value{
+		Kind: &types.Value_StringValue{StringValue: tcpIdleTimeout.String()},
+	}
+}
+
+// istioClusterMetadata returns the istio filter metadata of the cluster, adding it if missing.
+func istioClusterMetadata(cluster *v2.Cluster) *types.Struct {
+	if cluster.Metadata == nil {
+		cluster.Metadata = &core.Metadata{}
+	}
+	if cluster.Metadata.FilterMetadata == nil {
+		cluster.Metadata.FilterMetadata = make(map[string]*types.Struct)
+	}
+	istio := cluster.Metadata.FilterMetadata[clusterMetadataNamespace]
+	if istio == nil {
+		istio = &types.Struct{}
+		cluster.Metadata.FilterMetadata[clusterMetadataNamespace] = istio
+	}
+	if istio.Fields == nil {
+		istio.Fields = make(map[string]*types.Value)
+	}
+	return istio
+}
+
+func applyTCPKeepalive(cluster *v2.Cluster, keepalive *networking.ConnectionPoolSettings_TCPSettings_TcpKeepalive) {
+	if keepalive == nil {
+		return
+	}
+
+	// Fields that are not set fall back to the OS level defaults.
+	tcpKeepalive := &core.TcpKeepalive{}
+	if keepalive.Probes > 0 {
+		tcpKeepalive.KeepaliveProbes = &types.UInt32Value{Value: keepalive.Probes}
+	}
+	if keepalive.Time != nil {
+		tcpKeepalive.KeepaliveTime = &types.UInt32Value{Value: uint32(keepalive.Time.Seconds)}
+	}
+	if keepalive.Interval != nil {
+		tcpKeepalive.KeepaliveInterval = &types.UInt32Value{Value: uint32(keepalive.Interval.Seconds)}
+	}
+
+	cluster.UpstreamConnectionOptions = &v2.UpstreamConnectionOptions{
+		TcpKeepalive: tcpKeepalive,
+	}
+}
+
+// FIXME: there isn't a way to distinguish between unset values and zero values
+func applyOutlierDetection(cluster *v2.Cluster, outlier *networking.OutlierDetection) {
+	if outlier == nil || outlier.Http == nil {
+		return
+	}
+
+	out := &v2_cluster.OutlierDetection{}
+	maxEjectionPercent := uint32(defaultMaxEjectionPercent)
+
+	http := outlier.Http
+	if http.BaseEjectionTime != nil {
+		out.BaseEjectionTime = http.BaseEjectionTime
+	}
+	if http.ConsecutiveErrors > 0 {
+		out.Consecutive_5Xx = &types.UInt32Value{Value: uint32(http.ConsecutiveErrors)}
+	}
+	if outlierConsecutiveGatewayErrors > 0 {
+		out.ConsecutiveGatewayFailure = &types.UInt32Value{Value: outlierConsecutiveGatewayErrors}
+		// Envoy does not enforce gateway failure ejections unless told to
+		out.EnforcingConsecutiveGatewayFailure = &types.UInt32Value{Value: 100}
+	}
+	if http.Interval != nil {
+		out.Interval = http.Interval
+	}
+	if http.MaxEjectionPercent != 0 {
+		maxEjectionPercent = clampPercent("max ejection percent", http.MaxEjectionPercent)
+	}
+	if outlierMinHealthPercent > 0 {
+		minHealthPercent := outlierMinHealthPercent
+		if minHealthPercent > 100 {
+			log.Warnf("invalid min health percent %d%%, using 100%%", minHealthPercent)
+			minHealthPercent = 100
+		}
+		// never eject more hosts than allowed by the floor
+		if maxEjectionPercent > 100-minHealthPercent {
+			maxEjectionPercent = 100 - minHealthPercent
+		}
+		// below the floor Envoy ignores host health and balances across all hosts, unless the mesh
+		// wide healthy panic threshold is set, which takes precedence
+		if !healthyPanicThresholdSet {
+			if cluster.CommonLbConfig == nil {
+				cluster.CommonLbConfig = &v2.Cluster_CommonLbConfig{}
+			}
+			cluster.CommonLbConfig.HealthyPanicThreshold = &envoy_type.Percent{Value: float64(minHealthPercent)}
+		}
+	}
+
+	out.MaxEjectionPercent = &types.UInt32Value{Value: maxEjectionPercent}
+	cluster.OutlierDetection = out
+}
+
+// applyTCPOutlierDetection ejects the hosts of the clusters of TCP ports after the mesh wide number of
+// consecutive connection failures, which Envoy reports to the outlier detector as 5xx errors. The
+// outlier detection of a destination rule replaces it.
+func applyTCPOutlierDetection(cluster *v2.Cluster, hostname string, port *model.Port) {
+	if tcpOutlierConsecutiveErrors == 0 || upstreamProtocol(hostname, port).IsHTTP() {
+		return
+	}
+	cluster.OutlierDetection = &v2_cluster.OutlierDetection{
+		Consecutive_5Xx:    &types.UInt32Value{Value: tcpOutlierConsecutiveErrors},
+		MaxEjectionPercent: &types.UInt32Value{Value: defaultMaxEjectionPercent},
+	}
+}
+
+// clampPercent returns the percentage within the 0-100 range accepted by Envoy. Out of range values
+// are rejected by validation, but Envoy rejects the whole CDS update if one gets through.
+func clampPercent(name string, value int32) uint32 {
+	switch {
+	case value < 0:
+		log.Warnf("invalid %s %d%%, using 0%%", name, value)
+		return 0
+	case value > 100:
+		log.Warnf("invalid %s %d%%, using 100%%", name, value)
+		return 100
+	}
+	return uint32(value)
+}
+
+func applyLoadBalancer(cluster *v2.Cluster, lb *networking.LoadBalancerSettings) {
+	if lb == nil {
+		return
+	}
+
+	if consistentHash := lb.GetConsistentHash(); consistentHash != nil {
+		applyConsistentHash(cluster, consistentHash)
+		if lb.LocalityLbSetting != nil {
+			log.Warnf("locality load balancing is not supported with the consistent hash of cluster %s, ignoring",
+				cluster.Name)
+		}
+		return
+	}
+
+	switch lb.GetSimple() {
+	case networking.LoadBalancerSettings_LEAST_CONN:
+		cluster.LbPolicy = v2.Cluster_LEAST_REQUEST
+	case networking.LoadBalancerSettings_RANDOM:
+		cluster.LbPolicy = v2.Cluster_RANDOM
+		applyWeightedSimpleLb(cluster)
+	case networking.LoadBalancerSettings_ROUND_ROBIN:
+		cluster.LbPolicy = v2.Cluster_ROUND_ROBIN
+		applyWeightedSimpleLb(cluster)
+	case networking.LoadBalancerSettings_PASSTHROUGH:
+		if cluster.Type == v2.Cluster_EDS {
+			passthroughLbConflicts.Inc()
+			if rejectPassthroughLbOnEDS {
+				log.Warnf("PASSTHROUGH load balancer of cluster %s conflicts with its EDS resolution, ignoring", cluster.Name)
+				return
+			}
+			log.Warnf("PASSTHROUGH load balancer of cluster %s overrides its EDS resolution, "+
+				"the discovered endpoints are not used", cluster.Name)
+		}
+		cluster.LbPolicy = v2.Cluster_ORIGINAL_DST_LB
+		cluster.Type = v2.Cluster_ORIGINAL_DST
+		cleanupInterval := originalDstCleanupInterval
+		cluster.CleanupInterval = &cleanupInterval
+		// original destination clusters have no endpoints, and no localities to balance across
+		if cluster.CommonLbConfig != nil {
+			cluster.CommonLbConfig.LocalityConfigSpecifier = nil
+		}
+		if originalDstUseHTTPHeader {
+			cluster.LbConfig = &v2.Cluster_OriginalDstLbConfig_{
+				OriginalDstLbConfig: &v2.Cluster_OriginalDstLbConfig{UseHttpHeader: true},
+			}
+		}
+	case networking.LoadBalancerSettings_RING_HASH:
+		// The discovery type is left untouched, consistent hashing is applied over the
+		// endpoints of the existing EDS/DNS cluster.
+		cluster.LbPolicy = v2.Cluster_RING_HASH
+		cluster.LbConfig = &v2.Cluster_RingHashLbConfig_{
+			RingHashLbConfig: &v2.Cluster_RingHashLbConfig{
+				MinimumRingSize: &types.UInt64Value{Value: defaultMinimumRingSize},
+			},
+		}
+	case networking.LoadBalancerSettings_MAGLEV:
+		// Maglev takes no additional configuration.
+		cluster.LbPolicy = v2.Cluster_MAGLEV
+	}
+
+	// DO not do if else here. since lb.GetSimple returns a enum value (not pointer).
+
+	applyLocalityLbSetting(cluster, lb.LocalityLbSetting)
+}
+
+// applyLocalityLbSetting enables locality weighted load balancing on the EDS clusters of a destination
+// rule failing over across regions or distributing traffic across localities. The priorities and
+// weights of the localities are set by EDS for each proxy, see LocalityLbSetting.
+func applyLocalityLbSetting(cluster *v2.Cluster, setting *networking.LocalityLoadBalancerSetting) {
+	if setting == nil || (len(setting.Failover) == 0 && len(setting.Distribute) == 0) {
+		return
+	}
+	if cluster.Type != v2.Cluster_EDS {
+		log.Warnf("locality load balancing of cluster %s requires endpoints discovered over EDS, ignoring", cluster.Name)
+		return
+	}
+
+	failover := 0
+	for _, f := range setting.Failover {
+		if !validLocalityFailover(f) {
+			log.Warnf("invalid locality failover from %q to %q of cluster %s, ignoring", f.From, f.To, cluster.Name)
+			continue
+		}
+		failover++
+	}
+	distribute := 0
+	for _, d := range setting.Distribute {
+		if !validLocalityDistribute(d) {
+			log.Warnf("invalid locality distribution from %q of cluster %s, ignoring", d.From, cluster.Name)
+			continue
+		}
+		distribute++
+	}
+	if failover == 0 && distribute == 0 {
+		return
+	}
+
+	applyLocalityWeightedConfig(cluster)
+}
+
+// validLocalityFailover returns whether the failover moves the traffic of a region to another one.
+func validLocalityFailover(failover *networking.LocalityLoadBalancerSetting_Failover) bool {
+	return failover.From != "" && failover.To != "" && failover.From != failover.To
+}
+
+// validLocalityDistribute returns whether the distribution sends the traffic of some localities to others.
+func validLocalityDistribute(distribute *networking.LocalityLoadBalancerSetting_Distribute) bool {
+	return distribute.From != "" && len(distribute.To) > 0
+}
+
+// LocalityLbSettings looks up the locality load balancer settings of the outbound EDS clusters during a
+// push. The destination rule of a hostname, and the wildcard rules, are looked up once and shared by the
+// clusters, so it must not outlive the push.
+type LocalityLbSettings struct {
+	cache *outboundCache
+}
+
+// NewLocalityLbSettings returns the lookup of the locality load balancer settings of a push.
+func NewLocalityLbSettings(env model.Environment) *LocalityLbSettings {
+	return &LocalityLbSettings{cache: newOutboundCache(env)}
+}
+
+// LocalityLbSetting returns the locality load balancer setting applied to the outbound EDS cluster of a
+// subset of a service port, looking up the destination rules for this cluster alone.
+func LocalityLbSetting(env model.Environment, hostname, subset, portName string) *networking.LocalityLoadBalancerSetting {
+	return NewLocalityLbSettings(env).Get(hostname, subset, portName)
+}
+
+// Get returns the locality load balancer setting applied to the outbound EDS cluster of a subset of a
+// service port, without its invalid entries, or nil. EDS sets the priorities and weights of the
+// localities of the endpoints sent to each proxy from the setting.
+func (s *LocalityLbSettings) Get(hostname, subset, portName string) *networking.LocalityLoadBalancerSetting {
+	service, err := s.cache.env.GetService(hostname)
+	if err != nil || service == nil || clusterDiscoveryType(service) != v2.Cluster_EDS {
+		return nil
+	}
+	port, found := service.Ports.Get(portName)
+	if !found {
+		return nil
+	}
+	rule := s.cache.destinationRule(hostname)
+	if rule == nil {
+		return nil
+	}
+
+	lb := subsetTrafficPolicy(rule, subset, port).GetLoadBalancer()
+	// the consistent hash and original destination load balancers do not balance across localities
+	if lb.GetConsistentHash() != nil || lb.GetSimple() == networking.LoadBalancerSettings_PASSTHROUGH {
+		return nil
+	}
+	setting := lb.GetLocalityLbSetting()
+	if setting == nil {
+		return nil
+	}
+
+	out := &networking.LocalityLoadBalancerSetting{}
+	for _, f := range setting.Failover {
+		if validLocalityFailover(f) {
+			out.Failover = append(out.Failover, f)
+		}
+	}
+	for _, d := range setting.Distribute {
+		if validLocalityDistribute(d) {
+			out.Distribute = append(out.Distribute, d)
+		}
+	}
+	if len(out.Failover) == 0 && len(out.Distribute) == 0 {
+		return nil
+	}
+	return out
+}
+
+// applyConsistentHash makes sure the cluster uses a hashing load balancer. The hash key
+// (header, cookie or source IP) is part of the route configuration, see TranslateHashPolicy.
+func applyConsistentHash(cluster *v2.Cluster, consistentHash *networking.LoadBalancerSettings_ConsistentHashLB) {
+	if cluster.Type == v2.Cluster_ORIGINAL_DST {
+		log.Warnf("consistent hash load balancing is not supported for ORIGINAL_DST cluster %s, ignoring", cluster.Name)
+		return
+	}
+
+	switch cluster.LbPolicy {
+	case v2.Cluster_MAGLEV:
+		return
+	case v2.Cluster_RING_HASH:
+	default:
+		log.Warnf("consistent hash configured for cluster %s with lb policy %v, switching to RING_HASH",
+			cluster.Name, cluster.LbPolicy)
+		cluster.LbPolicy = v2.Cluster_RING_HASH
+	}
+
+	minimumRingSize := uint64(defaultMinimumRingSize)
+	if consistentHash.MinimumRingSize > 0 {
+		minimumRingSize = consistentHash.MinimumRingSize
+	}
+	cluster.LbConfig = &v2.Cluster_RingHashLbConfig_{
+		RingHashLbConfig: &v2.Cluster_RingHashLbConfig{
+			MinimumRingSize: &types.UInt64Value{Value: minimumRingSize},
+		},
+	}
+}
+
+func applyUpstreamTLSSettings(cluster *v2.Cluster, tls *networking.TLSSettings, ctx clusterContext) {
+	if tls == nil {
+		return
+	}
+
+	switch tls.Mode {
+	case networking.TLSSettings_DISABLE:
+		// TODO: Need to make sure that authN does not override this setting
+		// the settings replace those of a previously applied policy, e.g. a plaintext subset of a
+		// destination requiring TLS
+		cluster.TlsContext = nil
+	case networking.TLSSettings_SIMPLE:
+		if tls.GetInsecureSkipVerify().GetValue() {
+			cluster.TlsContext = buildInsecureTLSContext(cluster.Name, ctx.hostname, tls)
+			break
+		}
+		if tls.CredentialName != "" {
+			cluster.TlsContext = buildCredentialTLSContext(cluster.Name, ctx.hostname, tls)
+			break
+		}
+		cluster.TlsContext = &auth.UpstreamTlsContext{
+			CommonTlsContext: &auth.CommonTlsContext{
+				ValidationContext: buildSimpleTLSValidationContext(cluster.Name, ctx.hostname, tls),
+			},
+			Sni: tls.Sni,
+		}
+	case networking.TLSSettings_MUTUAL:
+		if tls.CredentialName != "" {
+			cluster.TlsContext = buildCredentialTLSContext(cluster.Name, ctx.hostname, tls)
+			break
+		}
+		// Envoy rejects a certificate without a key, and with it the whole CDS update, so a rule
+		// skipping validation only loses its TLS settings
+		if tls.ClientCertificate == "" || tls.PrivateKey == "" {
+			log.Errorf("mutual TLS of cluster %s requires a client certificate and a private key, ignoring the TLS settings",
+				cluster.Name)
+			return
+		}
+		cluster.TlsContext = buildMutualTLSContext(tls)
+		setCertificatePins(cluster.TlsContext.CommonTlsContext.ValidationContext, ctx.hostname)
+		// set before the SDS secrets, which keep the CA certificate files of a context verifying names or pins
+		applySubsetSubjectAltName(cluster.TlsContext, tls, ctx)
+		applySdsSecretConfigs(cluster.TlsContext.CommonTlsContext, tls.ClientCertificate, tls.CaCertificates)
+	case networking.TLSSettings_ISTIO_MUTUAL:
+		cluster.TlsContext = buildMutualTLSContext(buildIstioMutualTLS(tls))
+		cluster.TlsContext.CommonTlsContext.AlpnProtocols = util.ALPNInMesh
+		applySdsSecretConfigs(cluster.TlsContext.CommonTlsContext, sdsDefaultSecretName, sdsRootCASecretName)
+	}
+
+	if cluster.TlsContext != nil && tls.Mode != networking.TLSSettings_DISABLE {
+		cluster.TlsContext.CommonTlsContext.TlsParams = buildUpstreamTLSParams()
+		cluster.TlsContext.CommonTlsContext.AlpnProtocols = buildUpstreamALPN(
+			cluster.TlsContext.CommonTlsContext.AlpnProtocols, cluster, ctx)
+	}
+
+	// Upstreams selecting their certificate by SNI get the service hostname, as used for routing,
+	// prefixed by the subset for subset clusters, unless the user sets another one.
+	if (tls.Mode == networking.TLSSettings_MUTUAL || tls.Mode == networking.TLSSettings_ISTIO_MUTUAL) &&
+		cluster.TlsContext.Sni == "" {
+		cluster.TlsContext.Sni = buildUpstreamSNI(ctx)
+	}
+}
+
+// buildUpstreamSNI returns the SNI of the cluster, <subset>.<hostname> for subset clusters.
+func buildUpstreamSNI(ctx clusterContext) string {
+	if ctx.hostname == "" || ctx.subset == "" {
+		return ctx.hostname
+	}
+	return ctx.subset + "." + ctx.hostname
+}
+
+// buildUpstreamALPN appends the application protocol used by the cluster to the ALPN protocols, so
+// that upstreams requiring ALPN negotiate it: HTTP/2 if the cluster is configured for it, whether by
+// the protocol of the port, a protocol override or an upgrade policy, or else HTTP/1.1 for HTTP ports.
+// ISTIO_MUTUAL keeps the in mesh marker first.
+func buildUpstreamALPN(alpn []string, cluster *v2.Cluster, ctx clusterContext) []string {
+	if ctx.port == nil {
+		return alpn
+	}
+	var protocols []string
+	switch {
+	case cluster.Http2ProtocolOptions != nil:
+		protocols = util.ALPNH2Only
+	case upstreamProtocol(ctx.hostname, ctx.port).IsHTTP():
+		protocols = util.ALPNHTTP11Only
+	default:
+		return alpn
+	}
+	out := make([]string, 0, len(alpn)+len(protocols))
+	return append(append(out, alpn...), protocols...)
+}
 
-// BuildClusters returns the list of clusters for the given proxy. This is the CDS output
-// For outbound: Cluster for each service/subset hostname or cidr with SNI set to service hostname
-// Cluster type based on resolution
-// For inbound (sidecar only): Cluster for each inbound endpoint port and for each service port
-func BuildClusters(env model.Environment, proxy model.Proxy) []*v2.Cluster {
-	clusters := make([]*v2.Cluster, 0)
+// buildSimpleTLSValidationContext returns the validation of the upstream certificate in SIMPLE mode,
+// against the system CA certificates if the settings have none. Envoy rejects every certificate
+// validated against a file with an empty name, so the certificate is not verified if neither is set.
+func buildSimpleTLSValidationContext(clusterName, hostname string,
+	tls *networking.TLSSettings) *auth.CertificateValidationContext {
+	caCertificates := tls.CaCertificates
+	if caCertificates == "" {
+		caCertificates = upstreamSystemCACertificates
+	}
+	if caCertificates == "" {
+		if len(tls.SubjectAltNames) > 0 {
+			log.Warnf("cluster %s verifies subject alt names without CA certificates, ignoring", clusterName)
+		}
+		// a pinned certificate is trusted without a CA, e.g. a self signed one
+		if !hasCertificatePins(hostname) {
+			log.Warnf("cluster %s does not verify the certificate of its upstream, no CA certificates are set",
+				clusterName)
+			unverifiedUpstreamClusters.Inc()
+			return nil
+		}
+		validation := &auth.CertificateValidationContext{}
+		setCertificatePins(validation, hostname)
+		return validation
+	}
+	validation := &auth.CertificateValidationContext{
+		TrustedCa: &core.DataSource{
+			Specifier: &core.DataSource_Filename{
+				Filename: caCertificates,
+			},
+		},
+		VerifySubjectAltName: tls.SubjectAltNames,
+	}
+	setCertificatePins(validation, hostname)
+	return validation
+}
 
-	services, err := env.Services()
-	if err != nil {
-		log.Errorf("Failed for retrieve services: %v", err)
-		return nil
+// buildInsecureTLSContext returns the TLS context of SIMPLE settings skipping the verification of the
+// upstream certificate, e.g. a self signed certificate of a legacy upstream during a migration. The
+// connection is encrypted but not authenticated, so every use is logged and counted.
+func buildInsecureTLSContext(clusterName, hostname string, tls *networking.TLSSettings) *auth.UpstreamTlsContext {
+	log.Warnf("cluster %s skips the verification of the upstream certificate, the connections are "+
+		"not authenticated", clusterName)
+	insecureSkipVerifyClusters.Inc()
+	if tls.CaCertificates != "" || tls.CredentialName != "" || len(tls.SubjectAltNames) > 0 || hasCertificatePins(hostname) {
+		log.Warnf("cluster %s skips the verification of the upstream certificate, ignoring its validation settings",
+			clusterName)
 	}
+	return &auth.UpstreamTlsContext{
+		CommonTlsContext: &auth.CommonTlsContext{},
+		Sni:              tls.Sni,
+	}
+}
+
+// hasCertificatePins returns whether the certificate of the upstreams of the service is pinned by the
+// hash of its public key or of the certificate itself.
+func hasCertificatePins(hostname string) bool {
+	return len(upstreamTLSSpkiPins[hostname]) > 0 || len(upstreamTLSCertificateHashes[hostname]) > 0
+}
 
-	clusters = append(clusters, buildOutboundClusters(env, services)...)
-	for _, c := range clusters {
-		// Envoy requires a non-zero connect timeout
-		if c.ConnectTimeout == 0 {
-			c.ConnectTimeout = defaultClusterConnectTimeout
+// setCertificatePins verifies the pins of the certificate of the upstreams of the service, if any.
+func setCertificatePins(validation *auth.CertificateValidationContext, hostname string) {
+	validation.VerifyCertificateSpki = upstreamTLSSpkiPins[hostname]
+	validation.VerifyCertificateHash = upstreamTLSCertificateHashes[hostname]
+}
+
+// parseCertificatePins parses the <hostname>=<pin> certificate pins into the pins of each hostname,
+// skipping the invalid ones. The pin is split at the first "=" only, as base64 pins may end with "=".
+func parseCertificatePins(kind string, pins []string, valid func(string) bool) map[string][]string {
+	out := make(map[string][]string, len(pins))
+	for _, pin := range pins {
+		parts := strings.SplitN(pin, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || !valid(parts[1]) {
+			log.Warnf("invalid %s %q, ignoring", kind, pin)
+			continue
 		}
+		out[parts[0]] = append(out[parts[0]], parts[1])
 	}
-	if proxy.Type == model.Sidecar {
-		instances, err := env.GetProxyServiceInstances(proxy)
-		if err != nil {
-			log.Errorf("failed to get service proxy service instances: %v", err)
-			return nil
-		}
+	return out
+}
 
-		managementPorts := env.ManagementPorts(proxy.IPAddress)
-		clusters = append(clusters, buildInboundClusters(env, instances, managementPorts)...)
+// isSpkiPin returns whether the pin is a base64 encoded SHA-256 hash.
+func isSpkiPin(pin string) bool {
+	hash, err := base64.StdEncoding.DecodeString(pin)
+	return err == nil && len(hash) == sha256.Size
+}
 
-		// TODO: Bug? why only for sidecars?
-		// append cluster for JwksUri (for Jwt authentication) if necessary.
-		clusters = append(clusters, authn.BuildJwksURIClustersForProxyInstances(
-			env.Mesh, env.IstioConfigStore, instances)...)
+// isCertificateHash returns whether the pin is a hex encoded SHA-256 hash, optionally colon separated.
+func isCertificateHash(pin string) bool {
+	hash, err := hex.DecodeString(strings.Replace(pin, ":", "", -1))
+	return err == nil && len(hash) == sha256.Size
+}
+
+func buildUpstreamTLSParams() *auth.TlsParameters {
+	return &auth.TlsParameters{
+		TlsMinimumProtocolVersion: upstreamTLSMinimumProtocolVersion,
+		TlsMaximumProtocolVersion: upstreamTLSMaximumProtocolVersion,
+		CipherSuites:              upstreamTLSCipherSuites,
 	}
+}
 
-	return clusters // TODO: normalize/dedup/order
+// buildIstioMutualTLS returns the MUTUAL TLS settings equivalent to ISTIO_MUTUAL, using the
+// certificates provisioned by Istio in the proxy.
+func buildIstioMutualTLS(tls *networking.TLSSettings) *networking.TLSSettings {
+	return &networking.TLSSettings{
+		Mode:              networking.TLSSettings_MUTUAL,
+		ClientCertificate: path.Join(model.AuthCertsPath, model.CertChainFilename),
+		PrivateKey:        path.Join(model.AuthCertsPath, model.KeyFilename),
+		CaCertificates:    path.Join(model.AuthCertsPath, model.RootCertFilename),
+		SubjectAltNames:   tls.SubjectAltNames,
+		Sni:               tls.Sni,
+	}
 }
 
-func buildOutboundClusters(env model.Environment, services []*model.Service) []*v2.Cluster {
-	clusters := make([]*v2.Cluster, 0)
-	for _, service := range services {
-		config := env.DestinationRule(service.Hostname, "")
-		for _, port := range service.Ports {
-			hosts := buildClusterHosts(env, service, port)
-
-			// create default cluster
-			clusterName := model.BuildSubsetKey(model.TrafficDirectionOutbound, "", service.Hostname, port)
-			defaultCluster := buildDefaultCluster(env, clusterName, convertResolution(service.Resolution), hosts)
-			updateEds(env, defaultCluster, service.Hostname)
-			setUpstreamProtocol(defaultCluster, port)
-			clusters = append(clusters, defaultCluster)
-
-			if config != nil {
-				destinationRule := config.Spec.(*networking.DestinationRule)
-				applyTrafficPolicy(defaultCluster, destinationRule.TrafficPolicy)
-
-				for _, subset := range destinationRule.Subsets {
-					subsetClusterName := model.BuildSubsetKey(model.TrafficDirectionOutbound, subset.Name, service.Hostname, port)
-					subsetCluster := buildDefaultCluster(env, subsetClusterName, convertResolution(service.Resolution), hosts)
-					updateEds(env, subsetCluster, service.Hostname)
-					setUpstreamProtocol(subsetCluster, port)
-					applyTrafficPolicy(subsetCluster, destinationRule.TrafficPolicy)
-					applyTrafficPolicy(subsetCluster, subset.TrafficPolicy)
-					clusters = append(clusters, subsetCluster)
-				}
-			}
-		}
+// applySdsSecretConfigs replaces the certificate files of a mutual TLS context by the secrets with
+// the given names, fetched over SDS from the node agent, if enabled. The validation context is kept
+// in the cluster when verifying subject alt names or certificate pins, as the SDS secret would not
+// include them.
+func applySdsSecretConfigs(tlsContext *auth.CommonTlsContext, certificateName, validationName string) {
+	if sdsUdsPath == "" {
+		return
 	}
+	tlsContext.TlsCertificates = nil
+	tlsContext.TlsCertificateSdsSecretConfigs = []*auth.SdsSecretConfig{buildSdsSecretConfig(certificateName, sdsUdsPath)}
+	validation := tlsContext.ValidationContext
+	if len(validation.GetVerifySubjectAltName()) == 0 && len(validation.GetVerifyCertificateSpki()) == 0 &&
+		len(validation.GetVerifyCertificateHash()) == 0 {
+		tlsContext.ValidationContext = nil
+		tlsContext.ValidationContextSdsSecretConfig = buildSdsSecretConfig(validationName, sdsUdsPath)
+	}
+}
 
-	return clusters
+// buildCredentialTLSContext returns the TLS context of SIMPLE or MUTUAL settings referencing their
+// certificates by credential name. The client certificate and key are in the secret of the credential,
+// the validation context in the secret suffixed by -cacert, both fetched over SDS. The certificate
+// files and subject alt names of the settings are ignored, and so are the pins of the service, which
+// the validation secret must hold instead.
+func buildCredentialTLSContext(clusterName, hostname string, tls *networking.TLSSettings) *auth.UpstreamTlsContext {
+	validationName := tls.CredentialName + credentialCACertSuffix
+	if len(tls.SubjectAltNames) > 0 || hasCertificatePins(hostname) {
+		log.Warnf("cluster %s validates the upstream certificate with the secret %s, which must hold the subject "+
+			"alt names and certificate pins, ignoring those of the TLS settings and of the service", clusterName,
+			validationName)
+	}
+	common := &auth.CommonTlsContext{
+		ValidationContextSdsSecretConfig: buildSdsSecretConfig(validationName, credentialSdsUdsPath),
+	}
+	if tls.Mode == networking.TLSSettings_MUTUAL {
+		common.TlsCertificateSdsSecretConfigs = []*auth.SdsSecretConfig{
+			buildSdsSecretConfig(tls.CredentialName, credentialSdsUdsPath),
+		}
+	}
+	return &auth.UpstreamTlsContext{
+		CommonTlsContext: common,
+		Sni:              tls.Sni,
+	}
 }
 
-func updateEds(env model.Environment, cluster *v2.Cluster, serviceName string) {
-	if cluster.Type != v2.Cluster_EDS {
+// applySubsetSubjectAltName verifies that the certificate selected by the SNI of a MUTUAL subset
+// cluster is issued for the subset, unless the settings set the SNI or subject alt names. ISTIO_MUTUAL
+// certificates identify the workload instead, and the validation secrets of credentials cannot be
+// extended with names.
+func applySubsetSubjectAltName(tlsContext *auth.UpstreamTlsContext, tls *networking.TLSSettings, ctx clusterContext) {
+	if tls.Sni != "" || ctx.subset == "" || len(tls.SubjectAltNames) > 0 {
 		return
 	}
-	refresh := time.Duration(env.Mesh.RdsRefreshDelay.Seconds) * time.Second
-	if refresh == 0 {
-		// envoy crashes if 0. Will go away once we move to v2
-		refresh = 5 * time.Second
+	if sni := buildUpstreamSNI(ctx); sni != "" {
+		tlsContext.CommonTlsContext.ValidationContext.VerifySubjectAltName = []string{sni}
 	}
-	cluster.EdsClusterConfig = &v2.Cluster_EdsClusterConfig{
-		ServiceName: cluster.Name,
-		EdsConfig: &core.ConfigSource{
+}
+
+func buildSdsSecretConfig(name, udsPath string) *auth.SdsSecretConfig {
+	return &auth.SdsSecretConfig{
+		Name: name,
+		SdsConfig: &core.ConfigSource{
 			ConfigSourceSpecifier: &core.ConfigSource_ApiConfigSource{
 				ApiConfigSource: &core.ApiConfigSource{
-					ApiType:      core.ApiConfigSource_GRPC,
-					ClusterNames: []string{xdsName},
-					RefreshDelay: &refresh,
+					ApiType: core.ApiConfigSource_GRPC,
+					GrpcServices: []*core.GrpcService{
+						{
+							TargetSpecifier: &core.GrpcService_GoogleGrpc_{
+								GoogleGrpc: &core.GrpcService_GoogleGrpc{
+									TargetUri:  "unix:" + udsPath,
+									StatPrefix: sdsStatPrefix,
+								},
+							},
+						},
+					},
 				},
 			},
 		},
 	}
 }
 
-func buildClusterHosts(env model.Environment, service *model.Service, port *model.Port) []*core.Address {
-	if service.Resolution != model.DNSLB {
-		return nil
+func buildMutualTLSContext(tls *networking.TLSSettings) *auth.UpstreamTlsContext {
+	return &auth.UpstreamTlsContext{
+		CommonTlsContext: &auth.CommonTlsContext{
+			TlsCertificates: []*auth.TlsCertificate{
+				{
+					CertificateChain: &core.DataSource{
+						Specifier: &core.DataSource_Filename{
+							Filename: tls.ClientCertificate,
+						},
+					},
+					PrivateKey: &core.DataSource{
+						Specifier: &core.DataSource_Filename{
+							Filename: tls.PrivateKey,
+						},
+					},
+				},
+			},
+			ValidationContext: &auth.CertificateValidationContext{
+				TrustedCa: &core.DataSource{
+					Specifier: &core.DataSource_Filename{
+						Filename: tls.CaCertificates,
+					},
+				},
+				VerifySubjectAltName: tls.SubjectAltNames,
+			},
+		},
+		Sni: tls.Sni,
 	}
+}
 
-	// FIXME port name not required if only one port
-	instances, err := env.Instances(service.Hostname, []string{port.Name}, nil)
-	if err != nil {
-		log.Errorf("failed to retrieve instances for %s: %v", service.Hostname, err)
-		return nil
-	}
+func setUpstreamProtocol(cluster *v2.Cluster, hostname string, port *model.Port) {
+	setProtocolOptions(cluster, upstreamProtocol(hostname, port))
+}
 
-	hosts := make([]*core.Address, 0)
-	for _, instance := range instances {
-		host := util.BuildAddress(instance.Endpoint.Address, uint32(instance.Endpoint.Port))
-		hosts = append(hosts, &host)
+// setProtocolOptions sets the HTTP protocol options of the cluster for the protocol of its hosts.
+func setProtocolOptions(cluster *v2.Cluster, protocol model.Protocol) {
+	if protocol.IsHTTP() {
+		if protocol == model.ProtocolHTTP2 || protocol == model.ProtocolGRPC {
+			cluster.Http2ProtocolOptions = buildHTTP2ProtocolOptions()
+			// HTTP/2 is used whatever the protocol of the downstream, gRPC cannot be downgraded to HTTP/1.1
+			cluster.ProtocolSelection = v2.Cluster_USE_CONFIGURED_PROTOCOL
+		}
+		cluster.CommonHttpProtocolOptions = buildCommonHTTPProtocolOptions()
 	}
-
-	return hosts
 }
 
-func buildInboundClusters(env model.Environment, instances []*model.ServiceInstance, managementPorts []*model.Port) []*v2.Cluster {
-	clusters := make([]*v2.Cluster, 0)
-	for _, instance := range instances {
-		// This cluster name is mainly for stats.
-		clusterName := model.BuildSubsetKey(model.TrafficDirectionInbound, "", instance.Service.Hostname, instance.Endpoint.ServicePort)
-		address := util.BuildAddress("127.0.0.1", uint32(instance.Endpoint.Port))
-		localCluster := buildDefaultCluster(env, clusterName, v2.Cluster_STATIC, []*core.Address{&address})
-		setUpstreamProtocol(localCluster, instance.Endpoint.ServicePort)
-		clusters = append(clusters, localCluster)
+// upstreamProtocol returns the protocol of the service port, from the protocol overrides if the port
+// is listed, or else as classified by the port name.
+func upstreamProtocol(hostname string, port *model.Port) model.Protocol {
+	// the key is only built if needed, as this runs several times for every cluster
+	if len(protocolOverrides) == 0 {
+		return port.Protocol
+	}
+	if protocol, ok := protocolOverrides[protocolOverrideKey(hostname, port.Port)]; ok {
+		return protocol
 	}
+	return port.Protocol
+}
 
-	// Add a passthrough cluster for traffic to management ports (health check ports)
-	for _, port := range managementPorts {
-		clusterName := model.BuildSubsetKey(model.TrafficDirectionInbound, "", ManagementClusterHostname, port)
-		address := util.BuildAddress("127.0.0.1", uint32(port.Port))
-		mgmtCluster := buildDefaultCluster(env, clusterName, v2.Cluster_STATIC, []*core.Address{&address})
-		setUpstreamProtocol(mgmtCluster, port)
-		clusters = append(clusters, mgmtCluster)
+func protocolOverrideKey(hostname string, port int) string {
+	return hostname + ":" + strconv.Itoa(port)
+}
+
+// parseProtocolOverrides parses the <hostname>:<port>=<protocol> protocol overrides, skipping the
+// invalid ones.
+func parseProtocolOverrides(overrides []string) map[string]model.Protocol {
+	out := make(map[string]model.Protocol, len(overrides))
+	for _, override := range overrides {
+		parts := strings.Split(override, "=")
+		if len(parts) != 2 {
+			log.Warnf("invalid protocol override %q, ignoring", override)
+			continue
+		}
+		colon := strings.LastIndex(parts[0], ":")
+		if colon <= 0 {
+			log.Warnf("invalid protocol override %q, ignoring", override)
+			continue
+		}
+		port, err := strconv.Atoi(parts[0][colon+1:])
+		if err != nil || model.ValidatePort(port) != nil {
+			log.Warnf("invalid port in protocol override %q, ignoring", override)
+			continue
+		}
+		protocol := model.ConvertCaseInsensitiveStringToProtocol(parts[1])
+		if protocol == model.ProtocolUnsupported {
+			log.Warnf("invalid protocol in protocol override %q, ignoring", override)
+			continue
+		}
+		out[protocolOverrideKey(parts[0][:colon], port)] = protocol
 	}
-	return clusters
+	return out
 }
 
-func convertResolution(resolution model.Resolution) v2.Cluster_DiscoveryType {
-	switch resolution {
-	case model.ClientSideLB:
-		return v2.Cluster_EDS
-	case model.DNSLB:
-		return v2.Cluster_STRICT_DNS
-	case model.Passthrough:
-		return v2.Cluster_ORIGINAL_DST
-	default:
-		return v2.Cluster_EDS
+// buildCommonHTTPProtocolOptions returns the idle timeout of HTTP clusters, or nil if it is not set.
+func buildCommonHTTPProtocolOptions() *core.HttpProtocolOptions {
+	if httpIdleTimeout == 0 {
+		return nil
 	}
+	idleTimeout := httpIdleTimeout
+	return &core.HttpProtocolOptions{IdleTimeout: &idleTimeout}
 }
 
-func applyTrafficPolicy(cluster *v2.Cluster, policy *networking.TrafficPolicy) {
-	if policy == nil {
+// applyUpstreamBindConfig binds the upstream connections of the cluster to the configured source address.
+func applyUpstreamBindConfig(cluster *v2.Cluster) {
+	if upstreamSourceAddress == "" {
 		return
 	}
-	applyConnectionPool(cluster, policy.ConnectionPool)
-	applyOutlierDetection(cluster, policy.OutlierDetection)
-	applyLoadBalancer(cluster, policy.LoadBalancer)
-	applyUpstreamTLSSettings(cluster, policy.Tls)
+	cluster.UpstreamBindConfig = &core.BindConfig{
+		SourceAddress: core.SocketAddress{
+			Address: upstreamSourceAddress,
+			// any free port
+			PortSpecifier: &core.SocketAddress_PortValue{PortValue: 0},
+		},
+	}
 }
 
-// FIXME: there isn't a way to distinguish between unset values and zero values
-func applyConnectionPool(cluster *v2.Cluster, settings *networking.ConnectionPoolSettings) {
-	if settings == nil {
+// applyHealthCheck adds an active health check to clusters whose hosts are not health checked by
+// the platform, i.e. DNS and static clusters, and to EDS clusters if enabled. The hosts of HTTP
+// ports, as resolved with the protocol overrides, are checked over HTTP.
+func applyHealthCheck(cluster *v2.Cluster, hostname string, port *model.Port) {
+	if healthCheckInterval == 0 {
 		return
 	}
-
-	threshold := &v2_cluster.CircuitBreakers_Thresholds{}
-
-	if settings.Http != nil {
-		if settings.Http.Http2MaxRequests > 0 {
-			// Envoy only applies MaxRequests in HTTP/2 clusters
-			threshold.MaxRequests = &types.UInt32Value{Value: uint32(settings.Http.Http2MaxRequests)}
-		}
-		if settings.Http.Http1MaxPendingRequests > 0 {
-			// Envoy only applies MaxPendingRequests in HTTP/1.1 clusters
-			threshold.MaxPendingRequests = &types.UInt32Value{Value: uint32(settings.Http.Http1MaxPendingRequests)}
+	switch cluster.Type {
+	case v2.Cluster_STRICT_DNS, v2.Cluster_STATIC:
+	case v2.Cluster_EDS:
+		if !healthCheckEDS {
+			return
 		}
+	default:
+		return
+	}
 
-		if settings.Http.MaxRequestsPerConnection > 0 {
-			cluster.MaxRequestsPerConnection = &types.UInt32Value{Value: uint32(settings.Http.MaxRequestsPerConnection)}
+	interval, timeout := healthCheckInterval, healthCheckTimeout
+	healthCheck := &core.HealthCheck{
+		Interval:           &interval,
+		Timeout:            &timeout,
+		HealthyThreshold:   &types.UInt32Value{Value: healthCheckHealthyThreshold},
+		UnhealthyThreshold: &types.UInt32Value{Value: healthCheckUnhealthyThreshold},
+	}
+	if upstreamProtocol(hostname, port).IsHTTP() && healthCheckHTTPPath != "" {
+		healthCheck.HealthChecker = &core.HealthCheck_HttpHealthCheck_{
+			HttpHealthCheck: &core.HealthCheck_HttpHealthCheck{Path: healthCheckHTTPPath},
 		}
-
-		// FIXME: zero is a valid value if explicitly set, otherwise we want to use the default value of 3
-		if settings.Http.MaxRetries > 0 {
-			threshold.MaxRetries = &types.UInt32Value{Value: uint32(settings.Http.MaxRetries)}
+	} else {
+		// an empty payload only checks that a connection can be established
+		healthCheck.HealthChecker = &core.HealthCheck_TcpHealthCheck_{
+			TcpHealthCheck: &core.HealthCheck_TcpHealthCheck{},
 		}
 	}
+	cluster.HealthChecks = []*core.HealthCheck{healthCheck}
+	cluster.CloseConnectionsOnHostHealthFailure = closeConnectionsOnHostHealthFailure
+}
 
-	if settings.Tcp != nil {
-		if settings.Tcp.ConnectTimeout != nil {
-			cluster.ConnectTimeout = util.ConvertGogoDurationToDuration(settings.Tcp.ConnectTimeout)
-		}
+func buildHTTP2ProtocolOptions() *core.Http2ProtocolOptions {
+	options := &core.Http2ProtocolOptions{}
+	if http2MaxConcurrentStreams > 0 {
+		options.MaxConcurrentStreams = &types.UInt32Value{Value: http2MaxConcurrentStreams}
+	}
+	if http2InitialStreamWindowSize > 0 {
+		options.InitialStreamWindowSize = &types.UInt32Value{Value: http2InitialStreamWindowSize}
+	}
+	if http2InitialConnectionWindowSize > 0 {
+		options.InitialConnectionWindowSize = &types.UInt32Value{Value: http2InitialConnectionWindowSize}
+	}
+	return options
+}
 
-		if settings.Tcp.MaxConnections > 0 {
-			threshold.MaxConnections = &types.UInt32Value{Value: uint32(settings.Tcp.MaxConnections)}
-		}
+func buildDefaultCluster(env model.Environment, name string, discoveryType v2.Cluster_DiscoveryType,
+	hosts []*core.Address) *v2.Cluster {
+	cluster := &v2.Cluster{
+		Name:  name,
+		Type:  discoveryType,
+		Hosts: hosts,
 	}
+	// The defaults, including the connect timeout required by Envoy, are injected before any
+	// destination rule is applied, so that an explicit setting from the user is never overridden.
+	defaultTrafficPolicy := buildDefaultTrafficPolicy(env, discoveryType)
+	applyTrafficPolicy(cluster, defaultTrafficPolicy, clusterContext{})
+	applyDNSSettings(cluster)
+	applyLocalityWeightedLb(cluster)
+	applyHealthyPanicThreshold(cluster)
+	applyHostRemovalSettings(cluster)
+	applyPerConnectionBufferLimit(cluster, "")
+	return cluster
+}
 
-	cluster.CircuitBreakers = &v2_cluster.CircuitBreakers{
-		Thresholds: []*v2_cluster.CircuitBreakers_Thresholds{threshold},
+// applyPerConnectionBufferLimit sets the buffer limit of the connections of the cluster, the override of
+// the service hostname if any, or else the mesh wide limit.
+func applyPerConnectionBufferLimit(cluster *v2.Cluster, hostname string) {
+	if limit, ok := perConnectionBufferLimitOverrides[hostname]; ok {
+		cluster.PerConnectionBufferLimitBytes = &types.UInt32Value{Value: limit}
+		return
+	}
+	if perConnectionBufferLimitBytesSet {
+		cluster.PerConnectionBufferLimitBytes = &types.UInt32Value{Value: perConnectionBufferLimitBytes}
 	}
 }
 
-// FIXME: there isn't a way to distinguish between unset values and zero values
-func applyOutlierDetection(cluster *v2.Cluster, outlier *networking.OutlierDetection) {
-	if outlier == nil || outlier.Http == nil {
+// parsePerConnectionBufferLimitOverrides parses the <hostname>=<bytes> buffer limit overrides, skipping
+// the invalid ones.
+func parsePerConnectionBufferLimitOverrides(overrides []string) map[string]uint32 {
+	out := make(map[string]uint32, len(overrides))
+	for _, override := range overrides {
+		parts := strings.Split(override, "=")
+		if len(parts) != 2 || parts[0] == "" {
+			log.Warnf("invalid per connection buffer limit override %q, ignoring", override)
+			continue
+		}
+		limit, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			log.Warnf("invalid buffer limit in per connection buffer limit override %q, ignoring", override)
+			continue
+		}
+		out[parts[0]] = uint32(limit)
+	}
+	return out
+}
+
+// applyHostRemovalSettings sets how EDS clusters handle the hosts leaving the endpoints, as configured
+// mesh wide. The clusters are left unchanged by default.
+func applyHostRemovalSettings(cluster *v2.Cluster) {
+	if cluster.Type != v2.Cluster_EDS {
 		return
 	}
+	cluster.DrainConnectionsOnHostRemoval = drainConnectionsOnHostRemoval
+	if edsUpdateMergeWindow > 0 {
+		if cluster.CommonLbConfig == nil {
+			cluster.CommonLbConfig = &v2.Cluster_CommonLbConfig{}
+		}
+		cluster.CommonLbConfig.UpdateMergeWindow = types.DurationProto(edsUpdateMergeWindow)
+	}
+}
 
-	out := &v2_cluster.OutlierDetection{}
-	if outlier.Http.BaseEjectionTime != nil {
-		out.BaseEjectionTime = outlier.Http.BaseEjectionTime
+// applyHealthyPanicThreshold sets the mesh wide healthy panic threshold on EDS clusters. It takes
+// precedence over the min health percent of outlier detection.
+func applyHealthyPanicThreshold(cluster *v2.Cluster) {
+	if !healthyPanicThresholdSet || cluster.Type != v2.Cluster_EDS {
+		return
 	}
-	if outlier.Http.ConsecutiveErrors > 0 {
-		out.Consecutive_5Xx = &types.UInt32Value{Value: uint32(outlier.Http.ConsecutiveErrors)}
+	threshold := healthyPanicThreshold
+	if threshold > 100 {
+		log.Warnf("invalid healthy panic threshold %d%%, using 100%%", threshold)
+		threshold = 100
 	}
-	if outlier.Http.Interval != nil {
-		out.Interval = outlier.Http.Interval
+	if cluster.CommonLbConfig == nil {
+		cluster.CommonLbConfig = &v2.Cluster_CommonLbConfig{}
 	}
-	if outlier.Http.MaxEjectionPercent > 0 {
-		out.MaxEjectionPercent = &types.UInt32Value{Value: uint32(outlier.Http.MaxEjectionPercent)}
+	cluster.CommonLbConfig.HealthyPanicThreshold = &envoy_type.Percent{Value: float64(threshold)}
+}
+
+// applyLocalityWeightedLb enables locality weighted load balancing on EDS clusters.
+func applyLocalityWeightedLb(cluster *v2.Cluster) {
+	if !enableLocalityWeightedLb {
+		return
 	}
-	cluster.OutlierDetection = out
+	applyLocalityWeightedConfig(cluster)
 }
 
-func applyLoadBalancer(cluster *v2.Cluster, lb *networking.LoadBalancerSettings) {
-	if lb == nil {
+// applyLocalityWeightedConfig sets the locality weighted load balancing config of EDS clusters, the
+// only clusters whose endpoints carry locality weights.
+func applyLocalityWeightedConfig(cluster *v2.Cluster) {
+	if cluster.Type != v2.Cluster_EDS {
 		return
 	}
-	// TODO: RING_HASH and MAGLEV
-	switch lb.GetSimple() {
-	case networking.LoadBalancerSettings_LEAST_CONN:
-		cluster.LbPolicy = v2.Cluster_LEAST_REQUEST
-	case networking.LoadBalancerSettings_RANDOM:
-		cluster.LbPolicy = v2.Cluster_RANDOM
-	case networking.LoadBalancerSettings_ROUND_ROBIN:
-		cluster.LbPolicy = v2.Cluster_ROUND_ROBIN
-	case networking.LoadBalancerSettings_PASSTHROUGH:
-		cluster.LbPolicy = v2.Cluster_ORIGINAL_DST_LB
-		cluster.Type = v2.Cluster_ORIGINAL_DST
+	if cluster.CommonLbConfig == nil {
+		cluster.CommonLbConfig = &v2.Cluster_CommonLbConfig{}
+	}
+	cluster.CommonLbConfig.LocalityConfigSpecifier = &v2.Cluster_CommonLbConfig_LocalityWeightedLbConfig_{
+		LocalityWeightedLbConfig: &v2.Cluster_CommonLbConfig_LocalityWeightedLbConfig{},
 	}
-
-	// DO not do if else here. since lb.GetSimple returns a enum value (not pointer).
 }
 
-func applyUpstreamTLSSettings(cluster *v2.Cluster, tls *networking.TLSSettings) {
-	if tls == nil {
+// applyWeightedSimpleLb makes the RANDOM and ROUND_ROBIN load balancers of EDS clusters weight the
+// localities of the endpoints, when enabled mesh wide. Unless a destination rule distributes the
+// traffic across localities, the weights sent over EDS keep the load even across the endpoints.
+func applyWeightedSimpleLb(cluster *v2.Cluster) {
+	if !enableWeightedSimpleLb {
 		return
 	}
+	applyLocalityWeightedConfig(cluster)
+}
 
-	switch tls.Mode {
-	case networking.TLSSettings_DISABLE:
-		// TODO: Need to make sure that authN does not override this setting
-	case networking.TLSSettings_SIMPLE:
-		cluster.TlsContext = &auth.UpstreamTlsContext{
-			CommonTlsContext: &auth.CommonTlsContext{
-				ValidationContext: &auth.CertificateValidationContext{
-					TrustedCa: &core.DataSource{
-						Specifier: &core.DataSource_Filename{
-							Filename: tls.CaCertificates,
-						},
-					},
-					VerifySubjectAltName: tls.SubjectAltNames,
-				},
-			},
-			Sni: tls.Sni,
-		}
-	case networking.TLSSettings_MUTUAL:
-		cluster.TlsContext = &auth.UpstreamTlsContext{
-			CommonTlsContext: &auth.CommonTlsContext{
-				TlsCertificates: []*auth.TlsCertificate{
-					{
-						CertificateChain: &core.DataSource{
-							Specifier: &core.DataSource_Filename{
-								Filename: tls.ClientCertificate,
-							},
-						},
-						PrivateKey: &core.DataSource{
-							Specifier: &core.DataSource_Filename{
-								Filename: tls.PrivateKey,
-							},
-						},
-					},
-				},
-				ValidationContext: &auth.CertificateValidationContext{
-					TrustedCa: &core.DataSource{
-						Specifier: &core.DataSource_Filename{
-							Filename: tls.CaCertificates,
-						},
-					},
-					VerifySubjectAltName: tls.SubjectAltNames,
-				},
-			},
-			Sni: tls.Sni,
-		}
+// applyDNSSettings configures how Envoy resolves the hosts of DNS clusters.
+func applyDNSSettings(cluster *v2.Cluster) {
+	switch cluster.Type {
+	case v2.Cluster_STRICT_DNS:
+		refreshRate := dnsRefreshRate
+		cluster.DnsRefreshRate = &refreshRate
+	case v2.Cluster_LOGICAL_DNS:
+	default:
+		return
 	}
+	cluster.DnsLookupFamily = dnsLookupFamily
+	cluster.DnsResolvers = dnsResolvers
 }
 
-func setUpstreamProtocol(cluster *v2.Cluster, port *model.Port) {
-	if port.Protocol.IsHTTP() {
-		if port.Protocol == model.ProtocolHTTP2 || port.Protocol == model.ProtocolGRPC {
-			cluster.Http2ProtocolOptions = &core.Http2ProtocolOptions{}
+// parseDNSResolvers parses the <ip> or <ip>:<port> DNS resolvers, skipping the invalid ones. The
+// port defaults to 53.
+func parseDNSResolvers(resolvers []string) []*core.Address {
+	out := make([]*core.Address, 0, len(resolvers))
+	for _, resolver := range resolvers {
+		host, port := resolver, "53"
+		if net.ParseIP(resolver) == nil {
+			var err error
+			if host, port, err = net.SplitHostPort(resolver); err != nil {
+				log.Warnf("invalid DNS resolver %q, ignoring", resolver)
+				continue
+			}
+		}
+		ip := net.ParseIP(host)
+		portValue, err := strconv.Atoi(port)
+		if ip == nil || err != nil || model.ValidatePort(portValue) != nil {
+			log.Warnf("invalid DNS resolver %q, ignoring", resolver)
+			continue
 		}
+		address := util.BuildAddress(ip.String(), uint32(portValue))
+		out = append(out, &address)
+	}
+	if len(out) == 0 {
+		return nil
 	}
+	return out
 }
 
-func buildDefaultCluster(env model.Environment, name string, discoveryType v2.Cluster_DiscoveryType,
-	hosts []*core.Address) *v2.Cluster {
-	cluster := &v2.Cluster{
-		Name:  name,
-		Type:  discoveryType,
-		Hosts: hosts,
+// envDefaultLbPolicy returns the default load balancing policy from PILOT_DEFAULT_LB_POLICY, or
+// ROUND_ROBIN. PASSTHROUGH is rejected as only ORIGINAL_DST clusters can use it.
+func envDefaultLbPolicy() networking.LoadBalancerSettings_SimpleLB {
+	policy := networking.LoadBalancerSettings_SimpleLB(envEnum("PILOT_DEFAULT_LB_POLICY",
+		networking.LoadBalancerSettings_SimpleLB_value, int32(DefaultLbType)))
+	if policy == networking.LoadBalancerSettings_PASSTHROUGH {
+		log.Warnf("invalid default load balancing policy %v, using %v", policy, DefaultLbType)
+		return DefaultLbType
 	}
-	defaultTrafficPolicy := buildDefaultTrafficPolicy(env, discoveryType)
-	applyTrafficPolicy(cluster, defaultTrafficPolicy)
-	return cluster
+	return policy
 }
 
 func buildDefaultTrafficPolicy(env model.Environment, discoveryType v2.Cluster_DiscoveryType) *networking.TrafficPolicy {
-	lbPolicy := DefaultLbType
+	lbPolicy := defaultLbPolicy
+	tcp := &networking.ConnectionPoolSettings_TCPSettings{
+		ConnectTimeout: types.DurationProto(meshDuration(env.Mesh.ConnectTimeout, defaultMeshConfig.ConnectTimeout)),
+	}
 	if discoveryType == v2.Cluster_ORIGINAL_DST {
 		lbPolicy = networking.LoadBalancerSettings_PASSTHROUGH
+		if originalDstMaxConnections > 0 {
+			tcp.MaxConnections = int32(originalDstMaxConnections)
+		}
 	}
 
 	return &networking.TrafficPolicy{
@@ -379,12 +2627,7 @@ func buildDefaultTrafficPolicy(env model.Environment, discoveryType v2.Cluster_D
 			},
 		},
 		ConnectionPool: &networking.ConnectionPoolSettings{
-			Tcp: &networking.ConnectionPoolSettings_TCPSettings{
-				ConnectTimeout: &types.Duration{
-					Seconds: env.Mesh.ConnectTimeout.Seconds,
-					Nanos:   env.Mesh.ConnectTimeout.Nanos,
-				},
-			},
+			Tcp: tcp,
 		},
 	}
 }
@@ -0,0 +1,5431 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1alpha3
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/auth"
+	v2_cluster "github.com/envoyproxy/go-control-plane/envoy/api/v2/cluster"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	envoy_type "github.com/envoyproxy/go-control-plane/envoy/type"
+	"github.com/gogo/protobuf/types"
+	"github.com/golang/protobuf/ptypes"
+	dto "github.com/prometheus/client_model/go"
+
+	authn "istio.io/api/authentication/v1alpha1"
+	meshconfig "istio.io/api/mesh/v1alpha1"
+	networking "istio.io/api/networking/v1alpha3"
+	"istio.io/istio/pilot/pkg/config/memory"
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/networking/util"
+	"istio.io/istio/pilot/pkg/proxy/envoy/v1/mock"
+	"istio.io/istio/pilot/pkg/serviceregistry/external"
+)
+
+// buildTestEnv returns an environment with the given services and destination rules.
+func buildTestEnv(t *testing.T, services []*model.Service, rules ...*networking.DestinationRule) model.Environment {
+	configs := make([]model.Config, 0, len(rules))
+	for _, rule := range rules {
+		configs = append(configs, model.Config{
+			ConfigMeta: model.ConfigMeta{
+				Type:      model.DestinationRule.Type,
+				Name:      rule.Name,
+				Namespace: "default",
+			},
+			Spec: rule,
+		})
+	}
+	return buildTestEnvWithConfigs(t, services, configs...)
+}
+
+// buildTestEnvWithConfigs returns an environment with the given services and configs.
+func buildTestEnvWithConfigs(t *testing.T, services []*model.Service, configs ...model.Config) model.Environment {
+	serviceMap := make(map[string]*model.Service)
+	for _, service := range services {
+		serviceMap[service.Hostname] = service
+	}
+	discovery := mock.NewDiscovery(serviceMap, 2)
+
+	store := memory.Make(model.IstioConfigTypes)
+	for _, config := range configs {
+		if _, err := store.Create(config); err != nil {
+			t.Fatalf("failed to create %s %s: %v", config.Type, config.Name, err)
+		}
+	}
+
+	mesh := model.DefaultMeshConfig()
+	return model.Environment{
+		ServiceDiscovery: discovery,
+		ServiceAccounts:  discovery,
+		IstioConfigStore: model.MakeIstioStore(store),
+		Mesh:             &mesh,
+	}
+}
+
+// findCluster returns the cluster with the given name, or nil if there is none.
+func findCluster(clusters []*v2.Cluster, name string) *v2.Cluster {
+	for _, cluster := range clusters {
+		if cluster.Name == name {
+			return cluster
+		}
+	}
+	return nil
+}
+
+func clusterNames(clusters []*v2.Cluster) []string {
+	names := make([]string, 0, len(clusters))
+	for _, cluster := range clusters {
+		names = append(names, cluster.Name)
+	}
+	return names
+}
+
+func simpleLb(lb networking.LoadBalancerSettings_SimpleLB) *networking.LoadBalancerSettings {
+	return &networking.LoadBalancerSettings{
+		LbPolicy: &networking.LoadBalancerSettings_Simple{
+			Simple: lb,
+		},
+	}
+}
+
+func TestApplyLoadBalancer(t *testing.T) {
+	cases := []struct {
+		name           string
+		discoveryType  v2.Cluster_DiscoveryType
+		lb             *networking.LoadBalancerSettings
+		expectedPolicy v2.Cluster_LbPolicy
+		expectedType   v2.Cluster_DiscoveryType
+		expectedConfig interface{}
+	}{
+		{
+			name:           "nil settings",
+			discoveryType:  v2.Cluster_EDS,
+			lb:             nil,
+			expectedPolicy: v2.Cluster_ROUND_ROBIN,
+			expectedType:   v2.Cluster_EDS,
+		},
+		{
+			name:           "least conn",
+			discoveryType:  v2.Cluster_EDS,
+			lb:             simpleLb(networking.LoadBalancerSettings_LEAST_CONN),
+			expectedPolicy: v2.Cluster_LEAST_REQUEST,
+			expectedType:   v2.Cluster_EDS,
+		},
+		{
+			name:           "passthrough",
+			discoveryType:  v2.Cluster_EDS,
+			lb:             simpleLb(networking.LoadBalancerSettings_PASSTHROUGH),
+			expectedPolicy: v2.Cluster_ORIGINAL_DST_LB,
+			expectedType:   v2.Cluster_ORIGINAL_DST,
+		},
+		{
+			name:           "ring hash on eds cluster",
+			discoveryType:  v2.Cluster_EDS,
+			lb:             simpleLb(networking.LoadBalancerSettings_RING_HASH),
+			expectedPolicy: v2.Cluster_RING_HASH,
+			expectedType:   v2.Cluster_EDS,
+			expectedConfig: &v2.Cluster_RingHashLbConfig_{
+				RingHashLbConfig: &v2.Cluster_RingHashLbConfig{
+					MinimumRingSize: &types.UInt64Value{Value: defaultMinimumRingSize},
+				},
+			},
+		},
+		{
+			name:           "maglev",
+			discoveryType:  v2.Cluster_EDS,
+			lb:             simpleLb(networking.LoadBalancerSettings_MAGLEV),
+			expectedPolicy: v2.Cluster_MAGLEV,
+			expectedType:   v2.Cluster_EDS,
+		},
+		{
+			name:           "least conn on dns cluster",
+			discoveryType:  v2.Cluster_STRICT_DNS,
+			lb:             simpleLb(networking.LoadBalancerSettings_LEAST_CONN),
+			expectedPolicy: v2.Cluster_LEAST_REQUEST,
+			expectedType:   v2.Cluster_STRICT_DNS,
+		},
+		{
+			name:           "random on dns cluster",
+			discoveryType:  v2.Cluster_STRICT_DNS,
+			lb:             simpleLb(networking.LoadBalancerSettings_RANDOM),
+			expectedPolicy: v2.Cluster_RANDOM,
+			expectedType:   v2.Cluster_STRICT_DNS,
+		},
+		{
+			name:           "least conn on logical dns cluster",
+			discoveryType:  v2.Cluster_LOGICAL_DNS,
+			lb:             simpleLb(networking.LoadBalancerSettings_LEAST_CONN),
+			expectedPolicy: v2.Cluster_LEAST_REQUEST,
+			expectedType:   v2.Cluster_LOGICAL_DNS,
+		},
+		{
+			name:           "ring hash on dns cluster",
+			discoveryType:  v2.Cluster_STRICT_DNS,
+			lb:             simpleLb(networking.LoadBalancerSettings_RING_HASH),
+			expectedPolicy: v2.Cluster_RING_HASH,
+			expectedType:   v2.Cluster_STRICT_DNS,
+			expectedConfig: &v2.Cluster_RingHashLbConfig_{
+				RingHashLbConfig: &v2.Cluster_RingHashLbConfig{
+					MinimumRingSize: &types.UInt64Value{Value: defaultMinimumRingSize},
+				},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		cluster := &v2.Cluster{Type: c.discoveryType}
+		applyLoadBalancer(cluster, c.lb)
+
+		if cluster.LbPolicy != c.expectedPolicy {
+			t.Errorf("%s: got lb policy %v, want %v", c.name, cluster.LbPolicy, c.expectedPolicy)
+		}
+		if cluster.Type != c.expectedType {
+			t.Errorf("%s: got discovery type %v, want %v", c.name, cluster.Type, c.expectedType)
+		}
+		if c.expectedConfig == nil {
+			if cluster.LbConfig != nil {
+				t.Errorf("%s: got lb config %v, want nil", c.name, cluster.LbConfig)
+			}
+		} else if !reflect.DeepEqual(cluster.LbConfig, c.expectedConfig) {
+			t.Errorf("%s: got lb config %v, want %v", c.name, cluster.LbConfig, c.expectedConfig)
+		}
+	}
+}
+
+func TestApplyLoadBalancerMaglevKeepsOtherSettings(t *testing.T) {
+	circuitBreakers := &v2_cluster.CircuitBreakers{
+		Thresholds: []*v2_cluster.CircuitBreakers_Thresholds{
+			{MaxConnections: &types.UInt32Value{Value: 10}},
+		},
+	}
+	outlierDetection := &v2_cluster.OutlierDetection{
+		Consecutive_5Xx: &types.UInt32Value{Value: 5},
+	}
+	cluster := &v2.Cluster{
+		Type:             v2.Cluster_STRICT_DNS,
+		CircuitBreakers:  circuitBreakers,
+		OutlierDetection: outlierDetection,
+	}
+
+	applyLoadBalancer(cluster, simpleLb(networking.LoadBalancerSettings_MAGLEV))
+
+	if cluster.LbPolicy != v2.Cluster_MAGLEV {
+		t.Errorf("got lb policy %v, want %v", cluster.LbPolicy, v2.Cluster_MAGLEV)
+	}
+	if cluster.Type != v2.Cluster_STRICT_DNS {
+		t.Errorf("got discovery type %v, want %v", cluster.Type, v2.Cluster_STRICT_DNS)
+	}
+	if cluster.LbConfig != nil {
+		t.Errorf("got lb config %v, want nil", cluster.LbConfig)
+	}
+	if cluster.CircuitBreakers != circuitBreakers {
+		t.Errorf("circuit breakers modified: %v", cluster.CircuitBreakers)
+	}
+	if cluster.OutlierDetection != outlierDetection {
+		t.Errorf("outlier detection modified: %v", cluster.OutlierDetection)
+	}
+}
+
+func TestApplyConsistentHash(t *testing.T) {
+	cases := []struct {
+		name             string
+		discoveryType    v2.Cluster_DiscoveryType
+		lbPolicy         v2.Cluster_LbPolicy
+		consistentHash   *networking.LoadBalancerSettings_ConsistentHashLB
+		expectedPolicy   v2.Cluster_LbPolicy
+		expectedRingSize uint64
+	}{
+		{
+			name:          "header hash switches round robin to ring hash",
+			discoveryType: v2.Cluster_EDS,
+			lbPolicy:      v2.Cluster_ROUND_ROBIN,
+			consistentHash: &networking.LoadBalancerSettings_ConsistentHashLB{
+				HashKey: &networking.LoadBalancerSettings_ConsistentHashLB_HttpHeaderName{
+					HttpHeaderName: "x-user",
+				},
+			},
+			expectedPolicy:   v2.Cluster_RING_HASH,
+			expectedRingSize: defaultMinimumRingSize,
+		},
+		{
+			name:          "explicit ring size",
+			discoveryType: v2.Cluster_EDS,
+			lbPolicy:      v2.Cluster_RING_HASH,
+			consistentHash: &networking.LoadBalancerSettings_ConsistentHashLB{
+				HashKey: &networking.LoadBalancerSettings_ConsistentHashLB_UseSourceIp{
+					UseSourceIp: true,
+				},
+				MinimumRingSize: 4096,
+			},
+			expectedPolicy:   v2.Cluster_RING_HASH,
+			expectedRingSize: 4096,
+		},
+		{
+			name:          "maglev is kept",
+			discoveryType: v2.Cluster_EDS,
+			lbPolicy:      v2.Cluster_MAGLEV,
+			consistentHash: &networking.LoadBalancerSettings_ConsistentHashLB{
+				HashKey: &networking.LoadBalancerSettings_ConsistentHashLB_HttpHeaderName{
+					HttpHeaderName: "x-user",
+				},
+			},
+			expectedPolicy: v2.Cluster_MAGLEV,
+		},
+		{
+			name:          "original dst is not hashed",
+			discoveryType: v2.Cluster_ORIGINAL_DST,
+			lbPolicy:      v2.Cluster_ORIGINAL_DST_LB,
+			consistentHash: &networking.LoadBalancerSettings_ConsistentHashLB{
+				HashKey: &networking.LoadBalancerSettings_ConsistentHashLB_HttpHeaderName{
+					HttpHeaderName: "x-user",
+				},
+			},
+			expectedPolicy: v2.Cluster_ORIGINAL_DST_LB,
+		},
+	}
+
+	for _, c := range cases {
+		cluster := &v2.Cluster{Type: c.discoveryType, LbPolicy: c.lbPolicy}
+		applyLoadBalancer(cluster, &networking.LoadBalancerSettings{
+			LbPolicy: &networking.LoadBalancerSettings_ConsistentHash{
+				ConsistentHash: c.consistentHash,
+			},
+		})
+
+		if cluster.LbPolicy != c.expectedPolicy {
+			t.Errorf("%s: got lb policy %v, want %v", c.name, cluster.LbPolicy, c.expectedPolicy)
+		}
+		if cluster.Type != c.discoveryType {
+			t.Errorf("%s: got discovery type %v, want %v", c.name, cluster.Type, c.discoveryType)
+		}
+		if c.expectedRingSize == 0 {
+			if cluster.LbConfig != nil {
+				t.Errorf("%s: got lb config %v, want nil", c.name, cluster.LbConfig)
+			}
+			continue
+		}
+		ringHash := cluster.GetRingHashLbConfig()
+		if ringHash == nil || ringHash.MinimumRingSize.GetValue() != c.expectedRingSize {
+			t.Errorf("%s: got ring hash config %v, want minimum ring size %d", c.name, ringHash, c.expectedRingSize)
+		}
+	}
+}
+
+func TestApplyConnectionPoolTCP(t *testing.T) {
+	tcpPort := &model.Port{Name: "mysql", Port: 3306, Protocol: model.ProtocolTCP}
+	cases := []struct {
+		name     string
+		settings *networking.ConnectionPoolSettings
+		expected *v2_cluster.CircuitBreakers_Thresholds
+	}{
+		{
+			name: "tcp only",
+			settings: &networking.ConnectionPoolSettings{
+				Tcp: &networking.ConnectionPoolSettings_TCPSettings{
+					MaxConnections: 100,
+				},
+			},
+			expected: &v2_cluster.CircuitBreakers_Thresholds{
+				MaxConnections: &types.UInt32Value{Value: 100},
+			},
+		},
+		{
+			// the TCP proxy counts the connections waiting for an upstream connection as pending requests
+			name: "pending connections of the tcp proxy",
+			settings: &networking.ConnectionPoolSettings{
+				Http: &networking.ConnectionPoolSettings_HTTPSettings{
+					Http1MaxPendingRequests: 20,
+				},
+				Tcp: &networking.ConnectionPoolSettings_TCPSettings{
+					MaxConnections: 100,
+				},
+			},
+			expected: &v2_cluster.CircuitBreakers_Thresholds{
+				MaxConnections:     &types.UInt32Value{Value: 100},
+				MaxPendingRequests: &types.UInt32Value{Value: 20},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		cluster := &v2.Cluster{}
+		applyConnectionPool(cluster, c.settings, clusterContext{hostname: "mysql.default.svc.cluster.local", port: tcpPort})
+		if got := cluster.CircuitBreakers.Thresholds[0]; !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.expected)
+		}
+	}
+}
+
+func TestApplyTCPIdleTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { tcpIdleTimeout = timeout }(tcpIdleTimeout)
+
+	hostname := "mongo.default.svc.cluster.local"
+	mongoPort := &model.Port{Name: "mongo", Port: 27017, Protocol: model.ProtocolMongo}
+	httpPort := &model.Port{Name: "http", Port: 80, Protocol: model.ProtocolHTTP}
+	cases := []struct {
+		name     string
+		timeout  time.Duration
+		port     *model.Port
+		expected string
+	}{
+		{name: "unset", port: mongoPort},
+		{name: "tcp port", timeout: 5 * time.Minute, port: mongoPort, expected: "5m0s"},
+		{name: "http port", timeout: 5 * time.Minute, port: httpPort},
+	}
+
+	for _, c := range cases {
+		tcpIdleTimeout = c.timeout
+		cluster := &v2.Cluster{
+			Name:     model.BuildSubsetKey(model.TrafficDirectionOutbound, "", hostname, c.port),
+			Metadata: buildClusterMetadata(hostname, "", c.port, nil),
+		}
+		applyTCPIdleTimeout(cluster, hostname, c.port)
+		fields := cluster.Metadata.FilterMetadata[clusterMetadataNamespace].Fields
+		if got := fields[clusterMetadataTCPIdleTimeout].GetStringValue(); got != c.expected {
+			t.Errorf("%s: got tcp idle timeout %q, want %q", c.name, got, c.expected)
+		}
+		// the timeout is added to the metadata identifying the cluster
+		if fields["hostname"].GetStringValue() != hostname {
+			t.Errorf("%s: got metadata %v, want the hostname to be kept", c.name, fields)
+		}
+	}
+
+	// the metadata is created if the cluster has none
+	tcpIdleTimeout = time.Minute
+	cluster := &v2.Cluster{Name: "cluster"}
+	applyTCPIdleTimeout(cluster, hostname, mongoPort)
+	if got := cluster.GetMetadata().GetFilterMetadata()[clusterMetadataNamespace].GetFields()[clusterMetadataTCPIdleTimeout].GetStringValue(); got != "1m0s" {
+		t.Errorf("got tcp idle timeout %q, want %q", got, "1m0s")
+	}
+
+	// the default and subset clusters of TCP ports carry the timeout
+	service := mock.MakeService("redis.default.svc.cluster.local", "10.1.0.0")
+	redisPort, _ := service.Ports.Get("redis")
+	env := buildTestEnv(t, []*model.Service{service}, &networking.DestinationRule{
+		Name:    service.Hostname,
+		Subsets: []*networking.Subset{{Name: "v1", Labels: map[string]string{"version": "v1"}}},
+	})
+	clusters := BuildClusters(env, mock.Router)
+	for _, subset := range []string{"", "v1"} {
+		name := model.BuildSubsetKey(model.TrafficDirectionOutbound, subset, service.Hostname, redisPort)
+		cluster := findCluster(clusters, name)
+		if cluster == nil {
+			t.Errorf("cluster %s not found", name)
+			continue
+		}
+		if got := cluster.GetMetadata().GetFilterMetadata()[clusterMetadataNamespace].GetFields()[clusterMetadataTCPIdleTimeout].GetStringValue(); got != "1m0s" {
+			t.Errorf("cluster %s: got tcp idle timeout %q, want %q", name, got, "1m0s")
+		}
+	}
+}
+
+func TestApplyConnectionPoolWithoutLimits(t *testing.T) {
+	cases := []struct {
+		name     string
+		settings *networking.ConnectionPoolSettings
+	}{
+		{name: "empty", settings: &networking.ConnectionPoolSettings{}},
+		{
+			name: "empty http and tcp settings",
+			settings: &networking.ConnectionPoolSettings{
+				Http: &networking.ConnectionPoolSettings_HTTPSettings{},
+				Tcp:  &networking.ConnectionPoolSettings_TCPSettings{},
+			},
+		},
+		{
+			name: "connection settings only",
+			settings: &networking.ConnectionPoolSettings{
+				Http: &networking.ConnectionPoolSettings_HTTPSettings{MaxRequestsPerConnection: 10},
+				Tcp:  &networking.ConnectionPoolSettings_TCPSettings{ConnectTimeout: &types.Duration{Seconds: 2}},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		cluster := &v2.Cluster{}
+		applyConnectionPool(cluster, c.settings, clusterContext{})
+		if cluster.CircuitBreakers != nil {
+			t.Errorf("%s: got circuit breakers %v, want none", c.name, cluster.CircuitBreakers)
+		}
+	}
+
+	// the limits of a previously applied policy are kept
+	cluster := &v2.Cluster{}
+	applyConnectionPool(cluster, &networking.ConnectionPoolSettings{
+		Tcp: &networking.ConnectionPoolSettings_TCPSettings{MaxConnections: 10},
+	}, clusterContext{})
+	applyConnectionPool(cluster, &networking.ConnectionPoolSettings{}, clusterContext{})
+	if got := cluster.CircuitBreakers.GetThresholds()[0].GetMaxConnections().GetValue(); got != 10 {
+		t.Errorf("got max connections %d, want 10", got)
+	}
+}
+
+func TestApplyConnectionPoolPriorities(t *testing.T) {
+	defer func(factor uint32) { highPriorityThresholdFactor = factor }(highPriorityThresholdFactor)
+
+	settings := &networking.ConnectionPoolSettings{
+		Http: &networking.ConnectionPoolSettings_HTTPSettings{Http2MaxRequests: 100},
+		Tcp:  &networking.ConnectionPoolSettings_TCPSettings{MaxConnections: 10},
+	}
+	defaultThreshold := &v2_cluster.CircuitBreakers_Thresholds{
+		MaxConnections: &types.UInt32Value{Value: 10},
+		MaxRequests:    &types.UInt32Value{Value: 100},
+	}
+
+	cases := []struct {
+		name     string
+		factor   uint32
+		expected []*v2_cluster.CircuitBreakers_Thresholds
+	}{
+		{
+			name:     "default priority only",
+			expected: []*v2_cluster.CircuitBreakers_Thresholds{defaultThreshold},
+		},
+		{
+			name:   "default and high priorities",
+			factor: 2,
+			expected: []*v2_cluster.CircuitBreakers_Thresholds{
+				defaultThreshold,
+				{
+					Priority:       core.RoutingPriority_HIGH,
+					MaxConnections: &types.UInt32Value{Value: 20},
+					MaxRequests:    &types.UInt32Value{Value: 200},
+				},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		highPriorityThresholdFactor = c.factor
+		cluster := &v2.Cluster{}
+		applyConnectionPool(cluster, settings, clusterContext{})
+		// applying a policy again, as for subsets, merges into the default priority thresholds
+		applyConnectionPool(cluster, &networking.ConnectionPoolSettings{
+			Tcp: &networking.ConnectionPoolSettings_TCPSettings{MaxConnections: 10},
+		}, clusterContext{})
+		if !reflect.DeepEqual(cluster.CircuitBreakers.Thresholds, c.expected) {
+			t.Errorf("%s: got %v, want %v", c.name, cluster.CircuitBreakers.Thresholds, c.expected)
+		}
+	}
+}
+
+func TestApplyTCPKeepalive(t *testing.T) {
+	cases := []struct {
+		name      string
+		keepalive *networking.ConnectionPoolSettings_TCPSettings_TcpKeepalive
+		expected  *v2.UpstreamConnectionOptions
+	}{
+		{
+			name:      "no keepalive",
+			keepalive: nil,
+			expected:  nil,
+		},
+		{
+			name: "all fields",
+			keepalive: &networking.ConnectionPoolSettings_TCPSettings_TcpKeepalive{
+				Probes:   3,
+				Time:     &types.Duration{Seconds: 600},
+				Interval: &types.Duration{Seconds: 75},
+			},
+			expected: &v2.UpstreamConnectionOptions{
+				TcpKeepalive: &core.TcpKeepalive{
+					KeepaliveProbes:   &types.UInt32Value{Value: 3},
+					KeepaliveTime:     &types.UInt32Value{Value: 600},
+					KeepaliveInterval: &types.UInt32Value{Value: 75},
+				},
+			},
+		},
+		{
+			name: "time only",
+			keepalive: &networking.ConnectionPoolSettings_TCPSettings_TcpKeepalive{
+				Time: &types.Duration{Seconds: 300},
+			},
+			expected: &v2.UpstreamConnectionOptions{
+				TcpKeepalive: &core.TcpKeepalive{
+					KeepaliveTime: &types.UInt32Value{Value: 300},
+				},
+			},
+		},
+		{
+			name:      "empty keepalive uses os defaults",
+			keepalive: &networking.ConnectionPoolSettings_TCPSettings_TcpKeepalive{},
+			expected: &v2.UpstreamConnectionOptions{
+				TcpKeepalive: &core.TcpKeepalive{},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		cluster := &v2.Cluster{}
+		applyConnectionPool(cluster, &networking.ConnectionPoolSettings{
+			Tcp: &networking.ConnectionPoolSettings_TCPSettings{
+				TcpKeepalive: c.keepalive,
+			},
+		}, clusterContext{})
+		if !reflect.DeepEqual(cluster.UpstreamConnectionOptions, c.expected) {
+			t.Errorf("%s: got %v, want %v", c.name, cluster.UpstreamConnectionOptions, c.expected)
+		}
+	}
+}
+
+func TestApplyOutlierDetection(t *testing.T) {
+	cases := []struct {
+		name     string
+		outlier  *networking.OutlierDetection
+		expected *v2_cluster.OutlierDetection
+	}{
+		{
+			name:     "no outlier detection",
+			outlier:  nil,
+			expected: nil,
+		},
+		{
+			name: "consecutive errors only",
+			outlier: &networking.OutlierDetection{
+				Http: &networking.OutlierDetection_HTTPSettings{
+					ConsecutiveErrors: 5,
+				},
+			},
+			expected: &v2_cluster.OutlierDetection{
+				Consecutive_5Xx:    &types.UInt32Value{Value: 5},
+				MaxEjectionPercent: &types.UInt32Value{Value: defaultMaxEjectionPercent},
+			},
+		},
+		{
+			// the most aggressive ejection is kept as is rather than raised to a minimum
+			name: "single consecutive error",
+			outlier: &networking.OutlierDetection{
+				Http: &networking.OutlierDetection_HTTPSettings{
+					ConsecutiveErrors: 1,
+				},
+			},
+			expected: &v2_cluster.OutlierDetection{
+				Consecutive_5Xx:    &types.UInt32Value{Value: 1},
+				MaxEjectionPercent: &types.UInt32Value{Value: defaultMaxEjectionPercent},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		cluster := &v2.Cluster{}
+		applyOutlierDetection(cluster, c.outlier)
+		if !reflect.DeepEqual(cluster.OutlierDetection, c.expected) {
+			t.Errorf("%s: got %v, want %v", c.name, cluster.OutlierDetection, c.expected)
+		}
+	}
+}
+
+func TestApplyOutlierDetectionConsecutiveGatewayErrors(t *testing.T) {
+	defer func(errors uint32) { outlierConsecutiveGatewayErrors = errors }(outlierConsecutiveGatewayErrors)
+
+	cases := []struct {
+		name              string
+		consecutiveErrors int32
+		gatewayErrors     uint32
+		expected          *v2_cluster.OutlierDetection
+	}{
+		{
+			name:              "consecutive errors only",
+			consecutiveErrors: 5,
+			expected: &v2_cluster.OutlierDetection{
+				Consecutive_5Xx:    &types.UInt32Value{Value: 5},
+				MaxEjectionPercent: &types.UInt32Value{Value: defaultMaxEjectionPercent},
+			},
+		},
+		{
+			name:          "consecutive gateway errors only",
+			gatewayErrors: 3,
+			expected: &v2_cluster.OutlierDetection{
+				ConsecutiveGatewayFailure:          &types.UInt32Value{Value: 3},
+				EnforcingConsecutiveGatewayFailure: &types.UInt32Value{Value: 100},
+				MaxEjectionPercent:                 &types.UInt32Value{Value: defaultMaxEjectionPercent},
+			},
+		},
+		{
+			name:              "both",
+			consecutiveErrors: 5,
+			gatewayErrors:     3,
+			expected: &v2_cluster.OutlierDetection{
+				Consecutive_5Xx:                    &types.UInt32Value{Value: 5},
+				ConsecutiveGatewayFailure:          &types.UInt32Value{Value: 3},
+				EnforcingConsecutiveGatewayFailure: &types.UInt32Value{Value: 100},
+				MaxEjectionPercent:                 &types.UInt32Value{Value: defaultMaxEjectionPercent},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		outlierConsecutiveGatewayErrors = c.gatewayErrors
+		cluster := &v2.Cluster{}
+		applyOutlierDetection(cluster, &networking.OutlierDetection{
+			Http: &networking.OutlierDetection_HTTPSettings{ConsecutiveErrors: c.consecutiveErrors},
+		})
+		if !reflect.DeepEqual(cluster.OutlierDetection, c.expected) {
+			t.Errorf("%s: got %v, want %v", c.name, cluster.OutlierDetection, c.expected)
+		}
+	}
+
+	// clusters without outlier detection are not ejecting hosts on gateway errors
+	outlierConsecutiveGatewayErrors = 3
+	cluster := &v2.Cluster{}
+	applyOutlierDetection(cluster, nil)
+	if cluster.OutlierDetection != nil {
+		t.Errorf("got outlier detection %v without a destination rule, want none", cluster.OutlierDetection)
+	}
+}
+
+func TestApplyOutlierDetectionMaxEjectionPercent(t *testing.T) {
+	cases := []struct {
+		name     string
+		percent  int32
+		expected uint32
+	}{
+		{"unset", 0, defaultMaxEjectionPercent},
+		{"below range", -5, 0},
+		{"within range", 30, 30},
+		{"upper bound", 100, 100},
+		{"above range", 200, 100},
+	}
+
+	for _, c := range cases {
+		cluster := &v2.Cluster{}
+		applyOutlierDetection(cluster, &networking.OutlierDetection{
+			Http: &networking.OutlierDetection_HTTPSettings{ConsecutiveErrors: 5, MaxEjectionPercent: c.percent},
+		})
+		if got := cluster.OutlierDetection.MaxEjectionPercent.GetValue(); got != c.expected {
+			t.Errorf("%s: got max ejection percent %d, want %d", c.name, got, c.expected)
+		}
+	}
+}
+
+func TestApplyOutlierDetectionMinHealthPercent(t *testing.T) {
+	defer func(percent, threshold uint32, thresholdSet bool) {
+		outlierMinHealthPercent, healthyPanicThreshold, healthyPanicThresholdSet = percent, threshold, thresholdSet
+	}(outlierMinHealthPercent, healthyPanicThreshold, healthyPanicThresholdSet)
+
+	cases := []struct {
+		name                  string
+		maxEjectionPercent    int32
+		minHealthPercent      uint32
+		panicThresholdSet     bool
+		wantMaxEjection       uint32
+		wantPanicThreshold    float64
+		wantPanicThresholdSet bool
+	}{
+		{
+			name:            "defaults",
+			wantMaxEjection: defaultMaxEjectionPercent,
+		},
+		{
+			name:               "explicit max ejection",
+			maxEjectionPercent: 50,
+			wantMaxEjection:    50,
+		},
+		{
+			name:                  "floor caps max ejection",
+			maxEjectionPercent:    50,
+			minHealthPercent:      70,
+			wantMaxEjection:       30,
+			wantPanicThreshold:    70,
+			wantPanicThresholdSet: true,
+		},
+		{
+			name:                  "floor above max ejection",
+			maxEjectionPercent:    20,
+			minHealthPercent:      60,
+			wantMaxEjection:       20,
+			wantPanicThreshold:    60,
+			wantPanicThresholdSet: true,
+		},
+		{
+			name:                  "floor caps default max ejection",
+			minHealthPercent:      95,
+			wantMaxEjection:       5,
+			wantPanicThreshold:    95,
+			wantPanicThresholdSet: true,
+		},
+		{
+			name:                  "floor above range",
+			minHealthPercent:      150,
+			wantMaxEjection:       0,
+			wantPanicThreshold:    100,
+			wantPanicThresholdSet: true,
+		},
+		{
+			// the mesh wide healthy panic threshold takes precedence, the floor still caps the ejections
+			name:               "mesh wide healthy panic threshold",
+			maxEjectionPercent: 50,
+			minHealthPercent:   70,
+			panicThresholdSet:  true,
+			wantMaxEjection:    30,
+		},
+	}
+
+	for _, c := range cases {
+		outlierMinHealthPercent = c.minHealthPercent
+		healthyPanicThreshold, healthyPanicThresholdSet = 0, c.panicThresholdSet
+		cluster := &v2.Cluster{}
+		applyOutlierDetection(cluster, &networking.OutlierDetection{
+			Http: &networking.OutlierDetection_HTTPSettings{
+				ConsecutiveErrors:  5,
+				MaxEjectionPercent: c.maxEjectionPercent,
+			},
+		})
+		if got := cluster.OutlierDetection.MaxEjectionPercent.GetValue(); got != c.wantMaxEjection {
+			t.Errorf("%s: got max ejection percent %d, want %d", c.name, got, c.wantMaxEjection)
+		}
+		if !c.wantPanicThresholdSet {
+			if cluster.CommonLbConfig != nil {
+				t.Errorf("%s: unexpected common lb config %v", c.name, cluster.CommonLbConfig)
+			}
+			continue
+		}
+		if got := cluster.CommonLbConfig.GetHealthyPanicThreshold().GetValue(); got != c.wantPanicThreshold {
+			t.Errorf("%s: got healthy panic threshold %v, want %v", c.name, got, c.wantPanicThreshold)
+		}
+	}
+
+	// the mesh wide healthy panic threshold of an EDS cluster is kept
+	outlierMinHealthPercent = 70
+	healthyPanicThreshold, healthyPanicThresholdSet = 25, true
+	cluster := &v2.Cluster{Type: v2.Cluster_EDS}
+	applyHealthyPanicThreshold(cluster)
+	applyOutlierDetection(cluster, &networking.OutlierDetection{
+		Http: &networking.OutlierDetection_HTTPSettings{ConsecutiveErrors: 5},
+	})
+	if got := cluster.CommonLbConfig.GetHealthyPanicThreshold().GetValue(); got != 25 {
+		t.Errorf("got healthy panic threshold %v, want the mesh wide threshold 25", got)
+	}
+}
+
+func TestBuildClustersConnectTimeout(t *testing.T) {
+	service := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	rule := &networking.DestinationRule{
+		Name: service.Hostname,
+		TrafficPolicy: &networking.TrafficPolicy{
+			ConnectionPool: &networking.ConnectionPoolSettings{
+				Tcp: &networking.ConnectionPoolSettings_TCPSettings{
+					ConnectTimeout: &types.Duration{Nanos: int32(500 * time.Millisecond)},
+				},
+			},
+		},
+		Subsets: []*networking.Subset{
+			{Name: "v1", Labels: map[string]string{"version": "v1"}},
+		},
+	}
+
+	cases := []struct {
+		name     string
+		rules    []*networking.DestinationRule
+		subsets  []string
+		mesh     time.Duration
+		expected time.Duration
+	}{
+		{
+			name:     "mesh default",
+			subsets:  []string{""},
+			mesh:     time.Second,
+			expected: time.Second,
+		},
+		{
+			name:     "custom mesh default",
+			subsets:  []string{""},
+			mesh:     3 * time.Second,
+			expected: 3 * time.Second,
+		},
+		{
+			name:     "missing mesh default",
+			subsets:  []string{""},
+			mesh:     0,
+			expected: time.Second,
+		},
+		{
+			name:     "explicit sub-second timeout",
+			rules:    []*networking.DestinationRule{rule},
+			subsets:  []string{"", "v1"},
+			mesh:     0,
+			expected: 500 * time.Millisecond,
+		},
+	}
+
+	for _, c := range cases {
+		env := buildTestEnv(t, []*model.Service{service}, c.rules...)
+		env.Mesh.ConnectTimeout = ptypes.DurationProto(c.mesh)
+		clusters := BuildClusters(env, mock.Router)
+
+		for _, subset := range c.subsets {
+			name := model.BuildSubsetKey(model.TrafficDirectionOutbound, subset, service.Hostname, service.Ports[0])
+			cluster := findCluster(clusters, name)
+			if cluster == nil {
+				t.Fatalf("%s: cluster %s not found", c.name, name)
+			}
+			if cluster.ConnectTimeout != c.expected {
+				t.Errorf("%s: cluster %s got connect timeout %v, want %v", c.name, name, cluster.ConnectTimeout, c.expected)
+			}
+		}
+	}
+}
+
+func TestApplyUpstreamTLSSettingsIstioMutual(t *testing.T) {
+	cluster := &v2.Cluster{}
+	applyUpstreamTLSSettings(cluster, &networking.TLSSettings{
+		Mode:            networking.TLSSettings_ISTIO_MUTUAL,
+		SubjectAltNames: []string{"spiffe://cluster.local/ns/default/sa/hello"},
+	}, clusterContext{hostname: "hello.default.svc.cluster.local"})
+
+	expected := &auth.UpstreamTlsContext{
+		CommonTlsContext: &auth.CommonTlsContext{
+			TlsCertificates: []*auth.TlsCertificate{
+				{
+					CertificateChain: &core.DataSource{
+						Specifier: &core.DataSource_Filename{Filename: "/etc/certs/cert-chain.pem"},
+					},
+					PrivateKey: &core.DataSource{
+						Specifier: &core.DataSource_Filename{Filename: "/etc/certs/key.pem"},
+					},
+				},
+			},
+			ValidationContext: &auth.CertificateValidationContext{
+				TrustedCa: &core.DataSource{
+					Specifier: &core.DataSource_Filename{Filename: "/etc/certs/root-cert.pem"},
+				},
+				VerifySubjectAltName: []string{"spiffe://cluster.local/ns/default/sa/hello"},
+			},
+			AlpnProtocols: util.ALPNInMesh,
+			TlsParams: &auth.TlsParameters{
+				TlsMinimumProtocolVersion: auth.TlsParameters_TLSv1_2,
+			},
+		},
+		Sni: "hello.default.svc.cluster.local",
+	}
+	if !reflect.DeepEqual(cluster.TlsContext, expected) {
+		t.Errorf("got tls context\n%v\nwant\n%v", cluster.TlsContext, expected)
+	}
+}
+
+func TestApplyUpstreamTLSSettingsTLSParams(t *testing.T) {
+	defer func(min, max auth.TlsParameters_TlsProtocol) {
+		upstreamTLSMinimumProtocolVersion = min
+		upstreamTLSMaximumProtocolVersion = max
+	}(upstreamTLSMinimumProtocolVersion, upstreamTLSMaximumProtocolVersion)
+
+	cases := []struct {
+		name     string
+		min      auth.TlsParameters_TlsProtocol
+		max      auth.TlsParameters_TlsProtocol
+		mode     networking.TLSSettings_TLSmode
+		expected *auth.TlsParameters
+	}{
+		{
+			name: "simple with defaults",
+			min:  auth.TlsParameters_TLSv1_2,
+			max:  auth.TlsParameters_TLS_AUTO,
+			mode: networking.TLSSettings_SIMPLE,
+			expected: &auth.TlsParameters{
+				TlsMinimumProtocolVersion: auth.TlsParameters_TLSv1_2,
+				TlsMaximumProtocolVersion: auth.TlsParameters_TLS_AUTO,
+			},
+		},
+		{
+			name: "mutual pinned to tls 1.2",
+			min:  auth.TlsParameters_TLSv1_2,
+			max:  auth.TlsParameters_TLSv1_2,
+			mode: networking.TLSSettings_MUTUAL,
+			expected: &auth.TlsParameters{
+				TlsMinimumProtocolVersion: auth.TlsParameters_TLSv1_2,
+				TlsMaximumProtocolVersion: auth.TlsParameters_TLSv1_2,
+			},
+		},
+		{
+			name: "mutual with tls 1.3",
+			min:  auth.TlsParameters_TLSv1_3,
+			max:  auth.TlsParameters_TLSv1_3,
+			mode: networking.TLSSettings_MUTUAL,
+			expected: &auth.TlsParameters{
+				TlsMinimumProtocolVersion: auth.TlsParameters_TLSv1_3,
+				TlsMaximumProtocolVersion: auth.TlsParameters_TLSv1_3,
+			},
+		},
+	}
+
+	for _, c := range cases {
+		upstreamTLSMinimumProtocolVersion = c.min
+		upstreamTLSMaximumProtocolVersion = c.max
+
+		cluster := &v2.Cluster{}
+		applyUpstreamTLSSettings(cluster, &networking.TLSSettings{
+			Mode:              c.mode,
+			ClientCertificate: "/etc/certs/cert.pem",
+			PrivateKey:        "/etc/certs/key.pem",
+			CaCertificates:    "/etc/certs/ca.pem",
+		}, clusterContext{})
+		if got := cluster.TlsContext.CommonTlsContext.TlsParams; !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%s: got tls params %v, want %v", c.name, got, c.expected)
+		}
+	}
+}
+
+func TestApplyUpstreamTLSSettingsCipherSuites(t *testing.T) {
+	defer func(cipherSuites []string) {
+		upstreamTLSCipherSuites = cipherSuites
+	}(upstreamTLSCipherSuites)
+
+	cipherSuites := []string{"ECDHE-ECDSA-AES256-GCM-SHA384", "ECDHE-RSA-AES256-GCM-SHA384"}
+	tls := &networking.TLSSettings{
+		ClientCertificate: "/etc/certs/cert.pem",
+		PrivateKey:        "/etc/certs/key.pem",
+		CaCertificates:    "/etc/certs/ca.pem",
+	}
+
+	for _, suites := range [][]string{nil, cipherSuites} {
+		upstreamTLSCipherSuites = suites
+		for _, mode := range []networking.TLSSettings_TLSmode{
+			networking.TLSSettings_SIMPLE, networking.TLSSettings_MUTUAL, networking.TLSSettings_ISTIO_MUTUAL} {
+			tls.Mode = mode
+			cluster := &v2.Cluster{}
+			applyUpstreamTLSSettings(cluster, tls, clusterContext{})
+			if got := cluster.TlsContext.CommonTlsContext.TlsParams.CipherSuites; !reflect.DeepEqual(got, suites) {
+				t.Errorf("%v: got cipher suites %v, want %v", mode, got, suites)
+			}
+		}
+	}
+}
+
+func TestApplyUpstreamTLSSettingsSNI(t *testing.T) {
+	hostname := "hello.default.svc.cluster.local"
+	cases := []struct {
+		name     string
+		mode     networking.TLSSettings_TLSmode
+		sni      string
+		expected string
+	}{
+		{"simple", networking.TLSSettings_SIMPLE, "", ""},
+		{"mutual derived", networking.TLSSettings_MUTUAL, "", hostname},
+		{"mutual explicit", networking.TLSSettings_MUTUAL, "backend.example.com", "backend.example.com"},
+		{"istio mutual derived", networking.TLSSettings_ISTIO_MUTUAL, "", hostname},
+		{"istio mutual explicit", networking.TLSSettings_ISTIO_MUTUAL, "backend.example.com", "backend.example.com"},
+	}
+
+	for _, c := range cases {
+		cluster := &v2.Cluster{}
+		applyUpstreamTLSSettings(cluster, &networking.TLSSettings{
+			Mode:              c.mode,
+			ClientCertificate: "/etc/certs/cert.pem",
+			PrivateKey:        "/etc/certs/key.pem",
+			CaCertificates:    "/etc/certs/ca.pem",
+			Sni:               c.sni,
+		}, clusterContext{hostname: hostname})
+		if cluster.TlsContext.Sni != c.expected {
+			t.Errorf("%s: got sni %q, want %q", c.name, cluster.TlsContext.Sni, c.expected)
+		}
+	}
+}
+
+func TestApplyUpstreamTLSSettingsUnusedContext(t *testing.T) {
+	port := &model.Port{Name: "http", Port: 80, Protocol: model.ProtocolHTTP}
+	for _, mode := range []networking.TLSSettings_TLSmode{networking.TLSSettings_DISABLE, networking.TLSSettings_SIMPLE} {
+		tls := &networking.TLSSettings{
+			Mode:           mode,
+			CaCertificates: "/etc/certs/ca.pem",
+			Sni:            "backend.example.com",
+		}
+		withoutContext := &v2.Cluster{}
+		applyUpstreamTLSSettings(withoutContext, tls, clusterContext{})
+		withContext := &v2.Cluster{}
+		applyUpstreamTLSSettings(withContext, tls,
+			clusterContext{hostname: "hello.default.svc.cluster.local", subset: "v1", port: port})
+		if !reflect.DeepEqual(withContext.TlsContext, withoutContext.TlsContext) {
+			t.Errorf("%v: got tls context %v with the service context, want %v", mode,
+				withContext.TlsContext, withoutContext.TlsContext)
+		}
+	}
+}
+
+func TestBuildClustersServiceContext(t *testing.T) {
+	service := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	env := buildTestEnv(t, []*model.Service{service}, &networking.DestinationRule{
+		Name: service.Hostname,
+		TrafficPolicy: &networking.TrafficPolicy{
+			Tls: &networking.TLSSettings{Mode: networking.TLSSettings_ISTIO_MUTUAL},
+		},
+		Subsets: []*networking.Subset{
+			{
+				Name:   "v1",
+				Labels: map[string]string{"version": "v1"},
+			},
+		},
+	})
+
+	clusters := BuildClusters(env, mock.Router)
+	for _, port := range service.Ports {
+		for subset, sni := range map[string]string{"": service.Hostname, "v1": "v1." + service.Hostname} {
+			name := model.BuildSubsetKey(model.TrafficDirectionOutbound, subset, service.Hostname, port)
+			cluster := findCluster(clusters, name)
+			if cluster == nil {
+				t.Fatalf("cluster %s not found", name)
+			}
+			if cluster.TlsContext == nil || cluster.TlsContext.Sni != sni {
+				t.Errorf("%s: got tls context %v, want sni %q", name, cluster.TlsContext, sni)
+			}
+		}
+	}
+}
+
+func TestApplyUpstreamTLSSettingsALPN(t *testing.T) {
+	cases := []struct {
+		name     string
+		mode     networking.TLSSettings_TLSmode
+		protocol model.Protocol
+		expected []string
+	}{
+		{"simple grpc", networking.TLSSettings_SIMPLE, model.ProtocolGRPC, []string{"h2"}},
+		{"simple http2", networking.TLSSettings_SIMPLE, model.ProtocolHTTP2, []string{"h2"}},
+		{"simple http", networking.TLSSettings_SIMPLE, model.ProtocolHTTP, []string{"http/1.1"}},
+		{"simple tcp", networking.TLSSettings_SIMPLE, model.ProtocolTCP, nil},
+		{"mutual grpc", networking.TLSSettings_MUTUAL, model.ProtocolGRPC, []string{"h2"}},
+		{"mutual http", networking.TLSSettings_MUTUAL, model.ProtocolHTTP, []string{"http/1.1"}},
+		{"istio mutual grpc", networking.TLSSettings_ISTIO_MUTUAL, model.ProtocolGRPC, []string{"istio", "h2"}},
+		{"istio mutual http", networking.TLSSettings_ISTIO_MUTUAL, model.ProtocolHTTP, []string{"istio", "http/1.1"}},
+		{"istio mutual tcp", networking.TLSSettings_ISTIO_MUTUAL, model.ProtocolTCP, util.ALPNInMesh},
+	}
+
+	for _, c := range cases {
+		cluster := &v2.Cluster{}
+		port := &model.Port{Name: "port", Port: 443, Protocol: c.protocol}
+		setUpstreamProtocol(cluster, "", port)
+		applyUpstreamTLSSettings(cluster, &networking.TLSSettings{
+			Mode:              c.mode,
+			ClientCertificate: "/etc/certs/cert.pem",
+			PrivateKey:        "/etc/certs/key.pem",
+			CaCertificates:    "/etc/certs/ca.pem",
+		}, clusterContext{port: port})
+		if got := cluster.TlsContext.CommonTlsContext.AlpnProtocols; !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%s: got alpn %v, want %v", c.name, got, c.expected)
+		}
+	}
+	if !reflect.DeepEqual(util.ALPNInMesh, []string{"istio"}) {
+		t.Errorf("in mesh alpn modified: %v", util.ALPNInMesh)
+	}
+}
+
+func TestBuildClustersALPNResolvedProtocol(t *testing.T) {
+	defer func(overrides map[string]model.Protocol) { protocolOverrides = overrides }(protocolOverrides)
+
+	service := &model.Service{
+		Hostname: "hello.default.svc.cluster.local",
+		Address:  "10.1.0.1",
+		Ports: []*model.Port{
+			{Name: "http", Port: 80, Protocol: model.ProtocolHTTP},
+			{Name: "tcp", Port: 9000, Protocol: model.ProtocolTCP},
+		},
+	}
+	protocolOverrides = map[string]model.Protocol{protocolOverrideKey(service.Hostname, 9000): model.ProtocolHTTP2}
+	tls := &networking.TLSSettings{Mode: networking.TLSSettings_SIMPLE, CaCertificates: "/etc/certs/ca.pem"}
+	env := buildTestEnv(t, []*model.Service{service}, &networking.DestinationRule{
+		Name: service.Hostname,
+		TrafficPolicy: &networking.TrafficPolicy{
+			Tls: tls,
+			PortLevelSettings: []*networking.TrafficPolicy_PortTrafficPolicy{{
+				Port: &networking.PortSelector{Port: &networking.PortSelector_Number{Number: 80}},
+				ConnectionPool: &networking.ConnectionPoolSettings{
+					Http: &networking.ConnectionPoolSettings_HTTPSettings{
+						H2UpgradePolicy: networking.ConnectionPoolSettings_HTTPSettings_UPGRADE,
+					},
+				},
+			}},
+		},
+	})
+
+	clusters := BuildClusters(env, mock.Router)
+	// the HTTP port upgraded to HTTP/2 and the TCP port overridden to HTTP/2 both negotiate h2
+	for _, port := range service.Ports {
+		name := model.BuildSubsetKey(model.TrafficDirectionOutbound, "", service.Hostname, port)
+		cluster := findCluster(clusters, name)
+		if cluster == nil {
+			t.Fatalf("cluster %s not found", name)
+		}
+		if got := cluster.TlsContext.GetCommonTlsContext().GetAlpnProtocols(); !reflect.DeepEqual(got, []string{"h2"}) {
+			t.Errorf("%s: got alpn %v, want [h2]", name, got)
+		}
+	}
+}
+
+func TestBuildClustersGRPCALPN(t *testing.T) {
+	service := &model.Service{
+		Hostname: "grpc.default.svc.cluster.local",
+		Address:  "10.1.0.1",
+		Ports: []*model.Port{
+			{Name: "grpc", Port: 7070, Protocol: model.ProtocolGRPC},
+		},
+	}
+	env := buildTestEnv(t, []*model.Service{service}, &networking.DestinationRule{
+		Name: service.Hostname,
+		TrafficPolicy: &networking.TrafficPolicy{
+			Tls: &networking.TLSSettings{
+				Mode:           networking.TLSSettings_SIMPLE,
+				CaCertificates: "/etc/certs/ca.pem",
+			},
+		},
+	})
+
+	name := model.BuildSubsetKey(model.TrafficDirectionOutbound, "", service.Hostname, service.Ports[0])
+	cluster := findCluster(BuildClusters(env, mock.Router), name)
+	if cluster == nil {
+		t.Fatalf("cluster %s not found", name)
+	}
+	if got := cluster.TlsContext.GetCommonTlsContext().GetAlpnProtocols(); !reflect.DeepEqual(got, []string{"h2"}) {
+		t.Errorf("got alpn %v, want [h2]", got)
+	}
+}
+
+func TestBuildClustersDeterministicOrder(t *testing.T) {
+	services := []*model.Service{
+		mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0"),
+		mock.MakeService("world.default.svc.cluster.local", "10.2.0.0"),
+		mock.MakeService("abc.default.svc.cluster.local", "10.3.0.0"),
+	}
+	env := buildTestEnv(t, services)
+
+	first := BuildClusters(env, mock.Router)
+	for i := 1; i < len(first); i++ {
+		if first[i-1].Name > first[i].Name {
+			t.Errorf("clusters not sorted: %s before %s", first[i-1].Name, first[i].Name)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		if got := BuildClusters(env, mock.Router); !reflect.DeepEqual(got, first) {
+			t.Fatalf("clusters differ between builds:\n%v\n%v", got, first)
+		}
+	}
+}
+
+// countingConfigStore counts the listings of each config type.
+type countingConfigStore struct {
+	model.IstioConfigStore
+
+	mu    sync.Mutex
+	lists map[string]int
+}
+
+func (s *countingConfigStore) List(typ, namespace string) ([]model.Config, error) {
+	s.mu.Lock()
+	s.lists[typ]++
+	s.mu.Unlock()
+	return s.IstioConfigStore.List(typ, namespace)
+}
+
+func TestBuildClustersListsWildcardDestinationRulesOnce(t *testing.T) {
+	services := []*model.Service{
+		mock.MakeService("hello.prod.svc.cluster.local", "10.1.0.0"),
+		mock.MakeService("world.prod.svc.cluster.local", "10.2.0.0"),
+		mock.MakeService("hello.dev.svc.cluster.local", "10.3.0.0"),
+	}
+	wildcard := &networking.DestinationRule{
+		Name: "*.prod.svc.cluster.local",
+		TrafficPolicy: &networking.TrafficPolicy{
+			OutlierDetection: &networking.OutlierDetection{
+				Http: &networking.OutlierDetection_HTTPSettings{ConsecutiveErrors: 7},
+			},
+		},
+	}
+	env := buildTestEnv(t, services, wildcard)
+	store := &countingConfigStore{IstioConfigStore: env.IstioConfigStore, lists: make(map[string]int)}
+	env.IstioConfigStore = store
+
+	clusters := BuildClusters(env, mock.Router)
+	if got := store.lists[model.DestinationRule.Type]; got != 1 {
+		t.Errorf("destination rules listed %d times for %d services, want 1", got, len(services))
+	}
+
+	name := model.BuildSubsetKey(model.TrafficDirectionOutbound, "", services[1].Hostname, services[1].Ports[0])
+	if cluster := findCluster(clusters, name); cluster == nil || cluster.OutlierDetection == nil {
+		t.Errorf("cluster %s does not inherit the wildcard rule", name)
+	}
+}
+
+func TestBuildClustersWildcardDestinationRule(t *testing.T) {
+	hello := mock.MakeService("hello.prod.svc.cluster.local", "10.1.0.0")
+	world := mock.MakeService("world.prod.svc.cluster.local", "10.2.0.0")
+	other := mock.MakeService("hello.dev.svc.cluster.local", "10.3.0.0")
+
+	wildcardOutlier := &networking.OutlierDetection{
+		Http: &networking.OutlierDetection_HTTPSettings{ConsecutiveErrors: 7},
+	}
+	wildcard := &networking.DestinationRule{
+		Name: "*.prod.svc.cluster.local",
+		TrafficPolicy: &networking.TrafficPolicy{
+			OutlierDetection: wildcardOutlier,
+			ConnectionPool: &networking.ConnectionPoolSettings{
+				Tcp: &networking.ConnectionPoolSettings_TCPSettings{MaxConnections: 10},
+			},
+		},
+	}
+	exact := &networking.DestinationRule{
+		Name: hello.Hostname,
+		TrafficPolicy: &networking.TrafficPolicy{
+			ConnectionPool: &networking.ConnectionPoolSettings{
+				Tcp: &networking.ConnectionPoolSettings_TCPSettings{MaxConnections: 100},
+			},
+		},
+	}
+	env := buildTestEnv(t, []*model.Service{hello, world, other}, wildcard, exact)
+
+	cases := []struct {
+		service             *model.Service
+		expectedConns       uint32
+		expectedConsecutive uint32
+	}{
+		// exact rule wins on the connection pool, outlier detection is inherited
+		{service: hello, expectedConns: 100, expectedConsecutive: 7},
+		// only the wildcard rule applies
+		{service: world, expectedConns: 10, expectedConsecutive: 7},
+		// no rule applies
+		{service: other},
+	}
+
+	clusters := BuildClusters(env, mock.Router)
+	for _, c := range cases {
+		name := model.BuildSubsetKey(model.TrafficDirectionOutbound, "", c.service.Hostname, c.service.Ports[0])
+		cluster := findCluster(clusters, name)
+		if cluster == nil {
+			t.Fatalf("cluster %s not found", name)
+		}
+
+		var conns uint32
+		if cluster.CircuitBreakers != nil {
+			conns = cluster.CircuitBreakers.Thresholds[0].MaxConnections.GetValue()
+		}
+		if conns != c.expectedConns {
+			t.Errorf("%s: got max connections %d, want %d", name, conns, c.expectedConns)
+		}
+
+		var consecutive uint32
+		if cluster.OutlierDetection != nil {
+			consecutive = cluster.OutlierDetection.Consecutive_5Xx.GetValue()
+		}
+		if consecutive != c.expectedConsecutive {
+			t.Errorf("%s: got consecutive errors %d, want %d", name, consecutive, c.expectedConsecutive)
+		}
+	}
+}
+
+func TestMergeTrafficPolicy(t *testing.T) {
+	lb := simpleLb(networking.LoadBalancerSettings_RANDOM)
+	tls := &networking.TLSSettings{Mode: networking.TLSSettings_SIMPLE}
+	parent := &networking.TrafficPolicy{LoadBalancer: simpleLb(networking.LoadBalancerSettings_LEAST_CONN), Tls: tls}
+	policy := &networking.TrafficPolicy{LoadBalancer: lb}
+
+	merged := mergeTrafficPolicy(parent, policy)
+	if merged.LoadBalancer != lb {
+		t.Errorf("got load balancer %v, want %v", merged.LoadBalancer, lb)
+	}
+	if merged.Tls != tls {
+		t.Errorf("got tls %v, want %v", merged.Tls, tls)
+	}
+	if parent.LoadBalancer == lb {
+		t.Errorf("parent policy was modified")
+	}
+	if got := mergeTrafficPolicy(nil, policy); got != policy {
+		t.Errorf("got %v, want %v", got, policy)
+	}
+	if got := mergeTrafficPolicy(parent, nil); got != parent {
+		t.Errorf("got %v, want %v", got, parent)
+	}
+}
+
+func TestMergeConnectionPool(t *testing.T) {
+	parent := &networking.ConnectionPoolSettings{
+		Http: &networking.ConnectionPoolSettings_HTTPSettings{
+			Http2MaxRequests: 100,
+			MaxRetries:       5,
+			IdleTimeout:      &types.Duration{Seconds: 30},
+		},
+		Tcp: &networking.ConnectionPoolSettings_TCPSettings{
+			MaxConnections: 10,
+			ConnectTimeout: &types.Duration{Seconds: 1},
+			IdleTimeout:    &types.Duration{Seconds: 300},
+		},
+	}
+	settings := &networking.ConnectionPoolSettings{
+		Http: &networking.ConnectionPoolSettings_HTTPSettings{
+			MaxRetries:      3,
+			H2UpgradePolicy: networking.ConnectionPoolSettings_HTTPSettings_UPGRADE,
+		},
+		Tcp: &networking.ConnectionPoolSettings_TCPSettings{
+			MaxConnections: 20,
+			IdleTimeout:    &types.Duration{Seconds: 60},
+		},
+	}
+	expected := &networking.ConnectionPoolSettings{
+		Http: &networking.ConnectionPoolSettings_HTTPSettings{
+			Http2MaxRequests: 100,
+			MaxRetries:       3,
+			H2UpgradePolicy:  networking.ConnectionPoolSettings_HTTPSettings_UPGRADE,
+			IdleTimeout:      &types.Duration{Seconds: 30},
+		},
+		Tcp: &networking.ConnectionPoolSettings_TCPSettings{
+			MaxConnections: 20,
+			ConnectTimeout: &types.Duration{Seconds: 1},
+			IdleTimeout:    &types.Duration{Seconds: 60},
+		},
+	}
+
+	if got := mergeConnectionPool(parent, settings); !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %v, want %v", got, expected)
+	}
+	if parent.Tcp.MaxConnections != 10 || parent.Http.MaxRetries != 5 {
+		t.Errorf("parent settings were modified: %v", parent)
+	}
+	if got := mergeConnectionPool(nil, settings); got != settings {
+		t.Errorf("got %v, want %v", got, settings)
+	}
+}
+
+func TestBuildClustersSubsetInheritsPolicy(t *testing.T) {
+	service := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	env := buildTestEnv(t, []*model.Service{service}, &networking.DestinationRule{
+		Name: service.Hostname,
+		TrafficPolicy: &networking.TrafficPolicy{
+			LoadBalancer: simpleLb(networking.LoadBalancerSettings_LEAST_CONN),
+			ConnectionPool: &networking.ConnectionPoolSettings{
+				Tcp: &networking.ConnectionPoolSettings_TCPSettings{MaxConnections: 10},
+			},
+			OutlierDetection: &networking.OutlierDetection{
+				Http: &networking.OutlierDetection_HTTPSettings{ConsecutiveErrors: 7},
+			},
+		},
+		Subsets: []*networking.Subset{
+			{
+				Name:   "v1",
+				Labels: map[string]string{"version": "v1"},
+				TrafficPolicy: &networking.TrafficPolicy{
+					LoadBalancer: simpleLb(networking.LoadBalancerSettings_RANDOM),
+				},
+			},
+		},
+	})
+
+	name := model.BuildSubsetKey(model.TrafficDirectionOutbound, "v1", service.Hostname, service.Ports[0])
+	cluster := findCluster(BuildClusters(env, mock.Router), name)
+	if cluster == nil {
+		t.Fatalf("cluster %s not found", name)
+	}
+	if cluster.LbPolicy != v2.Cluster_RANDOM {
+		t.Errorf("got lb policy %v, want %v", cluster.LbPolicy, v2.Cluster_RANDOM)
+	}
+	if got := cluster.OutlierDetection.GetConsecutive_5Xx().GetValue(); got != 7 {
+		t.Errorf("got consecutive 5xx %d, want 7", got)
+	}
+	if cluster.CircuitBreakers == nil || len(cluster.CircuitBreakers.Thresholds) != 1 ||
+		cluster.CircuitBreakers.Thresholds[0].GetMaxConnections().GetValue() != 10 {
+		t.Errorf("got circuit breakers %v, want max connections 10", cluster.CircuitBreakers)
+	}
+}
+
+func TestBuildClustersPortLevelSettings(t *testing.T) {
+	service := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	tcp := func(maxConnections int32) *networking.ConnectionPoolSettings {
+		return &networking.ConnectionPoolSettings{
+			Tcp: &networking.ConnectionPoolSettings_TCPSettings{MaxConnections: maxConnections},
+		}
+	}
+	env := buildTestEnv(t, []*model.Service{service}, &networking.DestinationRule{
+		Name: service.Hostname,
+		TrafficPolicy: &networking.TrafficPolicy{
+			ConnectionPool: tcp(10),
+			LoadBalancer:   simpleLb(networking.LoadBalancerSettings_RANDOM),
+			PortLevelSettings: []*networking.TrafficPolicy_PortTrafficPolicy{
+				{
+					Port:           &networking.PortSelector{Port: &networking.PortSelector_Number{Number: 80}},
+					ConnectionPool: tcp(20),
+				},
+				{
+					Port:           &networking.PortSelector{Port: &networking.PortSelector_Name{Name: "http-status"}},
+					ConnectionPool: tcp(30),
+				},
+			},
+		},
+		Subsets: []*networking.Subset{{Name: "v1", Labels: map[string]string{"version": "v1"}}},
+	})
+
+	clusters := BuildClusters(env, mock.Router)
+	cases := []struct {
+		port           string
+		subset         string
+		maxConnections uint32
+	}{
+		{"http", "", 20},
+		{"http-status", "", 30},
+		{"custom", "", 10},
+		{"http", "v1", 20},
+		{"http-status", "v1", 30},
+		{"custom", "v1", 10},
+	}
+	for _, c := range cases {
+		port, _ := service.Ports.Get(c.port)
+		name := model.BuildSubsetKey(model.TrafficDirectionOutbound, c.subset, service.Hostname, port)
+		cluster := findCluster(clusters, name)
+		if cluster == nil {
+			t.Errorf("cluster %s not found", name)
+			continue
+		}
+		if got := cluster.CircuitBreakers.Thresholds[0].GetMaxConnections().GetValue(); got != c.maxConnections {
+			t.Errorf("cluster %s: got max connections %d, want %d", name, got, c.maxConnections)
+		}
+		// settings not overridden at the port level are inherited from the top level policy
+		if cluster.LbPolicy != v2.Cluster_RANDOM {
+			t.Errorf("cluster %s: got lb policy %v, want %v", name, cluster.LbPolicy, v2.Cluster_RANDOM)
+		}
+	}
+}
+
+func TestBuildClustersInbound(t *testing.T) {
+	service := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	env := buildTestEnv(t, []*model.Service{service})
+	sidecar := model.Proxy{
+		Type:      model.Sidecar,
+		IPAddress: mock.MakeIP(service, 0),
+		ID:        "v0.default",
+		Domain:    "default.svc.cluster.local",
+	}
+
+	managementClusters := make([]string, 0)
+	for _, port := range env.ManagementPorts("") {
+		managementClusters = append(managementClusters,
+			model.BuildSubsetKey(model.TrafficDirectionInbound, "", ManagementClusterHostname, port))
+	}
+	serviceClusters := make([]string, 0)
+	for _, port := range service.Ports {
+		serviceClusters = append(serviceClusters,
+			model.BuildSubsetKey(model.TrafficDirectionInbound, "", service.Hostname, port))
+	}
+
+	cases := []struct {
+		name     string
+		proxy    model.Proxy
+		expected []string
+		missing  []string
+	}{
+		{
+			name:     "sidecar",
+			proxy:    sidecar,
+			expected: append(append([]string{}, serviceClusters...), managementClusters...),
+		},
+		{
+			name:     "router",
+			proxy:    mock.Router,
+			expected: managementClusters,
+			missing:  serviceClusters,
+		},
+		{
+			name:    "ingress",
+			proxy:   mock.Ingress,
+			missing: append(append([]string{}, serviceClusters...), managementClusters...),
+		},
+	}
+
+	for _, c := range cases {
+		clusters := BuildClusters(env, c.proxy)
+		for _, name := range c.expected {
+			cluster := findCluster(clusters, name)
+			if cluster == nil {
+				t.Errorf("%s: cluster %s not found", c.name, name)
+			} else if cluster.Type != v2.Cluster_STATIC {
+				t.Errorf("%s: cluster %s got type %v, want STATIC", c.name, name, cluster.Type)
+			}
+		}
+		for _, name := range c.missing {
+			if findCluster(clusters, name) != nil {
+				t.Errorf("%s: unexpected cluster %s", c.name, name)
+			}
+		}
+	}
+}
+
+func TestBuildClustersGatewayJwksURI(t *testing.T) {
+	hello := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	world := mock.MakeService("world.default.svc.cluster.local", "10.2.0.0")
+	gateway := model.Config{
+		ConfigMeta: model.ConfigMeta{
+			Type:      model.Gateway.Type,
+			Name:      "gateway",
+			Namespace: "default",
+		},
+		Spec: &networking.Gateway{
+			Servers: []*networking.Server{
+				{
+					Port:  &networking.Port{Number: 80, Name: "http", Protocol: "HTTP"},
+					Hosts: []string{hello.Hostname},
+				},
+			},
+		},
+	}
+	policy := func(name, jwksURI string) model.Config {
+		return model.Config{
+			ConfigMeta: model.ConfigMeta{
+				Type:      model.AuthenticationPolicy.Type,
+				Name:      name,
+				Namespace: "default",
+			},
+			Spec: &authn.Policy{
+				Targets: []*authn.TargetSelector{{Name: name}},
+				Origins: []*authn.OriginAuthenticationMethod{
+					{Jwt: &authn.Jwt{Issuer: "issuer", JwksUri: jwksURI}},
+				},
+			},
+		}
+	}
+	env := buildTestEnvWithConfigs(t, []*model.Service{hello, world}, gateway,
+		policy("hello", "https://hello.example.com/keys"),
+		policy("world", "https://world.example.com/keys"))
+
+	jwksClusterName := func(uri string) string {
+		hostname, port, _, err := model.ParseJwksURI(uri)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %v", uri, err)
+		}
+		return model.JwksURIClusterName(hostname, port)
+	}
+
+	clusters := BuildClusters(env, mock.Router)
+	if name := jwksClusterName("https://hello.example.com/keys"); findCluster(clusters, name) == nil {
+		t.Errorf("cluster %s for the host exposed by the gateway not found", name)
+	}
+	if name := jwksClusterName("https://world.example.com/keys"); findCluster(clusters, name) != nil {
+		t.Errorf("unexpected cluster %s for a host not exposed by the gateway", name)
+	}
+}
+
+func TestBuildClustersDNSRefreshRate(t *testing.T) {
+	defer func(rate time.Duration) { dnsRefreshRate = rate }(dnsRefreshRate)
+	dnsRefreshRate = 30 * time.Second
+
+	dnsService := mock.MakeService("dns.default.svc.cluster.local", "10.1.0.0")
+	dnsService.Resolution = model.DNSLB
+	edsService := mock.MakeService("eds.default.svc.cluster.local", "10.2.0.0")
+	env := buildTestEnv(t, []*model.Service{dnsService, edsService},
+		&networking.DestinationRule{
+			Name:    dnsService.Hostname,
+			Subsets: []*networking.Subset{{Name: "v1", Labels: map[string]string{"version": "v1"}}},
+		})
+
+	clusters := BuildClusters(env, mock.Router)
+	for _, cluster := range clusters {
+		switch cluster.Type {
+		case v2.Cluster_STRICT_DNS:
+			if cluster.DnsRefreshRate == nil || *cluster.DnsRefreshRate != dnsRefreshRate {
+				t.Errorf("cluster %s: got dns refresh rate %v, want %v", cluster.Name, cluster.DnsRefreshRate, dnsRefreshRate)
+			}
+		default:
+			if cluster.DnsRefreshRate != nil {
+				t.Errorf("cluster %s: unexpected dns refresh rate %v", cluster.Name, *cluster.DnsRefreshRate)
+			}
+		}
+	}
+	subsetClusterName := model.BuildSubsetKey(model.TrafficDirectionOutbound, "v1", dnsService.Hostname, dnsService.Ports[0])
+	if findCluster(clusters, subsetClusterName) == nil {
+		t.Error("subset cluster for the dns service not found")
+	}
+}
+
+func TestApplyDNSSettingsLookupFamily(t *testing.T) {
+	defer func(family v2.Cluster_DnsLookupFamily) { dnsLookupFamily = family }(dnsLookupFamily)
+
+	env := buildTestEnv(t, nil)
+	cases := []struct {
+		name          string
+		family        v2.Cluster_DnsLookupFamily
+		discoveryType v2.Cluster_DiscoveryType
+		expected      v2.Cluster_DnsLookupFamily
+	}{
+		{"strict dns v4", v2.Cluster_V4_ONLY, v2.Cluster_STRICT_DNS, v2.Cluster_V4_ONLY},
+		{"strict dns v6", v2.Cluster_V6_ONLY, v2.Cluster_STRICT_DNS, v2.Cluster_V6_ONLY},
+		{"strict dns auto", v2.Cluster_AUTO, v2.Cluster_STRICT_DNS, v2.Cluster_AUTO},
+		{"logical dns v4", v2.Cluster_V4_ONLY, v2.Cluster_LOGICAL_DNS, v2.Cluster_V4_ONLY},
+		{"logical dns v6", v2.Cluster_V6_ONLY, v2.Cluster_LOGICAL_DNS, v2.Cluster_V6_ONLY},
+		{"logical dns auto", v2.Cluster_AUTO, v2.Cluster_LOGICAL_DNS, v2.Cluster_AUTO},
+		// the lookup family is left to the envoy default for non DNS clusters
+		{"eds", v2.Cluster_V4_ONLY, v2.Cluster_EDS, v2.Cluster_AUTO},
+	}
+
+	for _, c := range cases {
+		dnsLookupFamily = c.family
+		cluster := buildDefaultCluster(env, "cluster", c.discoveryType, nil)
+		if cluster.DnsLookupFamily != c.expected {
+			t.Errorf("%s: got dns lookup family %v, want %v", c.name, cluster.DnsLookupFamily, c.expected)
+		}
+	}
+}
+
+func TestApplyDNSSettingsResolvers(t *testing.T) {
+	defer func(resolvers []*core.Address) { dnsResolvers = resolvers }(dnsResolvers)
+	dnsResolvers = parseDNSResolvers([]string{"127.0.0.1", "10.0.0.10:5353", "[::1]:53", "dns.local", "10.0.0.11:0"})
+
+	expected := []string{"127.0.0.1:53", "10.0.0.10:5353", "[::1]:53"}
+	if len(dnsResolvers) != len(expected) {
+		t.Fatalf("got %d DNS resolvers, want %d", len(dnsResolvers), len(expected))
+	}
+	for i, resolver := range dnsResolvers {
+		socket := resolver.GetSocketAddress()
+		if got := net.JoinHostPort(socket.Address, strconv.Itoa(int(socket.GetPortValue()))); got != expected[i] {
+			t.Errorf("got DNS resolver %s, want %s", got, expected[i])
+		}
+	}
+
+	env := buildTestEnv(t, nil)
+	for _, discoveryType := range []v2.Cluster_DiscoveryType{v2.Cluster_STRICT_DNS, v2.Cluster_LOGICAL_DNS} {
+		cluster := buildDefaultCluster(env, "cluster", discoveryType, nil)
+		if !reflect.DeepEqual(cluster.DnsResolvers, dnsResolvers) {
+			t.Errorf("%v: got DNS resolvers %v, want %v", discoveryType, cluster.DnsResolvers, dnsResolvers)
+		}
+	}
+	for _, discoveryType := range []v2.Cluster_DiscoveryType{v2.Cluster_EDS, v2.Cluster_STATIC, v2.Cluster_ORIGINAL_DST} {
+		cluster := buildDefaultCluster(env, "cluster", discoveryType, nil)
+		if cluster.DnsResolvers != nil {
+			t.Errorf("%v: unexpected DNS resolvers %v", discoveryType, cluster.DnsResolvers)
+		}
+	}
+}
+
+func TestBuildClustersLogicalDNS(t *testing.T) {
+	strictService := mock.MakeService("strict.default.svc.cluster.local", "10.1.0.0")
+	strictService.Resolution = model.DNSLB
+	logicalService := mock.MakeService("logical.default.svc.cluster.local", "10.2.0.0")
+	logicalService.Resolution = model.LogicalDNSLB
+	env := buildTestEnv(t, []*model.Service{strictService, logicalService})
+
+	cases := []struct {
+		service       *model.Service
+		discoveryType v2.Cluster_DiscoveryType
+		hosts         int
+	}{
+		{strictService, v2.Cluster_STRICT_DNS, 2},
+		{logicalService, v2.Cluster_LOGICAL_DNS, 1},
+	}
+
+	clusters := BuildClusters(env, mock.Router)
+	for _, c := range cases {
+		port := c.service.Ports[0]
+		name := model.BuildSubsetKey(model.TrafficDirectionOutbound, "", c.service.Hostname, port)
+		cluster := findCluster(clusters, name)
+		if cluster == nil {
+			t.Errorf("cluster %s not found", name)
+			continue
+		}
+		if cluster.Type != c.discoveryType {
+			t.Errorf("cluster %s: got type %v, want %v", name, cluster.Type, c.discoveryType)
+		}
+		if len(cluster.Hosts) != c.hosts {
+			t.Errorf("cluster %s: got %d hosts, want %d", name, len(cluster.Hosts), c.hosts)
+			continue
+		}
+
+		instances, err := env.Instances(c.service.Hostname, []string{port.Name}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, host := range cluster.Hosts {
+			expected := util.BuildAddress(instances[i].Endpoint.Address, uint32(instances[i].Endpoint.Port))
+			if !reflect.DeepEqual(*host, expected) {
+				t.Errorf("cluster %s: got host %v, want %v", name, host, expected)
+			}
+		}
+	}
+}
+
+func TestBuildClustersSubsetConnectionPoolMerge(t *testing.T) {
+	service := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	env := buildTestEnv(t, []*model.Service{service}, &networking.DestinationRule{
+		Name: service.Hostname,
+		TrafficPolicy: &networking.TrafficPolicy{
+			ConnectionPool: &networking.ConnectionPoolSettings{
+				Http: &networking.ConnectionPoolSettings_HTTPSettings{
+					Http2MaxRequests: 100,
+					MaxRetries:       5,
+				},
+				Tcp: &networking.ConnectionPoolSettings_TCPSettings{
+					MaxConnections: 10,
+				},
+			},
+		},
+		Subsets: []*networking.Subset{
+			{
+				Name:   "v1",
+				Labels: map[string]string{"version": "v1"},
+				TrafficPolicy: &networking.TrafficPolicy{
+					ConnectionPool: &networking.ConnectionPoolSettings{
+						Tcp: &networking.ConnectionPoolSettings_TCPSettings{
+							MaxConnections: 20,
+						},
+					},
+				},
+			},
+		},
+	})
+
+	cases := []struct {
+		subset   string
+		expected *v2_cluster.CircuitBreakers_Thresholds
+	}{
+		{
+			subset: "",
+			expected: &v2_cluster.CircuitBreakers_Thresholds{
+				MaxConnections: &types.UInt32Value{Value: 10},
+				MaxRequests:    &types.UInt32Value{Value: 100},
+				MaxRetries:     &types.UInt32Value{Value: 5},
+			},
+		},
+		{
+			subset: "v1",
+			expected: &v2_cluster.CircuitBreakers_Thresholds{
+				MaxConnections: &types.UInt32Value{Value: 20},
+				MaxRequests:    &types.UInt32Value{Value: 100},
+				MaxRetries:     &types.UInt32Value{Value: 5},
+			},
+		},
+	}
+
+	clusters := BuildClusters(env, mock.Router)
+	for _, c := range cases {
+		name := model.BuildSubsetKey(model.TrafficDirectionOutbound, c.subset, service.Hostname, service.Ports[0])
+		cluster := findCluster(clusters, name)
+		if cluster == nil {
+			t.Errorf("cluster %s not found", name)
+			continue
+		}
+		if cluster.CircuitBreakers == nil || len(cluster.CircuitBreakers.Thresholds) != 1 {
+			t.Errorf("cluster %s: got circuit breakers %v, want a single threshold", name, cluster.CircuitBreakers)
+			continue
+		}
+		if got := cluster.CircuitBreakers.Thresholds[0]; !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("cluster %s: got thresholds %v, want %v", name, got, c.expected)
+		}
+	}
+}
+
+func TestBuildClustersSubsetConnectionPoolIsolation(t *testing.T) {
+	service := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	port := service.Ports[0]
+	connectTimeout := &types.Duration{Seconds: 7}
+
+	cases := []struct {
+		name        string
+		destination *networking.ConnectionPoolSettings
+		subset      *networking.ConnectionPoolSettings
+		timeout     time.Duration
+		expected    *v2_cluster.CircuitBreakers_Thresholds
+	}{
+		{
+			name: "http only subset keeps the destination thresholds and connect timeout",
+			destination: &networking.ConnectionPoolSettings{
+				Tcp: &networking.ConnectionPoolSettings_TCPSettings{MaxConnections: 10, ConnectTimeout: connectTimeout},
+			},
+			subset: &networking.ConnectionPoolSettings{
+				Http: &networking.ConnectionPoolSettings_HTTPSettings{MaxRetries: 2},
+			},
+			timeout: 7 * time.Second,
+			expected: &v2_cluster.CircuitBreakers_Thresholds{
+				MaxConnections: &types.UInt32Value{Value: 10},
+				MaxRetries:     &types.UInt32Value{Value: 2},
+			},
+		},
+		{
+			name: "connect timeout only subset keeps the destination thresholds",
+			destination: &networking.ConnectionPoolSettings{
+				Http: &networking.ConnectionPoolSettings_HTTPSettings{MaxRetries: 4},
+				Tcp:  &networking.ConnectionPoolSettings_TCPSettings{MaxConnections: 10},
+			},
+			subset: &networking.ConnectionPoolSettings{
+				Tcp: &networking.ConnectionPoolSettings_TCPSettings{ConnectTimeout: connectTimeout},
+			},
+			timeout: 7 * time.Second,
+			expected: &v2_cluster.CircuitBreakers_Thresholds{
+				MaxConnections: &types.UInt32Value{Value: 10},
+				MaxRetries:     &types.UInt32Value{Value: 4},
+			},
+		},
+		{
+			name: "threshold only subset keeps the destination connect timeout",
+			destination: &networking.ConnectionPoolSettings{
+				Tcp: &networking.ConnectionPoolSettings_TCPSettings{ConnectTimeout: connectTimeout},
+			},
+			subset: &networking.ConnectionPoolSettings{
+				Tcp: &networking.ConnectionPoolSettings_TCPSettings{MaxConnections: 20},
+			},
+			timeout: 7 * time.Second,
+			expected: &v2_cluster.CircuitBreakers_Thresholds{
+				MaxConnections: &types.UInt32Value{Value: 20},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		env := buildTestEnv(t, []*model.Service{service}, &networking.DestinationRule{
+			Name:          service.Hostname,
+			TrafficPolicy: &networking.TrafficPolicy{ConnectionPool: c.destination},
+			Subsets: []*networking.Subset{
+				{
+					Name:          "v1",
+					Labels:        map[string]string{"version": "v1"},
+					TrafficPolicy: &networking.TrafficPolicy{ConnectionPool: c.subset},
+				},
+			},
+		})
+		name := model.BuildSubsetKey(model.TrafficDirectionOutbound, "v1", service.Hostname, port)
+		cluster := findCluster(BuildClusters(env, mock.Router), name)
+		if cluster == nil {
+			t.Fatalf("%s: cluster %s not found", c.name, name)
+		}
+		if cluster.ConnectTimeout != c.timeout {
+			t.Errorf("%s: got connect timeout %v, want %v", c.name, cluster.ConnectTimeout, c.timeout)
+		}
+		if got := cluster.CircuitBreakers.GetThresholds(); len(got) != 1 || !reflect.DeepEqual(got[0], c.expected) {
+			t.Errorf("%s: got thresholds %v, want %v", c.name, got, c.expected)
+		}
+	}
+}
+
+func TestApplyConnectionPoolIsolation(t *testing.T) {
+	// a policy setting the connect timeout alone keeps the thresholds of a previous policy
+	cluster := &v2.Cluster{}
+	applyConnectionPool(cluster, &networking.ConnectionPoolSettings{
+		Tcp: &networking.ConnectionPoolSettings_TCPSettings{MaxConnections: 10},
+	}, clusterContext{})
+	applyConnectionPool(cluster, &networking.ConnectionPoolSettings{
+		Tcp: &networking.ConnectionPoolSettings_TCPSettings{ConnectTimeout: &types.Duration{Seconds: 3}},
+	}, clusterContext{})
+	if cluster.ConnectTimeout != 3*time.Second {
+		t.Errorf("got connect timeout %v, want 3s", cluster.ConnectTimeout)
+	}
+	if got := cluster.CircuitBreakers.GetThresholds()[0].GetMaxConnections().GetValue(); got != 10 {
+		t.Errorf("got max connections %d, want 10", got)
+	}
+
+	// a policy setting thresholds alone keeps the connect timeout of a previous policy
+	cluster = &v2.Cluster{}
+	applyConnectionPool(cluster, &networking.ConnectionPoolSettings{
+		Tcp: &networking.ConnectionPoolSettings_TCPSettings{ConnectTimeout: &types.Duration{Seconds: 3}},
+	}, clusterContext{})
+	applyConnectionPool(cluster, &networking.ConnectionPoolSettings{
+		Http: &networking.ConnectionPoolSettings_HTTPSettings{Http1MaxPendingRequests: 5},
+	}, clusterContext{})
+	if cluster.ConnectTimeout != 3*time.Second {
+		t.Errorf("got connect timeout %v, want 3s", cluster.ConnectTimeout)
+	}
+	if got := cluster.CircuitBreakers.GetThresholds()[0].GetMaxPendingRequests().GetValue(); got != 5 {
+		t.Errorf("got max pending requests %d, want 5", got)
+	}
+}
+
+func TestSetUpstreamProtocolHTTP2WindowSizes(t *testing.T) {
+	defer func(stream, connection uint32) {
+		http2InitialStreamWindowSize, http2InitialConnectionWindowSize = stream, connection
+	}(http2InitialStreamWindowSize, http2InitialConnectionWindowSize)
+
+	cases := []struct {
+		name       string
+		protocol   model.Protocol
+		stream     uint32
+		connection uint32
+		expected   *core.Http2ProtocolOptions
+	}{
+		{
+			name:     "grpc with envoy defaults",
+			protocol: model.ProtocolGRPC,
+			expected: &core.Http2ProtocolOptions{},
+		},
+		{
+			name:       "grpc",
+			protocol:   model.ProtocolGRPC,
+			stream:     1 << 20,
+			connection: 1 << 24,
+			expected: &core.Http2ProtocolOptions{
+				InitialStreamWindowSize:     &types.UInt32Value{Value: 1 << 20},
+				InitialConnectionWindowSize: &types.UInt32Value{Value: 1 << 24},
+			},
+		},
+		{
+			name:     "http2 stream window only",
+			protocol: model.ProtocolHTTP2,
+			stream:   1 << 20,
+			expected: &core.Http2ProtocolOptions{
+				InitialStreamWindowSize: &types.UInt32Value{Value: 1 << 20},
+			},
+		},
+		{
+			name:       "http1",
+			protocol:   model.ProtocolHTTP,
+			stream:     1 << 20,
+			connection: 1 << 24,
+			expected:   nil,
+		},
+	}
+
+	for _, c := range cases {
+		http2InitialStreamWindowSize, http2InitialConnectionWindowSize = c.stream, c.connection
+		cluster := &v2.Cluster{}
+		setUpstreamProtocol(cluster, "hello.default.svc.cluster.local", &model.Port{Name: "port", Port: 9090, Protocol: c.protocol})
+		if !reflect.DeepEqual(cluster.Http2ProtocolOptions, c.expected) {
+			t.Errorf("%s: got %v, want %v", c.name, cluster.Http2ProtocolOptions, c.expected)
+		}
+	}
+}
+
+func TestSetUpstreamProtocolSelection(t *testing.T) {
+	cases := []struct {
+		protocol model.Protocol
+		expected v2.Cluster_ClusterProtocolSelection
+	}{
+		{model.ProtocolGRPC, v2.Cluster_USE_CONFIGURED_PROTOCOL},
+		{model.ProtocolHTTP2, v2.Cluster_USE_CONFIGURED_PROTOCOL},
+		{model.ProtocolHTTP, v2.Cluster_USE_DOWNSTREAM_PROTOCOL},
+		{model.ProtocolTCP, v2.Cluster_USE_DOWNSTREAM_PROTOCOL},
+	}
+
+	for _, c := range cases {
+		// HTTP/2 clusters force their protocol whatever was set before, other clusters are left unchanged
+		cluster := &v2.Cluster{ProtocolSelection: v2.Cluster_USE_DOWNSTREAM_PROTOCOL}
+		setUpstreamProtocol(cluster, "hello.default.svc.cluster.local", &model.Port{Name: "port", Port: 9090, Protocol: c.protocol})
+		if cluster.ProtocolSelection != c.expected {
+			t.Errorf("%s: got protocol selection %v, want %v", c.protocol, cluster.ProtocolSelection, c.expected)
+		}
+	}
+}
+
+func TestBuildClustersHTTP2MaxConcurrentStreams(t *testing.T) {
+	defer func(streams uint32) { http2MaxConcurrentStreams = streams }(http2MaxConcurrentStreams)
+	http2MaxConcurrentStreams = 100
+
+	service := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	service.Ports = append(service.Ports, &model.Port{Name: "grpc", Port: 9090, Protocol: model.ProtocolGRPC})
+	env := buildTestEnv(t, []*model.Service{service})
+
+	clusters := BuildClusters(env, mock.Router)
+	for _, port := range service.Ports {
+		name := model.BuildSubsetKey(model.TrafficDirectionOutbound, "", service.Hostname, port)
+		cluster := findCluster(clusters, name)
+		if cluster == nil {
+			t.Errorf("cluster %s not found", name)
+			continue
+		}
+		if port.Protocol != model.ProtocolGRPC {
+			if cluster.Http2ProtocolOptions != nil {
+				t.Errorf("cluster %s: unexpected http2 options %v", name, cluster.Http2ProtocolOptions)
+			}
+			continue
+		}
+		if got := cluster.Http2ProtocolOptions.GetMaxConcurrentStreams().GetValue(); got != 100 {
+			t.Errorf("cluster %s: got max concurrent streams %d, want 100", name, got)
+		}
+	}
+}
+
+func TestBuildClustersHealthCheck(t *testing.T) {
+	defer func(interval, timeout time.Duration, healthy, unhealthy uint32, path string) {
+		healthCheckInterval, healthCheckTimeout = interval, timeout
+		healthCheckHealthyThreshold, healthCheckUnhealthyThreshold = healthy, unhealthy
+		healthCheckHTTPPath = path
+	}(healthCheckInterval, healthCheckTimeout, healthCheckHealthyThreshold, healthCheckUnhealthyThreshold, healthCheckHTTPPath)
+	healthCheckInterval, healthCheckTimeout = 10*time.Second, 2*time.Second
+	healthCheckHealthyThreshold, healthCheckUnhealthyThreshold = 2, 5
+	healthCheckHTTPPath = "/healthz"
+	defer func(overrides map[string]model.Protocol) { protocolOverrides = overrides }(protocolOverrides)
+
+	dnsService := mock.MakeService("dns.default.svc.cluster.local", "10.1.0.0")
+	dnsService.Resolution = model.DNSLB
+	edsService := mock.MakeService("eds.default.svc.cluster.local", "10.2.0.0")
+	overriddenService := mock.MakeService("overridden.default.svc.cluster.local", "10.3.0.0")
+	overriddenService.Resolution = model.DNSLB
+	protocolOverrides = map[string]model.Protocol{
+		protocolOverrideKey(overriddenService.Hostname, 80): model.ProtocolTCP,
+		protocolOverrideKey(overriddenService.Hostname, 90): model.ProtocolHTTP,
+	}
+	env := buildTestEnv(t, []*model.Service{dnsService, edsService, overriddenService})
+	clusters := BuildClusters(env, mock.Router)
+
+	interval, timeout := 10*time.Second, 2*time.Second
+	httpCheck := []*core.HealthCheck{{
+		Interval:           &interval,
+		Timeout:            &timeout,
+		HealthyThreshold:   &types.UInt32Value{Value: 2},
+		UnhealthyThreshold: &types.UInt32Value{Value: 5},
+		HealthChecker: &core.HealthCheck_HttpHealthCheck_{
+			HttpHealthCheck: &core.HealthCheck_HttpHealthCheck{Path: "/healthz"},
+		},
+	}}
+	tcpCheck := []*core.HealthCheck{{
+		Interval:           &interval,
+		Timeout:            &timeout,
+		HealthyThreshold:   &types.UInt32Value{Value: 2},
+		UnhealthyThreshold: &types.UInt32Value{Value: 5},
+		HealthChecker: &core.HealthCheck_TcpHealthCheck_{
+			TcpHealthCheck: &core.HealthCheck_TcpHealthCheck{},
+		},
+	}}
+
+	cases := []struct {
+		service  *model.Service
+		port     string
+		expected []*core.HealthCheck
+	}{
+		{dnsService, "http", httpCheck},
+		{dnsService, "custom", tcpCheck},
+		{edsService, "http", nil},
+		// the protocol overrides decide the health check
+		{overriddenService, "http", tcpCheck},
+		{overriddenService, "custom", httpCheck},
+	}
+	for _, c := range cases {
+		port, _ := c.service.Ports.Get(c.port)
+		name := model.BuildSubsetKey(model.TrafficDirectionOutbound, "", c.service.Hostname, port)
+		cluster := findCluster(clusters, name)
+		if cluster == nil {
+			t.Errorf("cluster %s not found", name)
+			continue
+		}
+		if !reflect.DeepEqual(cluster.HealthChecks, c.expected) {
+			t.Errorf("cluster %s: got health checks %v, want %v", name, cluster.HealthChecks, c.expected)
+		}
+	}
+}
+
+func TestApplyLbSubsetConfig(t *testing.T) {
+	cases := []struct {
+		name          string
+		discoveryType v2.Cluster_DiscoveryType
+		subsets       []*networking.Subset
+		expected      *v2.Cluster_LbSubsetConfig
+	}{
+		{
+			name:          "no subsets",
+			discoveryType: v2.Cluster_EDS,
+			expected:      nil,
+		},
+		{
+			name:          "subsets with shared and distinct keys",
+			discoveryType: v2.Cluster_EDS,
+			subsets: []*networking.Subset{
+				{Name: "v1", Labels: map[string]string{"version": "v1"}},
+				{Name: "v2", Labels: map[string]string{"version": "v2"}},
+				{Name: "canary", Labels: map[string]string{"version": "v3", "track": "canary"}},
+			},
+			expected: &v2.Cluster_LbSubsetConfig{
+				FallbackPolicy: v2.Cluster_LbSubsetConfig_ANY_ENDPOINT,
+				SubsetSelectors: []*v2.Cluster_LbSubsetConfig_LbSubsetSelector{
+					{Keys: []string{"version"}},
+					{Keys: []string{"track", "version"}},
+				},
+			},
+		},
+		{
+			name:          "dns cluster",
+			discoveryType: v2.Cluster_STRICT_DNS,
+			subsets:       []*networking.Subset{{Name: "v1", Labels: map[string]string{"version": "v1"}}},
+			expected:      nil,
+		},
+	}
+
+	for _, c := range cases {
+		cluster := &v2.Cluster{Type: c.discoveryType}
+		applyLbSubsetConfig(cluster, c.subsets)
+		if !reflect.DeepEqual(cluster.LbSubsetConfig, c.expected) {
+			t.Errorf("%s: got %v, want %v", c.name, cluster.LbSubsetConfig, c.expected)
+		}
+	}
+}
+
+func TestBuildClustersOriginalDstHTTPHeader(t *testing.T) {
+	defer func(useHTTPHeader bool) { originalDstUseHTTPHeader = useHTTPHeader }(originalDstUseHTTPHeader)
+
+	service := mock.MakeService("passthrough.default.svc.cluster.local", "10.1.0.0")
+	service.Resolution = model.Passthrough
+	env := buildTestEnv(t, []*model.Service{service})
+	name := model.BuildSubsetKey(model.TrafficDirectionOutbound, "", service.Hostname, service.Ports[0])
+
+	for _, useHTTPHeader := range []bool{false, true} {
+		originalDstUseHTTPHeader = useHTTPHeader
+		cluster := findCluster(BuildClusters(env, mock.Router), name)
+		if cluster == nil {
+			t.Fatalf("cluster %s not found", name)
+		}
+		if cluster.Type != v2.Cluster_ORIGINAL_DST || cluster.LbPolicy != v2.Cluster_ORIGINAL_DST_LB {
+			t.Errorf("use http header %v: got type %v and lb policy %v, want ORIGINAL_DST", useHTTPHeader, cluster.Type, cluster.LbPolicy)
+		}
+		if got := cluster.GetOriginalDstLbConfig().GetUseHttpHeader(); got != useHTTPHeader {
+			t.Errorf("use http header %v: got %v", useHTTPHeader, got)
+		}
+	}
+}
+
+func TestBuildClustersMetadata(t *testing.T) {
+	service := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	env := buildTestEnv(t, []*model.Service{service}, &networking.DestinationRule{
+		Name:    service.Hostname,
+		Subsets: []*networking.Subset{{Name: "v1", Labels: map[string]string{"version": "v1"}}},
+	})
+	sidecar := model.Proxy{
+		Type:      model.Sidecar,
+		IPAddress: mock.MakeIP(service, 0),
+		ID:        "v0.default",
+		Domain:    "default.svc.cluster.local",
+	}
+	port := service.Ports[0]
+
+	str := func(s string) *types.Value { return &types.Value{Kind: &types.Value_StringValue{StringValue: s}} }
+	num := func(n int) *types.Value { return &types.Value{Kind: &types.Value_NumberValue{NumberValue: float64(n)}} }
+
+	cases := []struct {
+		name     string
+		cluster  string
+		expected map[string]*types.Value
+	}{
+		{
+			name:    "outbound default",
+			cluster: model.BuildSubsetKey(model.TrafficDirectionOutbound, "", service.Hostname, port),
+			expected: map[string]*types.Value{
+				"hostname":  str(service.Hostname),
+				"port":      num(port.Port),
+				"port_name": str(port.Name),
+			},
+		},
+		{
+			name:    "outbound subset",
+			cluster: model.BuildSubsetKey(model.TrafficDirectionOutbound, "v1", service.Hostname, port),
+			expected: map[string]*types.Value{
+				"hostname":  str(service.Hostname),
+				"subset":    str("v1"),
+				"port":      num(port.Port),
+				"port_name": str(port.Name),
+			},
+		},
+		{
+			name:    "inbound",
+			cluster: model.BuildSubsetKey(model.TrafficDirectionInbound, "", service.Hostname, port),
+			expected: map[string]*types.Value{
+				"hostname":  str(service.Hostname),
+				"port":      num(port.Port),
+				"port_name": str(port.Name),
+				"labels": {Kind: &types.Value_StructValue{StructValue: &types.Struct{
+					Fields: map[string]*types.Value{"version": str("v0")},
+				}}},
+			},
+		},
+	}
+
+	clusters := BuildClusters(env, sidecar)
+	for _, c := range cases {
+		cluster := findCluster(clusters, c.cluster)
+		if cluster == nil {
+			t.Errorf("%s: cluster %s not found", c.name, c.cluster)
+			continue
+		}
+		metadata := cluster.Metadata.GetFilterMetadata()[clusterMetadataNamespace]
+		if metadata == nil {
+			t.Errorf("%s: cluster %s has no %s metadata", c.name, c.cluster, clusterMetadataNamespace)
+			continue
+		}
+		if !reflect.DeepEqual(metadata.Fields, c.expected) {
+			t.Errorf("%s: got metadata %v, want %v", c.name, metadata.Fields, c.expected)
+		}
+	}
+}
+
+func TestBuildClustersStaticExternalService(t *testing.T) {
+	externalService := &networking.ExternalService{
+		Hosts: []string{"db.example.com"},
+		Ports: []*networking.Port{
+			{Number: 5432, Protocol: "TCP", Name: "tcp-db"},
+		},
+		Endpoints: []*networking.ExternalService_Endpoint{
+			{Address: "10.10.0.1"},
+			{Address: "10.10.0.2", Ports: map[string]uint32{"tcp-db": 15432}},
+		},
+		Discovery: networking.ExternalService_STATIC,
+	}
+	env := buildTestEnvWithConfigs(t, nil, model.Config{
+		ConfigMeta: model.ConfigMeta{
+			Type:      model.ExternalService.Type,
+			Name:      "db",
+			Namespace: "default",
+		},
+		Spec: externalService,
+	})
+	env.ServiceDiscovery = external.NewServiceDiscovery(env.IstioConfigStore)
+	env.ServiceAccounts = external.NewServiceAccounts()
+
+	name := model.BuildSubsetKey(model.TrafficDirectionOutbound, "", "db.example.com", &model.Port{Name: "tcp-db"})
+	cluster := findCluster(BuildClusters(env, mock.Router), name)
+	if cluster == nil {
+		t.Fatalf("cluster %s not found", name)
+	}
+	if cluster.Type != v2.Cluster_STATIC {
+		t.Errorf("got type %v, want STATIC", cluster.Type)
+	}
+	if cluster.EdsClusterConfig != nil {
+		t.Errorf("unexpected eds config %v", cluster.EdsClusterConfig)
+	}
+
+	first := util.BuildAddress("10.10.0.1", 5432)
+	second := util.BuildAddress("10.10.0.2", 15432)
+	expected := []*core.Address{&first, &second}
+	if !reflect.DeepEqual(cluster.Hosts, expected) {
+		t.Errorf("got hosts %v, want %v", cluster.Hosts, expected)
+	}
+}
+
+func TestBuildClustersTCPOutlierDetection(t *testing.T) {
+	defer func(errors uint32) { tcpOutlierConsecutiveErrors = errors }(tcpOutlierConsecutiveErrors)
+
+	service := mock.MakeService("redis.default.svc.cluster.local", "10.1.0.0")
+	rule := &networking.DestinationRule{
+		Name: service.Hostname,
+		TrafficPolicy: &networking.TrafficPolicy{
+			OutlierDetection: &networking.OutlierDetection{
+				Http: &networking.OutlierDetection_HTTPSettings{ConsecutiveErrors: 7},
+			},
+		},
+		Subsets: []*networking.Subset{{Name: "v1", Labels: map[string]string{"version": "v1"}}},
+	}
+	redisPort, _ := service.Ports.Get("redis")
+	httpPort, _ := service.Ports.Get("http")
+
+	cases := []struct {
+		name     string
+		errors   uint32
+		rules    []*networking.DestinationRule
+		subset   string
+		port     *model.Port
+		expected *v2_cluster.OutlierDetection
+	}{
+		{name: "disabled", port: redisPort},
+		{
+			name:   "tcp port",
+			errors: 2,
+			port:   redisPort,
+			expected: &v2_cluster.OutlierDetection{
+				Consecutive_5Xx:    &types.UInt32Value{Value: 2},
+				MaxEjectionPercent: &types.UInt32Value{Value: defaultMaxEjectionPercent},
+			},
+		},
+		{name: "http port", errors: 2, port: httpPort},
+		{
+			// the outlier detection of the destination rule replaces the mesh wide one
+			name:   "destination rule",
+			errors: 2,
+			rules:  []*networking.DestinationRule{rule},
+			port:   redisPort,
+			expected: &v2_cluster.OutlierDetection{
+				Consecutive_5Xx:    &types.UInt32Value{Value: 7},
+				MaxEjectionPercent: &types.UInt32Value{Value: defaultMaxEjectionPercent},
+			},
+		},
+		{
+			name:   "subset",
+			errors: 2,
+			rules:  []*networking.DestinationRule{rule},
+			subset: "v1",
+			port:   redisPort,
+			expected: &v2_cluster.OutlierDetection{
+				Consecutive_5Xx:    &types.UInt32Value{Value: 7},
+				MaxEjectionPercent: &types.UInt32Value{Value: defaultMaxEjectionPercent},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		tcpOutlierConsecutiveErrors = c.errors
+		env := buildTestEnv(t, []*model.Service{service}, c.rules...)
+		name := model.BuildSubsetKey(model.TrafficDirectionOutbound, c.subset, service.Hostname, c.port)
+		cluster := findCluster(BuildClusters(env, mock.Router), name)
+		if cluster == nil {
+			t.Errorf("%s: cluster %s not found", c.name, name)
+			continue
+		}
+		if !reflect.DeepEqual(cluster.OutlierDetection, c.expected) {
+			t.Errorf("%s: got outlier detection %v, want %v", c.name, cluster.OutlierDetection, c.expected)
+		}
+	}
+}
+
+func TestApplyLoadBalancerPassthroughConflict(t *testing.T) {
+	defer func(reject bool) { rejectPassthroughLbOnEDS = reject }(rejectPassthroughLbOnEDS)
+
+	cases := []struct {
+		name           string
+		discoveryType  v2.Cluster_DiscoveryType
+		reject         bool
+		conflict       bool
+		expectedPolicy v2.Cluster_LbPolicy
+		expectedType   v2.Cluster_DiscoveryType
+	}{
+		{
+			name:           "eds cluster",
+			discoveryType:  v2.Cluster_EDS,
+			conflict:       true,
+			expectedPolicy: v2.Cluster_ORIGINAL_DST_LB,
+			expectedType:   v2.Cluster_ORIGINAL_DST,
+		},
+		{
+			name:           "eds cluster rejecting the override",
+			discoveryType:  v2.Cluster_EDS,
+			reject:         true,
+			conflict:       true,
+			expectedPolicy: v2.Cluster_RANDOM,
+			expectedType:   v2.Cluster_EDS,
+		},
+		{
+			name:           "original destination cluster",
+			discoveryType:  v2.Cluster_ORIGINAL_DST,
+			reject:         true,
+			expectedPolicy: v2.Cluster_ORIGINAL_DST_LB,
+			expectedType:   v2.Cluster_ORIGINAL_DST,
+		},
+	}
+
+	for _, c := range cases {
+		rejectPassthroughLbOnEDS = c.reject
+		before := new(dto.Metric)
+		_ = passthroughLbConflicts.Write(before)
+
+		cluster := &v2.Cluster{Name: "outbound|http||hello.default.svc.cluster.local", Type: c.discoveryType, LbPolicy: v2.Cluster_RANDOM}
+		applyLoadBalancer(cluster, simpleLb(networking.LoadBalancerSettings_PASSTHROUGH))
+		if cluster.LbPolicy != c.expectedPolicy || cluster.Type != c.expectedType {
+			t.Errorf("%s: got %v %v, want %v %v", c.name, cluster.Type, cluster.LbPolicy, c.expectedType, c.expectedPolicy)
+		}
+
+		after := new(dto.Metric)
+		_ = passthroughLbConflicts.Write(after)
+		if got := after.GetCounter().GetValue() - before.GetCounter().GetValue(); (got == 1) != c.conflict {
+			t.Errorf("%s: got %v conflicts counted, want conflict %v", c.name, got, c.conflict)
+		}
+	}
+}
+
+func TestBuildClustersLocalityWeightedLb(t *testing.T) {
+	defer func(enabled bool) { enableLocalityWeightedLb = enabled }(enableLocalityWeightedLb)
+
+	edsService := mock.MakeService("eds.default.svc.cluster.local", "10.1.0.0")
+	passthroughService := mock.MakeService("passthrough.default.svc.cluster.local", "10.2.0.0")
+	passthroughService.Resolution = model.Passthrough
+	dnsService := mock.MakeService("dns.default.svc.cluster.local", "10.3.0.0")
+	dnsService.Resolution = model.DNSLB
+	// a passthrough load balancer turns the EDS cluster into an original destination cluster
+	passthroughRuleService := mock.MakeService("rule.default.svc.cluster.local", "10.4.0.0")
+	env := buildTestEnv(t, []*model.Service{edsService, passthroughService, dnsService, passthroughRuleService},
+		&networking.DestinationRule{
+			Name: passthroughRuleService.Hostname,
+			TrafficPolicy: &networking.TrafficPolicy{
+				LoadBalancer: simpleLb(networking.LoadBalancerSettings_PASSTHROUGH),
+			},
+		})
+
+	cases := []struct {
+		service *model.Service
+		enabled bool
+		want    bool
+	}{
+		{edsService, false, false},
+		{edsService, true, true},
+		{passthroughService, true, false},
+		{dnsService, true, false},
+		{passthroughRuleService, true, false},
+	}
+
+	for _, c := range cases {
+		enableLocalityWeightedLb = c.enabled
+		name := model.BuildSubsetKey(model.TrafficDirectionOutbound, "", c.service.Hostname, c.service.Ports[0])
+		cluster := findCluster(BuildClusters(env, mock.Router), name)
+		if cluster == nil {
+			t.Errorf("cluster %s not found", name)
+			continue
+		}
+		got := cluster.CommonLbConfig.GetLocalityWeightedLbConfig() != nil
+		if got != c.want {
+			t.Errorf("cluster %s with locality weighted lb enabled=%v: got locality weighted lb config %v, want %v",
+				name, c.enabled, got, c.want)
+		}
+	}
+}
+
+func TestBuildClustersLocalityFailover(t *testing.T) {
+	failover := &networking.LocalityLoadBalancerSetting{
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{From: "us-east", To: "us-west"},
+			{From: "us-west", To: "us-east"},
+			{From: "eu-west", To: "eu-west"},
+		},
+	}
+	edsService := mock.MakeService("eds.default.svc.cluster.local", "10.1.0.0")
+	dnsService := mock.MakeService("dns.default.svc.cluster.local", "10.2.0.0")
+	dnsService.Resolution = model.DNSLB
+	hashService := mock.MakeService("hash.default.svc.cluster.local", "10.3.0.0")
+	noneService := mock.MakeService("none.default.svc.cluster.local", "10.4.0.0")
+	rule := func(hostname string, lb *networking.LoadBalancerSettings) *networking.DestinationRule {
+		return &networking.DestinationRule{
+			Name:          hostname,
+			TrafficPolicy: &networking.TrafficPolicy{LoadBalancer: lb},
+		}
+	}
+	roundRobin := simpleLb(networking.LoadBalancerSettings_ROUND_ROBIN)
+	roundRobin.LocalityLbSetting = failover
+	env := buildTestEnv(t, []*model.Service{edsService, dnsService, hashService, noneService},
+		rule(edsService.Hostname, roundRobin),
+		rule(dnsService.Hostname, roundRobin),
+		rule(hashService.Hostname, &networking.LoadBalancerSettings{
+			LbPolicy: &networking.LoadBalancerSettings_ConsistentHash{
+				ConsistentHash: &networking.LoadBalancerSettings_ConsistentHashLB{
+					HashKey: &networking.LoadBalancerSettings_ConsistentHashLB_UseSourceIp{UseSourceIp: true},
+				},
+			},
+			LocalityLbSetting: failover,
+		}),
+		rule(noneService.Hostname, simpleLb(networking.LoadBalancerSettings_ROUND_ROBIN)))
+	clusters := BuildClusters(env, mock.Router)
+
+	cases := []struct {
+		service  *model.Service
+		failover map[string]string
+	}{
+		// the failover of a region to itself is skipped
+		{edsService, map[string]string{"us-east": "us-west", "us-west": "us-east"}},
+		{dnsService, nil},
+		{hashService, nil},
+		{noneService, nil},
+	}
+	for _, c := range cases {
+		name := model.BuildSubsetKey(model.TrafficDirectionOutbound, "", c.service.Hostname, c.service.Ports[0])
+		cluster := findCluster(clusters, name)
+		if cluster == nil {
+			t.Errorf("cluster %s not found", name)
+			continue
+		}
+		if got := cluster.CommonLbConfig.GetLocalityWeightedLbConfig() != nil; got != (c.failover != nil) {
+			t.Errorf("cluster %s: got locality weighted lb config %v, want %v", name, got, c.failover != nil)
+		}
+
+		// the failover is read by EDS to set the priorities of the localities
+		var got map[string]string
+		if setting := LocalityLbSetting(env, c.service.Hostname, "", c.service.Ports[0].Name); setting != nil {
+			got = make(map[string]string)
+			for _, f := range setting.Failover {
+				got[f.From] = f.To
+			}
+		}
+		if !reflect.DeepEqual(got, c.failover) {
+			t.Errorf("cluster %s: got locality failover %v, want %v", name, got, c.failover)
+		}
+	}
+}
+
+func TestBuildClustersLocalityDistribute(t *testing.T) {
+	distribute := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{From: "us-east/zone1/*", To: map[string]uint32{"us-east/zone1/*": 80, "us-west/*": 20}},
+			{To: map[string]uint32{"us-west/*": 100}},
+		},
+	}
+	edsService := mock.MakeService("eds.default.svc.cluster.local", "10.1.0.0")
+	dnsService := mock.MakeService("dns.default.svc.cluster.local", "10.2.0.0")
+	dnsService.Resolution = model.DNSLB
+	lb := simpleLb(networking.LoadBalancerSettings_RANDOM)
+	lb.LocalityLbSetting = distribute
+	rule := func(hostname string) *networking.DestinationRule {
+		return &networking.DestinationRule{
+			Name:          hostname,
+			TrafficPolicy: &networking.TrafficPolicy{LoadBalancer: lb},
+			Subsets:       []*networking.Subset{{Name: "v1", Labels: map[string]string{"version": "v1"}}},
+		}
+	}
+	env := buildTestEnv(t, []*model.Service{edsService, dnsService}, rule(edsService.Hostname), rule(dnsService.Hostname))
+	clusters := BuildClusters(env, mock.Router)
+
+	// the distribution without a source locality is skipped
+	expected := map[string]map[string]uint32{"us-east/zone1/*": {"us-east/zone1/*": 80, "us-west/*": 20}}
+	cases := []struct {
+		name       string
+		distribute map[string]map[string]uint32
+	}{
+		{model.BuildSubsetKey(model.TrafficDirectionOutbound, "", edsService.Hostname, edsService.Ports[0]), expected},
+		{model.BuildSubsetKey(model.TrafficDirectionOutbound, "v1", edsService.Hostname, edsService.Ports[0]), expected},
+		{model.BuildSubsetKey(model.TrafficDirectionOutbound, "", dnsService.Hostname, dnsService.Ports[0]), nil},
+	}
+	for _, c := range cases {
+		cluster := findCluster(clusters, c.name)
+		if cluster == nil {
+			t.Errorf("cluster %s not found", c.name)
+			continue
+		}
+		if got := cluster.CommonLbConfig.GetLocalityWeightedLbConfig() != nil; got != (c.distribute != nil) {
+			t.Errorf("cluster %s: got locality weighted lb config %v, want %v", c.name, got, c.distribute != nil)
+		}
+
+		// the distribution is read by EDS to set the weights of the localities
+		var got map[string]map[string]uint32
+		_, subset, hostname, port := model.ParseSubsetKey(c.name)
+		if setting := LocalityLbSetting(env, hostname, subset, port.Name); setting != nil {
+			got = make(map[string]map[string]uint32)
+			for _, d := range setting.Distribute {
+				got[d.From] = d.To
+			}
+		}
+		if !reflect.DeepEqual(got, c.distribute) {
+			t.Errorf("cluster %s: got locality distribution %v, want %v", c.name, got, c.distribute)
+		}
+	}
+}
+
+func TestLocalityLbSettingsListsDestinationRulesOnce(t *testing.T) {
+	services := []*model.Service{
+		mock.MakeService("hello.prod.svc.cluster.local", "10.1.0.0"),
+		mock.MakeService("world.prod.svc.cluster.local", "10.2.0.0"),
+		mock.MakeService("hello.dev.svc.cluster.local", "10.3.0.0"),
+	}
+	lb := simpleLb(networking.LoadBalancerSettings_RANDOM)
+	lb.LocalityLbSetting = &networking.LocalityLoadBalancerSetting{
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{{From: "us-east", To: "us-west"}},
+	}
+	wildcard := &networking.DestinationRule{
+		Name:          "*.prod.svc.cluster.local",
+		TrafficPolicy: &networking.TrafficPolicy{LoadBalancer: lb},
+	}
+	env := buildTestEnv(t, services, wildcard)
+	store := &countingConfigStore{IstioConfigStore: env.IstioConfigStore, lists: make(map[string]int)}
+	env.IstioConfigStore = store
+
+	// the settings of every cluster of a push share the listing of the destination rules
+	settings := NewLocalityLbSettings(env)
+	for _, service := range services {
+		for _, port := range service.Ports {
+			setting := settings.Get(service.Hostname, "", port.Name)
+			if inherited := strings.HasSuffix(service.Hostname, ".prod.svc.cluster.local"); (setting != nil) != inherited {
+				t.Errorf("%s:%s: got locality lb setting %v, want inherited %v", service.Hostname, port.Name, setting, inherited)
+			}
+		}
+	}
+	if got := store.lists[model.DestinationRule.Type]; got != 1 {
+		t.Errorf("destination rules listed %d times for %d services, want 1", got, len(services))
+	}
+}
+
+func TestBuildClustersWeightedSimpleLb(t *testing.T) {
+	defer func(enabled bool) { enableWeightedSimpleLb = enabled }(enableWeightedSimpleLb)
+	defer func(policy networking.LoadBalancerSettings_SimpleLB) { defaultLbPolicy = policy }(defaultLbPolicy)
+	defaultLbPolicy = networking.LoadBalancerSettings_LEAST_CONN
+
+	services := make(map[networking.LoadBalancerSettings_SimpleLB]*model.Service)
+	rules := make([]*networking.DestinationRule, 0)
+	for i, lb := range []networking.LoadBalancerSettings_SimpleLB{
+		networking.LoadBalancerSettings_RANDOM,
+		networking.LoadBalancerSettings_ROUND_ROBIN,
+		networking.LoadBalancerSettings_LEAST_CONN,
+		networking.LoadBalancerSettings_PASSTHROUGH,
+	} {
+		service := mock.MakeService(fmt.Sprintf("lb%d.default.svc.cluster.local", i), fmt.Sprintf("10.%d.0.0", i+1))
+		services[lb] = service
+		rules = append(rules, &networking.DestinationRule{
+			Name:          service.Hostname,
+			TrafficPolicy: &networking.TrafficPolicy{LoadBalancer: simpleLb(lb)},
+		})
+	}
+	dnsService := mock.MakeService("dns.default.svc.cluster.local", "10.9.0.0")
+	dnsService.Resolution = model.DNSLB
+	rules = append(rules, &networking.DestinationRule{
+		Name:          dnsService.Hostname,
+		TrafficPolicy: &networking.TrafficPolicy{LoadBalancer: simpleLb(networking.LoadBalancerSettings_RANDOM)},
+	})
+	all := []*model.Service{dnsService}
+	for _, service := range services {
+		all = append(all, service)
+	}
+	env := buildTestEnv(t, all, rules...)
+
+	cases := []struct {
+		name    string
+		service *model.Service
+		enabled bool
+		want    bool
+	}{
+		{"random disabled", services[networking.LoadBalancerSettings_RANDOM], false, false},
+		{"random", services[networking.LoadBalancerSettings_RANDOM], true, true},
+		{"round robin", services[networking.LoadBalancerSettings_ROUND_ROBIN], true, true},
+		{"least conn", services[networking.LoadBalancerSettings_LEAST_CONN], true, false},
+		{"passthrough", services[networking.LoadBalancerSettings_PASSTHROUGH], true, false},
+		{"dns", dnsService, true, false},
+	}
+
+	for _, c := range cases {
+		enableWeightedSimpleLb = c.enabled
+		name := model.BuildSubsetKey(model.TrafficDirectionOutbound, "", c.service.Hostname, c.service.Ports[0])
+		cluster := findCluster(BuildClusters(env, mock.Router), name)
+		if cluster == nil {
+			t.Errorf("%s: cluster %s not found", c.name, name)
+			continue
+		}
+		if got := cluster.CommonLbConfig.GetLocalityWeightedLbConfig() != nil; got != c.want {
+			t.Errorf("%s: got locality weighted lb config %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestBuildClustersHealthyPanicThreshold(t *testing.T) {
+	defer func(threshold uint32, set bool) {
+		healthyPanicThreshold, healthyPanicThresholdSet = threshold, set
+	}(healthyPanicThreshold, healthyPanicThresholdSet)
+
+	service := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	env := buildTestEnv(t, []*model.Service{service})
+	name := model.BuildSubsetKey(model.TrafficDirectionOutbound, "", service.Hostname, service.Ports[0])
+
+	cases := []struct {
+		name      string
+		threshold uint32
+		set       bool
+		expected  *envoy_type.Percent
+	}{
+		{name: "unset", expected: nil},
+		{name: "custom", threshold: 30, set: true, expected: &envoy_type.Percent{Value: 30}},
+		{name: "disabled", threshold: 0, set: true, expected: &envoy_type.Percent{Value: 0}},
+	}
+
+	for _, c := range cases {
+		healthyPanicThreshold, healthyPanicThresholdSet = c.threshold, c.set
+		cluster := findCluster(BuildClusters(env, mock.Router), name)
+		if cluster == nil {
+			t.Fatalf("cluster %s not found", name)
+		}
+		if got := cluster.CommonLbConfig.GetHealthyPanicThreshold(); !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%s: got healthy panic threshold %v, want %v", c.name, got, c.expected)
+		}
+	}
+}
+
+func TestBuildClustersHostRemovalSettings(t *testing.T) {
+	defer func(drain bool, window time.Duration) {
+		drainConnectionsOnHostRemoval, edsUpdateMergeWindow = drain, window
+	}(drainConnectionsOnHostRemoval, edsUpdateMergeWindow)
+
+	edsService := mock.MakeService("eds.default.svc.cluster.local", "10.1.0.0")
+	dnsService := mock.MakeService("dns.default.svc.cluster.local", "10.3.0.0")
+	dnsService.Resolution = model.DNSLB
+	env := buildTestEnv(t, []*model.Service{edsService, dnsService}, &networking.DestinationRule{
+		Name:    edsService.Hostname,
+		Subsets: []*networking.Subset{{Name: "v1", Labels: map[string]string{"version": "v1"}}},
+	})
+	port := edsService.Ports[0]
+
+	cases := []struct {
+		name    string
+		cluster string
+		drain   bool
+		window  time.Duration
+		// settings expected on the cluster
+		expectedDrain  bool
+		expectedWindow *types.Duration
+	}{
+		{
+			name:    "disabled",
+			cluster: model.BuildSubsetKey(model.TrafficDirectionOutbound, "", edsService.Hostname, port),
+		},
+		{
+			name:           "eds",
+			cluster:        model.BuildSubsetKey(model.TrafficDirectionOutbound, "", edsService.Hostname, port),
+			drain:          true,
+			window:         3 * time.Second,
+			expectedDrain:  true,
+			expectedWindow: &types.Duration{Seconds: 3},
+		},
+		{
+			name:           "eds subset",
+			cluster:        model.BuildSubsetKey(model.TrafficDirectionOutbound, "v1", edsService.Hostname, port),
+			drain:          true,
+			window:         3 * time.Second,
+			expectedDrain:  true,
+			expectedWindow: &types.Duration{Seconds: 3},
+		},
+		{
+			name:    "dns",
+			cluster: model.BuildSubsetKey(model.TrafficDirectionOutbound, "", dnsService.Hostname, dnsService.Ports[0]),
+			drain:   true,
+			window:  3 * time.Second,
+		},
+		{
+			name:          "drain only",
+			cluster:       model.BuildSubsetKey(model.TrafficDirectionOutbound, "", edsService.Hostname, port),
+			drain:         true,
+			expectedDrain: true,
+		},
+	}
+
+	for _, c := range cases {
+		drainConnectionsOnHostRemoval, edsUpdateMergeWindow = c.drain, c.window
+		cluster := findCluster(BuildClusters(env, mock.Router), c.cluster)
+		if cluster == nil {
+			t.Fatalf("%s: cluster %s not found", c.name, c.cluster)
+		}
+		if cluster.DrainConnectionsOnHostRemoval != c.expectedDrain {
+			t.Errorf("%s: got drain connections on host removal %v, want %v", c.name,
+				cluster.DrainConnectionsOnHostRemoval, c.expectedDrain)
+		}
+		if c.expectedWindow != nil && cluster.CommonLbConfig == nil {
+			t.Errorf("%s: got no common lb config, want an update merge window", c.name)
+		}
+		if got := cluster.CommonLbConfig.GetUpdateMergeWindow(); !reflect.DeepEqual(got, c.expectedWindow) {
+			t.Errorf("%s: got update merge window %v, want %v", c.name, got, c.expectedWindow)
+		}
+	}
+}
+
+func TestBuildClustersUpstreamBindConfig(t *testing.T) {
+	defer func(address string) { upstreamSourceAddress = address }(upstreamSourceAddress)
+
+	service := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	env := buildTestEnv(t, []*model.Service{service}, &networking.DestinationRule{
+		Name:    service.Hostname,
+		Subsets: []*networking.Subset{{Name: "v1", Labels: map[string]string{"version": "v1"}}},
+	})
+	sidecar := model.Proxy{
+		Type:      model.Sidecar,
+		IPAddress: mock.MakeIP(service, 0),
+		ID:        "v0.default",
+		Domain:    "default.svc.cluster.local",
+	}
+	port := service.Ports[0]
+	outbound := []string{
+		model.BuildSubsetKey(model.TrafficDirectionOutbound, "", service.Hostname, port),
+		model.BuildSubsetKey(model.TrafficDirectionOutbound, "v1", service.Hostname, port),
+	}
+	inbound := model.BuildSubsetKey(model.TrafficDirectionInbound, "", service.Hostname, port)
+
+	for _, address := range []string{"", "192.168.1.10", "fd00::10"} {
+		upstreamSourceAddress = address
+		var expected *core.BindConfig
+		if address != "" {
+			expected = &core.BindConfig{
+				SourceAddress: core.SocketAddress{
+					Address:       address,
+					PortSpecifier: &core.SocketAddress_PortValue{PortValue: 0},
+				},
+			}
+		}
+
+		clusters := BuildClusters(env, sidecar)
+		for _, name := range outbound {
+			cluster := findCluster(clusters, name)
+			if cluster == nil {
+				t.Fatalf("cluster %s not found", name)
+			}
+			if !reflect.DeepEqual(cluster.UpstreamBindConfig, expected) {
+				t.Errorf("source address %q: cluster %s got bind config %v, want %v", address, name, cluster.UpstreamBindConfig, expected)
+			}
+		}
+		// connections to the local workload are not bound to the source address
+		if cluster := findCluster(clusters, inbound); cluster == nil || cluster.UpstreamBindConfig != nil {
+			t.Errorf("source address %q: cluster %s got bind config, want none", address, inbound)
+		}
+	}
+}
+
+func TestUpdateEdsRefreshDelay(t *testing.T) {
+	defer func(pushOnly bool) { edsPushOnly = pushOnly }(edsPushOnly)
+
+	defaultRefresh, _ := ptypes.Duration(model.DefaultMeshConfig().RdsRefreshDelay)
+	refresh := func(d time.Duration) *time.Duration { return &d }
+	cases := []struct {
+		name     string
+		pushOnly bool
+		mesh     time.Duration
+		expected *time.Duration
+	}{
+		{name: "mesh refresh delay", mesh: 3 * time.Second, expected: refresh(3 * time.Second)},
+		{name: "zero refresh delay uses the default", mesh: 0, expected: refresh(defaultRefresh)},
+		{name: "push only", pushOnly: true, mesh: 0, expected: nil},
+		{name: "push only ignores the mesh refresh delay", pushOnly: true, mesh: 3 * time.Second, expected: nil},
+	}
+
+	for _, c := range cases {
+		edsPushOnly = c.pushOnly
+		env := buildTestEnv(t, nil)
+		env.Mesh.RdsRefreshDelay = ptypes.DurationProto(c.mesh)
+
+		cluster := &v2.Cluster{Name: "outbound|http||hello.default.svc.cluster.local", Type: v2.Cluster_EDS}
+		updateEds(env, cluster, cluster.Name)
+		got := cluster.EdsClusterConfig.GetEdsConfig().GetApiConfigSource().GetRefreshDelay()
+		if !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%s: got refresh delay %v, want %v", c.name, got, c.expected)
+		}
+	}
+}
+
+func TestUpdateEdsConfigSource(t *testing.T) {
+	defer func(useADS bool) { edsUseADS = useADS }(edsUseADS)
+
+	env := buildTestEnv(t, nil)
+	name := "outbound|http||hello.default.svc.cluster.local"
+	refresh := time.Second
+
+	cases := []struct {
+		name     string
+		useADS   bool
+		expected *core.ConfigSource
+	}{
+		{
+			name: "grpc",
+			expected: &core.ConfigSource{
+				ConfigSourceSpecifier: &core.ConfigSource_ApiConfigSource{
+					ApiConfigSource: &core.ApiConfigSource{
+						ApiType:      core.ApiConfigSource_GRPC,
+						ClusterNames: []string{xdsName},
+						RefreshDelay: &refresh,
+					},
+				},
+			},
+		},
+		{
+			name:   "ads",
+			useADS: true,
+			expected: &core.ConfigSource{
+				ConfigSourceSpecifier: &core.ConfigSource_Ads{
+					Ads: &core.AggregatedConfigSource{},
+				},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		edsUseADS = c.useADS
+		cluster := &v2.Cluster{Name: name, Type: v2.Cluster_EDS}
+		updateEds(env, cluster, name)
+		if cluster.EdsClusterConfig.GetServiceName() != name {
+			t.Errorf("%s: got service name %q, want %q", c.name, cluster.EdsClusterConfig.GetServiceName(), name)
+		}
+		if got := cluster.EdsClusterConfig.GetEdsConfig(); !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%s: got eds config %v, want %v", c.name, got, c.expected)
+		}
+	}
+}
+
+func TestBuildClustersEDSServiceNameOverrides(t *testing.T) {
+	defer func(overrides map[string]string) { edsServiceNameOverrides = overrides }(edsServiceNameOverrides)
+
+	service := mock.MakeService("reviews.default.svc.cluster.local", "10.1.0.0")
+	port := service.Ports[0]
+	env := buildTestEnv(t, []*model.Service{service}, &networking.DestinationRule{
+		Name:    service.Hostname,
+		Subsets: []*networking.Subset{{Name: "v1", Labels: map[string]string{"version": "v1"}}},
+	})
+
+	subsetKey := model.BuildSubsetServiceKey(model.TrafficDirectionOutbound, "v1", service.Hostname, port)
+	serviceKey := model.BuildSubsetServiceKey(model.TrafficDirectionOutbound, "", service.Hostname, port)
+	aliasKey := model.BuildSubsetServiceKey(model.TrafficDirectionOutbound, "", "reviews.prod.svc.cluster.local", port)
+	edsServiceNameOverrides = parseEDSServiceNameOverrides([]string{
+		subsetKey + "=" + serviceKey,
+		serviceKey + "=" + aliasKey,
+		"reviews=outbound|http||reviews.default.svc.cluster.local",
+		"outbound|http||ratings.default.svc.cluster.local",
+	})
+	if len(edsServiceNameOverrides) != 2 {
+		t.Errorf("got overrides %v, want the 2 valid ones", edsServiceNameOverrides)
+	}
+
+	clusters := BuildClusters(env, mock.Router)
+	cases := []struct {
+		subset   string
+		expected string
+	}{
+		// the subset cluster shares the endpoints of the service
+		{"v1", serviceKey},
+		// the service cluster points at an alias
+		{"", aliasKey},
+	}
+	for _, c := range cases {
+		name := model.BuildSubsetKey(model.TrafficDirectionOutbound, c.subset, service.Hostname, port)
+		cluster := findCluster(clusters, name)
+		if cluster == nil {
+			t.Errorf("cluster %s not found", name)
+			continue
+		}
+		if got := cluster.EdsClusterConfig.GetServiceName(); got != c.expected {
+			t.Errorf("cluster %s: got EDS service name %q, want %q", name, got, c.expected)
+		}
+	}
+
+	// clusters without an override keep their own key
+	other := model.BuildSubsetKey(model.TrafficDirectionOutbound, "", service.Hostname, service.Ports[1])
+	if cluster := findCluster(clusters, other); cluster == nil || cluster.EdsClusterConfig.GetServiceName() != other {
+		t.Errorf("cluster %s: got EDS config %v, want the cluster name", other, cluster)
+	}
+}
+
+func TestBuildClustersLongHostname(t *testing.T) {
+	defer func(length int) { model.MaxClusterNameLength = length }(model.MaxClusterNameLength)
+	model.MaxClusterNameLength = 60
+
+	service := mock.MakeService("a-very-long-service-name-exceeding-the-limit.some-namespace.svc.cluster.local",
+		"10.1.0.0")
+	env := buildTestEnv(t, []*model.Service{service}, &networking.DestinationRule{
+		Name: service.Hostname,
+		Subsets: []*networking.Subset{
+			{
+				Name:   "a-long-subset-name",
+				Labels: map[string]string{"version": "v1"},
+			},
+		},
+	})
+
+	clusters := BuildClusters(env, mock.Router)
+	for _, subset := range []string{"", "a-long-subset-name"} {
+		port := service.Ports[0]
+		name := model.BuildSubsetKey(model.TrafficDirectionOutbound, subset, service.Hostname, port)
+		if len(name) > model.MaxClusterNameLength {
+			t.Errorf("got cluster name %q of length %d, want at most %d", name, len(name), model.MaxClusterNameLength)
+		}
+		cluster := findCluster(clusters, name)
+		if cluster == nil {
+			t.Fatalf("cluster %s not found", name)
+		}
+		serviceKey := model.BuildSubsetServiceKey(model.TrafficDirectionOutbound, subset, service.Hostname, port)
+		if got := cluster.EdsClusterConfig.GetServiceName(); got != serviceKey {
+			t.Errorf("got eds service name %q, want %q", got, serviceKey)
+		}
+	}
+}
+
+func TestBuildClustersInvalidPort(t *testing.T) {
+	service := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	valid := service.Ports
+	service.Ports = append(model.PortList{nil, {Name: "invalid", Port: 0, Protocol: model.ProtocolHTTP}}, valid...)
+	env := buildTestEnv(t, []*model.Service{service})
+
+	clusters := BuildClusters(env, mock.Router)
+	for _, port := range valid {
+		name := model.BuildSubsetKey(model.TrafficDirectionOutbound, "", service.Hostname, port)
+		if findCluster(clusters, name) == nil {
+			t.Errorf("cluster %s not found", name)
+		}
+	}
+	invalid := model.BuildSubsetKey(model.TrafficDirectionOutbound, "", service.Hostname, &model.Port{Name: "invalid"})
+	if findCluster(clusters, invalid) != nil {
+		t.Errorf("got cluster %s for an invalid port", invalid)
+	}
+}
+
+func TestBuildClustersServicesError(t *testing.T) {
+	service := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	env := buildTestEnv(t, []*model.Service{service})
+	env.ServiceDiscovery.(*mock.ServiceDiscovery).ServicesError = errors.New("registry unavailable")
+
+	clusters := BuildClusters(env, mock.HelloProxyV0)
+	if len(clusters) == 0 {
+		t.Fatal("got no clusters, want the inbound clusters")
+	}
+	for _, cluster := range clusters {
+		if strings.HasPrefix(cluster.Name, string(model.TrafficDirectionOutbound)) {
+			t.Errorf("got outbound cluster %s without services", cluster.Name)
+		}
+	}
+	for _, port := range service.Ports {
+		name := model.BuildSubsetKey(model.TrafficDirectionInbound, "", service.Hostname, port)
+		if findCluster(clusters, name) == nil {
+			t.Errorf("inbound cluster %s not found", name)
+		}
+	}
+}
+
+func TestBuildClustersInboundBindAddress(t *testing.T) {
+	service := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	env := buildTestEnv(t, []*model.Service{service})
+
+	cases := []struct {
+		name     string
+		metadata map[string]string
+		expected string
+	}{
+		{name: "default", expected: "127.0.0.1"},
+		{name: "ipv6 loopback", metadata: map[string]string{model.NodeMetadataInboundBindAddress: "::1"}, expected: "::1"},
+		{name: "pod ip", metadata: map[string]string{model.NodeMetadataInboundBindAddress: "10.60.1.6"}, expected: "10.60.1.6"},
+		{name: "invalid", metadata: map[string]string{model.NodeMetadataInboundBindAddress: "localhost"}, expected: "127.0.0.1"},
+	}
+
+	for _, c := range cases {
+		proxy := model.Proxy{
+			Type:      model.Sidecar,
+			IPAddress: mock.MakeIP(service, 0),
+			ID:        "v0.default",
+			Domain:    "default.svc.cluster.local",
+			Metadata:  c.metadata,
+		}
+		clusters := BuildClusters(env, proxy)
+		names := []string{
+			model.BuildSubsetKey(model.TrafficDirectionInbound, "", service.Hostname, service.Ports[0]),
+			model.BuildSubsetKey(model.TrafficDirectionInbound, "", ManagementClusterHostname, env.ManagementPorts("")[0]),
+		}
+		for _, name := range names {
+			cluster := findCluster(clusters, name)
+			if cluster == nil {
+				t.Fatalf("%s: cluster %s not found", c.name, name)
+			}
+			if got := cluster.Hosts[0].GetSocketAddress().GetAddress(); got != c.expected {
+				t.Errorf("%s: cluster %s got address %q, want %q", c.name, name, got, c.expected)
+			}
+		}
+	}
+}
+
+func TestBuildInboundClustersEndpointProtocol(t *testing.T) {
+	// the common http protocol options are only set with a connection timeout
+	defer func(timeout time.Duration) { httpIdleTimeout = timeout }(httpIdleTimeout)
+	httpIdleTimeout = time.Minute
+
+	service := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	env := buildTestEnv(t, []*model.Service{service})
+	httpPort, tcpPort := service.Ports[0], service.Ports[2]
+
+	cases := []struct {
+		name     string
+		port     *model.Port
+		protocol model.Protocol
+		http     bool
+		http2    bool
+	}{
+		{name: "http service port", port: httpPort, http: true},
+		{name: "tcp service port", port: tcpPort},
+		{name: "http2 endpoint behind http service port", port: httpPort, protocol: model.ProtocolHTTP2, http: true, http2: true},
+		{name: "grpc endpoint behind tcp service port", port: tcpPort, protocol: model.ProtocolGRPC, http: true, http2: true},
+		{name: "tcp endpoint behind http service port", port: httpPort, protocol: model.ProtocolTCP},
+	}
+
+	for _, c := range cases {
+		instance := mock.MakeInstance(service, c.port, 0, "")
+		instance.Endpoint.Protocol = c.protocol
+		clusters := buildInboundClusters(env, mock.HelloProxyV0, []*model.ServiceInstance{instance}, nil)
+		if len(clusters) != 1 {
+			t.Fatalf("%s: got %d clusters, want 1", c.name, len(clusters))
+		}
+		cluster := clusters[0]
+		if got := cluster.Http2ProtocolOptions != nil; got != c.http2 {
+			t.Errorf("%s: got http2 protocol options %v, want %v", c.name, got, c.http2)
+		}
+		if got := cluster.CommonHttpProtocolOptions != nil; got != c.http {
+			t.Errorf("%s: got http protocol options %v, want %v", c.name, got, c.http)
+		}
+	}
+}
+
+func TestBuildClustersInboundMaxRequestsPerConnection(t *testing.T) {
+	service := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	env := buildTestEnv(t, []*model.Service{service})
+	serviceCluster := model.BuildSubsetKey(model.TrafficDirectionInbound, "", service.Hostname, service.Ports[0])
+	managementCluster := model.BuildSubsetKey(model.TrafficDirectionInbound, "", ManagementClusterHostname,
+		env.ManagementPorts("")[0])
+
+	cases := []struct {
+		name     string
+		value    string
+		expected uint32
+	}{
+		{name: "unset"},
+		{name: "set", value: "100", expected: 100},
+		{name: "zero", value: "0"},
+		{name: "invalid", value: "many"},
+	}
+
+	for _, c := range cases {
+		proxy := model.Proxy{
+			Type:      model.Sidecar,
+			IPAddress: mock.MakeIP(service, 0),
+			ID:        "v0.default",
+			Domain:    "default.svc.cluster.local",
+		}
+		if c.value != "" {
+			proxy.Metadata = map[string]string{model.NodeMetadataInboundMaxRequestsPerConnection: c.value}
+		}
+		clusters := BuildClusters(env, proxy)
+		cluster := findCluster(clusters, serviceCluster)
+		if cluster == nil {
+			t.Fatalf("%s: cluster %s not found", c.name, serviceCluster)
+		}
+		if got := cluster.MaxRequestsPerConnection.GetValue(); got != c.expected {
+			t.Errorf("%s: got max requests per connection %d, want %d", c.name, got, c.expected)
+		}
+		if cluster.CircuitBreakers != nil {
+			t.Errorf("%s: unexpected circuit breakers %v", c.name, cluster.CircuitBreakers)
+		}
+		if mgmt := findCluster(clusters, managementCluster); mgmt == nil || mgmt.MaxRequestsPerConnection != nil {
+			t.Errorf("%s: management cluster %s not found or with max requests per connection", c.name, managementCluster)
+		}
+	}
+}
+
+func TestBuildClustersInboundTLS(t *testing.T) {
+	service := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	env := buildTestEnv(t, []*model.Service{service})
+	serviceCluster := model.BuildSubsetKey(model.TrafficDirectionInbound, "", service.Hostname, service.Ports[0])
+	managementCluster := model.BuildSubsetKey(model.TrafficDirectionInbound, "", ManagementClusterHostname,
+		env.ManagementPorts("")[0])
+
+	cases := []struct {
+		name     string
+		metadata map[string]string
+		cert     string
+		ca       string
+	}{
+		{name: "plaintext"},
+		{
+			name: "simple",
+			metadata: map[string]string{
+				model.NodeMetadataInboundTLSMode:           "SIMPLE",
+				model.NodeMetadataInboundTLSCaCertificates: "/etc/app/ca.pem",
+			},
+			ca: "/etc/app/ca.pem",
+		},
+		{
+			name:     "simple without ca certificates",
+			metadata: map[string]string{model.NodeMetadataInboundTLSMode: "SIMPLE"},
+		},
+		{
+			name:     "istio mutual",
+			metadata: map[string]string{model.NodeMetadataInboundTLSMode: "ISTIO_MUTUAL"},
+			cert:     path.Join(model.AuthCertsPath, model.CertChainFilename),
+			ca:       path.Join(model.AuthCertsPath, model.RootCertFilename),
+		},
+		{
+			name:     "invalid mode",
+			metadata: map[string]string{model.NodeMetadataInboundTLSMode: "STRICT"},
+		},
+	}
+
+	for _, c := range cases {
+		proxy := model.Proxy{
+			Type:      model.Sidecar,
+			IPAddress: mock.MakeIP(service, 0),
+			ID:        "v0.default",
+			Domain:    "default.svc.cluster.local",
+			Metadata:  c.metadata,
+		}
+		clusters := BuildClusters(env, proxy)
+		cluster := findCluster(clusters, serviceCluster)
+		if cluster == nil {
+			t.Fatalf("%s: cluster %s not found", c.name, serviceCluster)
+		}
+		if c.ca == "" {
+			if cluster.TlsContext != nil {
+				t.Errorf("%s: got tls context %v, want plaintext", c.name, cluster.TlsContext)
+			}
+		} else {
+			common := cluster.TlsContext.GetCommonTlsContext()
+			if got := common.GetValidationContext().GetTrustedCa().GetFilename(); got != c.ca {
+				t.Errorf("%s: got ca certificates %q, want %q", c.name, got, c.ca)
+			}
+			var cert string
+			if len(common.GetTlsCertificates()) > 0 {
+				cert = common.GetTlsCertificates()[0].GetCertificateChain().GetFilename()
+			}
+			if cert != c.cert {
+				t.Errorf("%s: got certificate chain %q, want %q", c.name, cert, c.cert)
+			}
+		}
+		if mgmt := findCluster(clusters, managementCluster); mgmt == nil || mgmt.TlsContext != nil {
+			t.Errorf("%s: got management cluster %v, want plaintext", c.name, mgmt)
+		}
+	}
+}
+
+func TestBuildClustersAltStatName(t *testing.T) {
+	defer func(enabled bool) { enableAltStatName = enabled }(enableAltStatName)
+
+	service := mock.MakeService("hello-world.default.svc.cluster.local", "10.1.0.0")
+	env := buildTestEnv(t, []*model.Service{service}, &networking.DestinationRule{
+		Name:    service.Hostname,
+		Subsets: []*networking.Subset{{Name: "v1.beta", Labels: map[string]string{"version": "v1"}}},
+	})
+	sidecar := model.Proxy{
+		Type:      model.Sidecar,
+		IPAddress: mock.MakeIP(service, 0),
+		ID:        "v0.default",
+		Domain:    "default.svc.cluster.local",
+	}
+	port := service.Ports[0]
+
+	cases := []struct {
+		cluster  string
+		expected string
+	}{
+		{
+			cluster:  model.BuildSubsetKey(model.TrafficDirectionOutbound, "", service.Hostname, port),
+			expected: "outbound_hello_world_80",
+		},
+		{
+			cluster:  model.BuildSubsetKey(model.TrafficDirectionOutbound, "v1.beta", service.Hostname, port),
+			expected: "outbound_hello_world_v1_beta_80",
+		},
+		{
+			cluster:  model.BuildSubsetKey(model.TrafficDirectionInbound, "", service.Hostname, port),
+			expected: "inbound_hello_world_80",
+		},
+	}
+
+	for _, enabled := range []bool{false, true} {
+		enableAltStatName = enabled
+		clusters := BuildClusters(env, sidecar)
+		for _, c := range cases {
+			cluster := findCluster(clusters, c.cluster)
+			if cluster == nil {
+				t.Fatalf("cluster %s not found", c.cluster)
+			}
+			expected := c.expected
+			if !enabled {
+				expected = ""
+			}
+			if cluster.AltStatName != expected {
+				t.Errorf("%s (enabled %v): got alt stat name %q, want %q", c.cluster, enabled, cluster.AltStatName, expected)
+			}
+		}
+	}
+}
+
+func TestBuildClustersCommonHTTPProtocolOptions(t *testing.T) {
+	defer func(idle time.Duration) { httpIdleTimeout = idle }(httpIdleTimeout)
+	httpIdleTimeout = time.Minute
+
+	service := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	env := buildTestEnv(t, []*model.Service{service})
+	idleTimeout := time.Minute
+	expected := &core.HttpProtocolOptions{IdleTimeout: &idleTimeout}
+
+	clusters := BuildClusters(env, mock.Router)
+	for _, port := range service.Ports {
+		name := model.BuildSubsetKey(model.TrafficDirectionOutbound, "", service.Hostname, port)
+		cluster := findCluster(clusters, name)
+		if cluster == nil {
+			t.Fatalf("cluster %s not found", name)
+		}
+		if !port.Protocol.IsHTTP() {
+			if cluster.CommonHttpProtocolOptions != nil {
+				t.Errorf("cluster %s: unexpected http protocol options %v", name, cluster.CommonHttpProtocolOptions)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(cluster.CommonHttpProtocolOptions, expected) {
+			t.Errorf("cluster %s: got http protocol options %v, want %v", name, cluster.CommonHttpProtocolOptions, expected)
+		}
+	}
+
+	httpIdleTimeout = 0
+	name := model.BuildSubsetKey(model.TrafficDirectionOutbound, "", service.Hostname, service.Ports[0])
+	if cluster := findCluster(BuildClusters(env, mock.Router), name); cluster.CommonHttpProtocolOptions != nil {
+		t.Errorf("cluster %s: got http protocol options %v, want none", name, cluster.CommonHttpProtocolOptions)
+	}
+}
+
+func TestBuildClustersHTTPIdleTimeout(t *testing.T) {
+	defer func(idle time.Duration) { httpIdleTimeout = idle }(httpIdleTimeout)
+	httpIdleTimeout = time.Minute
+
+	service := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	service.Ports = append(service.Ports, &model.Port{
+		Name:                 "grpc",
+		Port:                 120,
+		Protocol:             model.ProtocolGRPC,
+		AuthenticationPolicy: meshconfig.AuthenticationPolicy_INHERIT,
+	})
+	httpPort, tcpPort, grpcPort := service.Ports[0], service.Ports[2], service.Ports[len(service.Ports)-1]
+	idleTimeout := func(seconds int64) *networking.ConnectionPoolSettings {
+		return &networking.ConnectionPoolSettings{
+			Http: &networking.ConnectionPoolSettings_HTTPSettings{IdleTimeout: &types.Duration{Seconds: seconds}},
+		}
+	}
+	env := buildTestEnv(t, []*model.Service{service}, &networking.DestinationRule{
+		Name:          service.Hostname,
+		TrafficPolicy: &networking.TrafficPolicy{ConnectionPool: idleTimeout(30)},
+		Subsets: []*networking.Subset{
+			{Name: "v1", Labels: map[string]string{"version": "v1"}},
+			{
+				Name:          "v2",
+				Labels:        map[string]string{"version": "v2"},
+				TrafficPolicy: &networking.TrafficPolicy{ConnectionPool: idleTimeout(10)},
+			},
+		},
+	})
+	clusters := BuildClusters(env, mock.Router)
+
+	cases := []struct {
+		subset  string
+		port    *model.Port
+		timeout time.Duration
+	}{
+		{"", httpPort, 30 * time.Second},
+		{"", grpcPort, 30 * time.Second},
+		{"", tcpPort, 0},
+		{"v1", httpPort, 30 * time.Second},
+		{"v2", httpPort, 10 * time.Second},
+		{"v2", grpcPort, 10 * time.Second},
+	}
+
+	for _, c := range cases {
+		name := model.BuildSubsetKey(model.TrafficDirectionOutbound, c.subset, service.Hostname, c.port)
+		cluster := findCluster(clusters, name)
+		if cluster == nil {
+			t.Errorf("cluster %s not found", name)
+			continue
+		}
+		if c.timeout == 0 {
+			if cluster.CommonHttpProtocolOptions != nil {
+				t.Errorf("cluster %s: got http protocol options %v, want none", name, cluster.CommonHttpProtocolOptions)
+			}
+			continue
+		}
+		options := cluster.CommonHttpProtocolOptions
+		if options.GetIdleTimeout() == nil || *options.IdleTimeout != c.timeout {
+			t.Errorf("cluster %s: got idle timeout %v, want %v", name, options.GetIdleTimeout(), c.timeout)
+		}
+	}
+}
+
+func TestBuildClustersCloseConnectionsOnHostHealthFailure(t *testing.T) {
+	defer func(interval time.Duration, closeConnections bool) {
+		healthCheckInterval, closeConnectionsOnHostHealthFailure = interval, closeConnections
+	}(healthCheckInterval, closeConnectionsOnHostHealthFailure)
+
+	dnsService := mock.MakeService("dns.default.svc.cluster.local", "10.1.0.0")
+	dnsService.Resolution = model.DNSLB
+	edsService := mock.MakeService("eds.default.svc.cluster.local", "10.2.0.0")
+	env := buildTestEnv(t, []*model.Service{dnsService, edsService})
+	dnsCluster := model.BuildSubsetKey(model.TrafficDirectionOutbound, "", dnsService.Hostname, dnsService.Ports[2])
+	edsCluster := model.BuildSubsetKey(model.TrafficDirectionOutbound, "", edsService.Hostname, edsService.Ports[2])
+
+	cases := []struct {
+		name     string
+		interval time.Duration
+		close    bool
+		cluster  string
+		expected bool
+	}{
+		{name: "health checked", interval: 10 * time.Second, close: true, cluster: dnsCluster, expected: true},
+		{name: "flag unset", interval: 10 * time.Second, cluster: dnsCluster},
+		{name: "health checking disabled", close: true, cluster: dnsCluster},
+		{name: "not health checked", interval: 10 * time.Second, close: true, cluster: edsCluster},
+	}
+
+	for _, c := range cases {
+		healthCheckInterval, closeConnectionsOnHostHealthFailure = c.interval, c.close
+		cluster := findCluster(BuildClusters(env, mock.Router), c.cluster)
+		if cluster == nil {
+			t.Fatalf("%s: cluster %s not found", c.name, c.cluster)
+		}
+		if cluster.CloseConnectionsOnHostHealthFailure != c.expected {
+			t.Errorf("%s: got close connections on host health failure %v, want %v",
+				c.name, cluster.CloseConnectionsOnHostHealthFailure, c.expected)
+		}
+	}
+}
+
+func TestBuildClustersProtocolOverrides(t *testing.T) {
+	defer func(overrides map[string]model.Protocol) { protocolOverrides = overrides }(protocolOverrides)
+	protocolOverrides = parseProtocolOverrides([]string{
+		"hello.default.svc.cluster.local:90=HTTP2",
+		"world.default.svc.cluster.local:90=grpc",
+		"invalid",
+		"hello.default.svc.cluster.local:http=HTTP2",
+		"hello.default.svc.cluster.local:100=SMTP",
+	})
+	expected := map[string]model.Protocol{
+		"hello.default.svc.cluster.local:90": model.ProtocolHTTP2,
+		"world.default.svc.cluster.local:90": model.ProtocolGRPC,
+	}
+	if !reflect.DeepEqual(protocolOverrides, expected) {
+		t.Errorf("got protocol overrides %v, want %v", protocolOverrides, expected)
+	}
+
+	service := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	env := buildTestEnv(t, []*model.Service{service})
+	clusters := BuildClusters(env, mock.Router)
+
+	cases := []struct {
+		port  string
+		http2 bool
+	}{
+		{"custom", true},
+		{"mongo", false},
+	}
+	for _, c := range cases {
+		port, _ := service.Ports.Get(c.port)
+		name := model.BuildSubsetKey(model.TrafficDirectionOutbound, "", service.Hostname, port)
+		cluster := findCluster(clusters, name)
+		if cluster == nil {
+			t.Fatalf("cluster %s not found", name)
+		}
+		if got := cluster.Http2ProtocolOptions != nil; got != c.http2 {
+			t.Errorf("cluster %s: got http2 options %v, want %v", name, cluster.Http2ProtocolOptions, c.http2)
+		}
+	}
+}
+
+func TestBuildClustersPerConnectionBufferLimit(t *testing.T) {
+	defer func(limit uint32, set bool, overrides map[string]uint32) {
+		perConnectionBufferLimitBytes, perConnectionBufferLimitBytesSet = limit, set
+		perConnectionBufferLimitOverrides = overrides
+	}(perConnectionBufferLimitBytes, perConnectionBufferLimitBytesSet, perConnectionBufferLimitOverrides)
+	perConnectionBufferLimitBytes, perConnectionBufferLimitBytesSet = 32768, true
+	perConnectionBufferLimitOverrides = parsePerConnectionBufferLimitOverrides([]string{
+		"world.default.svc.cluster.local=8388608",
+		"invalid",
+		"=1024",
+		"hello.default.svc.cluster.local=1MiB",
+	})
+	expected := map[string]uint32{"world.default.svc.cluster.local": 8388608}
+	if !reflect.DeepEqual(perConnectionBufferLimitOverrides, expected) {
+		t.Errorf("got buffer limit overrides %v, want %v", perConnectionBufferLimitOverrides, expected)
+	}
+
+	hello := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	world := mock.MakeService("world.default.svc.cluster.local", "10.2.0.0")
+	env := buildTestEnv(t, []*model.Service{hello, world}, &networking.DestinationRule{
+		Name:    world.Hostname,
+		Subsets: []*networking.Subset{{Name: "v1", Labels: map[string]string{"version": "v1"}}},
+	})
+	clusters := BuildClusters(env, mock.Router)
+
+	cases := []struct {
+		name     string
+		expected uint32
+	}{
+		{model.BuildSubsetKey(model.TrafficDirectionOutbound, "", hello.Hostname, hello.Ports[0]), 32768},
+		{model.BuildSubsetKey(model.TrafficDirectionOutbound, "", world.Hostname, world.Ports[0]), 8388608},
+		{model.BuildSubsetKey(model.TrafficDirectionOutbound, "v1", world.Hostname, world.Ports[0]), 8388608},
+		{BlackHoleCluster, 32768},
+	}
+	for _, c := range cases {
+		cluster := findCluster(clusters, c.name)
+		if cluster == nil {
+			t.Errorf("cluster %s not found", c.name)
+			continue
+		}
+		if got := cluster.PerConnectionBufferLimitBytes.GetValue(); got != c.expected {
+			t.Errorf("cluster %s: got buffer limit %d, want %d", c.name, got, c.expected)
+		}
+	}
+
+	// the Envoy default is kept if unset
+	perConnectionBufferLimitBytesSet = false
+	name := cases[0].name
+	if cluster := findCluster(BuildClusters(env, mock.Router), name); cluster.PerConnectionBufferLimitBytes != nil {
+		t.Errorf("cluster %s: got buffer limit %v, want none", name, cluster.PerConnectionBufferLimitBytes)
+	}
+}
+
+func TestBuildClustersWellKnown(t *testing.T) {
+	service := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	env := buildTestEnv(t, []*model.Service{service})
+
+	for _, proxy := range []model.Proxy{mock.HelloProxyV0, mock.Router, mock.Ingress} {
+		count := map[string]int{}
+		for _, cluster := range BuildClusters(env, proxy) {
+			count[cluster.Name]++
+		}
+		for _, name := range []string{BlackHoleCluster, PassthroughCluster} {
+			if count[name] != 1 {
+				t.Errorf("%s: got %d clusters %s, want 1", proxy.Type, count[name], name)
+			}
+		}
+	}
+
+	clusters := BuildClusters(env, mock.Router)
+	blackHole := findCluster(clusters, BlackHoleCluster)
+	if blackHole.Type != v2.Cluster_STATIC || len(blackHole.Hosts) != 0 {
+		t.Errorf("got black hole cluster %v, want STATIC without hosts", blackHole)
+	}
+	passthrough := findCluster(clusters, PassthroughCluster)
+	if passthrough.Type != v2.Cluster_ORIGINAL_DST || passthrough.LbPolicy != v2.Cluster_ORIGINAL_DST_LB {
+		t.Errorf("got passthrough cluster %v, want ORIGINAL_DST", passthrough)
+	}
+}
+
+func TestBuildClustersOutboundTrafficPolicy(t *testing.T) {
+	service := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+
+	cases := []struct {
+		name        string
+		policy      *meshconfig.MeshConfig_OutboundTrafficPolicy
+		passthrough bool
+	}{
+		{
+			name:        "allow any",
+			policy:      &meshconfig.MeshConfig_OutboundTrafficPolicy{Mode: meshconfig.MeshConfig_OutboundTrafficPolicy_ALLOW_ANY},
+			passthrough: true,
+		},
+		{
+			name:   "registry only",
+			policy: &meshconfig.MeshConfig_OutboundTrafficPolicy{Mode: meshconfig.MeshConfig_OutboundTrafficPolicy_REGISTRY_ONLY},
+		},
+		{
+			name:        "missing policy",
+			passthrough: true,
+		},
+	}
+
+	for _, c := range cases {
+		env := buildTestEnv(t, []*model.Service{service})
+		env.Mesh.OutboundTrafficPolicy = c.policy
+		clusters := BuildClusters(env, mock.HelloProxyV0)
+		if got := findCluster(clusters, PassthroughCluster) != nil; got != c.passthrough {
+			t.Errorf("%s: got passthrough cluster %v, want %v", c.name, got, c.passthrough)
+		}
+		if findCluster(clusters, BlackHoleCluster) == nil {
+			t.Errorf("%s: black hole cluster not found", c.name)
+		}
+	}
+}
+
+func TestBuildClustersRegistryOnly(t *testing.T) {
+	service := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	catchAll := &model.Service{
+		Hostname:     "*",
+		Address:      "0.0.0.0",
+		MeshExternal: true,
+		Resolution:   model.Passthrough,
+		Ports:        model.PortList{{Name: "http", Port: 80, Protocol: model.ProtocolHTTP}},
+	}
+	catchAllCluster := model.BuildSubsetKey(model.TrafficDirectionOutbound, "", catchAll.Hostname, catchAll.Ports[0])
+	serviceCluster := model.BuildSubsetKey(model.TrafficDirectionOutbound, "", service.Hostname, service.Ports[0])
+
+	cases := []struct {
+		mode     meshconfig.MeshConfig_OutboundTrafficPolicy_Mode
+		expected []string
+		missing  []string
+	}{
+		{
+			mode:     meshconfig.MeshConfig_OutboundTrafficPolicy_ALLOW_ANY,
+			expected: []string{serviceCluster, catchAllCluster, PassthroughCluster, BlackHoleCluster},
+		},
+		{
+			mode:     meshconfig.MeshConfig_OutboundTrafficPolicy_REGISTRY_ONLY,
+			expected: []string{serviceCluster, BlackHoleCluster},
+			missing:  []string{catchAllCluster, PassthroughCluster},
+		},
+	}
+
+	for _, c := range cases {
+		env := buildTestEnv(t, []*model.Service{service, catchAll})
+		env.Mesh.OutboundTrafficPolicy = &meshconfig.MeshConfig_OutboundTrafficPolicy{Mode: c.mode}
+		clusters := BuildClusters(env, mock.Router)
+		for _, name := range c.expected {
+			if findCluster(clusters, name) == nil {
+				t.Errorf("%v: cluster %s not found", c.mode, name)
+			}
+		}
+		for _, name := range c.missing {
+			if findCluster(clusters, name) != nil {
+				t.Errorf("%v: unexpected cluster %s", c.mode, name)
+			}
+		}
+	}
+}
+
+func TestBuildClustersDefaultLbPolicy(t *testing.T) {
+	defer func(policy networking.LoadBalancerSettings_SimpleLB) { defaultLbPolicy = policy }(defaultLbPolicy)
+
+	service := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	passthrough := mock.MakeService("passthrough.default.svc.cluster.local", "10.2.0.0")
+	passthrough.Resolution = model.Passthrough
+	env := buildTestEnv(t, []*model.Service{service, passthrough})
+	name := model.BuildSubsetKey(model.TrafficDirectionOutbound, "", service.Hostname, service.Ports[0])
+	passthroughName := model.BuildSubsetKey(model.TrafficDirectionOutbound, "", passthrough.Hostname, passthrough.Ports[0])
+
+	cases := []struct {
+		policy   networking.LoadBalancerSettings_SimpleLB
+		expected v2.Cluster_LbPolicy
+	}{
+		{networking.LoadBalancerSettings_ROUND_ROBIN, v2.Cluster_ROUND_ROBIN},
+		{networking.LoadBalancerSettings_LEAST_CONN, v2.Cluster_LEAST_REQUEST},
+	}
+	for _, c := range cases {
+		defaultLbPolicy = c.policy
+		clusters := BuildClusters(env, mock.Router)
+		if got := findCluster(clusters, name).LbPolicy; got != c.expected {
+			t.Errorf("%v: got lb policy %v, want %v", c.policy, got, c.expected)
+		}
+		if got := findCluster(clusters, passthroughName).LbPolicy; got != v2.Cluster_ORIGINAL_DST_LB {
+			t.Errorf("%v: got passthrough lb policy %v, want %v", c.policy, got, v2.Cluster_ORIGINAL_DST_LB)
+		}
+	}
+}
+
+func TestEnvDefaultLbPolicy(t *testing.T) {
+	defer os.Unsetenv("PILOT_DEFAULT_LB_POLICY")
+
+	cases := []struct {
+		value    string
+		expected networking.LoadBalancerSettings_SimpleLB
+	}{
+		{"", networking.LoadBalancerSettings_ROUND_ROBIN},
+		{"LEAST_CONN", networking.LoadBalancerSettings_LEAST_CONN},
+		{"PASSTHROUGH", networking.LoadBalancerSettings_ROUND_ROBIN},
+		{"FASTEST", networking.LoadBalancerSettings_ROUND_ROBIN},
+	}
+	for _, c := range cases {
+		os.Setenv("PILOT_DEFAULT_LB_POLICY", c.value)
+		if got := envDefaultLbPolicy(); got != c.expected {
+			t.Errorf("%q: got %v, want %v", c.value, got, c.expected)
+		}
+	}
+}
+
+func TestApplyUpstreamTLSSettingsSimpleWithoutCA(t *testing.T) {
+	defer func(ca string) { upstreamSystemCACertificates = ca }(upstreamSystemCACertificates)
+
+	cases := []struct {
+		name       string
+		ca         string
+		systemCA   string
+		sans       []string
+		expected   *auth.CertificateValidationContext
+		unverified bool
+	}{
+		{
+			name: "ca certificates",
+			ca:   "/etc/certs/ca.pem",
+			expected: &auth.CertificateValidationContext{
+				TrustedCa: &core.DataSource{Specifier: &core.DataSource_Filename{Filename: "/etc/certs/ca.pem"}},
+			},
+		},
+		{
+			name:     "system ca certificates",
+			systemCA: "/etc/ssl/certs/ca-certificates.crt",
+			expected: &auth.CertificateValidationContext{
+				TrustedCa: &core.DataSource{Specifier: &core.DataSource_Filename{Filename: "/etc/ssl/certs/ca-certificates.crt"}},
+			},
+		},
+		{
+			name:     "ca certificates override the system ones",
+			ca:       "/etc/certs/ca.pem",
+			systemCA: "/etc/ssl/certs/ca-certificates.crt",
+			expected: &auth.CertificateValidationContext{
+				TrustedCa: &core.DataSource{Specifier: &core.DataSource_Filename{Filename: "/etc/certs/ca.pem"}},
+			},
+		},
+		{
+			name:       "no ca certificates",
+			unverified: true,
+		},
+		{
+			// the subject alt names cannot be verified without CA certificates
+			name:       "no ca certificates with subject alt names",
+			sans:       []string{"api.example.com"},
+			unverified: true,
+		},
+	}
+
+	for _, c := range cases {
+		upstreamSystemCACertificates = c.systemCA
+		before := new(dto.Metric)
+		_ = unverifiedUpstreamClusters.Write(before)
+		cluster := &v2.Cluster{Name: "outbound|443||api.example.com"}
+		applyUpstreamTLSSettings(cluster, &networking.TLSSettings{
+			Mode:            networking.TLSSettings_SIMPLE,
+			CaCertificates:  c.ca,
+			SubjectAltNames: c.sans,
+			Sni:             "api.example.com",
+		}, clusterContext{})
+		after := new(dto.Metric)
+		_ = unverifiedUpstreamClusters.Write(after)
+
+		if cluster.TlsContext == nil || cluster.TlsContext.Sni != "api.example.com" {
+			t.Fatalf("%s: got tls context %v, want sni api.example.com", c.name, cluster.TlsContext)
+		}
+		if got := cluster.TlsContext.CommonTlsContext.ValidationContext; !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%s: got validation context %v, want %v", c.name, got, c.expected)
+		}
+		if counted := after.GetCounter().GetValue() > before.GetCounter().GetValue(); counted != c.unverified {
+			t.Errorf("%s: got unverified cluster counted %v, want %v", c.name, counted, c.unverified)
+		}
+	}
+}
+
+func TestApplyUpstreamTLSSettingsSds(t *testing.T) {
+	defer func(path string) { sdsUdsPath = path }(sdsUdsPath)
+	sdsUdsPath = "/var/run/sds/uds_path"
+
+	cases := []struct {
+		name        string
+		tls         *networking.TLSSettings
+		certificate string
+		validation  string
+	}{
+		{
+			name:        "istio mutual",
+			tls:         &networking.TLSSettings{Mode: networking.TLSSettings_ISTIO_MUTUAL},
+			certificate: "default",
+			validation:  "ROOTCA",
+		},
+		{
+			name: "istio mutual with subject alt names",
+			tls: &networking.TLSSettings{
+				Mode:            networking.TLSSettings_ISTIO_MUTUAL,
+				SubjectAltNames: []string{"spiffe://cluster.local/ns/default/sa/hello"},
+			},
+			certificate: "default",
+		},
+		{
+			name: "mutual",
+			tls: &networking.TLSSettings{
+				Mode:              networking.TLSSettings_MUTUAL,
+				ClientCertificate: "/etc/certs/cert.pem",
+				PrivateKey:        "/etc/certs/key.pem",
+				CaCertificates:    "/etc/certs/ca.pem",
+			},
+			certificate: "/etc/certs/cert.pem",
+			validation:  "/etc/certs/ca.pem",
+		},
+	}
+
+	for _, c := range cases {
+		cluster := &v2.Cluster{}
+		applyUpstreamTLSSettings(cluster, c.tls, clusterContext{})
+		common := cluster.TlsContext.CommonTlsContext
+		if len(common.TlsCertificates) != 0 {
+			t.Errorf("%s: got certificate files %v, want none", c.name, common.TlsCertificates)
+		}
+		if len(common.TlsCertificateSdsSecretConfigs) != 1 || common.TlsCertificateSdsSecretConfigs[0].Name != c.certificate {
+			t.Errorf("%s: got certificate secrets %v, want %s", c.name, common.TlsCertificateSdsSecretConfigs, c.certificate)
+		} else {
+			target := common.TlsCertificateSdsSecretConfigs[0].SdsConfig.GetApiConfigSource().
+				GetGrpcServices()[0].GetGoogleGrpc().GetTargetUri()
+			if target != "unix:/var/run/sds/uds_path" {
+				t.Errorf("%s: got sds target %q, want unix:/var/run/sds/uds_path", c.name, target)
+			}
+		}
+		if c.validation == "" {
+			if common.ValidationContextSdsSecretConfig != nil || common.ValidationContext == nil {
+				t.Errorf("%s: got validation secret %v, want the validation context", c.name, common.ValidationContextSdsSecretConfig)
+			}
+			continue
+		}
+		if common.ValidationContext != nil || common.ValidationContextSdsSecretConfig.GetName() != c.validation {
+			t.Errorf("%s: got validation secret %v, want %s", c.name, common.ValidationContextSdsSecretConfig, c.validation)
+		}
+	}
+}
+
+func TestApplyUpstreamTLSSettingsCredentialName(t *testing.T) {
+	// the credentials do not depend on the SDS server of the workload certificates
+	defer func(path string) { sdsUdsPath = path }(sdsUdsPath)
+	sdsUdsPath = ""
+
+	cases := []struct {
+		name        string
+		tls         *networking.TLSSettings
+		certificate string
+	}{
+		{
+			name: "simple",
+			tls: &networking.TLSSettings{
+				Mode:           networking.TLSSettings_SIMPLE,
+				CredentialName: "backend-credential",
+				CaCertificates: "/etc/certs/ca.pem",
+			},
+		},
+		{
+			name: "simple with subject alt names",
+			tls: &networking.TLSSettings{
+				Mode:            networking.TLSSettings_SIMPLE,
+				CredentialName:  "backend-credential",
+				SubjectAltNames: []string{"backend.example.com"},
+			},
+		},
+		{
+			name: "mutual",
+			tls: &networking.TLSSettings{
+				Mode:           networking.TLSSettings_MUTUAL,
+				CredentialName: "backend-credential",
+			},
+			certificate: "backend-credential",
+		},
+		{
+			name: "mutual ignoring certificate files",
+			tls: &networking.TLSSettings{
+				Mode:              networking.TLSSettings_MUTUAL,
+				CredentialName:    "backend-credential",
+				ClientCertificate: "/etc/certs/cert.pem",
+				PrivateKey:        "/etc/certs/key.pem",
+			},
+			certificate: "backend-credential",
+		},
+	}
+
+	target := func(config *auth.SdsSecretConfig) string {
+		return config.GetSdsConfig().GetApiConfigSource().GetGrpcServices()[0].GetGoogleGrpc().GetTargetUri()
+	}
+	for _, c := range cases {
+		cluster := &v2.Cluster{Name: "outbound|443||backend.example.com"}
+		applyUpstreamTLSSettings(cluster, c.tls, clusterContext{hostname: "backend.example.com"})
+		if cluster.TlsContext == nil {
+			t.Fatalf("%s: got no tls context", c.name)
+		}
+		common := cluster.TlsContext.CommonTlsContext
+		if len(common.TlsCertificates) != 0 || common.ValidationContext != nil {
+			t.Errorf("%s: got certificate files %v and validation %v, want none", c.name, common.TlsCertificates,
+				common.ValidationContext)
+		}
+
+		// the subject alt names of the settings are left to the validation secret
+		validation := common.ValidationContextSdsSecretConfig
+		if validation.GetName() != "backend-credential-cacert" || target(validation) != "unix:"+defaultCredentialSdsUdsPath {
+			t.Errorf("%s: got validation secret %v, want backend-credential-cacert from %s", c.name, validation,
+				defaultCredentialSdsUdsPath)
+		}
+
+		if c.certificate == "" {
+			if len(common.TlsCertificateSdsSecretConfigs) != 0 {
+				t.Errorf("%s: got certificate secrets %v, want none", c.name, common.TlsCertificateSdsSecretConfigs)
+			}
+			continue
+		}
+		if len(common.TlsCertificateSdsSecretConfigs) != 1 || common.TlsCertificateSdsSecretConfigs[0].Name != c.certificate ||
+			target(common.TlsCertificateSdsSecretConfigs[0]) != "unix:"+defaultCredentialSdsUdsPath {
+			t.Errorf("%s: got certificate secrets %v, want %s from %s", c.name, common.TlsCertificateSdsSecretConfigs,
+				c.certificate, defaultCredentialSdsUdsPath)
+		}
+		if cluster.TlsContext.Sni != "backend.example.com" {
+			t.Errorf("%s: got sni %q, want backend.example.com", c.name, cluster.TlsContext.Sni)
+		}
+	}
+}
+
+func TestApplyUpstreamTLSSettingsCertificatePins(t *testing.T) {
+	defer func(path, ca string, spki, hashes map[string][]string) {
+		sdsUdsPath, upstreamSystemCACertificates = path, ca
+		upstreamTLSSpkiPins, upstreamTLSCertificateHashes = spki, hashes
+	}(sdsUdsPath, upstreamSystemCACertificates, upstreamTLSSpkiPins, upstreamTLSCertificateHashes)
+	upstreamSystemCACertificates = ""
+
+	spki := []string{"NvqYIYSbgK2vCJpQhObf77vv+bQWtc5ek5RIOwPiC9A="}
+	hash := []string{"df6ff72fe9116521268f6f2dd4966f51df479883fe7037b39f75916ac3049d1a"}
+	upstreamTLSSpkiPins = map[string][]string{"backend.example.com": spki}
+	upstreamTLSCertificateHashes = map[string][]string{"backend.example.com": hash}
+	cases := []struct {
+		name       string
+		sdsUdsPath string
+		tls        *networking.TLSSettings
+		trustedCa  string
+	}{
+		{
+			name: "simple",
+			tls: &networking.TLSSettings{
+				Mode:           networking.TLSSettings_SIMPLE,
+				CaCertificates: "/etc/certs/ca.pem",
+			},
+			trustedCa: "/etc/certs/ca.pem",
+		},
+		{
+			name: "simple without ca",
+			tls: &networking.TLSSettings{
+				Mode: networking.TLSSettings_SIMPLE,
+			},
+		},
+		{
+			name: "mutual",
+			tls: &networking.TLSSettings{
+				Mode:              networking.TLSSettings_MUTUAL,
+				ClientCertificate: "/etc/certs/cert.pem",
+				PrivateKey:        "/etc/certs/key.pem",
+				CaCertificates:    "/etc/certs/ca.pem",
+			},
+			trustedCa: "/etc/certs/ca.pem",
+		},
+		{
+			// the pins are kept in the cluster rather than replaced by the SDS validation secret
+			name:       "mutual over sds",
+			sdsUdsPath: "/var/run/sds/uds_path",
+			tls: &networking.TLSSettings{
+				Mode:              networking.TLSSettings_MUTUAL,
+				ClientCertificate: "/etc/certs/cert.pem",
+				PrivateKey:        "/etc/certs/key.pem",
+				CaCertificates:    "/etc/certs/ca.pem",
+			},
+			trustedCa: "/etc/certs/ca.pem",
+		},
+	}
+
+	for _, c := range cases {
+		sdsUdsPath = c.sdsUdsPath
+		cluster := &v2.Cluster{Name: "outbound|443||backend.example.com"}
+		applyUpstreamTLSSettings(cluster, c.tls, clusterContext{hostname: "backend.example.com"})
+		validation := cluster.TlsContext.GetCommonTlsContext().GetValidationContext()
+		if validation == nil {
+			t.Errorf("%s: got no validation context", c.name)
+			continue
+		}
+		if !reflect.DeepEqual(validation.VerifyCertificateSpki, spki) {
+			t.Errorf("%s: got spki pins %v, want %v", c.name, validation.VerifyCertificateSpki, spki)
+		}
+		if !reflect.DeepEqual(validation.VerifyCertificateHash, hash) {
+			t.Errorf("%s: got hash pins %v, want %v", c.name, validation.VerifyCertificateHash, hash)
+		}
+		if got := validation.TrustedCa.GetFilename(); got != c.trustedCa {
+			t.Errorf("%s: got trusted ca %q, want %q", c.name, got, c.trustedCa)
+		}
+	}
+
+	// the pins only apply to the upstreams of their service
+	cluster := &v2.Cluster{Name: "outbound|443||other.example.com"}
+	applyUpstreamTLSSettings(cluster, &networking.TLSSettings{
+		Mode:           networking.TLSSettings_SIMPLE,
+		CaCertificates: "/etc/certs/ca.pem",
+	}, clusterContext{hostname: "other.example.com"})
+	validation := cluster.TlsContext.CommonTlsContext.ValidationContext
+	if len(validation.VerifyCertificateSpki) != 0 || len(validation.VerifyCertificateHash) != 0 {
+		t.Errorf("got spki pins %v and hash pins %v for another service, want none", validation.VerifyCertificateSpki,
+			validation.VerifyCertificateHash)
+	}
+}
+
+func TestParseCertificatePins(t *testing.T) {
+	spki := parseCertificatePins("spki pin", []string{
+		"a.example.com=NvqYIYSbgK2vCJpQhObf77vv+bQWtc5ek5RIOwPiC9A=",
+		"a.example.com=x2sHHc7gkp6oDJ3ku6ILBTzQvyUtmwt5RIDs5yfZ8Lo=",
+		"b.example.com=not-base64",
+		"b.example.com=c2hvcnQ=",
+		"=NvqYIYSbgK2vCJpQhObf77vv+bQWtc5ek5RIOwPiC9A=",
+		"c.example.com",
+	}, isSpkiPin)
+	expected := map[string][]string{
+		"a.example.com": {"NvqYIYSbgK2vCJpQhObf77vv+bQWtc5ek5RIOwPiC9A=", "x2sHHc7gkp6oDJ3ku6ILBTzQvyUtmwt5RIDs5yfZ8Lo="},
+	}
+	if !reflect.DeepEqual(spki, expected) {
+		t.Errorf("got spki pins %v, want %v", spki, expected)
+	}
+
+	hashes := parseCertificatePins("certificate hash", []string{
+		"a.example.com=df6ff72fe9116521268f6f2dd4966f51df479883fe7037b39f75916ac3049d1a",
+		"b.example.com=DF:6F:F7:2F:E9:11:65:21:26:8F:6F:2D:D4:96:6F:51:DF:47:98:83:FE:70:37:B3:9F:75:91:6A:C3:04:9D:1A",
+		"c.example.com=df6ff72fe9116521",
+	}, isCertificateHash)
+	expected = map[string][]string{
+		"a.example.com": {"df6ff72fe9116521268f6f2dd4966f51df479883fe7037b39f75916ac3049d1a"},
+		"b.example.com": {"DF:6F:F7:2F:E9:11:65:21:26:8F:6F:2D:D4:96:6F:51:DF:47:98:83:FE:70:37:B3:9F:75:91:6A:C3:04:9D:1A"},
+	}
+	if !reflect.DeepEqual(hashes, expected) {
+		t.Errorf("got certificate hashes %v, want %v", hashes, expected)
+	}
+}
+
+func TestApplyUpstreamTLSSettingsInsecureSkipVerify(t *testing.T) {
+	defer func(ca string) { upstreamSystemCACertificates = ca }(upstreamSystemCACertificates)
+	upstreamSystemCACertificates = "/etc/ssl/certs/ca-certificates.crt"
+
+	cases := []struct {
+		name     string
+		tls      *networking.TLSSettings
+		insecure bool
+	}{
+		{
+			name: "default",
+			tls:  &networking.TLSSettings{Mode: networking.TLSSettings_SIMPLE, Sni: "backend.example.com"},
+		},
+		{
+			name: "explicitly secure",
+			tls: &networking.TLSSettings{
+				Mode:               networking.TLSSettings_SIMPLE,
+				Sni:                "backend.example.com",
+				InsecureSkipVerify: &types.BoolValue{Value: false},
+			},
+		},
+		{
+			name: "insecure",
+			tls: &networking.TLSSettings{
+				Mode:               networking.TLSSettings_SIMPLE,
+				Sni:                "backend.example.com",
+				InsecureSkipVerify: &types.BoolValue{Value: true},
+			},
+			insecure: true,
+		},
+		{
+			name: "insecure ignoring validation settings",
+			tls: &networking.TLSSettings{
+				Mode:               networking.TLSSettings_SIMPLE,
+				Sni:                "backend.example.com",
+				CaCertificates:     "/etc/certs/ca.pem",
+				SubjectAltNames:    []string{"backend.example.com"},
+				CredentialName:     "backend-credential",
+				InsecureSkipVerify: &types.BoolValue{Value: true},
+			},
+			insecure: true,
+		},
+	}
+
+	for _, c := range cases {
+		before := new(dto.Metric)
+		_ = insecureSkipVerifyClusters.Write(before)
+		cluster := &v2.Cluster{Name: "outbound|443||backend.example.com"}
+		applyUpstreamTLSSettings(cluster, c.tls, clusterContext{hostname: "backend.example.com"})
+		after := new(dto.Metric)
+		_ = insecureSkipVerifyClusters.Write(after)
+
+		if cluster.TlsContext == nil {
+			t.Fatalf("%s: got no tls context", c.name)
+		}
+		if cluster.TlsContext.Sni != "backend.example.com" {
+			t.Errorf("%s: got sni %q, want backend.example.com", c.name, cluster.TlsContext.Sni)
+		}
+		common := cluster.TlsContext.CommonTlsContext
+		verified := common.ValidationContext != nil || common.ValidationContextSdsSecretConfig != nil
+		if verified == c.insecure {
+			t.Errorf("%s: got validation context %v and secret %v, want verified %v", c.name, common.ValidationContext,
+				common.ValidationContextSdsSecretConfig, !c.insecure)
+		}
+		if got := after.GetCounter().GetValue() - before.GetCounter().GetValue(); (got == 1) != c.insecure {
+			t.Errorf("%s: got %v insecure clusters counted, want insecure %v", c.name, got, c.insecure)
+		}
+	}
+}
+
+func TestBuildClustersSidecarEgress(t *testing.T) {
+	hello := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	world := mock.MakeService("world.default.svc.cluster.local", "10.2.0.0")
+	ratings := mock.MakeService("ratings.other.svc.cluster.local", "10.3.0.0")
+	external := mock.MakeExternalHTTPService("httpbin.org", "httpbin.org", "")
+	services := []*model.Service{hello, world, ratings, external}
+	sidecar := model.Config{
+		ConfigMeta: model.ConfigMeta{Type: model.SidecarConfig.Type, Name: "default", Namespace: "default"},
+		Spec: &networking.Sidecar{
+			Egress: []*networking.IstioEgressListener{
+				{Hosts: []string{"./hello.default.svc.cluster.local", "*/httpbin.org"}},
+			},
+		},
+	}
+
+	cases := []struct {
+		name     string
+		configs  []model.Config
+		proxy    model.Proxy
+		expected []string
+	}{
+		{
+			name:     "restricted",
+			configs:  []model.Config{sidecar},
+			proxy:    mock.HelloProxyV0,
+			expected: []string{hello.Hostname, external.Hostname},
+		},
+		{
+			name:     "no sidecar configuration",
+			proxy:    mock.HelloProxyV0,
+			expected: []string{hello.Hostname, world.Hostname, ratings.Hostname, external.Hostname},
+		},
+		{
+			name:     "gateway",
+			configs:  []model.Config{sidecar},
+			proxy:    mock.Router,
+			expected: []string{hello.Hostname, world.Hostname, ratings.Hostname, external.Hostname},
+		},
+	}
+
+	for _, c := range cases {
+		env := buildTestEnvWithConfigs(t, services, c.configs...)
+		discovery := &countingProxyDiscovery{ServiceDiscovery: env.ServiceDiscovery}
+		env.ServiceDiscovery = discovery
+		got := make(map[string]bool)
+		for _, cluster := range BuildClusters(env, c.proxy) {
+			if strings.HasPrefix(cluster.Name, string(model.TrafficDirectionOutbound)+"|") {
+				_, _, hostname, _ := model.ParseSubsetKey(cluster.Name)
+				got[hostname] = true
+			}
+		}
+		// the instances of the sidecar are looked up once, for both its configuration and its inbound clusters
+		if c.proxy.Type == model.Sidecar && discovery.calls != 1 {
+			t.Errorf("%s: got %d lookups of the proxy instances, want 1", c.name, discovery.calls)
+		}
+		expected := make(map[string]bool)
+		for _, hostname := range c.expected {
+			expected[hostname] = true
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s: got outbound clusters of %v, want %v", c.name, got, expected)
+		}
+	}
+}
+
+// countingProxyDiscovery counts the lookups of the instances of the proxies.
+type countingProxyDiscovery struct {
+	model.ServiceDiscovery
+	calls int
+}
+
+func (d *countingProxyDiscovery) GetProxyServiceInstances(proxy model.Proxy) ([]*model.ServiceInstance, error) {
+	d.calls++
+	return d.ServiceDiscovery.GetProxyServiceInstances(proxy)
+}
+
+func TestMatchEgressHost(t *testing.T) {
+	cases := []struct {
+		host      string
+		namespace string
+		hostname  string
+		expected  bool
+	}{
+		{"default/hello.default.svc.cluster.local", "default", "hello.default.svc.cluster.local", true},
+		{"default/hello.default.svc.cluster.local", "default", "world.default.svc.cluster.local", false},
+		{"./*", "default", "hello.default.svc.cluster.local", true},
+		{"./*", "default", "ratings.other.svc.cluster.local", false},
+		{"./*", "default", "httpbin.org", false},
+		{"./*", "", "httpbin.org", false},
+		{"other/*", "default", "ratings.other.svc.cluster.local", true},
+		{"*/*.example.com", "default", "api.example.com", true},
+		{"*/*.example.com", "default", "example.org", false},
+		{"*/*", "default", "httpbin.org", true},
+		{"hello.default.svc.cluster.local", "default", "hello.default.svc.cluster.local", false},
+	}
+
+	for _, c := range cases {
+		if got := matchEgressHost(c.host, c.namespace, c.hostname); got != c.expected {
+			t.Errorf("matchEgressHost(%q, %q, %q) => got %v, want %v", c.host, c.namespace, c.hostname, got, c.expected)
+		}
+	}
+}
+
+func TestBuildClustersServiceWithoutPorts(t *testing.T) {
+	service := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	noPorts := &model.Service{Hostname: "noports.default.svc.cluster.local", Address: "10.2.0.0"}
+	env := buildTestEnv(t, []*model.Service{service, noPorts})
+
+	before := new(dto.Metric)
+	_ = servicesWithoutPorts.Write(before)
+	clusters := BuildClusters(env, mock.Router)
+	after := new(dto.Metric)
+	_ = servicesWithoutPorts.Write(after)
+
+	if got := after.GetCounter().GetValue() - before.GetCounter().GetValue(); got != 1 {
+		t.Errorf("got %v services without ports, want 1", got)
+	}
+	for _, port := range service.Ports {
+		name := model.BuildSubsetKey(model.TrafficDirectionOutbound, "", service.Hostname, port)
+		if findCluster(clusters, name) == nil {
+			t.Errorf("cluster %s not found", name)
+		}
+	}
+}
+
+func TestBuildClustersDuplicatePorts(t *testing.T) {
+	service := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	service.Ports = append(service.Ports, &model.Port{
+		Name:                 "http-alt",
+		Port:                 80,
+		Protocol:             model.ProtocolTCP,
+		AuthenticationPolicy: meshconfig.AuthenticationPolicy_INHERIT,
+	})
+	env := buildTestEnv(t, []*model.Service{service})
+
+	clusters := BuildClusters(env, mock.Router)
+	seen := make(map[string]bool)
+	for _, name := range clusterNames(clusters) {
+		if seen[name] {
+			t.Errorf("duplicate cluster %s", name)
+		}
+		seen[name] = true
+	}
+	// the cluster names are built from the port names, both ports with the same number have a cluster
+	for _, port := range service.Ports {
+		name := model.BuildSubsetKey(model.TrafficDirectionOutbound, "", service.Hostname, port)
+		if findCluster(clusters, name) == nil {
+			t.Errorf("cluster %s not found", name)
+		}
+	}
+}
+
+func TestBuildClustersDuplicatePortNames(t *testing.T) {
+	service := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	first := service.Ports[0]
+	service.Ports = append(service.Ports, &model.Port{
+		Name:                 first.Name,
+		Port:                 8080,
+		Protocol:             model.ProtocolTCP,
+		AuthenticationPolicy: meshconfig.AuthenticationPolicy_INHERIT,
+	})
+	env := buildTestEnv(t, []*model.Service{service})
+
+	clusters := BuildClusters(env, mock.Router)
+	seen := make(map[string]bool)
+	for _, name := range clusterNames(clusters) {
+		if seen[name] {
+			t.Errorf("duplicate cluster %s", name)
+		}
+		seen[name] = true
+	}
+
+	// the first port with the name wins
+	name := model.BuildSubsetKey(model.TrafficDirectionOutbound, "", service.Hostname, first)
+	cluster := findCluster(clusters, name)
+	if cluster == nil {
+		t.Fatalf("cluster %s not found", name)
+	}
+	fields := cluster.Metadata.GetFilterMetadata()[clusterMetadataNamespace].GetFields()
+	if got := fields["port"].GetNumberValue(); got != float64(first.Port) {
+		t.Errorf("cluster %s: got port %v, want %d", name, got, first.Port)
+	}
+}
+
+// managementPortsDiscovery records the addresses whose management ports are looked up.
+type managementPortsDiscovery struct {
+	model.ServiceDiscovery
+	addresses []string
+}
+
+func (d *managementPortsDiscovery) ManagementPorts(addr string) model.PortList {
+	d.addresses = append(d.addresses, addr)
+	return d.ServiceDiscovery.ManagementPorts(addr)
+}
+
+func TestBuildClustersEmptyProxyIP(t *testing.T) {
+	service := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	env := buildTestEnv(t, []*model.Service{service})
+	discovery := &managementPortsDiscovery{ServiceDiscovery: env.ServiceDiscovery}
+	env.ServiceDiscovery = discovery
+
+	for _, proxy := range []model.Proxy{mock.HelloProxyV0, mock.Router} {
+		proxy.IPAddress = ""
+		discovery.addresses = nil
+		clusters := BuildClusters(env, proxy)
+
+		if len(discovery.addresses) != 0 {
+			t.Errorf("%s: got management ports looked up for %v, want none", proxy.ID, discovery.addresses)
+		}
+		for _, port := range service.Ports {
+			name := model.BuildSubsetKey(model.TrafficDirectionOutbound, "", service.Hostname, port)
+			if findCluster(clusters, name) == nil {
+				t.Errorf("%s: cluster %s not found", proxy.ID, name)
+			}
+		}
+		for _, name := range clusterNames(clusters) {
+			if strings.HasSuffix(name, "|"+ManagementClusterHostname) {
+				t.Errorf("%s: got management cluster %s, want none", proxy.ID, name)
+			}
+		}
+		if findCluster(clusters, BlackHoleCluster) == nil {
+			t.Errorf("%s: cluster %s not found", proxy.ID, BlackHoleCluster)
+		}
+	}
+}
+
+// duplicateInstancesDiscovery lists every instance twice.
+type duplicateInstancesDiscovery struct {
+	model.ServiceDiscovery
+}
+
+func (d *duplicateInstancesDiscovery) Instances(hostname string, ports []string,
+	labels model.LabelsCollection) ([]*model.ServiceInstance, error) {
+	instances, err := d.ServiceDiscovery.Instances(hostname, ports, labels)
+	return append(instances, instances...), err
+}
+
+func TestBuildClusterHostsDuplicates(t *testing.T) {
+	service := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	service.Resolution = model.DNSLB
+	env := buildTestEnv(t, []*model.Service{service})
+	env.ServiceDiscovery = &duplicateInstancesDiscovery{env.ServiceDiscovery}
+
+	port := service.Ports[0]
+	hosts := buildClusterHosts(newOutboundCache(env), service, port, "")
+	expected := []*core.Address{}
+	for _, version := range []int{0, 1} {
+		host := util.BuildAddress(mock.MakeIP(service, version), uint32(port.Port))
+		expected = append(expected, &host)
+	}
+	if !reflect.DeepEqual(hosts, expected) {
+		t.Errorf("got hosts %v, want %v", hosts, expected)
+	}
+}
+
+func TestBuildClustersSubsetSNI(t *testing.T) {
+	service := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	port := service.Ports[0]
+
+	cases := []struct {
+		name string
+		tls  *networking.TLSSettings
+		sans map[string][]string
+	}{
+		{
+			name: "istio mutual",
+			tls:  &networking.TLSSettings{Mode: networking.TLSSettings_ISTIO_MUTUAL},
+		},
+		{
+			name: "mutual",
+			tls: &networking.TLSSettings{
+				Mode:              networking.TLSSettings_MUTUAL,
+				ClientCertificate: "/etc/certs/cert.pem",
+				PrivateKey:        "/etc/certs/key.pem",
+				CaCertificates:    "/etc/certs/ca.pem",
+			},
+			sans: map[string][]string{
+				"v1": {"v1.hello.default.svc.cluster.local"},
+				"v2": {"v2.hello.default.svc.cluster.local"},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		env := buildTestEnv(t, []*model.Service{service}, &networking.DestinationRule{
+			Name:          service.Hostname,
+			TrafficPolicy: &networking.TrafficPolicy{Tls: c.tls},
+			Subsets: []*networking.Subset{
+				{Name: "v1", Labels: map[string]string{"version": "v1"}},
+				{Name: "v2", Labels: map[string]string{"version": "v2"}},
+			},
+		})
+		clusters := BuildClusters(env, mock.Router)
+
+		expected := map[string]string{
+			"":   "hello.default.svc.cluster.local",
+			"v1": "v1.hello.default.svc.cluster.local",
+			"v2": "v2.hello.default.svc.cluster.local",
+		}
+		for subset, sni := range expected {
+			name := model.BuildSubsetKey(model.TrafficDirectionOutbound, subset, service.Hostname, port)
+			cluster := findCluster(clusters, name)
+			if cluster == nil {
+				t.Fatalf("%s: cluster %s not found", c.name, name)
+			}
+			if cluster.TlsContext.Sni != sni {
+				t.Errorf("%s: cluster %s got sni %q, want %q", c.name, name, cluster.TlsContext.Sni, sni)
+			}
+			got := cluster.TlsContext.CommonTlsContext.ValidationContext.VerifySubjectAltName
+			if !reflect.DeepEqual(got, c.sans[subset]) {
+				t.Errorf("%s: cluster %s got subject alt names %v, want %v", c.name, name, got, c.sans[subset])
+			}
+		}
+	}
+}
+
+func TestBuildClustersSubsetSANSds(t *testing.T) {
+	defer func(path string) { sdsUdsPath = path }(sdsUdsPath)
+	sdsUdsPath = "/var/run/sds/uds_path"
+
+	service := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	port := service.Ports[0]
+	cases := []struct {
+		name       string
+		tls        *networking.TLSSettings
+		validation string
+		sans       []string
+	}{
+		{
+			name: "mutual over sds",
+			tls: &networking.TLSSettings{
+				Mode:              networking.TLSSettings_MUTUAL,
+				ClientCertificate: "/etc/certs/cert.pem",
+				PrivateKey:        "/etc/certs/key.pem",
+				CaCertificates:    "/etc/certs/ca.pem",
+			},
+			validation: "/etc/certs/ca.pem",
+			sans:       []string{"v1.hello.default.svc.cluster.local"},
+		},
+		{
+			// the validation secret of the credential cannot be extended with the subject alt name
+			name: "mutual with credential",
+			tls: &networking.TLSSettings{
+				Mode:           networking.TLSSettings_MUTUAL,
+				CredentialName: "hello-credential",
+			},
+			validation: "hello-credential-cacert",
+		},
+	}
+
+	for _, c := range cases {
+		env := buildTestEnv(t, []*model.Service{service}, &networking.DestinationRule{
+			Name:          service.Hostname,
+			TrafficPolicy: &networking.TrafficPolicy{Tls: c.tls},
+			Subsets:       []*networking.Subset{{Name: "v1", Labels: map[string]string{"version": "v1"}}},
+		})
+		clusters := BuildClusters(env, mock.Router)
+
+		// the CA certificates of the default cluster are the SDS secret alone
+		name := model.BuildSubsetKey(model.TrafficDirectionOutbound, "", service.Hostname, port)
+		common := findCluster(clusters, name).TlsContext.CommonTlsContext
+		if common.ValidationContext != nil || common.ValidationContextSdsSecretConfig.GetName() != c.validation {
+			t.Errorf("%s: cluster %s got validation %v and secret %v, want secret %s",
+				c.name, name, common.ValidationContext, common.ValidationContextSdsSecretConfig, c.validation)
+		}
+
+		name = model.BuildSubsetKey(model.TrafficDirectionOutbound, "v1", service.Hostname, port)
+		common = findCluster(clusters, name).TlsContext.CommonTlsContext
+		if c.sans == nil {
+			if common.ValidationContext != nil || common.ValidationContextSdsSecretConfig.GetName() != c.validation {
+				t.Errorf("%s: cluster %s got validation %v and secret %v, want secret %s",
+					c.name, name, common.ValidationContext, common.ValidationContextSdsSecretConfig, c.validation)
+			}
+			continue
+		}
+		// the subset keeps the CA certificate files to verify its subject alt name
+		validation := common.ValidationContext
+		if common.ValidationContextSdsSecretConfig != nil || validation.GetTrustedCa().GetFilename() != c.validation {
+			t.Errorf("%s: cluster %s got validation %v and secret %v, want the validation of %s",
+				c.name, name, validation, common.ValidationContextSdsSecretConfig, c.validation)
+		}
+		if got := validation.GetVerifySubjectAltName(); !reflect.DeepEqual(got, c.sans) {
+			t.Errorf("%s: cluster %s got subject alt names %v, want %v", c.name, name, got, c.sans)
+		}
+	}
+}
+
+func TestBuildClustersSubsetTLS(t *testing.T) {
+	service := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	port := service.Ports[0]
+	disable := &networking.TLSSettings{Mode: networking.TLSSettings_DISABLE}
+	mutual := &networking.TLSSettings{
+		Mode:              networking.TLSSettings_MUTUAL,
+		ClientCertificate: "/etc/certs/cert.pem",
+		PrivateKey:        "/etc/certs/key.pem",
+		CaCertificates:    "/etc/certs/ca.pem",
+	}
+
+	cases := []struct {
+		name        string
+		destination *networking.TLSSettings
+		subset      *networking.TLSSettings
+		// whether the default and the subset clusters have a tls context
+		defaultTLS bool
+		subsetTLS  bool
+	}{
+		{name: "disable to mutual", destination: disable, subset: mutual, subsetTLS: true},
+		{name: "mutual to disable", destination: mutual, subset: disable, defaultTLS: true},
+		{name: "mutual inherited", destination: mutual, defaultTLS: true, subsetTLS: true},
+		{name: "subset only", subset: mutual, subsetTLS: true},
+	}
+
+	for _, c := range cases {
+		rule := &networking.DestinationRule{
+			Name: service.Hostname,
+			Subsets: []*networking.Subset{
+				{Name: "v1", Labels: map[string]string{"version": "v1"}},
+			},
+		}
+		if c.destination != nil {
+			rule.TrafficPolicy = &networking.TrafficPolicy{Tls: c.destination}
+		}
+		if c.subset != nil {
+			rule.Subsets[0].TrafficPolicy = &networking.TrafficPolicy{Tls: c.subset}
+		}
+		clusters := BuildClusters(buildTestEnv(t, []*model.Service{service}, rule), mock.Router)
+
+		for subset, expected := range map[string]bool{"": c.defaultTLS, "v1": c.subsetTLS} {
+			name := model.BuildSubsetKey(model.TrafficDirectionOutbound, subset, service.Hostname, port)
+			cluster := findCluster(clusters, name)
+			if cluster == nil {
+				t.Fatalf("%s: cluster %s not found", c.name, name)
+			}
+			if got := cluster.TlsContext != nil; got != expected {
+				t.Errorf("%s: cluster %s got tls context %v, want %v", c.name, name, cluster.TlsContext, expected)
+			}
+			if expected && cluster.TlsContext.GetCommonTlsContext().GetTlsCertificates() == nil &&
+				cluster.TlsContext.GetCommonTlsContext().GetTlsCertificateSdsSecretConfigs() == nil {
+				t.Errorf("%s: cluster %s got no client certificate", c.name, name)
+			}
+		}
+	}
+
+	// a policy disabling TLS clears the context of a previously applied one
+	cluster := &v2.Cluster{}
+	applyUpstreamTLSSettings(cluster, mutual, clusterContext{})
+	applyUpstreamTLSSettings(cluster, disable, clusterContext{})
+	if cluster.TlsContext != nil {
+		t.Errorf("got tls context %v, want none", cluster.TlsContext)
+	}
+}
+
+func TestApplyUpstreamTLSSettingsMutualWithoutCertificate(t *testing.T) {
+	cases := []struct {
+		name string
+		tls  *networking.TLSSettings
+	}{
+		{
+			name: "missing private key",
+			tls: &networking.TLSSettings{
+				Mode:              networking.TLSSettings_MUTUAL,
+				ClientCertificate: "/etc/certs/cert.pem",
+				CaCertificates:    "/etc/certs/ca.pem",
+			},
+		},
+		{
+			name: "missing client certificate",
+			tls: &networking.TLSSettings{
+				Mode:           networking.TLSSettings_MUTUAL,
+				PrivateKey:     "/etc/certs/key.pem",
+				CaCertificates: "/etc/certs/ca.pem",
+			},
+		},
+		{
+			name: "missing both",
+			tls:  &networking.TLSSettings{Mode: networking.TLSSettings_MUTUAL},
+		},
+	}
+
+	service := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	port := service.Ports[0]
+	for _, c := range cases {
+		cluster := &v2.Cluster{Name: "outbound|80||hello.default.svc.cluster.local"}
+		applyUpstreamTLSSettings(cluster, c.tls, clusterContext{hostname: service.Hostname, subset: "v1", port: port})
+		if cluster.TlsContext != nil {
+			t.Errorf("%s: got tls context %v, want none", c.name, cluster.TlsContext)
+		}
+
+		// the clusters are still built, without TLS
+		env := buildTestEnv(t, []*model.Service{service}, &networking.DestinationRule{
+			Name:          service.Hostname,
+			TrafficPolicy: &networking.TrafficPolicy{Tls: c.tls},
+			Subsets:       []*networking.Subset{{Name: "v1", Labels: map[string]string{"version": "v1"}}},
+		})
+		clusters := BuildClusters(env, mock.Router)
+		for _, subset := range []string{"", "v1"} {
+			name := model.BuildSubsetKey(model.TrafficDirectionOutbound, subset, service.Hostname, port)
+			cluster := findCluster(clusters, name)
+			if cluster == nil {
+				t.Fatalf("%s: cluster %s not found", c.name, name)
+			}
+			if cluster.TlsContext != nil {
+				t.Errorf("%s: cluster %s got tls context %v, want none", c.name, name, cluster.TlsContext)
+			}
+		}
+	}
+}
+
+func TestApplyConnectionPoolHTTPProtocol(t *testing.T) {
+	cases := []struct {
+		name           string
+		protocol       model.Protocol
+		maxConnections uint32
+		expected       uint32
+	}{
+		{name: "http/1.1", protocol: model.ProtocolHTTP, expected: 50},
+		{name: "http/1.1 with lower tcp limit", protocol: model.ProtocolHTTP, maxConnections: 20, expected: 20},
+		{name: "http/1.1 with higher tcp limit", protocol: model.ProtocolHTTP, maxConnections: 100, expected: 50},
+		{name: "http2", protocol: model.ProtocolHTTP2},
+		{name: "http2 with tcp limit", protocol: model.ProtocolHTTP2, maxConnections: 100, expected: 100},
+		{name: "grpc", protocol: model.ProtocolGRPC},
+	}
+
+	for _, c := range cases {
+		settings := &networking.ConnectionPoolSettings{
+			Http: &networking.ConnectionPoolSettings_HTTPSettings{Http2MaxRequests: 50},
+		}
+		if c.maxConnections > 0 {
+			settings.Tcp = &networking.ConnectionPoolSettings_TCPSettings{MaxConnections: int32(c.maxConnections)}
+		}
+		cluster := &v2.Cluster{}
+		applyConnectionPool(cluster, settings, clusterContext{
+			hostname: "hello.default.svc.cluster.local",
+			port:     &model.Port{Name: "port", Port: 80, Protocol: c.protocol},
+		})
+		threshold := cluster.CircuitBreakers.Thresholds[0]
+		if got := threshold.GetMaxRequests().GetValue(); got != 50 {
+			t.Errorf("%s: got max requests %d, want 50", c.name, got)
+		}
+		if got := threshold.GetMaxConnections().GetValue(); got != c.expected {
+			t.Errorf("%s: got max connections %d, want %d", c.name, got, c.expected)
+		}
+	}
+}
+
+func TestBuildClustersDNSWithoutHosts(t *testing.T) {
+	dnsService := mock.MakeService("dns.default.svc.cluster.local", "10.1.0.0")
+	dnsService.Resolution = model.DNSLB
+	logicalService := mock.MakeService("logical.default.svc.cluster.local", "10.2.0.0")
+	logicalService.Resolution = model.LogicalDNSLB
+	edsService := mock.MakeService("eds.default.svc.cluster.local", "10.3.0.0")
+	env := buildTestEnv(t, []*model.Service{dnsService, logicalService, edsService})
+
+	cases := []struct {
+		name      string
+		err       error
+		clustered []*model.Service
+		missing   []*model.Service
+	}{
+		{
+			name:      "resolved",
+			clustered: []*model.Service{dnsService, logicalService, edsService},
+		},
+		{
+			name:      "resolution failure",
+			err:       errors.New("registry unavailable"),
+			clustered: []*model.Service{edsService},
+			missing:   []*model.Service{dnsService, logicalService},
+		},
+	}
+
+	for _, c := range cases {
+		env.ServiceDiscovery.(*mock.ServiceDiscovery).InstancesError = c.err
+		clusters := BuildClusters(env, mock.Router)
+		for _, service := range c.clustered {
+			name := model.BuildSubsetKey(model.TrafficDirectionOutbound, "", service.Hostname, service.Ports[0])
+			if cluster := findCluster(clusters, name); cluster == nil {
+				t.Errorf("%s: cluster %s not found", c.name, name)
+			} else if cluster.Type != v2.Cluster_EDS && len(cluster.Hosts) == 0 {
+				t.Errorf("%s: got cluster %s without hosts", c.name, name)
+			}
+		}
+		for _, service := range c.missing {
+			name := model.BuildSubsetKey(model.TrafficDirectionOutbound, "", service.Hostname, service.Ports[0])
+			if findCluster(clusters, name) != nil {
+				t.Errorf("%s: unexpected cluster %s without hosts", c.name, name)
+			}
+		}
+	}
+}
+
+// staticInstancesDiscovery returns the same instances for any service, selected by port name.
+type staticInstancesDiscovery struct {
+	model.ServiceDiscovery
+	instances []*model.ServiceInstance
+}
+
+func (d *staticInstancesDiscovery) Instances(hostname string, ports []string,
+	labels model.LabelsCollection) ([]*model.ServiceInstance, error) {
+	out := make([]*model.ServiceInstance, 0)
+	for _, instance := range d.instances {
+		for _, port := range ports {
+			if instance.Endpoint.ServicePort.Name == port {
+				out = append(out, instance)
+			}
+		}
+	}
+	return out, nil
+}
+
+func TestBuildClustersHeadlessEndpoints(t *testing.T) {
+	defer func(enabled bool) { enableHeadlessEndpointClusters = enabled }(enableHeadlessEndpointClusters)
+
+	service := &model.Service{
+		Hostname:   "cassandra.default.svc.cluster.local",
+		Resolution: model.Passthrough,
+		Ports: model.PortList{
+			{Name: "cql", Port: 9042, Protocol: model.ProtocolTCP},
+			{Name: "http-status", Port: 8080, Protocol: model.ProtocolHTTP},
+		},
+	}
+	port, httpPort := service.Ports[0], service.Ports[1]
+	addresses := []string{"10.4.1.7", "10.4.2.9"}
+	instances := make([]*model.ServiceInstance, 0)
+	for _, address := range addresses {
+		instance := &model.ServiceInstance{
+			Endpoint: model.NetworkEndpoint{Address: address, Port: 9042, ServicePort: port},
+			Service:  service,
+		}
+		// the same endpoint listed twice only gets a single cluster
+		instances = append(instances, instance, instance, &model.ServiceInstance{
+			Endpoint: model.NetworkEndpoint{Address: address, Port: 8080, ServicePort: httpPort},
+			Service:  service,
+		})
+	}
+	env := buildTestEnv(t, []*model.Service{service})
+	env.ServiceDiscovery = &staticInstancesDiscovery{env.ServiceDiscovery, instances}
+
+	count := func(kind string) float64 {
+		metric := new(dto.Metric)
+		_ = clustersBuilt.WithLabelValues(kind).Write(metric)
+		return metric.GetCounter().GetValue()
+	}
+
+	for _, enabled := range []bool{false, true} {
+		enableHeadlessEndpointClusters = enabled
+		subsets, endpoints := count("subset"), count("endpoint")
+		clusters := BuildClusters(env, mock.Router)
+
+		// the clusters of the endpoints are not counted as subset clusters
+		wantEndpoints := 0.0
+		if enabled {
+			wantEndpoints = float64(len(addresses))
+		}
+		if got := count("endpoint") - endpoints; got != wantEndpoints {
+			t.Errorf("enabled %v: got %v endpoint clusters counted, want %v", enabled, got, wantEndpoints)
+		}
+		if got := count("subset") - subsets; got != 0 {
+			t.Errorf("enabled %v: got %v subset clusters counted, want 0", enabled, got)
+		}
+
+		serviceCluster := findCluster(clusters, model.BuildSubsetKey(model.TrafficDirectionOutbound, "", service.Hostname, port))
+		if serviceCluster == nil || serviceCluster.Type != v2.Cluster_ORIGINAL_DST {
+			t.Errorf("enabled %v: got service cluster %v, want an ORIGINAL_DST cluster", enabled, serviceCluster)
+		}
+
+		for _, address := range addresses {
+			name := model.BuildSubsetKey(model.TrafficDirectionOutbound, address, service.Hostname, port)
+			cluster := findCluster(clusters, name)
+			if !enabled {
+				if cluster != nil {
+					t.Errorf("unexpected cluster %s", name)
+				}
+				continue
+			}
+			if cluster == nil {
+				t.Errorf("cluster %s not found", name)
+				continue
+			}
+			if cluster.Type != v2.Cluster_STATIC || len(cluster.Hosts) != 1 ||
+				cluster.Hosts[0].GetSocketAddress().GetAddress() != address {
+				t.Errorf("cluster %s: got %v %v, want a STATIC cluster of %s", name, cluster.Type, cluster.Hosts, address)
+			}
+			// the HTTP ports are routed by host name, to the cluster of the service only
+			httpName := model.BuildSubsetKey(model.TrafficDirectionOutbound, address, service.Hostname, httpPort)
+			if findCluster(clusters, httpName) != nil {
+				t.Errorf("unexpected cluster %s", httpName)
+			}
+		}
+
+		listeners := buildSidecarOutboundListeners(env, mock.HelloProxyV0, nil, []*model.Service{service})
+		for _, address := range addresses {
+			listenerName := fmt.Sprintf("%s_%s_%d", model.ProtocolTCP, address, 9042)
+			var endpointListener *v2.Listener
+			for _, l := range listeners {
+				if l.Name == listenerName {
+					endpointListener = l
+				}
+			}
+			if !enabled {
+				if endpointListener != nil {
+					t.Errorf("unexpected listener %s", listenerName)
+				}
+				continue
+			}
+			if endpointListener == nil {
+				t.Errorf("listener %s not found", listenerName)
+				continue
+			}
+			want := model.BuildSubsetKey(model.TrafficDirectionOutbound, address, service.Hostname, port)
+			routes := endpointListener.FilterChains[0].Filters[0].Config.Fields["value"].GetStructValue().
+				Fields["route_config"].GetStructValue().Fields["routes"].GetListValue().GetValues()
+			if len(routes) != 1 || routes[0].GetStructValue().Fields["cluster"].GetStringValue() != want {
+				t.Errorf("listener %s: got routes %v, want a route to %s", listenerName, routes, want)
+			}
+		}
+	}
+}
+
+func TestBuildClustersOriginalDstMaxConnections(t *testing.T) {
+	defer func(limit uint32) { originalDstMaxConnections = limit }(originalDstMaxConnections)
+
+	passthroughService := mock.MakeService("passthrough.default.svc.cluster.local", "10.1.0.0")
+	passthroughService.Resolution = model.Passthrough
+	ruleService := mock.MakeService("rule.default.svc.cluster.local", "10.2.0.0")
+	ruleService.Resolution = model.Passthrough
+	edsService := mock.MakeService("eds.default.svc.cluster.local", "10.3.0.0")
+	env := buildTestEnv(t, []*model.Service{passthroughService, ruleService, edsService},
+		&networking.DestinationRule{
+			Name: ruleService.Hostname,
+			TrafficPolicy: &networking.TrafficPolicy{
+				ConnectionPool: &networking.ConnectionPoolSettings{
+					Tcp: &networking.ConnectionPoolSettings_TCPSettings{MaxConnections: 50},
+				},
+			},
+		})
+	clusterName := func(service *model.Service) string {
+		return model.BuildSubsetKey(model.TrafficDirectionOutbound, "", service.Hostname, service.Ports[0])
+	}
+
+	cases := []struct {
+		name     string
+		limit    uint32
+		cluster  string
+		expected uint32
+	}{
+		{name: "passthrough cluster without limit", cluster: PassthroughCluster},
+		{name: "passthrough cluster", limit: 100, cluster: PassthroughCluster, expected: 100},
+		{name: "original dst service", limit: 100, cluster: clusterName(passthroughService), expected: 100},
+		{name: "original dst service with destination rule", limit: 100, cluster: clusterName(ruleService), expected: 50},
+		{name: "destination rule without default limit", cluster: clusterName(ruleService), expected: 50},
+		{name: "eds service", limit: 100, cluster: clusterName(edsService)},
+	}
+
+	for _, c := range cases {
+		originalDstMaxConnections = c.limit
+		cluster := findCluster(BuildClusters(env, mock.Router), c.cluster)
+		if cluster == nil {
+			t.Errorf("%s: cluster %s not found", c.name, c.cluster)
+			continue
+		}
+		var got uint32
+		if cluster.CircuitBreakers != nil {
+			got = cluster.CircuitBreakers.Thresholds[0].GetMaxConnections().GetValue()
+		}
+		if got != c.expected {
+			t.Errorf("%s: got max connections %d, want %d", c.name, got, c.expected)
+		}
+	}
+}
+
+func TestBuildClustersNetworkGateways(t *testing.T) {
+	defer func(gateways map[string]networkGateway) { meshNetworkGateways = gateways }(meshNetworkGateways)
+	meshNetworkGateways = parseMeshNetworkGateways([]string{
+		"network1=192.168.1.1:15443",
+		"network2=192.168.2.1:15443",
+		"network3=gateway.example.com:15443",
+		"network4",
+	})
+	if len(meshNetworkGateways) != 2 {
+		t.Errorf("got network gateways %v, want the 2 valid ones", meshNetworkGateways)
+	}
+
+	service := &model.Service{
+		Hostname:   "hello.default.svc.cluster.local",
+		Resolution: model.DNSLB,
+		Ports:      model.PortList{{Name: "http", Port: 80, Protocol: model.ProtocolHTTP}},
+	}
+	port := service.Ports[0]
+	endpoint := func(address, network string) *model.ServiceInstance {
+		return &model.ServiceInstance{
+			Endpoint: model.NetworkEndpoint{Address: address, Port: 8080, ServicePort: port, Network: network},
+			Service:  service,
+		}
+	}
+	env := buildTestEnv(t, []*model.Service{service})
+	env.ServiceDiscovery = &staticInstancesDiscovery{env.ServiceDiscovery, []*model.ServiceInstance{
+		endpoint("10.1.0.1", "network1"),
+		endpoint("10.1.0.2", "network1"),
+		endpoint("10.2.0.1", "network2"),
+		endpoint("10.2.0.2", "network2"),
+		// an endpoint of a network without gateway is unreachable from other networks
+		endpoint("10.3.0.1", "network3"),
+	}}
+
+	cases := []struct {
+		network  string
+		expected []string
+	}{
+		{
+			network:  "network1",
+			expected: []string{"10.1.0.1:8080", "10.1.0.2:8080", "192.168.2.1:15443"},
+		},
+		{
+			network:  "network2",
+			expected: []string{"192.168.1.1:15443", "10.2.0.1:8080", "10.2.0.2:8080"},
+		},
+		{
+			network:  "network3",
+			expected: []string{"192.168.1.1:15443", "192.168.2.1:15443", "10.3.0.1:8080"},
+		},
+		{
+			// a proxy without network is in the default network
+			network:  "",
+			expected: []string{"192.168.1.1:15443", "192.168.2.1:15443"},
+		},
+	}
+
+	name := model.BuildSubsetKey(model.TrafficDirectionOutbound, "", service.Hostname, port)
+	for _, c := range cases {
+		proxy := mock.Router
+		if c.network != "" {
+			proxy.Metadata = map[string]string{model.NodeMetadataNetwork: c.network}
+		}
+		cluster := findCluster(BuildClusters(env, proxy), name)
+		if cluster == nil {
+			t.Errorf("network %q: cluster %s not found", c.network, name)
+			continue
+		}
+		got := make([]string, 0, len(cluster.Hosts))
+		for _, host := range cluster.Hosts {
+			socket := host.GetSocketAddress()
+			got = append(got, net.JoinHostPort(socket.Address, strconv.Itoa(int(socket.GetPortValue()))))
+		}
+		if !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("network %q: got hosts %v, want %v", c.network, got, c.expected)
+		}
+	}
+}
+
+func TestBuildClustersH2UpgradePolicy(t *testing.T) {
+	defer func(policy networking.ConnectionPoolSettings_HTTPSettings_H2UpgradePolicy) {
+		h2UpgradePolicy = policy
+	}(h2UpgradePolicy)
+
+	service := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	httpPort, tcpPort := service.Ports[0], service.Ports[2]
+	rule := func(policy networking.ConnectionPoolSettings_HTTPSettings_H2UpgradePolicy) *networking.DestinationRule {
+		return &networking.DestinationRule{
+			Name: service.Hostname,
+			TrafficPolicy: &networking.TrafficPolicy{
+				ConnectionPool: &networking.ConnectionPoolSettings{
+					Http: &networking.ConnectionPoolSettings_HTTPSettings{H2UpgradePolicy: policy},
+				},
+			},
+			Subsets: []*networking.Subset{{Name: "v1", Labels: map[string]string{"version": "v1"}}},
+		}
+	}
+
+	cases := []struct {
+		name     string
+		mesh     networking.ConnectionPoolSettings_HTTPSettings_H2UpgradePolicy
+		rule     *networking.DestinationRule
+		upgraded bool
+	}{
+		{name: "default", mesh: networking.ConnectionPoolSettings_HTTPSettings_DEFAULT},
+		{
+			name:     "destination rule upgrade",
+			mesh:     networking.ConnectionPoolSettings_HTTPSettings_DEFAULT,
+			rule:     rule(networking.ConnectionPoolSettings_HTTPSettings_UPGRADE),
+			upgraded: true,
+		},
+		{name: "mesh upgrade", mesh: networking.ConnectionPoolSettings_HTTPSettings_UPGRADE, upgraded: true},
+		{
+			name:     "mesh upgrade kept by default destination rule policy",
+			mesh:     networking.ConnectionPoolSettings_HTTPSettings_UPGRADE,
+			rule:     rule(networking.ConnectionPoolSettings_HTTPSettings_DEFAULT),
+			upgraded: true,
+		},
+		{
+			name: "destination rule overrides mesh upgrade",
+			mesh: networking.ConnectionPoolSettings_HTTPSettings_UPGRADE,
+			rule: rule(networking.ConnectionPoolSettings_HTTPSettings_DO_NOT_UPGRADE),
+		},
+	}
+
+	for _, c := range cases {
+		h2UpgradePolicy = c.mesh
+		var env model.Environment
+		if c.rule != nil {
+			env = buildTestEnv(t, []*model.Service{service}, c.rule)
+		} else {
+			env = buildTestEnv(t, []*model.Service{service})
+		}
+		clusters := BuildClusters(env, mock.HelloProxyV0)
+
+		subsets := []string{""}
+		if c.rule != nil {
+			subsets = append(subsets, "v1")
+		}
+		for _, subset := range subsets {
+			name := model.BuildSubsetKey(model.TrafficDirectionOutbound, subset, service.Hostname, httpPort)
+			cluster := findCluster(clusters, name)
+			if cluster == nil {
+				t.Fatalf("%s: cluster %s not found", c.name, name)
+			}
+			if got := cluster.Http2ProtocolOptions != nil; got != c.upgraded {
+				t.Errorf("%s: cluster %s got http2 protocol options %v, want %v", c.name, name, got, c.upgraded)
+			}
+		}
+
+		// TCP ports and the connections to the local application are never upgraded
+		names := []string{
+			model.BuildSubsetKey(model.TrafficDirectionOutbound, "", service.Hostname, tcpPort),
+			model.BuildSubsetKey(model.TrafficDirectionInbound, "", service.Hostname, httpPort),
+		}
+		for _, name := range names {
+			if cluster := findCluster(clusters, name); cluster == nil || cluster.Http2ProtocolOptions != nil {
+				t.Errorf("%s: cluster %s not found or upgraded to http2", c.name, name)
+			}
+		}
+	}
+}
+
+func TestBuildClustersDNSLoadBalancer(t *testing.T) {
+	service := mock.MakeService("dns.default.svc.cluster.local", "10.1.0.0")
+	service.Resolution = model.DNSLB
+	port := service.Ports[0]
+
+	cases := []struct {
+		name     string
+		lb       networking.LoadBalancerSettings_SimpleLB
+		expected v2.Cluster_LbPolicy
+	}{
+		{"least conn", networking.LoadBalancerSettings_LEAST_CONN, v2.Cluster_LEAST_REQUEST},
+		{"random", networking.LoadBalancerSettings_RANDOM, v2.Cluster_RANDOM},
+		{"round robin", networking.LoadBalancerSettings_ROUND_ROBIN, v2.Cluster_ROUND_ROBIN},
+	}
+
+	for _, c := range cases {
+		env := buildTestEnv(t, []*model.Service{service}, &networking.DestinationRule{
+			Name:          service.Hostname,
+			TrafficPolicy: &networking.TrafficPolicy{LoadBalancer: simpleLb(c.lb)},
+			Subsets:       []*networking.Subset{{Name: "v1", Labels: map[string]string{"version": "v1"}}},
+		})
+		clusters := BuildClusters(env, mock.Router)
+		for _, subset := range []string{"", "v1"} {
+			name := model.BuildSubsetKey(model.TrafficDirectionOutbound, subset, service.Hostname, port)
+			cluster := findCluster(clusters, name)
+			if cluster == nil {
+				t.Fatalf("%s: cluster %s not found", c.name, name)
+			}
+			// the policy applies over the resolved hosts, without changing the discovery type
+			if cluster.Type != v2.Cluster_STRICT_DNS || len(cluster.Hosts) == 0 {
+				t.Errorf("%s: cluster %s got type %v with %d hosts, want a STRICT_DNS cluster with hosts",
+					c.name, name, cluster.Type, len(cluster.Hosts))
+			}
+			if cluster.LbPolicy != c.expected {
+				t.Errorf("%s: cluster %s got lb policy %v, want %v", c.name, name, cluster.LbPolicy, c.expected)
+			}
+		}
+	}
+}
+
+func TestBuildClustersOriginalDstCleanupInterval(t *testing.T) {
+	defer func(interval time.Duration) { originalDstCleanupInterval = interval }(originalDstCleanupInterval)
+
+	passthroughService := mock.MakeService("passthrough.default.svc.cluster.local", "10.1.0.0")
+	passthroughService.Resolution = model.Passthrough
+	ruleService := mock.MakeService("rule.default.svc.cluster.local", "10.2.0.0")
+	edsService := mock.MakeService("eds.default.svc.cluster.local", "10.3.0.0")
+	env := buildTestEnv(t, []*model.Service{passthroughService, ruleService, edsService},
+		&networking.DestinationRule{
+			Name: ruleService.Hostname,
+			TrafficPolicy: &networking.TrafficPolicy{
+				LoadBalancer: simpleLb(networking.LoadBalancerSettings_PASSTHROUGH),
+			},
+		})
+	clusterName := func(service *model.Service) string {
+		return model.BuildSubsetKey(model.TrafficDirectionOutbound, "", service.Hostname, service.Ports[0])
+	}
+
+	for _, interval := range []time.Duration{defaultOriginalDstCleanupInterval, time.Second} {
+		originalDstCleanupInterval = interval
+		clusters := BuildClusters(env, mock.Router)
+		cases := []struct {
+			cluster  string
+			expected *time.Duration
+		}{
+			{PassthroughCluster, &interval},
+			{clusterName(passthroughService), &interval},
+			// the PASSTHROUGH load balancer turns the EDS cluster into an ORIGINAL_DST cluster
+			{clusterName(ruleService), &interval},
+			{clusterName(edsService), nil},
+		}
+		for _, c := range cases {
+			cluster := findCluster(clusters, c.cluster)
+			if cluster == nil {
+				t.Errorf("cluster %s not found", c.cluster)
+				continue
+			}
+			if !reflect.DeepEqual(cluster.CleanupInterval, c.expected) {
+				t.Errorf("cluster %s: got cleanup interval %v, want %v", c.cluster, cluster.CleanupInterval, c.expected)
+			}
+		}
+	}
+}
+
+func TestBuildClustersMetrics(t *testing.T) {
+	service := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	env := buildTestEnv(t, []*model.Service{service}, &networking.DestinationRule{
+		Name: service.Hostname,
+		Subsets: []*networking.Subset{
+			{Name: "v1", Labels: map[string]string{"version": "v1"}},
+			{Name: "v2", Labels: map[string]string{"version": "v2"}},
+		},
+	})
+
+	kinds := []string{"outbound", "subset", "endpoint", "inbound", "other"}
+	counts := func() map[string]float64 {
+		out := make(map[string]float64)
+		for _, kind := range kinds {
+			metric := new(dto.Metric)
+			_ = clustersBuilt.WithLabelValues(kind).Write(metric)
+			out[kind] = metric.GetCounter().GetValue()
+		}
+		return out
+	}
+	builds := func() uint64 {
+		metric := new(dto.Metric)
+		_ = clusterBuildDuration.Write(metric)
+		return metric.GetHistogram().GetSampleCount()
+	}
+
+	ports := float64(len(service.Ports))
+	managementPorts := float64(len(env.ManagementPorts("")))
+	cases := []struct {
+		name     string
+		proxy    model.Proxy
+		expected map[string]float64
+	}{
+		{
+			name:  "sidecar",
+			proxy: mock.HelloProxyV0,
+			// the other clusters are the black hole and passthrough clusters
+			expected: map[string]float64{"outbound": ports, "subset": 2 * ports, "inbound": ports + managementPorts, "other": 2},
+		},
+		{
+			name:     "router",
+			proxy:    mock.Router,
+			expected: map[string]float64{"outbound": ports, "subset": 2 * ports, "inbound": managementPorts, "other": 2},
+		},
+	}
+
+	for _, c := range cases {
+		before, beforeBuilds := counts(), builds()
+		clusters := BuildClusters(env, c.proxy)
+		after, afterBuilds := counts(), builds()
+
+		total := 0.0
+		for _, kind := range kinds {
+			got := after[kind] - before[kind]
+			total += got
+			if got != c.expected[kind] {
+				t.Errorf("%s: got %v %s clusters counted, want %v", c.name, got, kind, c.expected[kind])
+			}
+		}
+		if total != float64(len(clusters)) {
+			t.Errorf("%s: got %v clusters counted, want %d", c.name, total, len(clusters))
+		}
+		if got := afterBuilds - beforeBuilds; got != 1 {
+			t.Errorf("%s: got %d build durations observed, want 1", c.name, got)
+		}
+	}
+}
+
+// countingDiscovery counts the instance lookups, which may be concurrent.
+type countingDiscovery struct {
+	model.ServiceDiscovery
+	calls int64
+}
+
+func (d *countingDiscovery) Instances(hostname string, ports []string,
+	labels model.LabelsCollection) ([]*model.ServiceInstance, error) {
+	atomic.AddInt64(&d.calls, 1)
+	return d.ServiceDiscovery.Instances(hostname, ports, labels)
+}
+
+// buildDNSServices returns DNS resolved services, each listed twice as by two registries.
+func buildDNSServices(count int) []*model.Service {
+	services := make([]*model.Service, 0, 2*count)
+	for i := 0; i < count; i++ {
+		service := mock.MakeService(fmt.Sprintf("service%d.default.svc.cluster.local", i), fmt.Sprintf("10.%d.%d.0", i/256, i%256))
+		service.Resolution = model.DNSLB
+		services = append(services, service, service)
+	}
+	return services
+}
+
+func TestBuildOutboundClustersCache(t *testing.T) {
+	services := buildDNSServices(3)
+	rule := &networking.DestinationRule{
+		Name:    services[0].Hostname,
+		Subsets: []*networking.Subset{{Name: "v1", Labels: map[string]string{"version": "v1"}}},
+	}
+	env := buildTestEnv(t, services, rule)
+	discovery := &countingDiscovery{ServiceDiscovery: env.ServiceDiscovery}
+	env.ServiceDiscovery = discovery
+
+	cached := buildOutboundClusters(env, mock.Router, services)
+	ports := 0
+	for i := 0; i < len(services); i += 2 {
+		ports += len(services[i].Ports)
+	}
+	if discovery.calls != int64(ports) {
+		t.Errorf("got %d instance lookups, want one per service port (%d)", discovery.calls, ports)
+	}
+
+	// the clusters match the ones built without cache, one lookup per cluster
+	for i, cluster := range cached {
+		if cluster.Type != v2.Cluster_STRICT_DNS {
+			t.Fatalf("cluster %s: got type %v, want STRICT_DNS", cluster.Name, cluster.Type)
+		}
+		_, subset, hostname, port := model.ParseSubsetKey(cluster.Name)
+		service := services[0]
+		for _, s := range services {
+			if s.Hostname == hostname {
+				service = s
+			}
+		}
+		servicePort, _ := service.Ports.Get(port.Name)
+		expected := buildClusterHosts(newOutboundCache(env), service, servicePort, "")
+		if !reflect.DeepEqual(cluster.Hosts, expected) {
+			t.Errorf("cluster %d %s (subset %q): got hosts %v, want %v", i, cluster.Name, subset, cluster.Hosts, expected)
+		}
+	}
+}
+
+func TestBuildOutboundClustersParallel(t *testing.T) {
+	defer func(workers int) { outboundClusterWorkers = workers }(outboundClusterWorkers)
+
+	services := buildDNSServices(50)
+	for i := 0; i < 10; i++ {
+		service := mock.MakeService(fmt.Sprintf("eds%d.default.svc.cluster.local", i), fmt.Sprintf("10.200.%d.0", i))
+		services = append(services, service)
+	}
+	rules := []*networking.DestinationRule{
+		{
+			Name:    services[0].Hostname,
+			Subsets: []*networking.Subset{{Name: "v1", Labels: map[string]string{"version": "v1"}}},
+		},
+		{
+			Name: "*.default.svc.cluster.local",
+			TrafficPolicy: &networking.TrafficPolicy{
+				ConnectionPool: &networking.ConnectionPoolSettings{
+					Tcp: &networking.ConnectionPoolSettings_TCPSettings{MaxConnections: 10},
+				},
+			},
+		},
+	}
+	env := buildTestEnv(t, services, rules...)
+
+	outboundClusterWorkers = 1
+	serial := buildOutboundClusters(env, mock.Router, services)
+	for _, workers := range []int{2, 8, 1000} {
+		outboundClusterWorkers = workers
+		parallel := buildOutboundClusters(env, mock.Router, services)
+		if !reflect.DeepEqual(parallel, serial) {
+			t.Errorf("%d workers: got clusters different from the serial build", workers)
+		}
+	}
+}
+
+func TestBuildClustersForService(t *testing.T) {
+	services := []*model.Service{mock.HelloService, mock.WorldService}
+	env := buildTestEnv(t, services, &networking.DestinationRule{
+		Name: mock.HelloService.Hostname,
+		Subsets: []*networking.Subset{
+			{Name: "v1", Labels: map[string]string{"version": "v1"}},
+			{Name: "v2", Labels: map[string]string{"version": "v2"}},
+		},
+	})
+
+	for _, proxy := range []model.Proxy{mock.HelloProxyV0, mock.Router} {
+		all := BuildClusters(env, proxy)
+		for _, service := range services {
+			// the clusters of the service are named after its hostname
+			expected := make([]*v2.Cluster, 0)
+			for _, cluster := range all {
+				if strings.HasSuffix(cluster.Name, "|"+service.Hostname) {
+					expected = append(expected, cluster)
+				}
+			}
+
+			clusters, err := BuildClustersForService(env, proxy, service.Hostname)
+			if err != nil {
+				t.Fatalf("%s %s: unexpected error: %v", proxy.ID, service.Hostname, err)
+			}
+			if !reflect.DeepEqual(clusters, expected) {
+				t.Errorf("%s %s: got clusters %v, want %v", proxy.ID, service.Hostname, clusterNames(clusters),
+					clusterNames(expected))
+			}
+		}
+	}
+
+	// the default and subset clusters of every port, and the inbound cluster of every port for the
+	// instance of the service on the sidecar
+	clusters, _ := BuildClustersForService(env, mock.HelloProxyV0, mock.HelloService.Hostname)
+	if got, want := len(clusters), 4*len(mock.HelloService.Ports); got != want {
+		t.Errorf("got %d clusters %v, want %d", got, clusterNames(clusters), want)
+	}
+	for _, port := range mock.HelloService.Ports {
+		for _, name := range []string{
+			model.BuildSubsetKey(model.TrafficDirectionOutbound, "", mock.HelloService.Hostname, port),
+			model.BuildSubsetKey(model.TrafficDirectionOutbound, "v1", mock.HelloService.Hostname, port),
+			model.BuildSubsetKey(model.TrafficDirectionOutbound, "v2", mock.HelloService.Hostname, port),
+			model.BuildSubsetKey(model.TrafficDirectionInbound, "", mock.HelloService.Hostname, port),
+		} {
+			if findCluster(clusters, name) == nil {
+				t.Errorf("cluster %s not found in %v", name, clusterNames(clusters))
+			}
+		}
+	}
+
+	// an unknown service has no clusters
+	if clusters, err := BuildClustersForService(env, mock.HelloProxyV0, "unknown.default.svc.cluster.local"); err != nil ||
+		len(clusters) != 0 {
+		t.Errorf("got clusters %v and error %v for an unknown service, want none", clusterNames(clusters), err)
+	}
+}
+
+func TestBuildClustersForServiceError(t *testing.T) {
+	discovery := mock.NewDiscovery(map[string]*model.Service{mock.HelloService.Hostname: mock.HelloService}, 2)
+	mesh := model.DefaultMeshConfig()
+	env := model.Environment{
+		ServiceDiscovery: discovery,
+		ServiceAccounts:  discovery,
+		IstioConfigStore: model.MakeIstioStore(memory.Make(model.IstioConfigTypes)),
+		Mesh:             &mesh,
+	}
+
+	discovery.ServicesError = errors.New("services unavailable")
+	if _, err := BuildClustersForService(env, mock.HelloProxyV0, mock.HelloService.Hostname); err == nil {
+		t.Error("got no error when the services are unavailable")
+	}
+
+	discovery.ClearErrors()
+	discovery.GetProxyServiceInstancesError = errors.New("instances unavailable")
+	if _, err := BuildClustersForService(env, mock.HelloProxyV0, mock.HelloService.Hostname); err == nil {
+		t.Error("got no error when the proxy instances are unavailable")
+	}
+}
+
+func BenchmarkBuildOutboundClusters(b *testing.B) {
+	services := buildDNSServices(100)
+	serviceMap := make(map[string]*model.Service)
+	for _, service := range services {
+		serviceMap[service.Hostname] = service
+	}
+	discovery := &countingDiscovery{ServiceDiscovery: mock.NewDiscovery(serviceMap, 2)}
+	mesh := model.DefaultMeshConfig()
+	env := model.Environment{
+		ServiceDiscovery: discovery,
+		ServiceAccounts:  discovery,
+		IstioConfigStore: model.MakeIstioStore(memory.Make(model.IstioConfigTypes)),
+		Mesh:             &mesh,
+	}
+
+	defer func(workers int) { outboundClusterWorkers = workers }(outboundClusterWorkers)
+	for _, workers := range []int{1, runtime.NumCPU()} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			outboundClusterWorkers = workers
+			atomic.StoreInt64(&discovery.calls, 0)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				buildOutboundClusters(env, mock.Router, services)
+			}
+			b.StopTimer()
+			b.Logf("%d instance lookups per build of %d services", atomic.LoadInt64(&discovery.calls)/int64(b.N), len(services))
+		})
+	}
+}
+
+func BenchmarkApplyTrafficPolicy(b *testing.B) {
+	mesh := model.DefaultMeshConfig()
+	env := model.Environment{Mesh: &mesh}
+	port := &model.Port{Name: "http", Port: 80, Protocol: model.ProtocolHTTP}
+	ctx := clusterContext{hostname: "reviews.default.svc.cluster.local", port: port}
+	policies := map[string]*networking.TrafficPolicy{
+		"default": buildDefaultTrafficPolicy(env, v2.Cluster_EDS),
+		"destination rule": {
+			ConnectionPool: &networking.ConnectionPoolSettings{
+				Http: &networking.ConnectionPoolSettings_HTTPSettings{Http2MaxRequests: 100, MaxRetries: 3},
+				Tcp:  &networking.ConnectionPoolSettings_TCPSettings{MaxConnections: 50},
+			},
+			OutlierDetection: &networking.OutlierDetection{
+				Http: &networking.OutlierDetection_HTTPSettings{ConsecutiveErrors: 5},
+			},
+			LoadBalancer: simpleLb(networking.LoadBalancerSettings_LEAST_CONN),
+		},
+	}
+
+	for name, policy := range policies {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				cluster := &v2.Cluster{Name: "outbound|80||reviews.default.svc.cluster.local", Type: v2.Cluster_EDS}
+				applyTrafficPolicy(cluster, policy, ctx)
+			}
+		})
+	}
+}
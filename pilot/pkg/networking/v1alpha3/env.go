@@ -0,0 +1,144 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1alpha3
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"istio.io/istio/pkg/log"
+)
+
+// Helpers for settings that are not (yet) part of the mesh config and are read from the
+// pilot environment instead. Invalid values are logged and replaced by the default.
+
+// envEnum returns the enum value named by the environment variable, using the generated
+// proto name to value map.
+func envEnum(name string, values map[string]int32, defaultValue int32) int32 {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	v, ok := values[value]
+	if !ok {
+		log.Warnf("invalid value %s=%q, using default", name, value)
+		return defaultValue
+	}
+	return v
+}
+
+// envStringList returns the comma separated list in the environment variable, preserving order.
+func envStringList(name string) []string {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	out := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// envDuration returns the duration in the environment variable, in time.ParseDuration format.
+func envDuration(name string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Warnf("invalid value %s=%q, using default", name, value)
+		return defaultValue
+	}
+	return d
+}
+
+// envUint32 returns the unsigned integer in the environment variable.
+func envUint32(name string, defaultValue uint32) uint32 {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	v, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		log.Warnf("invalid value %s=%q, using default", name, value)
+		return defaultValue
+	}
+	return uint32(v)
+}
+
+// EnvUint32 returns the unsigned integer in the environment variable, for the settings read by
+// other packages of pilot.
+func EnvUint32(name string, defaultValue uint32) uint32 {
+	return envUint32(name, defaultValue)
+}
+
+// envOptionalUint32 returns the unsigned integer in the environment variable, and whether it is set.
+// This distinguishes an explicit zero from an unset variable.
+func envOptionalUint32(name string) (uint32, bool) {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0, false
+	}
+	v, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		log.Warnf("invalid value %s=%q, ignoring", name, value)
+		return 0, false
+	}
+	return uint32(v), true
+}
+
+// envString returns the value of the environment variable, or the default value if it is unset.
+func envString(name, defaultValue string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// envBool returns the boolean in the environment variable, in strconv.ParseBool format.
+func envBool(name string, defaultValue bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Warnf("invalid value %s=%q, using default", name, value)
+		return defaultValue
+	}
+	return b
+}
+
+// envIP returns the IPv4 or IPv6 address in the environment variable in canonical form, or an
+// empty string if unset or invalid.
+func envIP(name string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		return ""
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		log.Warnf("invalid value %s=%q, ignoring", name, value)
+		return ""
+	}
+	return ip.String()
+}
@@ -159,7 +159,7 @@ func buildGatewayInboundHTTPRouteConfig(env model.Environment, gatewayName strin
 	virtualHosts := make([]route.VirtualHost, 0)
 	// TODO: Need to trim output based on source label/gateway match
 	for _, v := range virtualServices {
-		guardedRoute := TranslateRoutes(v, nil)
+		guardedRoute := TranslateRoutes(v, nil, nil)
 		var routes []route.Route
 		for _, g := range guardedRoute {
 			routes = append(routes, g.Route)
@@ -301,6 +301,9 @@ func buildSidecarOutboundListeners(env model.Environment, node model.Proxy,
 			}
 			switch servicePort.Protocol {
 			case model.ProtocolTCP, model.ProtocolHTTPS, model.ProtocolMongo, model.ProtocolRedis:
+				if hasHeadlessEndpointClusters(service, servicePort) {
+					tcpListeners = append(tcpListeners, buildHeadlessEndpointListeners(listenerOpts, service, servicePort)...)
+				}
 				if service.Resolution == model.Passthrough {
 					// ensure only one wildcard listener is created per port if its headless service
 					// or if this is in environment where services don't get a dummy load balancer IP.
@@ -346,6 +349,34 @@ func buildSidecarOutboundListeners(env model.Environment, node model.Proxy,
 	return append(tcpListeners, httpListeners...)
 }
 
+// buildHeadlessEndpointListeners returns a TCP listener for each endpoint address of the headless service
+// port, forwarding the connections to the cluster of the endpoint instead of the cluster of the service.
+func buildHeadlessEndpointListeners(opts buildListenerOpts, service *model.Service, port *model.Port) []*xdsapi.Listener {
+	instances, err := opts.env.Instances(service.Hostname, []string{port.Name}, nil)
+	if err != nil {
+		log.Errorf("failed to retrieve instances for %s: %v", service.Hostname, err)
+		return nil
+	}
+
+	listeners := make([]*xdsapi.Listener, 0, len(instances))
+	seen := make(map[string]bool)
+	for _, instance := range instances {
+		address := instance.Endpoint.Address
+		if seen[address] {
+			continue
+		}
+		seen[address] = true
+
+		clusterName := model.BuildSubsetKey(model.TrafficDirectionOutbound, address, service.Hostname, port)
+		endpointOpts := opts
+		endpointOpts.ip = address
+		endpointOpts.port = instance.Endpoint.Port
+		endpointOpts.networkFilters = buildOutboundNetworkFilters(clusterName, []string{address}, port)
+		listeners = append(listeners, buildListener(endpointOpts))
+	}
+	return listeners
+}
+
 // buildMgmtPortListeners creates inbound TCP only listeners for the management ports on
 // server (inbound). Management port listeners are slightly different from standard Inbound listeners
 // in that, they do not have mixer filters nor do they have inbound auth.
@@ -713,7 +744,7 @@ func buildSidecarOutboundHTTPRouteConfig(env model.Environment, node model.Proxy
 	virtualServices := env.VirtualServices([]string{model.IstioMeshGateway})
 	// TODO: Need to trim output based on source label/gateway match
 	guardedHosts := TranslateVirtualHosts(virtualServices,
-		nameToServiceMap, nil, node.Domain)
+		nameToServiceMap, nil, outboundTrafficPolicySelector(newOutboundCache(env)), node.Domain)
 	vHostPortMap := make(map[int][]route.VirtualHost)
 
 	// there should be only one guarded host in the return val since we supplied services with just one port
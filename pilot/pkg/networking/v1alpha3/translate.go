@@ -51,6 +51,9 @@ type ServiceByName func(host string, contextNamespace string) *model.Service
 // SubsetSelector resolves a subset to labels.
 type SubsetSelector func(service *model.Service, subset string) map[string]string
 
+// TrafficPolicySelector resolves the destination rule traffic policy of a service port and subset.
+type TrafficPolicySelector func(service *model.Service, port *model.Port, subset string) *networking.TrafficPolicy
+
 // GuardedHost is a context-dependent virtual host entry with guarded routes.
 type GuardedHost struct {
 	// Port is the capture port (e.g. service port)
@@ -82,17 +85,19 @@ func TranslateServiceHostname(services map[string]*model.Service, clusterDomain
 // TranslateVirtualHosts creates the entire routing table for Istio v1alpha3 configs.
 // Services are indexed by FQDN hostnames.
 // Cluster domain is used to resolve short service names (e.g. "svc.cluster.local").
+// The traffic policy selector, if any, resolves the consistent hash settings of the destinations.
 func TranslateVirtualHosts(
 	serviceConfigs []model.Config,
 	services map[string]*model.Service,
 	subsetSelector SubsetSelector,
+	trafficPolicySelector TrafficPolicySelector,
 	clusterDomain string) []GuardedHost {
 	out := make([]GuardedHost, 0)
 	serviceByName := TranslateServiceHostname(services, clusterDomain)
 
 	// translate all virtual service configs
 	for _, config := range serviceConfigs {
-		out = append(out, TranslateVirtualHost(config, serviceByName, subsetSelector)...)
+		out = append(out, TranslateVirtualHost(config, serviceByName, subsetSelector, trafficPolicySelector)...)
 	}
 
 	// compute services missing service configs
@@ -112,6 +117,15 @@ func TranslateVirtualHosts(
 		for _, port := range svc.Ports {
 			if port.Protocol.IsHTTP() {
 				cluster := model.BuildSubsetKey(model.TrafficDirectionOutbound, "", svc.Hostname, port)
+				action := &route.RouteAction{
+					ClusterSpecifier: &route.RouteAction_Cluster{Cluster: cluster},
+				}
+				if trafficPolicySelector != nil {
+					policy := trafficPolicySelector(svc, port, "")
+					if hashPolicy := TranslateHashPolicy(policy.GetLoadBalancer().GetConsistentHash()); hashPolicy != nil {
+						action.HashPolicy = []*route.RouteAction_HashPolicy{hashPolicy}
+					}
+				}
 				out = append(out, GuardedHost{
 					Port:     port.Port,
 					Services: []*model.Service{svc},
@@ -119,11 +133,7 @@ func TranslateVirtualHosts(
 						Route: route.Route{
 							Match:     TranslateRouteMatch(nil),
 							Decorator: &route.Decorator{Operation: DefaultOperation},
-							Action: &route.Route_Route{
-								Route: &route.RouteAction{
-									ClusterSpecifier: &route.RouteAction_Cluster{Cluster: cluster},
-								},
-							},
+							Action:    &route.Route_Route{Route: action},
 						},
 					}},
 				})
@@ -150,7 +160,8 @@ func MatchServiceHosts(in model.Config, serviceByName ServiceByName) ([]string,
 }
 
 // TranslateVirtualHost creates virtual hosts corresponding to a virtual service.
-func TranslateVirtualHost(in model.Config, serviceByName ServiceByName, subsetSelector SubsetSelector) []GuardedHost {
+func TranslateVirtualHost(in model.Config, serviceByName ServiceByName, subsetSelector SubsetSelector,
+	trafficPolicySelector TrafficPolicySelector) []GuardedHost {
 	hosts, services := MatchServiceHosts(in, serviceByName)
 	serviceByPort := make(map[int][]*model.Service)
 	for _, svc := range services {
@@ -170,7 +181,8 @@ func TranslateVirtualHost(in model.Config, serviceByName ServiceByName, subsetSe
 	out := make([]GuardedHost, len(serviceByPort))
 	for port, services := range serviceByPort {
 		clusterNaming := TranslateDestination(serviceByName, subsetSelector, in.ConfigMeta.Namespace, port)
-		routes := TranslateRoutes(in, clusterNaming)
+		hashPolicy := TranslateDestinationHashPolicy(serviceByName, trafficPolicySelector, in.ConfigMeta.Namespace, port)
+		routes := TranslateRoutes(in, clusterNaming, hashPolicy)
 		out = append(out, GuardedHost{
 			Port:     port,
 			Services: services,
@@ -189,37 +201,70 @@ func TranslateDestination(
 	contextNamespace string,
 	defaultPort int) ClusterNaming {
 	return func(destination *networking.Destination) string {
-		// detect if it is a service
-		svc := serviceByName(destination.Name, contextNamespace)
-
 		// TODO: create clusters for non-service hostnames/IPs
-		if svc == nil {
+		svc, svcPort := resolveDestination(serviceByName, destination, contextNamespace, defaultPort)
+		if svcPort == nil {
 			return UnresolvedCluster
 		}
 
-		// default port uses port number
-		svcPort, _ := svc.Ports.GetByPort(defaultPort)
-		if destination.Port != nil {
-			switch selector := destination.Port.Port.(type) {
-			case *networking.PortSelector_Name:
-				svcPort, _ = svc.Ports.Get(selector.Name)
-			case *networking.PortSelector_Number:
-				svcPort, _ = svc.Ports.GetByPort(int(selector.Number))
-			}
-		}
+		// use subsets if it is a service
+		return model.BuildSubsetKey(model.TrafficDirectionOutbound, destination.Subset, svc.Hostname, svcPort)
+	}
+}
 
+// TranslateDestinationHashPolicy produces a hash policy function using the config context. It returns nil
+// without a traffic policy selector.
+func TranslateDestinationHashPolicy(
+	serviceByName ServiceByName,
+	trafficPolicySelector TrafficPolicySelector,
+	contextNamespace string,
+	defaultPort int) HashPolicySelector {
+	if trafficPolicySelector == nil {
+		return nil
+	}
+	return func(destination *networking.Destination) *route.RouteAction_HashPolicy {
+		svc, svcPort := resolveDestination(serviceByName, destination, contextNamespace, defaultPort)
 		if svcPort == nil {
-			return UnresolvedCluster
+			return nil
 		}
 
-		// use subsets if it is a service
-		return model.BuildSubsetKey(model.TrafficDirectionOutbound, destination.Subset, svc.Hostname, svcPort)
+		policy := trafficPolicySelector(svc, svcPort, destination.Subset)
+		return TranslateHashPolicy(policy.GetLoadBalancer().GetConsistentHash())
 	}
 }
 
+// resolveDestination returns the service and the service port of a destination, or a nil port if
+// either is unknown. The port defaults to the port number of the virtual host.
+func resolveDestination(
+	serviceByName ServiceByName,
+	destination *networking.Destination,
+	contextNamespace string,
+	defaultPort int) (*model.Service, *model.Port) {
+	// detect if it is a service
+	svc := serviceByName(destination.Name, contextNamespace)
+	if svc == nil {
+		return nil, nil
+	}
+
+	// default port uses port number
+	svcPort, _ := svc.Ports.GetByPort(defaultPort)
+	if destination.Port != nil {
+		switch selector := destination.Port.Port.(type) {
+		case *networking.PortSelector_Name:
+			svcPort, _ = svc.Ports.Get(selector.Name)
+		case *networking.PortSelector_Number:
+			svcPort, _ = svc.Ports.GetByPort(int(selector.Number))
+		}
+	}
+	return svc, svcPort
+}
+
 // ClusterNaming specifies cluster name for a destination
 type ClusterNaming func(*networking.Destination) string
 
+// HashPolicySelector specifies the route hash policy for a destination, or nil
+type HashPolicySelector func(*networking.Destination) *route.RouteAction_HashPolicy
+
 // GuardedRoute are routes for a destination guarded by deployment conditions.
 type GuardedRoute struct {
 	route.Route
@@ -234,7 +279,7 @@ type GuardedRoute struct {
 // TranslateRoutes creates virtual host routes from the v1alpha3 config.
 // The rule should be adapted to destination names (outbound clusters).
 // Each rule is guarded by source labels.
-func TranslateRoutes(in model.Config, name ClusterNaming) []GuardedRoute {
+func TranslateRoutes(in model.Config, name ClusterNaming, hashPolicy HashPolicySelector) []GuardedRoute {
 	rule, ok := in.Spec.(*networking.VirtualService)
 	if !ok {
 		return nil
@@ -245,10 +290,10 @@ func TranslateRoutes(in model.Config, name ClusterNaming) []GuardedRoute {
 	out := make([]GuardedRoute, 0)
 	for _, http := range rule.Http {
 		if len(http.Match) == 0 {
-			out = append(out, TranslateRoute(http, nil, operation, name))
+			out = append(out, TranslateRoute(http, nil, operation, name, hashPolicy))
 		} else {
 			for _, match := range http.Match {
-				out = append(out, TranslateRoute(http, match, operation, name))
+				out = append(out, TranslateRoute(http, match, operation, name, hashPolicy))
 			}
 		}
 	}
@@ -257,11 +302,13 @@ func TranslateRoutes(in model.Config, name ClusterNaming) []GuardedRoute {
 }
 
 // TranslateRoute translates HTTP routes
+// The hash policy of the route is that of the first destination, if any.
 // TODO: fault filters -- issue https://github.com/istio/api/issues/388
 func TranslateRoute(in *networking.HTTPRoute,
 	match *networking.HTTPMatchRequest,
 	operation string,
-	name ClusterNaming) GuardedRoute {
+	name ClusterNaming,
+	hashPolicy HashPolicySelector) GuardedRoute {
 	out := route.Route{
 		Match: TranslateRouteMatch(match),
 		Decorator: &route.Decorator{
@@ -305,6 +352,12 @@ func TranslateRoute(in *networking.HTTPRoute,
 			}
 		}
 
+		if hashPolicy != nil && len(in.Route) > 0 {
+			if policy := hashPolicy(in.Route[0].Destination); policy != nil {
+				action.HashPolicy = []*route.RouteAction_HashPolicy{policy}
+			}
+		}
+
 		if in.Mirror != nil {
 			action.RequestMirrorPolicy = &route.RouteAction_RequestMirrorPolicy{Cluster: name(in.Mirror)}
 		}
@@ -421,6 +474,47 @@ func TranslateRetryPolicy(in *networking.HTTPRetry) *route.RouteAction_RetryPoli
 	return nil
 }
 
+// TranslateHashPolicy translates the consistent hash load balancer settings of a destination
+// rule into the route hash policy used by RING_HASH and MAGLEV clusters.
+func TranslateHashPolicy(in *networking.LoadBalancerSettings_ConsistentHashLB) *route.RouteAction_HashPolicy {
+	if in == nil {
+		return nil
+	}
+
+	switch {
+	case in.GetHttpHeaderName() != "":
+		return &route.RouteAction_HashPolicy{
+			PolicySpecifier: &route.RouteAction_HashPolicy_Header_{
+				Header: &route.RouteAction_HashPolicy_Header{
+					HeaderName: in.GetHttpHeaderName(),
+				},
+			},
+		}
+	case in.GetHttpCookie() != nil:
+		cookie := in.GetHttpCookie()
+		return &route.RouteAction_HashPolicy{
+			PolicySpecifier: &route.RouteAction_HashPolicy_Cookie_{
+				Cookie: &route.RouteAction_HashPolicy_Cookie{
+					Name: cookie.Name,
+					Path: cookie.Path,
+					Ttl:  TranslateTime(cookie.Ttl),
+				},
+			},
+		}
+	case in.GetUseSourceIp():
+		return &route.RouteAction_HashPolicy{
+			PolicySpecifier: &route.RouteAction_HashPolicy_ConnectionProperties_{
+				ConnectionProperties: &route.RouteAction_HashPolicy_ConnectionProperties{
+					SourceIp: true,
+				},
+			},
+		}
+	}
+
+	log.Warnf("consistent hash load balancer settings without a hash key: %v", in)
+	return nil
+}
+
 // TranslateCORSPolicy translates CORS policy
 func TranslateCORSPolicy(in *networking.CorsPolicy) *route.CorsPolicy {
 	if in == nil {
@@ -0,0 +1,191 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1alpha3
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	"github.com/gogo/protobuf/types"
+
+	networking "istio.io/api/networking/v1alpha3"
+	"istio.io/istio/pilot/pkg/model"
+)
+
+func TestTranslateHashPolicy(t *testing.T) {
+	ttl := 10 * time.Second
+	cases := []struct {
+		name     string
+		in       *networking.LoadBalancerSettings_ConsistentHashLB
+		expected *route.RouteAction_HashPolicy
+	}{
+		{
+			name:     "nil",
+			in:       nil,
+			expected: nil,
+		},
+		{
+			name: "header",
+			in: &networking.LoadBalancerSettings_ConsistentHashLB{
+				HashKey: &networking.LoadBalancerSettings_ConsistentHashLB_HttpHeaderName{
+					HttpHeaderName: "x-user",
+				},
+			},
+			expected: &route.RouteAction_HashPolicy{
+				PolicySpecifier: &route.RouteAction_HashPolicy_Header_{
+					Header: &route.RouteAction_HashPolicy_Header{HeaderName: "x-user"},
+				},
+			},
+		},
+		{
+			name: "cookie",
+			in: &networking.LoadBalancerSettings_ConsistentHashLB{
+				HashKey: &networking.LoadBalancerSettings_ConsistentHashLB_HttpCookie{
+					HttpCookie: &networking.LoadBalancerSettings_ConsistentHashLB_HTTPCookie{
+						Name: "session",
+						Path: "/",
+						Ttl:  &types.Duration{Seconds: 10},
+					},
+				},
+			},
+			expected: &route.RouteAction_HashPolicy{
+				PolicySpecifier: &route.RouteAction_HashPolicy_Cookie_{
+					Cookie: &route.RouteAction_HashPolicy_Cookie{
+						Name: "session",
+						Path: "/",
+						Ttl:  &ttl,
+					},
+				},
+			},
+		},
+		{
+			name: "source ip",
+			in: &networking.LoadBalancerSettings_ConsistentHashLB{
+				HashKey: &networking.LoadBalancerSettings_ConsistentHashLB_UseSourceIp{
+					UseSourceIp: true,
+				},
+			},
+			expected: &route.RouteAction_HashPolicy{
+				PolicySpecifier: &route.RouteAction_HashPolicy_ConnectionProperties_{
+					ConnectionProperties: &route.RouteAction_HashPolicy_ConnectionProperties{SourceIp: true},
+				},
+			},
+		},
+		{
+			name:     "no hash key",
+			in:       &networking.LoadBalancerSettings_ConsistentHashLB{MinimumRingSize: 1024},
+			expected: nil,
+		},
+	}
+
+	for _, c := range cases {
+		if got := TranslateHashPolicy(c.in); !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.expected)
+		}
+	}
+}
+
+func TestTranslateVirtualHostsHashPolicy(t *testing.T) {
+	headerHash := func(header string) *networking.LoadBalancerSettings {
+		return &networking.LoadBalancerSettings{
+			LbPolicy: &networking.LoadBalancerSettings_ConsistentHash{
+				ConsistentHash: &networking.LoadBalancerSettings_ConsistentHashLB{
+					HashKey: &networking.LoadBalancerSettings_ConsistentHashLB_HttpHeaderName{
+						HttpHeaderName: header,
+					},
+				},
+			},
+		}
+	}
+	rule := &networking.DestinationRule{
+		Name:          "reviews.default.svc.cluster.local",
+		TrafficPolicy: &networking.TrafficPolicy{LoadBalancer: headerHash("x-user")},
+		Subsets: []*networking.Subset{
+			{Name: "v1"},
+			{Name: "v2", TrafficPolicy: &networking.TrafficPolicy{LoadBalancer: headerHash("x-session")}},
+		},
+	}
+	services := map[string]*model.Service{
+		"reviews.default.svc.cluster.local": {
+			Hostname: "reviews.default.svc.cluster.local",
+			Ports:    model.PortList{{Name: "http", Port: 9080, Protocol: model.ProtocolHTTP}},
+		},
+		"ratings.default.svc.cluster.local": {
+			Hostname: "ratings.default.svc.cluster.local",
+			Ports:    model.PortList{{Name: "http", Port: 9080, Protocol: model.ProtocolHTTP}},
+		},
+	}
+	selector := func(service *model.Service, port *model.Port, subset string) *networking.TrafficPolicy {
+		if service.Hostname != rule.Name {
+			return nil
+		}
+		return subsetTrafficPolicy(rule, subset, port)
+	}
+	virtualService := model.Config{
+		ConfigMeta: model.ConfigMeta{Name: "reviews", Namespace: "default"},
+		Spec: &networking.VirtualService{
+			Hosts: []string{"reviews"},
+			Http: []*networking.HTTPRoute{
+				{
+					Match: []*networking.HTTPMatchRequest{{Uri: &networking.StringMatch{
+						MatchType: &networking.StringMatch_Prefix{Prefix: "/v2"}}}},
+					Route: []*networking.DestinationWeight{{Destination: &networking.Destination{Name: "reviews", Subset: "v2"}}},
+				},
+				{
+					Route: []*networking.DestinationWeight{{Destination: &networking.Destination{Name: "reviews", Subset: "v1"}}},
+				},
+			},
+		},
+	}
+
+	hashHeaders := func(hosts []GuardedHost) map[string][]string {
+		out := make(map[string][]string)
+		for _, host := range hosts {
+			for _, r := range host.Routes {
+				action := r.Route.Action.(*route.Route_Route).Route
+				name := action.GetCluster()
+				for _, policy := range action.HashPolicy {
+					out[name] = append(out[name], policy.GetHeader().HeaderName)
+				}
+			}
+		}
+		return out
+	}
+
+	got := hashHeaders(TranslateVirtualHosts([]model.Config{virtualService}, services, nil, selector, "svc.cluster.local"))
+	expected := map[string][]string{
+		"outbound|http|v2|reviews.default.svc.cluster.local": {"x-session"},
+		"outbound|http|v1|reviews.default.svc.cluster.local": {"x-user"},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("route hash policies: got %v, expected %v", got, expected)
+	}
+
+	// without a traffic policy selector, e.g. on gateways, the routes carry no hash policy
+	if got := hashHeaders(TranslateVirtualHosts([]model.Config{virtualService}, services, nil, nil, "svc.cluster.local")); len(got) != 0 {
+		t.Errorf("route hash policies without a selector: got %v, expected none", got)
+	}
+
+	// the default route of a service without virtual service uses the destination rule policy
+	got = hashHeaders(TranslateVirtualHosts(nil, services, nil, selector, "svc.cluster.local"))
+	expected = map[string][]string{
+		"outbound|http||reviews.default.svc.cluster.local": {"x-user"},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("default route hash policies: got %v, expected %v", got, expected)
+	}
+}
@@ -137,6 +137,7 @@ func (s *DiscoveryServer) StreamClusters(stream xdsapi.ClusterDiscoveryService_S
 			if err != nil {
 				return err
 			}
+			nt.Metadata = model.ParseMetadata(discReq.Node.Metadata)
 
 			con.modelNode = &nt
 
@@ -19,6 +19,7 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"math"
 	"net"
 	"net/http"
 	"os"
@@ -37,7 +38,9 @@ import (
 
 	"strings"
 
+	networking "istio.io/api/networking/v1alpha3"
 	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/networking/v1alpha3"
 	"istio.io/istio/pkg/log"
 )
 
@@ -70,6 +73,11 @@ var (
 	// Default is enabled (not set: "" != "0")
 	edsDebug = os.Getenv("PILOT_DEBUG_EDS") != "0"
 
+	// Overprovisioning factor of the endpoints of all clusters, in percent, controlling how early
+	// traffic fails over to the hosts of the next priority level as the hosts of a priority become
+	// unhealthy. Zero leaves the Envoy default of 140.
+	overprovisioningFactor = v1alpha3.EnvUint32("PILOT_OVERPROVISIONING_FACTOR", 0)
+
 	edsClusterMutex sync.Mutex
 	edsClusters     = map[string]*EdsCluster{}
 
@@ -77,6 +85,13 @@ var (
 	connectionNumber = int64(0)
 )
 
+// maxLocalityWeight is the highest load balancing weight of a locality accepted by Envoy.
+const maxLocalityWeight = 128
+
+// lbMetadataNamespace is the namespace of the endpoint metadata matched by the subset selectors of the
+// load balancer of a cluster.
+const lbMetadataNamespace = "envoy.lb"
+
 // EdsCluster tracks eds-related info for monitored clusters. In practice it'll include
 // all clusters until we support on-demand cluster loading.
 type EdsCluster struct {
@@ -88,6 +103,10 @@ type EdsCluster struct {
 
 	LoadAssignment *xdsapi.ClusterLoadAssignment
 
+	// LocalityLbSetting is the locality load balancer setting of the destination rule of the cluster,
+	// from which the priorities and weights of the localities are set for each proxy.
+	LocalityLbSetting *networking.LocalityLoadBalancerSetting
+
 	// FirstUse is the time the cluster was first used, for debugging
 	FirstUse time.Time
 
@@ -108,6 +127,9 @@ type EdsConnection struct {
 	// current list of clusters monitored by the client
 	Clusters []string
 
+	// Locality of the client, as the availability zone of its service instances (e.g. region/zone)
+	Locality string
+
 	// Time of connection, for debugging
 	Connect time.Time
 
@@ -116,8 +138,8 @@ type EdsConnection struct {
 	pushChannel chan bool
 }
 
-// Endpoints aggregate a DiscoveryResponse for pushing.
-func (s *DiscoveryServer) endpoints(clusterNames []string) *xdsapi.DiscoveryResponse {
+// Endpoints aggregate a DiscoveryResponse for pushing to a proxy in the locality.
+func (s *DiscoveryServer) endpoints(clusterNames []string, locality string) *xdsapi.DiscoveryResponse {
 	out := &xdsapi.DiscoveryResponse{
 		// All resources for EDS ought to be of the type ClusterLoadAssignment
 		TypeUrl: endpointType,
@@ -132,7 +154,7 @@ func (s *DiscoveryServer) endpoints(clusterNames []string) *xdsapi.DiscoveryResp
 
 	out.Resources = make([]types.Any, 0, len(clusterNames))
 	for _, clusterName := range clusterNames {
-		clAssignmentRes := s.clusterEndpoints(clusterName)
+		clAssignmentRes := s.clusterEndpoints(clusterName, locality)
 		if clAssignmentRes != nil {
 			out.Resources = append(out.Resources, *clAssignmentRes)
 		}
@@ -141,26 +163,27 @@ func (s *DiscoveryServer) endpoints(clusterNames []string) *xdsapi.DiscoveryResp
 	return out
 }
 
-// Get the ClusterLoadAssignment for a cluster.
-func (s *DiscoveryServer) clusterEndpoints(clusterName string) *types.Any {
+// Get the ClusterLoadAssignment for a cluster, as sent to a proxy in the locality.
+func (s *DiscoveryServer) clusterEndpoints(clusterName string, locality string) *types.Any {
 	c := s.getOrAddEdsCluster(clusterName)
-	l := loadAssignment(c)
+	l, setting := loadAssignment(c)
 	if l == nil { // fresh cluster
-		updateCluster(clusterName, c)
-		l = loadAssignment(c)
+		updateCluster(clusterName, c, v1alpha3.NewLocalityLbSettings(s.env))
+		l, setting = loadAssignment(c)
 	}
 
 	// Previously computed load assignments. They are re-computed on cache invalidation or
 	// event, but don't have to be recomputed once for each sidecar.
-	clAssignmentRes, _ := types.MarshalAny(l)
+	clAssignmentRes, _ := types.MarshalAny(localityLoadAssignment(l, setting, locality))
 	return clAssignmentRes
 }
 
-// Return the load assignment. The field can be updated by another routine.
-func loadAssignment(c *EdsCluster) *xdsapi.ClusterLoadAssignment {
+// Return the load assignment and the locality load balancer setting. The fields can be updated by
+// another routine.
+func loadAssignment(c *EdsCluster) (*xdsapi.ClusterLoadAssignment, *networking.LocalityLoadBalancerSetting) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	return c.LoadAssignment
+	return c.LoadAssignment, c.LocalityLbSetting
 }
 
 func newEndpoint(address string, port uint32) (*endpoint.LbEndpoint, error) {
@@ -190,12 +213,14 @@ func newEndpoint(address string, port uint32) (*endpoint.LbEndpoint, error) {
 }
 
 // updateCluster is called from the event (or global cache invalidation) to update
-// the endpoints for the cluster.
-func updateCluster(clusterName string, edsCluster *EdsCluster) {
+// the endpoints for the cluster. The locality load balancer settings are shared by the
+// clusters updated by a push.
+func updateCluster(clusterName string, edsCluster *EdsCluster, localityLbSettings *v1alpha3.LocalityLbSettings) {
 	// TODO: should we lock this as well ? Once we move to event-based it may not matter.
 	var hostname string
 	var ports model.PortList
 	var labels model.LabelsCollection
+	var localityLbSetting *networking.LocalityLoadBalancerSetting
 	// Single port
 	var portName string
 
@@ -207,6 +232,7 @@ func updateCluster(clusterName string, edsCluster *EdsCluster) {
 		ports = []*model.Port{p}
 		portName = p.Name
 		labels = edsCluster.discovery.env.IstioConfigStore.SubsetToLabels(subsetName, hostname, "")
+		localityLbSetting = localityLbSettings.Get(hostname, subsetName, portName)
 	} else {
 		hostname, ports, labels = model.ParseServiceKey(clusterName)
 		if len(ports) > 0 {
@@ -232,17 +258,20 @@ func updateCluster(clusterName string, edsCluster *EdsCluster) {
 	edsCluster.LoadAssignment = &xdsapi.ClusterLoadAssignment{
 		ClusterName: clusterName,
 		Endpoints:   locEps,
+		Policy:      buildLoadAssignmentPolicy(),
 	}
+	edsCluster.LocalityLbSetting = localityLbSetting
 	if len(locEps) > 0 && edsCluster.NonEmptyTime.IsZero() {
 		edsCluster.NonEmptyTime = time.Now()
 	}
 
 }
 
-// LocalityLbEndpointsFromInstances returns a list of Envoy v2 LocalityLbEndpoints.
+// localityLbEndpointsFromInstances returns a list of Envoy v2 LocalityLbEndpoints.
 // Envoy v2 Endpoints are constructed from Pilot's older data structure involving
 // model.ServiceInstance objects. Envoy expects the endpoints grouped by zone, so
 // a map is created - in new data structures this should be part of the model.
+// The localities are weighted by their number of endpoints, see applyLocalityWeights.
 func localityLbEndpointsFromInstances(instances []*model.ServiceInstance) []endpoint.LocalityLbEndpoints {
 	localityEpMap := make(map[string]*endpoint.LocalityLbEndpoints)
 	for _, instance := range instances {
@@ -251,6 +280,7 @@ func localityLbEndpointsFromInstances(instances []*model.ServiceInstance) []endp
 			log.Errorf("EDS: unexpected pilot model endpoint v1 to v2 conversion: %v", err)
 			continue
 		}
+		lbEp.Metadata = endpointMetadata(instance)
 		// TODO: Need to accommodate region, zone and subzone. Older Pilot datamodel only has zone = availability zone.
 		// Once we do that, the key must be a | separated tupple.
 		locality := instance.AvailabilityZone
@@ -269,9 +299,243 @@ func localityLbEndpointsFromInstances(instances []*model.ServiceInstance) []endp
 	for _, locLbEps := range localityEpMap {
 		out = append(out, *locLbEps)
 	}
+	applyLocalityWeights(out)
 	return out
 }
 
+// applyLocalityWeights weights the localities by their number of endpoints, so that the clusters
+// balancing load across localities (locality weighted load balancing) spread it evenly across the
+// endpoints, as the other clusters do. Envoy ignores the weights of the other clusters, but drops
+// all the traffic of a cluster balancing load across localities without weights.
+func applyLocalityWeights(localities []endpoint.LocalityLbEndpoints) {
+	max := 0
+	for _, locality := range localities {
+		if len(locality.LbEndpoints) > max {
+			max = len(locality.LbEndpoints)
+		}
+	}
+	for i := range localities {
+		weight := uint32(len(localities[i].LbEndpoints))
+		if max > maxLocalityWeight {
+			weight = scaleLocalityWeight(float64(weight), float64(max))
+		}
+		localities[i].LoadBalancingWeight = &types.UInt32Value{Value: weight}
+	}
+}
+
+// scaleLocalityWeight scales a weight down to the range of the locality weights accepted by Envoy,
+// in which max is the highest weight. A positive weight never rounds down to zero.
+func scaleLocalityWeight(weight, max float64) uint32 {
+	scaled := uint32(math.Floor(weight*maxLocalityWeight/max + 0.5))
+	if scaled == 0 && weight > 0 {
+		scaled = 1
+	}
+	return scaled
+}
+
+// localityLoadAssignment returns the load assignment of a cluster as sent to a proxy in the locality,
+// with the priorities and weights of the localities set by the locality load balancer setting of the
+// cluster. The shared load assignment is left untouched.
+func localityLoadAssignment(l *xdsapi.ClusterLoadAssignment, setting *networking.LocalityLoadBalancerSetting,
+	locality string) *xdsapi.ClusterLoadAssignment {
+	if l == nil || setting == nil || locality == "" {
+		return l
+	}
+
+	out := *l
+	out.Endpoints = append([]endpoint.LocalityLbEndpoints(nil), l.Endpoints...)
+	// the localities receiving no traffic are dropped before the priorities are made contiguous
+	if len(setting.Distribute) > 0 {
+		out.Endpoints = applyLocalityDistribute(out.Endpoints, setting.Distribute, locality)
+	}
+	if len(setting.Failover) > 0 {
+		applyLocalityFailover(out.Endpoints, setting.Failover, locality)
+	}
+	return &out
+}
+
+// Priorities of the localities of a failover, relative to the locality of the proxy, before they are
+// made contiguous.
+const (
+	priorityLocalZone = iota
+	priorityLocalRegion
+	priorityFailoverRegion
+	priorityOther
+)
+
+// applyLocalityFailover sets the priorities of the localities for a proxy in the locality. The endpoints
+// in the zone of the proxy come first, then those in its region, then those in the region its traffic
+// fails over to, then all the others. Envoy moves on to the next priority as the hosts of a priority
+// become unhealthy.
+func applyLocalityFailover(localities []endpoint.LocalityLbEndpoints,
+	failover []*networking.LocalityLoadBalancerSetting_Failover, locality string) {
+	region := localityRegion(locality)
+	failoverRegion := ""
+	for _, f := range failover {
+		if f.From == region {
+			failoverRegion = f.To
+			break
+		}
+	}
+
+	priorities := make([]int, len(localities))
+	used := make([]bool, priorityOther+1)
+	for i := range localities {
+		zone := localities[i].Locality.GetZone()
+		switch {
+		case zone == locality:
+			priorities[i] = priorityLocalZone
+		case localityRegion(zone) == region:
+			priorities[i] = priorityLocalRegion
+		case failoverRegion != "" && localityRegion(zone) == failoverRegion:
+			priorities[i] = priorityFailoverRegion
+		default:
+			priorities[i] = priorityOther
+		}
+		used[priorities[i]] = true
+	}
+
+	// Envoy requires the priorities to be contiguous, starting from 0
+	contiguous := make([]uint32, len(used))
+	next := uint32(0)
+	for priority := range used {
+		contiguous[priority] = next
+		if used[priority] {
+			next++
+		}
+	}
+	for i := range localities {
+		localities[i].Priority = contiguous[priorities[i]]
+	}
+}
+
+// applyLocalityDistribute weights the localities for a proxy in the locality, by the first distribution
+// whose source matches the locality of the proxy. The percentage of the traffic sent to each destination
+// pattern is split across the localities it matches by their number of endpoints, and the localities
+// matched by no destination are dropped. The localities are left untouched if no distribution applies,
+// or if it matches none of them.
+func applyLocalityDistribute(localities []endpoint.LocalityLbEndpoints,
+	distribute []*networking.LocalityLoadBalancerSetting_Distribute, locality string) []endpoint.LocalityLbEndpoints {
+	var to map[string]uint32
+	for _, d := range distribute {
+		if matchLocality(d.From, locality) {
+			to = d.To
+			break
+		}
+	}
+	if to == nil {
+		return localities
+	}
+
+	weights := make([]float64, len(localities))
+	for pattern, percent := range to {
+		endpoints := 0
+		for i := range localities {
+			if matchLocality(pattern, localities[i].Locality.GetZone()) {
+				endpoints += len(localities[i].LbEndpoints)
+			}
+		}
+		for i := range localities {
+			if endpoints > 0 && matchLocality(pattern, localities[i].Locality.GetZone()) {
+				weights[i] += float64(percent) * float64(len(localities[i].LbEndpoints)) / float64(endpoints)
+			}
+		}
+	}
+
+	max := 0.0
+	for _, weight := range weights {
+		if weight > max {
+			max = weight
+		}
+	}
+	if max == 0 {
+		return localities
+	}
+
+	out := make([]endpoint.LocalityLbEndpoints, 0, len(localities))
+	for i, l := range localities {
+		if weights[i] == 0 {
+			continue
+		}
+		l.LoadBalancingWeight = &types.UInt32Value{Value: scaleLocalityWeight(weights[i], max)}
+		out = append(out, l)
+	}
+	return out
+}
+
+// matchLocality returns whether the availability zone matches the locality pattern, a region, zone and
+// sub-zone separated by slashes in which * matches the rest of the locality (e.g. us-east/*).
+func matchLocality(pattern, zone string) bool {
+	patternParts, parts := strings.Split(pattern, "/"), strings.Split(zone, "/")
+	for i, part := range patternParts {
+		if part == "*" {
+			return true
+		}
+		if i >= len(parts) || part != parts[i] {
+			return false
+		}
+	}
+	return len(patternParts) == len(parts)
+}
+
+// localityRegion returns the region of an availability zone (e.g. us-east of us-east/zone1).
+func localityRegion(zone string) string {
+	return strings.SplitN(zone, "/", 2)[0]
+}
+
+// proxyLocality returns the locality of a proxy, as the availability zone of its service instances, or
+// else the locality declared by the proxy itself.
+func (s *DiscoveryServer) proxyLocality(node *core.Node) string {
+	if proxy, err := model.ParseServiceNode(node.Id); err == nil {
+		instances, err := s.env.GetProxyServiceInstances(proxy)
+		if err != nil {
+			log.Warnf("EDS: failed to get the service instances of %s: %v", node.Id, err)
+		}
+		for _, instance := range instances {
+			if instance.AvailabilityZone != "" {
+				return instance.AvailabilityZone
+			}
+		}
+	}
+
+	parts := make([]string, 0, 2)
+	for _, part := range []string{node.GetLocality().GetRegion(), node.GetLocality().GetZone()} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// buildLoadAssignmentPolicy returns the load balancing policy of the endpoints of a cluster, or nil
+// for the Envoy defaults.
+func buildLoadAssignmentPolicy() *xdsapi.ClusterLoadAssignment_Policy {
+	if overprovisioningFactor == 0 {
+		return nil
+	}
+	return &xdsapi.ClusterLoadAssignment_Policy{
+		OverprovisioningFactor: &types.UInt32Value{Value: overprovisioningFactor},
+	}
+}
+
+// endpointMetadata returns the metadata of the endpoint of the instance, holding its labels so that
+// the subset load balancer of the default cluster selects the endpoints of a subset, or nil if the
+// instance has no labels.
+func endpointMetadata(instance *model.ServiceInstance) *core.Metadata {
+	if len(instance.Labels) == 0 {
+		return nil
+	}
+	fields := make(map[string]*types.Value, len(instance.Labels))
+	for key, value := range instance.Labels {
+		fields[key] = &types.Value{Kind: &types.Value_StringValue{StringValue: value}}
+	}
+	return &core.Metadata{
+		FilterMetadata: map[string]*types.Struct{
+			lbMetadataNamespace: {Fields: fields},
+		},
+	}
+}
+
 func connectionID(node string) string {
 	edsClusterMutex.Lock()
 	connectionNumber++
@@ -333,6 +597,7 @@ func (s *DiscoveryServer) StreamEndpoints(stream xdsapi.EndpointDiscoveryService
 			// Should not change. A node monitors multiple clusters
 			if node == "" && discReq.Node != nil {
 				node = connectionID(discReq.Node.Id)
+				con.Locality = s.proxyLocality(discReq.Node)
 			}
 
 			clusters2 := discReq.GetResourceNames()
@@ -378,7 +643,7 @@ func (s *DiscoveryServer) StreamEndpoints(stream xdsapi.EndpointDiscoveryService
 			continue
 		}
 
-		response := s.endpoints(con.Clusters)
+		response := s.endpoints(con.Clusters, con.Locality)
 		err := stream.Send(response)
 		if err != nil {
 			log.Warnf("EDS: Send failure, closing grpc %v", err)
@@ -401,8 +666,15 @@ func edsPushAll() {
 	}
 	edsClusterMutex.Unlock()
 
+	// the destination rules are looked up once for all the clusters of a discovery server
+	localityLbSettings := map[*DiscoveryServer]*v1alpha3.LocalityLbSettings{}
 	for clusterName, edsCluster := range tmpMap {
-		updateCluster(clusterName, edsCluster)
+		settings, ok := localityLbSettings[edsCluster.discovery]
+		if !ok {
+			settings = v1alpha3.NewLocalityLbSettings(edsCluster.discovery.env)
+			localityLbSettings[edsCluster.discovery] = settings
+		}
+		updateCluster(clusterName, edsCluster, settings)
 		edsCluster.mutex.Lock()
 		for _, edsCon := range edsCluster.EdsClients {
 			edsCon.pushChannel <- true
@@ -0,0 +1,309 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
+
+	networking "istio.io/api/networking/v1alpha3"
+	"istio.io/istio/pilot/pkg/model"
+)
+
+func TestBuildLoadAssignmentPolicy(t *testing.T) {
+	defer func(factor uint32) { overprovisioningFactor = factor }(overprovisioningFactor)
+
+	overprovisioningFactor = 0
+	if policy := buildLoadAssignmentPolicy(); policy != nil {
+		t.Errorf("got policy %v, want none", policy)
+	}
+
+	overprovisioningFactor = 200
+	if got := buildLoadAssignmentPolicy().GetOverprovisioningFactor().GetValue(); got != 200 {
+		t.Errorf("got overprovisioning factor %d, want 200", got)
+	}
+}
+
+func TestLocalityLbEndpointsSubsetMetadata(t *testing.T) {
+	instances := []*model.ServiceInstance{
+		{Endpoint: model.NetworkEndpoint{Address: "10.0.0.1", Port: 8080}, Labels: model.Labels{"version": "v1", "app": "hello"}},
+		{Endpoint: model.NetworkEndpoint{Address: "10.0.0.2", Port: 8080}, Labels: model.Labels{"version": "v2", "app": "hello"}},
+		{Endpoint: model.NetworkEndpoint{Address: "10.0.0.3", Port: 8080}},
+	}
+	localities := localityLbEndpointsFromInstances(instances)
+
+	// the endpoints of a subset are those whose metadata matches the labels of the subset on every key
+	// of the subset selector, as the subset load balancer of Envoy selects them
+	selector := []string{"version"}
+	subsets := map[string]model.Labels{
+		"v1": {"version": "v1"},
+		"v2": {"version": "v2"},
+		"v3": {"version": "v3"},
+	}
+	expected := map[string][]string{
+		"v1": {"10.0.0.1"},
+		"v2": {"10.0.0.2"},
+	}
+	for name, labels := range subsets {
+		var got []string
+		for _, locality := range localities {
+			for _, lbEndpoint := range locality.LbEndpoints {
+				fields := lbEndpoint.Metadata.GetFilterMetadata()[lbMetadataNamespace].GetFields()
+				match := true
+				for _, key := range selector {
+					if fields[key].GetStringValue() != labels[key] {
+						match = false
+					}
+				}
+				if match {
+					got = append(got, lbEndpoint.Endpoint.Address.GetSocketAddress().Address)
+				}
+			}
+		}
+		if !reflect.DeepEqual(got, expected[name]) {
+			t.Errorf("subset %s: got endpoints %v, want %v", name, got, expected[name])
+		}
+	}
+
+	// the endpoints without labels have no metadata
+	if metadata := endpointMetadata(instances[2]); metadata != nil {
+		t.Errorf("got metadata %v for an instance without labels, want none", metadata)
+	}
+}
+
+// makeInstances returns the given number of instances in each availability zone.
+func makeInstances(zones map[string]int) []*model.ServiceInstance {
+	var out []*model.ServiceInstance
+	for zone, count := range zones {
+		for i := 0; i < count; i++ {
+			out = append(out, &model.ServiceInstance{
+				Endpoint:         model.NetworkEndpoint{Address: fmt.Sprintf("10.0.%d.%d", len(out)/256, len(out)%256), Port: 8080},
+				AvailabilityZone: zone,
+			})
+		}
+	}
+	return out
+}
+
+// localityWeights returns the load balancing weights of the localities, by zone.
+func localityWeights(localities []endpoint.LocalityLbEndpoints) map[string]uint32 {
+	out := make(map[string]uint32, len(localities))
+	for _, locality := range localities {
+		out[locality.Locality.Zone] = locality.LoadBalancingWeight.GetValue()
+	}
+	return out
+}
+
+func TestLocalityLbEndpointsWeights(t *testing.T) {
+	cases := []struct {
+		name     string
+		zones    map[string]int
+		expected map[string]uint32
+	}{
+		{
+			name:     "single locality",
+			zones:    map[string]int{"region/a": 3},
+			expected: map[string]uint32{"region/a": 3},
+		},
+		{
+			name:     "weighted by endpoints",
+			zones:    map[string]int{"region/a": 2, "region/b": 1, "": 4},
+			expected: map[string]uint32{"region/a": 2, "region/b": 1, "": 4},
+		},
+		{
+			name:     "scaled down to the envoy range",
+			zones:    map[string]int{"region/a": 256, "region/b": 64, "region/c": 1},
+			expected: map[string]uint32{"region/a": 128, "region/b": 32, "region/c": 1},
+		},
+	}
+	for _, c := range cases {
+		localities := localityLbEndpointsFromInstances(makeInstances(c.zones))
+		if got := localityWeights(localities); !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%s: got locality weights %v, want %v", c.name, got, c.expected)
+		}
+		for i := range localities {
+			if err := localities[i].Validate(); err != nil {
+				t.Errorf("%s: invalid locality %v: %v", c.name, localities[i].Locality, err)
+			}
+		}
+	}
+}
+
+// localityPriorities returns the priorities of the localities, by zone.
+func localityPriorities(localities []endpoint.LocalityLbEndpoints) map[string]uint32 {
+	out := make(map[string]uint32, len(localities))
+	for _, locality := range localities {
+		out[locality.Locality.Zone] = locality.Priority
+	}
+	return out
+}
+
+func TestLocalityLoadAssignmentFailover(t *testing.T) {
+	shared := &xdsapi.ClusterLoadAssignment{
+		ClusterName: "outbound|http||hello.default.svc.cluster.local",
+		Endpoints: localityLbEndpointsFromInstances(makeInstances(map[string]int{
+			"us-east/zone1": 2, "us-east/zone2": 1, "us-west/zone1": 1, "eu-west/zone1": 1,
+		})),
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{{From: "us-east", To: "us-west"}},
+	}
+
+	cases := []struct {
+		name     string
+		setting  *networking.LocalityLoadBalancerSetting
+		locality string
+		expected map[string]uint32
+	}{
+		{
+			name:     "failover to another region",
+			setting:  setting,
+			locality: "us-east/zone1",
+			expected: map[string]uint32{"us-east/zone1": 0, "us-east/zone2": 1, "us-west/zone1": 2, "eu-west/zone1": 3},
+		},
+		{
+			name:     "no endpoint in the zone of the proxy",
+			setting:  setting,
+			locality: "us-east/zone3",
+			expected: map[string]uint32{"us-east/zone1": 0, "us-east/zone2": 0, "us-west/zone1": 1, "eu-west/zone1": 2},
+		},
+		{
+			name:     "no failover of the region of the proxy",
+			setting:  setting,
+			locality: "eu-west/zone2",
+			expected: map[string]uint32{"us-east/zone1": 1, "us-east/zone2": 1, "us-west/zone1": 1, "eu-west/zone1": 0},
+		},
+		{
+			name:     "proxy without locality",
+			setting:  setting,
+			expected: map[string]uint32{"us-east/zone1": 0, "us-east/zone2": 0, "us-west/zone1": 0, "eu-west/zone1": 0},
+		},
+		{
+			name:     "no setting",
+			locality: "us-east/zone1",
+			expected: map[string]uint32{"us-east/zone1": 0, "us-east/zone2": 0, "us-west/zone1": 0, "eu-west/zone1": 0},
+		},
+	}
+	for _, c := range cases {
+		l := localityLoadAssignment(shared, c.setting, c.locality)
+		if got := localityPriorities(l.Endpoints); !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%s: got locality priorities %v, want %v", c.name, got, c.expected)
+		}
+		if err := l.Validate(); err != nil {
+			t.Errorf("%s: invalid load assignment: %v", c.name, err)
+		}
+		// the locality weights are kept
+		if got := localityWeights(l.Endpoints)["us-east/zone1"]; got != 2 {
+			t.Errorf("%s: got locality weight %d, want 2", c.name, got)
+		}
+	}
+
+	// the load assignment shared by the proxies is left untouched
+	for _, locality := range shared.Endpoints {
+		if locality.Priority != 0 {
+			t.Errorf("shared load assignment modified: locality %s has priority %d", locality.Locality.Zone, locality.Priority)
+		}
+	}
+}
+
+func TestLocalityLoadAssignmentDistribute(t *testing.T) {
+	shared := &xdsapi.ClusterLoadAssignment{
+		ClusterName: "outbound|http||hello.default.svc.cluster.local",
+		Endpoints: localityLbEndpointsFromInstances(makeInstances(map[string]int{
+			"us-east/zone1": 2, "us-east/zone2": 1, "us-west/zone1": 1, "us-west/zone2": 3, "eu-west/zone1": 1,
+		})),
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{From: "us-east/zone1/*", To: map[string]uint32{"us-east/zone1/*": 80, "us-west/*": 20}},
+			{From: "eu-west/*", To: map[string]uint32{"eu-west/*": 50, "us-east/zone2": 50}},
+		},
+	}
+
+	cases := []struct {
+		name     string
+		locality string
+		expected map[string]uint32
+	}{
+		{
+			// 20% split by endpoints across us-west: 5% and 15%, scaled with 80% as the highest weight
+			name:     "distribution across regions",
+			locality: "us-east/zone1",
+			expected: map[string]uint32{"us-east/zone1": 128, "us-west/zone1": 8, "us-west/zone2": 24},
+		},
+		{
+			name:     "exact locality",
+			locality: "eu-west/zone2",
+			expected: map[string]uint32{"eu-west/zone1": 128, "us-east/zone2": 128},
+		},
+		{
+			// the weights of the endpoints are kept
+			name:     "no distribution from the locality of the proxy",
+			locality: "us-west/zone1",
+			expected: map[string]uint32{
+				"us-east/zone1": 2, "us-east/zone2": 1, "us-west/zone1": 1, "us-west/zone2": 3, "eu-west/zone1": 1,
+			},
+		},
+	}
+	for _, c := range cases {
+		l := localityLoadAssignment(shared, setting, c.locality)
+		if got := localityWeights(l.Endpoints); !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%s: got locality weights %v, want %v", c.name, got, c.expected)
+		}
+		if err := l.Validate(); err != nil {
+			t.Errorf("%s: invalid load assignment: %v", c.name, err)
+		}
+	}
+
+	// the localities receiving no traffic are dropped before the failover priorities are set
+	setting.Failover = []*networking.LocalityLoadBalancerSetting_Failover{{From: "us-east", To: "eu-west"}}
+	l := localityLoadAssignment(shared, setting, "us-east/zone1")
+	expected := map[string]uint32{"us-east/zone1": 0, "us-west/zone1": 1, "us-west/zone2": 1}
+	if got := localityPriorities(l.Endpoints); !reflect.DeepEqual(got, expected) {
+		t.Errorf("got locality priorities %v, want %v", got, expected)
+	}
+
+	// the load assignment shared by the proxies is left untouched
+	if got := localityWeights(shared.Endpoints); len(got) != 5 || got["us-west/zone2"] != 3 {
+		t.Errorf("shared load assignment modified: got locality weights %v", got)
+	}
+}
+
+func TestMatchLocality(t *testing.T) {
+	cases := []struct {
+		pattern  string
+		zone     string
+		expected bool
+	}{
+		{"*", "us-east/zone1", true},
+		{"*", "", true},
+		{"us-east/*", "us-east/zone1", true},
+		{"us-east/zone1/*", "us-east/zone1", true},
+		{"us-east/zone1", "us-east/zone1", true},
+		{"us-east/zone1", "us-east/zone2", false},
+		{"us-east", "us-east/zone1", false},
+		{"us-east/zone1/subzone1", "us-east/zone1", false},
+		{"us-west/*", "us-east/zone1", false},
+	}
+	for _, c := range cases {
+		if got := matchLocality(c.pattern, c.zone); got != c.expected {
+			t.Errorf("matchLocality(%q, %q): got %v, want %v", c.pattern, c.zone, got, c.expected)
+		}
+	}
+}
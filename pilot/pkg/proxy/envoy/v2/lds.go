@@ -119,6 +119,7 @@ func (s *DiscoveryServer) StreamListeners(stream xdsapi.ListenerDiscoveryService
 			if err != nil {
 				return err
 			}
+			nt.Metadata = model.ParseMetadata(discReq.Node.Metadata)
 			node = nt
 			if initialRequestReceived {
 				if discReq.ErrorDetail != nil {
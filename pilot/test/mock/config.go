@@ -97,6 +97,13 @@ var (
 		},
 	}
 
+	// ExampleSidecar is an example sidecar configuration
+	ExampleSidecar = &networking.Sidecar{
+		Egress: []*networking.IstioEgressListener{
+			{Hosts: []string{"./*", "istio-system/*"}},
+		},
+	}
+
 	// ExampleIngressRule is an example ingress rule
 	ExampleIngressRule = &routing.IngressRule{
 		Destination: &routing.IstioService{
@@ -481,6 +488,7 @@ func CheckIstioConfigTypes(store model.ConfigStore, namespace string, t *testing
 		{"RouteRule", model.RouteRule, ExampleRouteRule},
 		{"VirtualService", model.VirtualService, ExampleVirtualService},
 		{"DestinationRule", model.DestinationRule, ExampleDestinationRule},
+		{"Sidecar", model.SidecarConfig, ExampleSidecar},
 		{"ExternalService", model.ExternalService, ExampleExternalService},
 		{"Gatway", model.Gateway, ExampleGateway},
 		{"IngressRule", model.IngressRule, ExampleIngressRule},
@@ -47,6 +47,10 @@ func MakeConfigData(schema model.ProtoSchema) ConfigData {
 	if schema.Group == "authentication" {
 		out.IstioKind = crd.KabobCaseToCamelCase(schema.Group + "-" + schema.Type)
 	}
+	// The Sidecar name is taken by the sidecar node type of the model.
+	if schema.Type == model.SidecarConfig.Type {
+		out.IstioKind = "SidecarConfig"
+	}
 	log.Printf("Generating Istio type %s for %s.%s CRD\n", out.IstioKind, out.CrdKind, schema.Group)
 	return out
 }